@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"go-image-web/internal/config"
+	"go-image-web/internal/models"
+	"go-image-web/internal/repo"
+	"go-image-web/internal/services"
+	"go-image-web/internal/store"
+	"log"
+	"os"
+	"strings"
+)
+
+// command is a one off maintenance task run instead of the server
+type command func(args []string) error
+
+var commands = map[string]command{
+	"fix-extensions": fixExtensions,
+	"gc":             gc,
+	"fsck":           fsck,
+	"regen":          regen,
+	"board":          board,
+}
+
+func runCommand(name string, args []string) {
+	cmd, ok := commands[name]
+	if !ok {
+		log.Fatalf("unknown command: %s", name)
+	}
+	if err := cmd(args); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// fixExtensions renames stored images whose extension doesn't match their bytes
+func fixExtensions(args []string) error {
+	fs := flag.NewFlagSet("fix-extensions", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "only report mislabelled files")
+	fs.Parse(args)
+
+	cfg := config.Load()
+
+	xdb := openDB()
+	defer xdb.Close()
+
+	store.Configure(openStorage(cfg), cfg.TmpDir)
+	if err := store.LoadImages(repo.NewImageRepo(xdb)); err != nil {
+		return err
+	}
+
+	fixes, err := store.FixExtensions(context.Background(), *dryRun)
+	for _, f := range fixes {
+		log.Printf("%s is %s, %s -> %s", f.UUID, f.Format, f.OldPath, f.NewPath)
+	}
+	if err != nil {
+		return err
+	}
+
+	if *dryRun {
+		log.Printf("found %d mislabelled files, none renamed", len(fixes))
+	} else {
+		log.Printf("renamed %d mislabelled files", len(fixes))
+	}
+
+	return nil
+}
+
+// gc removes orphaned images, files and temp files, and detaches posts from
+// missing images
+func gc(args []string) error {
+	cfg := config.Load()
+
+	fs := flag.NewFlagSet("gc", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "only report what would be removed")
+	grace := fs.Duration("grace", cfg.GCGrace, "leave anything younger than this")
+	fs.Parse(args)
+
+	xdb := openDB()
+	defer xdb.Close()
+
+	store.Configure(openStorage(cfg), cfg.TmpDir)
+	store.ConfigureTransformCache(cfg.TransformCacheDir)
+	if err := store.LoadImages(repo.NewImageRepo(xdb)); err != nil {
+		return err
+	}
+
+	found, err := store.GC(context.Background(), *grace, *dryRun, true)
+	for _, g := range found {
+		log.Print(g)
+	}
+	if err != nil {
+		return err
+	}
+
+	if *dryRun {
+		log.Printf("found %d items older than %s, none removed", len(found), *grace)
+	} else {
+		log.Printf("removed %d items older than %s", len(found), *grace)
+	}
+
+	return nil
+}
+
+// fsck checks every stored original and varient and every post's image,
+// printing the problems as JSON
+func fsck(args []string) error {
+	fs := flag.NewFlagSet("fsck", flag.ExitOnError)
+	repair := fs.Bool("repair", false, "quarantine corrupt files and regenerate bad or missing varients")
+	fs.Parse(args)
+
+	cfg := config.Load()
+
+	xdb := openDB()
+	defer xdb.Close()
+
+	store.Configure(openStorage(cfg), cfg.TmpDir)
+	services.ConfigureDecoding(cfg.MaxImagePixels, cfg.DecodeMemoryBytes)
+	configureVarients(cfg)
+	if err := store.LoadImages(repo.NewImageRepo(xdb)); err != nil {
+		return err
+	}
+
+	report, err := services.Fsck(context.Background(), *repair)
+	if report != nil {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			return err
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	left := report.Unrepaired()
+	log.Printf("checked %d originals, %d uploads, %d varients and %d posts, found %d problems, %d left",
+		report.Originals, report.Uploads, report.Varients, report.Posts, len(report.Problems), left)
+
+	if left > 0 {
+		return fmt.Errorf("fsck: %d problems left", left)
+	}
+	return nil
+}
+
+// regen brings the varients of every image in line with the active profile
+func regen(args []string) error {
+	fs := flag.NewFlagSet("regen", flag.ExitOnError)
+	deleteRetired := fs.Bool("delete-retired", false, "delete varients the profile no longer has")
+	force := fs.Bool("force", false, "encode every varient again, for a change of quality, filter or sharpening")
+	dryRun := fs.Bool("dry-run", false, "only count what would change")
+	fs.Parse(args)
+
+	cfg := config.Load()
+
+	xdb := openDB()
+	defer xdb.Close()
+
+	store.Configure(openStorage(cfg), cfg.TmpDir)
+	services.ConfigureDecoding(cfg.MaxImagePixels, cfg.DecodeMemoryBytes)
+	configureVarients(cfg)
+	if err := store.LoadImages(repo.NewImageRepo(xdb)); err != nil {
+		return err
+	}
+
+	res, err := services.Regen(context.Background(), services.RegenOptions{
+		DeleteRetired: *deleteRetired,
+		Force:         *force,
+		DryRun:        *dryRun,
+	})
+	if err != nil {
+		return err
+	}
+
+	if *dryRun {
+		log.Printf("%d images, would create %d varients and delete %d", res.Images, res.Created, res.Deleted)
+		return nil
+	}
+	log.Printf("%d images, created %d varients and deleted %d, %d failed", res.Images, res.Created, res.Deleted, res.Failed)
+
+	if res.Failed > 0 {
+		return fmt.Errorf("regen: %d varients failed", res.Failed)
+	}
+	return nil
+}
+
+// board creates a board or changes the settings given of one, without a slug
+// it lists them
+func board(args []string) error {
+	fs := flag.NewFlagSet("board", flag.ExitOnError)
+	slug := fs.String("slug", "", "board to create or update, all are listed without it")
+	title := fs.String("title", "", "title shown on the board")
+	description := fs.String("description", "", "description shown on the board index")
+	formats := fs.String("formats", "", "comma separated formats uploads may have, empty for all")
+	maxUpload := fs.Int64("max-upload-bytes", 0, "cap on the size of uploads, 0 for the global 15MiB")
+	imageRequired := fs.Bool("image-required", true, "whether opening posts need an image")
+	name := fs.String("name", "Anonymous", "name of posters who give none")
+	nsfw := fs.Bool("nsfw", false, "whether the board is not safe for work")
+	repostPolicy := fs.String("repost-policy", "", "warn, link or reject images already posted on the board")
+	fs.Parse(args)
+
+	cfg := config.Load()
+	xdb := openDB()
+	defer xdb.Close()
+
+	boards := services.NewBoardService(repo.NewBoardRepo(xdb), cfg.RepostPolicy)
+
+	if *slug == "" {
+		list, err := boards.GetBoards()
+		if err != nil {
+			return err
+		}
+		for _, b := range list {
+			fmt.Printf("/%s/\t%s\tformats=%s max-upload-bytes=%d image-required=%t name=%q nsfw=%t repost-policy=%s posts=%d\n",
+				b.Slug, b.Title, strings.Join(b.FormatList(), ","), b.MaxUploadBytes, b.ImageRequired, b.DefaultName, b.NSFW, b.RepostPolicy, b.LastNo)
+		}
+		return nil
+	}
+
+	b, err := boards.GetBoard(*slug)
+	switch {
+	case errors.Is(err, services.ErrBoardNotFound):
+		b = &models.Board{Slug: *slug, ImageRequired: true, DefaultName: "Anonymous"}
+	case err != nil:
+		return err
+	}
+
+	// only the flags given change an existing board
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "title":
+			b.Title = *title
+		case "description":
+			b.Description = *description
+		case "formats":
+			b.Formats = *formats
+		case "max-upload-bytes":
+			b.MaxUploadBytes = *maxUpload
+		case "image-required":
+			b.ImageRequired = *imageRequired
+		case "name":
+			b.DefaultName = *name
+		case "nsfw":
+			b.NSFW = *nsfw
+		case "repost-policy":
+			b.RepostPolicy = *repostPolicy
+		}
+	})
+
+	if err := boards.SaveBoard(b); err != nil {
+		return err
+	}
+	log.Printf("saved board /%s/", b.Slug)
+	return nil
+}
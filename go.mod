@@ -11,4 +11,7 @@ require (
 	github.com/mattn/go-sqlite3 v1.14.32
 )
 
-require golang.org/x/image v0.34.0
+require (
+	golang.org/x/image v0.34.0
+	golang.org/x/sync v0.18.0
+)
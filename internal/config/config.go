@@ -0,0 +1,227 @@
+package config
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// near duplicate handling, see services.PostService.FindReposts
+const (
+	RepostWarn   string = "warn"
+	RepostLink   string = "link"
+	RepostReject string = "reject"
+)
+
+// storage backends for originals and varients
+const (
+	StorageLocal string = "local"
+	StorageS3    string = "s3"
+)
+
+// Config holds the settings read from the environment at startup
+type Config struct {
+	// local or s3
+	StorageBackend string
+	// root directory of the local backend
+	StorageDir string
+	// local scratch directory for uploads being processed, whatever the backend
+	TmpDir string
+
+	S3Endpoint  string
+	S3Region    string
+	S3Bucket    string
+	S3AccessKey string
+	S3SecretKey string
+	S3PathStyle bool
+
+	// total bytes of generated varients kept in storage, 0 for no limit
+	VarientCacheBytes int64
+	// JSON file of named varient profiles, empty for only the default
+	VarientProfiles string
+	// name of the profile varients are generated with
+	VarientProfile string
+	// quality originals in a lossy format are stored at
+	OriginalQuality int
+	// keep uploads as sent less their metadata besides the display copy
+	KeepUploads bool
+
+	// most pixels, width times height, an image may have to be decoded
+	MaxImagePixels int64
+	// bytes all decodes in progress may hold between them
+	DecodeMemoryBytes int64
+
+	// workers generating varients in the background
+	JobWorkers int
+	// attempts before a failed job is given up on
+	JobMaxAttempts int
+	// how long done jobs are kept, 0 to keep them
+	JobRetention time.Duration
+
+	// secret transform URLs are signed with, random per run when empty
+	ImageSigningKey string
+	// local directory transformed images are cached in
+	TransformCacheDir string
+
+	// how often orphaned images and files are collected, 0 to only run gc by hand
+	GCInterval time.Duration
+	// how old garbage must be before it is collected, uploads in progress are younger
+	GCGrace time.Duration
+
+	// what new boards do when an upload is perceptually close to an earlier
+	// post, each board keeps its own
+	RepostPolicy string
+	// max hamming distance between perceptual hashes to count as a repost
+	RepostMaxDistance int
+
+	// replies after which a thread is no longer bumped
+	BumpLimit int
+	// posts with an image a thread may have, its opening post included
+	ImageLimit int
+
+	// secret secure tripcodes are keyed with, random per run when empty
+	TripcodeSecret string
+	// names only staff may post under, compared ignoring case
+	ReservedNames []string
+	// key staff log in with at /staff, nobody can when empty
+	StaffKey string
+}
+
+func Load() *Config {
+	cfg := &Config{
+		StorageBackend: envString("STORAGE_BACKEND", StorageLocal),
+		StorageDir:     envString("STORAGE_DIR", "data/img"),
+		TmpDir:         envString("TMP_DIR", "data/img/tmp"),
+
+		S3Endpoint:  envString("S3_ENDPOINT", ""),
+		S3Region:    envString("S3_REGION", "us-east-1"),
+		S3Bucket:    envString("S3_BUCKET", ""),
+		S3AccessKey: envString("S3_ACCESS_KEY", ""),
+		S3SecretKey: envString("S3_SECRET_KEY", ""),
+		S3PathStyle: envBool("S3_PATH_STYLE", true),
+
+		VarientCacheBytes: int64(envInt("VARIENT_CACHE_BYTES", 2<<30)),
+		VarientProfiles:   envString("VARIENT_PROFILES", ""),
+		VarientProfile:    envString("VARIENT_PROFILE", "default"),
+		OriginalQuality:   envInt("ORIGINAL_QUALITY", 75),
+		KeepUploads:       envBool("KEEP_UPLOADS", false),
+
+		MaxImagePixels:    int64(envInt("MAX_IMAGE_PIXELS", 50_000_000)),
+		DecodeMemoryBytes: int64(envInt("DECODE_MEMORY_BYTES", 1<<30)),
+
+		JobWorkers:     envInt("JOB_WORKERS", 2),
+		JobMaxAttempts: envInt("JOB_MAX_ATTEMPTS", 5),
+		JobRetention:   envDuration("JOB_RETENTION", 7*24*time.Hour),
+
+		ImageSigningKey:   envString("IMAGE_SIGNING_KEY", ""),
+		TransformCacheDir: envString("TRANSFORM_CACHE_DIR", "data/img/cache"),
+
+		GCInterval: envDuration("GC_INTERVAL", time.Hour),
+		GCGrace:    envDuration("GC_GRACE", time.Hour),
+
+		RepostPolicy:      envString("REPOST_POLICY", RepostLink),
+		RepostMaxDistance: envInt("REPOST_MAX_DISTANCE", 10),
+
+		BumpLimit:  envInt("BUMP_LIMIT", 300),
+		ImageLimit: envInt("IMAGE_LIMIT", 150),
+
+		TripcodeSecret: envString("TRIPCODE_SECRET", ""),
+		ReservedNames:  envList("RESERVED_NAMES", "Admin,Administrator,Mod,Moderator,Janitor,Staff"),
+		StaffKey:       envString("STAFF_KEY", ""),
+	}
+
+	switch cfg.StorageBackend {
+	case StorageLocal, StorageS3:
+	default:
+		log.Fatalf("invalid STORAGE_BACKEND %q, expected local or s3", cfg.StorageBackend)
+	}
+
+	if cfg.BumpLimit < 0 {
+		log.Fatalf("invalid BUMP_LIMIT %d", cfg.BumpLimit)
+	}
+	if cfg.ImageLimit < 1 {
+		log.Fatalf("invalid IMAGE_LIMIT %d, the opening post needs an image", cfg.ImageLimit)
+	}
+
+	if cfg.OriginalQuality < 1 || cfg.OriginalQuality > 100 {
+		log.Fatalf("invalid ORIGINAL_QUALITY %d, expected 1 to 100", cfg.OriginalQuality)
+	}
+
+	if cfg.MaxImagePixels < 1 || cfg.DecodeMemoryBytes < 1 {
+		log.Fatalf("invalid MAX_IMAGE_PIXELS %d or DECODE_MEMORY_BYTES %d, expected at least 1", cfg.MaxImagePixels, cfg.DecodeMemoryBytes)
+	}
+
+	if cfg.JobWorkers < 1 {
+		log.Fatalf("invalid JOB_WORKERS %d, expected at least 1", cfg.JobWorkers)
+	}
+	if cfg.JobRetention < 0 {
+		log.Fatalf("invalid JOB_RETENTION %s, expected 0 or more", cfg.JobRetention)
+	}
+
+	switch cfg.RepostPolicy {
+	case RepostWarn, RepostLink, RepostReject:
+	default:
+		log.Fatalf("invalid REPOST_POLICY %q, expected warn, link or reject", cfg.RepostPolicy)
+	}
+
+	return cfg
+}
+
+func envString(key string, def string) string {
+	if v, ok := os.LookupEnv(key); ok && v != "" {
+		return v
+	}
+	return def
+}
+
+// envList splits a comma separated setting, dropping empty items
+func envList(key string, def string) []string {
+	var list []string
+	for _, item := range strings.Split(envString(key, def), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func envInt(key string, def int) int {
+	v, ok := os.LookupEnv(key)
+	if !ok || v == "" {
+		return def
+	}
+
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Fatalf("invalid %s %q: %v", key, v, err)
+	}
+	return n
+}
+
+func envDuration(key string, def time.Duration) time.Duration {
+	v, ok := os.LookupEnv(key)
+	if !ok || v == "" {
+		return def
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Fatalf("invalid %s %q: %v", key, v, err)
+	}
+	return d
+}
+
+func envBool(key string, def bool) bool {
+	v, ok := os.LookupEnv(key)
+	if !ok || v == "" {
+		return def
+	}
+
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Fatalf("invalid %s %q: %v", key, v, err)
+	}
+	return b
+}
@@ -0,0 +1,18 @@
+CREATE TABLE posts_old (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name TEXT NOT NULL,
+    subject TEXT,
+    message TEXT,
+    image_uuid TEXT,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+INSERT INTO posts_old (id, name, subject, message, image_uuid, created_at)
+SELECT id, name, subject, message, image_uuid, created_at
+FROM posts;
+
+DROP TABLE posts;
+ALTER TABLE posts_old RENAME TO posts;
+
+DROP TABLE IF EXISTS image_variants;
+DROP TABLE IF EXISTS images;
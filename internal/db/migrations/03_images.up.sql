@@ -0,0 +1,45 @@
+CREATE TABLE IF NOT EXISTS images (
+    uuid TEXT PRIMARY KEY,
+    ext TEXT NOT NULL,
+    path TEXT NOT NULL,
+    width INTEGER NOT NULL DEFAULT 0,
+    height INTEGER NOT NULL DEFAULT 0,
+    size INTEGER NOT NULL DEFAULT 0,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS image_variants (
+    image_uuid TEXT NOT NULL REFERENCES images(uuid) ON DELETE CASCADE,
+    width INTEGER NOT NULL,
+    ext TEXT NOT NULL,
+    path TEXT NOT NULL,
+    size INTEGER NOT NULL DEFAULT 0,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (image_uuid, width, ext)
+);
+
+-- images already referenced by posts are registered with an empty ext and
+-- path, store.LoadImages fills them in from disk on the next startup
+INSERT INTO images (uuid, ext, path)
+SELECT DISTINCT image_uuid, '', ''
+FROM posts
+WHERE image_uuid IS NOT NULL AND image_uuid != '';
+
+-- sqlite cannot add a foreign key to an existing table, so rebuild posts
+CREATE TABLE posts_new (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name TEXT NOT NULL,
+    subject TEXT,
+    message TEXT,
+    image_uuid TEXT REFERENCES images(uuid),
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+INSERT INTO posts_new (id, name, subject, message, image_uuid, created_at)
+SELECT id, name, subject, message, NULLIF(image_uuid, ''), created_at
+FROM posts;
+
+DROP TABLE posts;
+ALTER TABLE posts_new RENAME TO posts;
+
+CREATE INDEX IF NOT EXISTS idx_posts_image_uuid ON posts(image_uuid);
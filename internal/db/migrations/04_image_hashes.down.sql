@@ -0,0 +1,8 @@
+DROP TRIGGER IF EXISTS posts_image_ref_update;
+DROP TRIGGER IF EXISTS posts_image_ref_delete;
+DROP TRIGGER IF EXISTS posts_image_ref_insert;
+
+DROP INDEX IF EXISTS idx_images_sha256;
+
+ALTER TABLE images DROP COLUMN ref_count;
+ALTER TABLE images DROP COLUMN sha256;
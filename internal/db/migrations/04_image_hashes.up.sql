@@ -0,0 +1,30 @@
+ALTER TABLE images ADD COLUMN sha256 TEXT;
+ALTER TABLE images ADD COLUMN ref_count INTEGER NOT NULL DEFAULT 0;
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_images_sha256 ON images(sha256);
+
+UPDATE images
+SET ref_count = (SELECT COUNT(*) FROM posts WHERE posts.image_uuid = images.uuid);
+
+-- keep ref_count in step with posts no matter which code path writes them
+CREATE TRIGGER IF NOT EXISTS posts_image_ref_insert
+AFTER INSERT ON posts
+WHEN NEW.image_uuid IS NOT NULL
+BEGIN
+    UPDATE images SET ref_count = ref_count + 1 WHERE uuid = NEW.image_uuid;
+END;
+
+CREATE TRIGGER IF NOT EXISTS posts_image_ref_delete
+AFTER DELETE ON posts
+WHEN OLD.image_uuid IS NOT NULL
+BEGIN
+    UPDATE images SET ref_count = ref_count - 1 WHERE uuid = OLD.image_uuid;
+END;
+
+CREATE TRIGGER IF NOT EXISTS posts_image_ref_update
+AFTER UPDATE OF image_uuid ON posts
+WHEN OLD.image_uuid IS NOT NEW.image_uuid
+BEGIN
+    UPDATE images SET ref_count = ref_count - 1 WHERE uuid = OLD.image_uuid;
+    UPDATE images SET ref_count = ref_count + 1 WHERE uuid = NEW.image_uuid;
+END;
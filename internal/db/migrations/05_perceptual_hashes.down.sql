@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS post_reposts;
+
+ALTER TABLE images DROP COLUMN phash;
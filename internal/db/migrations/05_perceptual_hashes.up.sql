@@ -0,0 +1,8 @@
+ALTER TABLE images ADD COLUMN phash TEXT;
+
+CREATE TABLE IF NOT EXISTS post_reposts (
+    post_id INTEGER NOT NULL REFERENCES posts(id) ON DELETE CASCADE,
+    repost_of INTEGER NOT NULL REFERENCES posts(id) ON DELETE CASCADE,
+    distance INTEGER NOT NULL,
+    PRIMARY KEY (post_id, repost_of)
+);
@@ -0,0 +1,7 @@
+UPDATE images
+SET path = 'data/img/' || path
+WHERE path != '' AND path NOT LIKE 'data/img/%';
+
+UPDATE image_variants
+SET path = 'data/img/' || path
+WHERE path NOT LIKE 'data/img/%';
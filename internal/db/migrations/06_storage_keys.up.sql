@@ -0,0 +1,9 @@
+-- paths become keys relative to the storage root, e.g.
+-- data/img/original/x_original.png -> original/x_original.png
+UPDATE images
+SET path = substr(path, length('data/img/') + 1)
+WHERE path LIKE 'data/img/%';
+
+UPDATE image_variants
+SET path = substr(path, length('data/img/') + 1)
+WHERE path LIKE 'data/img/%';
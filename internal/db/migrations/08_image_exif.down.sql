@@ -0,0 +1,3 @@
+ALTER TABLE images DROP COLUMN camera_model;
+ALTER TABLE images DROP COLUMN camera_make;
+ALTER TABLE images DROP COLUMN taken_at;
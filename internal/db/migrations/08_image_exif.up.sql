@@ -0,0 +1,4 @@
+-- the only EXIF kept from uploads, everything else is stripped
+ALTER TABLE images ADD COLUMN taken_at DATETIME;
+ALTER TABLE images ADD COLUMN camera_make TEXT NOT NULL DEFAULT '';
+ALTER TABLE images ADD COLUMN camera_model TEXT NOT NULL DEFAULT '';
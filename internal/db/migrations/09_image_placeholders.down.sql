@@ -0,0 +1,2 @@
+ALTER TABLE images DROP COLUMN color;
+ALTER TABLE images DROP COLUMN blurhash;
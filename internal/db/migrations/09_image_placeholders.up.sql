@@ -0,0 +1,3 @@
+-- shown while an image loads, empty for images uploaded before
+ALTER TABLE images ADD COLUMN blurhash TEXT NOT NULL DEFAULT '';
+ALTER TABLE images ADD COLUMN color TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,2 @@
+ALTER TABLE image_variants DROP COLUMN checksum;
+ALTER TABLE images DROP COLUMN checksum;
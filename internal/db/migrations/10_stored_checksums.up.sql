@@ -0,0 +1,3 @@
+-- sha256 of the bytes as stored, checked by fsck, empty for files stored before
+ALTER TABLE images ADD COLUMN checksum TEXT NOT NULL DEFAULT '';
+ALTER TABLE image_variants ADD COLUMN checksum TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,2 @@
+ALTER TABLE images DROP COLUMN upload_size;
+ALTER TABLE images DROP COLUMN upload_path;
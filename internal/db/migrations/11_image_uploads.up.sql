@@ -0,0 +1,3 @@
+-- the upload kept as sent less its metadata, empty when not kept
+ALTER TABLE images ADD COLUMN upload_path TEXT NOT NULL DEFAULT '';
+ALTER TABLE images ADD COLUMN upload_size INTEGER NOT NULL DEFAULT 0;
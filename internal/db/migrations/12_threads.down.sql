@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS idx_posts_bumped_at;
+DROP INDEX IF EXISTS idx_posts_thread_id;
+
+ALTER TABLE posts DROP COLUMN bumped_at;
+ALTER TABLE posts DROP COLUMN parent_id;
+ALTER TABLE posts DROP COLUMN thread_id;
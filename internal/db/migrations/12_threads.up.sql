@@ -0,0 +1,13 @@
+-- every post belongs to the thread its opening post starts, an opening post
+-- to its own
+ALTER TABLE posts ADD COLUMN thread_id INTEGER;
+-- the post a reply answers, NULL for an opening post
+ALTER TABLE posts ADD COLUMN parent_id INTEGER;
+-- when a thread was last bumped by a reply, set on opening posts
+ALTER TABLE posts ADD COLUMN bumped_at DATETIME;
+
+-- every post so far opens its own thread
+UPDATE posts SET thread_id = id, bumped_at = created_at;
+
+CREATE INDEX IF NOT EXISTS idx_posts_thread_id ON posts(thread_id, id);
+CREATE INDEX IF NOT EXISTS idx_posts_bumped_at ON posts(bumped_at) WHERE thread_id = id;
@@ -0,0 +1,8 @@
+DROP INDEX IF EXISTS idx_posts_board_bumped_at;
+DROP INDEX IF EXISTS idx_posts_board_no;
+CREATE INDEX IF NOT EXISTS idx_posts_bumped_at ON posts(bumped_at) WHERE thread_id = id;
+
+ALTER TABLE posts DROP COLUMN no;
+ALTER TABLE posts DROP COLUMN board;
+
+DROP TABLE IF EXISTS boards;
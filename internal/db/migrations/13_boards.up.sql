@@ -0,0 +1,29 @@
+CREATE TABLE IF NOT EXISTS boards (
+    slug TEXT PRIMARY KEY,
+    title TEXT NOT NULL,
+    description TEXT NOT NULL DEFAULT '',
+    -- comma separated formats uploads may have, empty for every supported one
+    formats TEXT NOT NULL DEFAULT '',
+    -- 0 for the global cap, which also caps this
+    max_upload_bytes INTEGER NOT NULL DEFAULT 0,
+    -- whether opening posts need an image
+    image_required INTEGER NOT NULL DEFAULT 1,
+    default_name TEXT NOT NULL DEFAULT 'Anonymous',
+    nsfw INTEGER NOT NULL DEFAULT 0,
+    -- last post number given out on the board
+    last_no INTEGER NOT NULL DEFAULT 0,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- everything posted so far goes to /b/, numbered as before
+INSERT INTO boards (slug, title, last_no)
+SELECT 'b', 'Random', COALESCE(MAX(id), 0)
+FROM posts;
+
+ALTER TABLE posts ADD COLUMN board TEXT NOT NULL DEFAULT '';
+ALTER TABLE posts ADD COLUMN no INTEGER;
+UPDATE posts SET board = 'b', no = id;
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_posts_board_no ON posts(board, no);
+DROP INDEX IF EXISTS idx_posts_bumped_at;
+CREATE INDEX IF NOT EXISTS idx_posts_board_bumped_at ON posts(board, bumped_at) WHERE thread_id = id;
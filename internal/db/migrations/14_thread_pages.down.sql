@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_posts_board_bumped_at_no;
+CREATE INDEX IF NOT EXISTS idx_posts_board_bumped_at ON posts(board, bumped_at) WHERE thread_id = id;
@@ -0,0 +1,3 @@
+-- pages of threads are read in the order of this index, from a cursor
+DROP INDEX IF EXISTS idx_posts_board_bumped_at;
+CREATE INDEX IF NOT EXISTS idx_posts_board_bumped_at_no ON posts(board, bumped_at, no) WHERE thread_id = id;
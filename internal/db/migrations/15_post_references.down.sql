@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_post_references_board_no;
+DROP TABLE IF EXISTS post_references;
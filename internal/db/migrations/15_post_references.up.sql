@@ -0,0 +1,10 @@
+-- posts a message links to with >>no or >>>/board/no, by board and number
+-- so references to posts that don't exist, or no longer do, are kept
+CREATE TABLE IF NOT EXISTS post_references (
+    post_id INTEGER NOT NULL REFERENCES posts(id) ON DELETE CASCADE,
+    board TEXT NOT NULL,
+    no INTEGER NOT NULL,
+    PRIMARY KEY (post_id, board, no)
+);
+
+CREATE INDEX IF NOT EXISTS idx_post_references_board_no ON post_references(board, no);
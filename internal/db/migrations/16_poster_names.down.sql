@@ -0,0 +1,2 @@
+ALTER TABLE posts DROP COLUMN capcode;
+ALTER TABLE posts DROP COLUMN tripcode;
@@ -0,0 +1,4 @@
+-- the tripcode a name was signed with, !hash or !!hash for a secure one
+ALTER TABLE posts ADD COLUMN tripcode TEXT NOT NULL DEFAULT '';
+-- the reserved name staff posted under
+ALTER TABLE posts ADD COLUMN capcode TEXT NOT NULL DEFAULT '';
@@ -0,0 +1 @@
+ALTER TABLE boards DROP COLUMN repost_policy;
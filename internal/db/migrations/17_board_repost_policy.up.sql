@@ -0,0 +1,3 @@
+-- what happens to an image already posted on the board, see config.RepostWarn
+ALTER TABLE boards ADD COLUMN repost_policy TEXT NOT NULL DEFAULT 'link'
+    CHECK (repost_policy IN ('warn', 'link', 'reject'));
@@ -0,0 +1,2 @@
+-- when gc first saw the original missing from storage, NULL while it is there
+ALTER TABLE images ADD COLUMN missing_since DATETIME;
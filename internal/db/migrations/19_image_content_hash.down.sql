@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_images_content_sha256;
+
+ALTER TABLE images DROP COLUMN content_sha256;
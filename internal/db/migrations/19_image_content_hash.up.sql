@@ -0,0 +1,5 @@
+-- sha256 of the upload stripped of its metadata, which uploads differing
+-- only in metadata share, see store.ContentHash
+ALTER TABLE images ADD COLUMN content_sha256 TEXT;
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_images_content_sha256 ON images(content_sha256);
@@ -1,7 +1,9 @@
 package handlers
 
 import (
+	"errors"
 	"fmt"
+	"go-image-web/internal/markup"
 	"go-image-web/internal/models"
 	"go-image-web/internal/repo"
 	"go-image-web/internal/services"
@@ -10,129 +12,548 @@ import (
 	"log"
 	"net/http"
 	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
 )
 
 type IndexHandler struct {
-	PostService *services.PostService
+	PostService  *services.PostService
+	BoardService *services.BoardService
+	StaffService *services.StaffService
 }
 
-func NewIndexHandler(postService *services.PostService) *IndexHandler {
+func NewIndexHandler(postService *services.PostService, boardService *services.BoardService, staffService *services.StaffService) *IndexHandler {
 	return &IndexHandler{
-		PostService: postService,
+		PostService:  postService,
+		BoardService: boardService,
+		StaffService: staffService,
 	}
 }
 
-var baseLayout = template.Must(template.ParseFiles(path.Join(publicDir, "layout.html")))
+// helpers available to every page
+var templateFuncs = template.FuncMap{
+	"imageURL": services.TransformURL,
+}
+
+var baseLayout = template.Must(template.New("layout.html").Funcs(templateFuncs).ParseFiles(path.Join(publicDir, "layout.html")))
 
+// pages are parsed with the post template they share
+func parsePage(page string) *template.Template {
+	return template.Must(template.Must(baseLayout.Clone()).ParseFiles(path.Join(publicDir, "post.html"), path.Join(publicDir, page)))
+}
+
+// Home lists the boards
 func (h *IndexHandler) Home(w http.ResponseWriter, r *http.Request) {
+	boards, err := h.BoardService.GetBoards()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "failed to retrieve boards", http.StatusInternalServerError)
+		return
+	}
 
-	tpl := template.Must(template.Must(baseLayout.Clone()).ParseFiles(path.Join(publicDir, "index.html")))
+	if err := parsePage("index.html").ExecuteTemplate(w, "layout", boards); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
 
-	var viewModel []*models.PostViewModel
+// board returns the board named in the route, answering 404 when there is none
+func (h *IndexHandler) board(w http.ResponseWriter, r *http.Request) *models.Board {
+	board, err := h.BoardService.GetBoard(mux.Vars(r)["board"])
+	if errors.Is(err, services.ErrBoardNotFound) {
+		http.Error(w, "board not found", http.StatusNotFound)
+		return nil
+	}
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "failed to retrieve board", http.StatusInternalServerError)
+		return nil
+	}
+	return board
+}
 
-	// do nothing with error at the moment, however in future display error message
-	postData, _ := h.PostService.GetPosts()
-	for _, post := range postData {
-
-		if post.ImageUUID == "" {
-			viewModel = append(viewModel, &models.PostViewModel{
-				Post: post,
-			})
-			continue
+// Board shows the threads of a board and the form opening one
+func (h *IndexHandler) Board(w http.ResponseWriter, r *http.Request) {
+	board := h.board(w, r)
+	if board == nil {
+		return
+	}
+
+	var before *models.ThreadCursor
+	if v := r.URL.Query().Get("before"); v != "" {
+		var err error
+		if before, err = models.ParseThreadCursor(v); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
+	}
+
+	// do nothing with error at the moment, however in future display error message
+	threads, next, _ := h.PostService.GetThreads(board.Slug, before)
+
+	posts := make([]*models.PostModel, 0, len(threads))
+	byID := make(map[int]*models.ThreadModel, len(threads))
+	for _, thread := range threads {
+		posts = append(posts, &thread.PostModel)
+		byID[thread.ID] = thread
+	}
 
-		meta := store.GetGuidImageMetadata(post.ImageUUID)
-		if meta != nil {
-			viewModel = append(viewModel, &models.PostViewModel{
-				Image: &models.ImageModel{
-					ID:        meta.UUID,
-					Path:      meta.OriginalPath,
-					Extension: meta.OriginalExt,
-					Width:     meta.OriginalWidth,
-					Height:    meta.OriginalHeight,
-					Timestamp: meta.ModifiedTime,
-					Size:      meta.OriginalSize,
-				},
-				Post: post,
-			})
+	page := &models.BoardPageModel{
+		Board:  board,
+		Posts:  h.postViewModels(board, posts, isStaff(h.StaffService, r)),
+		Before: before,
+		Next:   next,
+	}
+	for _, m := range page.Posts {
+		m.Thread = byID[m.Post.ID]
+	}
+
+	if err := parsePage("board.html").ExecuteTemplate(w, "layout", page); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Thread shows an opening post, all its replies and the reply form
+func (h *IndexHandler) Thread(w http.ResponseWriter, r *http.Request) {
+	board := h.board(w, r)
+	if board == nil {
+		return
+	}
+	no, err := strconv.Atoi(mux.Vars(r)["no"])
+	if err != nil {
+		http.Error(w, "invalid thread number", http.StatusBadRequest)
+		return
+	}
+
+	thread, posts, err := h.PostService.GetThread(board.Slug, no)
+	if errors.Is(err, services.ErrThreadNotFound) {
+		// a reply goes to its thread
+		if post, _ := h.PostService.GetPost(board.Slug, no); post != nil {
+			http.Redirect(w, r, postURL(post), http.StatusMovedPermanently)
+			return
 		}
+		http.Error(w, "thread not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "failed to retrieve thread", http.StatusInternalServerError)
+		return
+	}
 
+	page := &models.ThreadPageModel{
+		Board:      board,
+		Thread:     thread,
+		Posts:      h.postViewModels(board, posts, isStaff(h.StaffService, r)),
+		ReplyTo:    thread.No,
+		BumpLimit:  h.PostService.BumpLimit(),
+		ImageLimit: h.PostService.ImageLimit(),
+	}
+	// No. links of the thread's posts pick the one answered
+	if reply, err := strconv.Atoi(r.URL.Query().Get("reply")); err == nil {
+		for _, post := range posts {
+			if post.No == reply {
+				page.ReplyTo = reply
+			}
+		}
 	}
 
-	if err := tpl.ExecuteTemplate(w, "layout", viewModel); err != nil {
+	if err := parsePage("thread.html").ExecuteTemplate(w, "layout", page); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
 
+// Post redirects to a post in its thread
+func (h *IndexHandler) Post(w http.ResponseWriter, r *http.Request) {
+	board := h.board(w, r)
+	if board == nil {
+		return
+	}
+	no, err := strconv.Atoi(mux.Vars(r)["no"])
+	if err != nil {
+		http.Error(w, "invalid post number", http.StatusBadRequest)
+		return
+	}
+
+	post, err := h.PostService.GetPost(board.Slug, no)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "failed to retrieve post", http.StatusInternalServerError)
+		return
+	}
+	if post == nil {
+		http.Error(w, fmt.Sprintf("post /%s/%d not found", board.Slug, no), http.StatusNotFound)
+		return
+	}
+
+	http.Redirect(w, r, postURL(post), http.StatusSeeOther)
+}
+
+// DeletePost lets staff delete a post, along with its thread when it opens
+// one, and returns to what is left
+func (h *IndexHandler) DeletePost(w http.ResponseWriter, r *http.Request) {
+	if !isStaff(h.StaffService, r) {
+		http.Error(w, "only staff may delete posts", http.StatusForbidden)
+		return
+	}
+	board := h.board(w, r)
+	if board == nil {
+		return
+	}
+	no, err := strconv.Atoi(mux.Vars(r)["no"])
+	if err != nil {
+		http.Error(w, "invalid post number", http.StatusBadRequest)
+		return
+	}
+
+	post, err := h.PostService.GetPost(board.Slug, no)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "failed to retrieve post", http.StatusInternalServerError)
+		return
+	}
+	if post == nil {
+		http.Error(w, fmt.Sprintf("post /%s/%d not found", board.Slug, no), http.StatusNotFound)
+		return
+	}
+
+	if err := h.PostService.DeletePost(post.ID); err != nil {
+		log.Println(err)
+		http.Error(w, "failed to delete post", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("staff deleted post /%s/%d", board.Slug, no)
+
+	if post.IsOpening() {
+		http.Redirect(w, r, fmt.Sprintf("/%s/", board.Slug), http.StatusSeeOther)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/%s/thread/%d", board.Slug, post.ThreadNo), http.StatusSeeOther)
+}
+
+// postURL is where a post is shown in its thread
+func postURL(post *models.PostModel) string {
+	return fmt.Sprintf("/%s/thread/%d#p%d", post.Board, post.ThreadNo, post.No)
+}
+
+// postViewModels pairs posts on board with their images and reposts, posts
+// whose image is no longer recorded are left out. staff is whether they are
+// shown to staff
+func (h *IndexHandler) postViewModels(board *models.Board, posts []*models.PostModel, staff bool) []*models.PostViewModel {
+	ids := make([]int, 0, len(posts))
+	for _, post := range posts {
+		ids = append(ids, post.ID)
+	}
+
+	reposts, err := h.PostService.GetReposts(ids)
+	if err != nil {
+		log.Println(err)
+	}
+	// without them references are left as text and backlinks are missing
+	links, err := h.PostService.GetReferences(ids)
+	if err != nil {
+		log.Println(err)
+	}
+	backlinks, err := h.PostService.GetBacklinks(ids)
+	if err != nil {
+		log.Println(err)
+	}
+
+	viewModel := make([]*models.PostViewModel, 0, len(posts))
+	for _, post := range posts {
+		m := &models.PostViewModel{
+			Post:           post,
+			Message:        markup.Render(post.Board, post.Message, links[post.ID]),
+			MessagePreview: markup.Render(post.Board, post.TruncatedMessage(), links[post.ID]),
+			Backlinks:      backlinks[post.ID],
+			Staff:          staff,
+		}
+
+		if post.ImageUUID != "" {
+			meta := store.GetGuidImageMetadata(post.ImageUUID)
+			if meta == nil {
+				continue
+			}
+			m.Image = newImageModel(meta)
+			m.Reposts = reposts[post.ID]
+			m.RepostPolicy = board.RepostPolicy
+		}
+
+		viewModel = append(viewModel, m)
+	}
+
+	return viewModel
+}
+
+// newImageModel describes a stored image and the varients it has so far
+func newImageModel(meta *models.ImageMetadata) *models.ImageModel {
+	m := &models.ImageModel{
+		ID:        meta.UUID,
+		Path:      meta.OriginalPath,
+		Extension: meta.OriginalExt,
+		Width:     meta.OriginalWidth,
+		Height:    meta.OriginalHeight,
+		Timestamp: meta.ModifiedTime,
+		Size:      meta.OriginalSize,
+		HasUpload: meta.UploadPath != "",
+		Pending:   services.VarientsPending(meta.UUID),
+
+		Placeholder: placeholderCSS(meta),
+	}
+
+	// shown while pending, the original when it is no wider
+	if w := store.ActiveVarientProfile().Widths[0]; w < meta.OriginalWidth {
+		m.PreviewWidth = w
+	}
+
+	widths := make(map[string][]int)
+	meta.VarientsMu.RLock()
+	for id := range meta.Varients {
+		// varients once scaled up are no better than the original
+		if id.Width < meta.OriginalWidth {
+			widths[id.Ext] = append(widths[id.Ext], id.Width)
+		}
+	}
+	meta.VarientsMu.RUnlock()
+
+	// the original is the largest size of a still image, browsers taking
+	// only the fallback format may not take a webp original
+	formats := services.VarientFormats(meta)
+	var original string
+	if !m.Animated() {
+		original = fmt.Sprintf("/img/%s %dw", meta.UUID, meta.OriginalWidth)
+	}
+	fallbackOriginal := original
+	if meta.OriginalExt == "webp" && formats[0] != "webp" {
+		fallbackOriginal = ""
+	}
+
+	// the original is the only source until a varient exists
+	m.Fallback = models.ImageSource{Type: services.ContentType(meta.OriginalExt), Src: "/img/" + meta.UUID}
+	if len(widths[formats[0]]) > 0 {
+		m.Fallback = imageSource(meta.UUID, formats[0], widths[formats[0]], fallbackOriginal)
+	}
+
+	// browsers take the first source they support, so the smallest goes first
+	for i := len(formats) - 1; i > 0; i-- {
+		if len(widths[formats[i]]) > 0 {
+			m.Sources = append(m.Sources, imageSource(meta.UUID, formats[i], widths[formats[i]], original))
+		}
+	}
+
+	// the original stands in for animations at and above its width
+	if m.Animated() {
+		gifs := widths["gif"]
+		slices.Sort(gifs)
+		srcset := make([]string, 0, len(gifs)+1)
+		for _, w := range gifs {
+			srcset = append(srcset, fmt.Sprintf("/img/%s_%d.gif %dw", meta.UUID, w, w))
+		}
+		srcset = append(srcset, fmt.Sprintf("/img/%s %dw", meta.UUID, meta.OriginalWidth))
+		m.AnimatedSrcset = strings.Join(srcset, ", ")
+	}
+
+	return m
+}
+
+// placeholderCSS is the background of an image until it loads, its
+// dominant colour under its BlurHash
+func placeholderCSS(meta *models.ImageMetadata) template.CSS {
+	var layers []string
+
+	if meta.BlurHash != "" {
+		uri, err := store.PlaceholderURI(meta.BlurHash, meta.OriginalWidth, meta.OriginalHeight)
+		if err != nil {
+			log.Printf("placeholder for %s: %v", meta.UUID, err)
+		} else {
+			layers = append(layers, fmt.Sprintf("url(%s) center / cover no-repeat", uri))
+		}
+	}
+
+	// it goes into the page unescaped, so only ever a hex colour
+	if hexColor.MatchString(meta.Color) {
+		layers = append(layers, meta.Color)
+	}
+
+	if len(layers) == 0 {
+		return ""
+	}
+	return template.CSS("background: " + strings.Join(layers, " "))
+}
+
+var hexColor = regexp.MustCompile(`^#[0-9a-f]{6}$`)
+
+// imageSource lists the varients of an image in one format smallest first,
+// followed by original as the largest size unless it is empty
+func imageSource(uuid string, ext string, widths []int, original string) models.ImageSource {
+	slices.Sort(widths)
+	srcset := make([]string, 0, len(widths)+1)
+	for _, w := range widths {
+		srcset = append(srcset, fmt.Sprintf("/img/%s_%d.%s %dw", uuid, w, ext, w))
+	}
+	if original != "" {
+		srcset = append(srcset, original)
+	}
+	return models.ImageSource{
+		Type:   services.ContentType(ext),
+		Src:    fmt.Sprintf("/img/%s_%d.%s", uuid, widths[0], ext),
+		Srcset: strings.Join(srcset, ", "),
+	}
+}
+
 func (h *IndexHandler) Upload(w http.ResponseWriter, r *http.Request) {
+	board := h.board(w, r)
+	if board == nil {
+		return
+	}
+
 	// hard limit upload size
-	r.Body = http.MaxBytesReader(w, r.Body, store.MaxUploadBytes)
+	maxBytes := board.UploadLimit(store.MaxUploadBytes)
+	r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
 
 	var uuid string
 
 	// read multipart file and header
 	file, header, fileErr := r.FormFile("imageFile")
 
-	if fileErr == http.ErrMissingFile {
-		http.Error(w, fmt.Errorf("must provide an image").Error(), http.StatusBadRequest)
-		return
-	}
-
 	// if file detected but has error and isn't missing file
 	if fileErr != nil && fileErr != http.ErrMissingFile {
 		http.Error(w, fileErr.Error(), http.StatusBadRequest)
 		return
 	}
 
+	// a reply names the number of its thread, a new thread nothing
+	var threadNo, parentNo int
+	if v := r.FormValue("thread"); v != "" {
+		var err error
+		if threadNo, err = strconv.Atoi(v); err != nil || threadNo < 1 {
+			http.Error(w, "invalid thread number", http.StatusBadRequest)
+			return
+		}
+		parentNo, _ = strconv.Atoi(r.FormValue("parent"))
+	}
+
+	subject, message := r.FormValue("subject"), r.FormValue("message")
+
+	// refuse before the image is stored
+	name, trip, capcode, err := h.PostService.SignName(r.FormValue("name"), isStaff(h.StaffService, r))
+	if err != nil {
+		writePostError(w, err)
+		return
+	}
+	if len(name) > repo.MaxNameChars {
+		http.Error(w, fmt.Errorf("name too long. max %d characters", repo.MaxNameChars).Error(), http.StatusBadRequest)
+		return
+	}
+	if len(message) > repo.MaxMessageChars {
+		http.Error(w, fmt.Errorf("message too long. max %d characters", repo.MaxMessageChars).Error(), http.StatusBadRequest)
+		return
+	}
+	if len(subject) > repo.MaxSubjectChars {
+		http.Error(w, fmt.Errorf("subject too long. max %d characters", repo.MaxSubjectChars).Error(), http.StatusBadRequest)
+		return
+	}
+	if err := h.PostService.CheckPost(board, threadNo, fileErr == nil, message); err != nil {
+		writePostError(w, err)
+		return
+	}
+
 	if fileErr == nil {
 
 		defer file.Close()
 
 		// check if size in header is too big
-		if header.Size > store.MaxUploadBytes {
+		if header.Size > maxBytes {
 			http.Error(w, "file too big", http.StatusRequestEntityTooLarge)
 			return
 		}
 
 		// save image to system and return uuid
 		var saveErr error
-		uuid, saveErr = services.SaveImage(file, header.Filename)
-		if saveErr != nil {
+		uuid, saveErr = services.SaveImage(r.Context(), file, header.Filename, board.AllowsFormat)
+		switch {
+		case errors.Is(saveErr, services.ErrFormatNotAllowed):
+			http.Error(w, fmt.Sprintf("/%s/ only takes %s", board.Slug, strings.Join(board.FormatList(), ", ")), http.StatusUnsupportedMediaType)
+			return
+		case errors.Is(saveErr, services.ErrImageTooLarge):
+			http.Error(w, saveErr.Error(), http.StatusRequestEntityTooLarge)
+			return
+		case errors.Is(saveErr, services.ErrInvalidImage):
+			http.Error(w, saveErr.Error(), http.StatusUnprocessableEntity)
+			return
+		case saveErr != nil:
 			http.Error(w, saveErr.Error(), http.StatusInternalServerError)
 			return
 		}
-	}
 
-	subject, message := r.FormValue("subject"), r.FormValue("message")
-
-	// validate required fields
-	// if message == "" && fileErr != nil {
-	// 	http.Error(w, fmt.Errorf("must provide a message or an image").Error(), http.StatusBadRequest)
-	// 	return
-	// }
-
-	if len(message) > repo.MaxMessageChars {
-		http.Error(w, fmt.Errorf("message too long. max %d characters", repo.MaxMessageChars).Error(), http.StatusBadRequest)
-		return
-	}
-
-	if len(subject) > repo.MaxSubjectChars {
-		http.Error(w, fmt.Errorf("subject too long. max %d characters", repo.MaxSubjectChars).Error(), http.StatusBadRequest)
-		return
+		// refuse reposts on boards that reject them
+		if err := h.PostService.CheckRepost(board, uuid); err != nil {
+			discardImage(uuid)
+			if errors.Is(err, services.ErrRepost) {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
 	}
 
 	// Create post model
 	postModel := &models.PostModel{
-		Name:      services.DefaultPostName,
+		Name:      name,
+		Tripcode:  trip,
+		Capcode:   capcode,
 		Subject:   subject,
 		Message:   message,
 		ImageUUID: uuid,
+		ThreadNo:  threadNo,
+		ParentNo:  parentNo,
 	}
 
-	_, saveErr := h.PostService.SavePost(postModel)
+	// sage replies without bumping the thread
+	post, saveErr := h.PostService.SavePost(board, postModel, r.FormValue("sage") != "")
 	if saveErr != nil {
-		log.Println(saveErr)
+		// the image was stored for this post alone
+		if uuid != "" {
+			discardImage(uuid)
+		}
+		writePostError(w, saveErr)
+		return
+	}
+	// the post holds the image now
+	if uuid != "" {
+		store.Unlease(uuid)
 	}
 
-	http.Redirect(w, r, "/", http.StatusSeeOther)
+	http.Redirect(w, r, postURL(post), http.StatusSeeOther)
+}
+
+// discardImage drops the lease SaveImage took on uuid and deletes the
+// image, unless a post or another upload holds it
+func discardImage(uuid string) {
+	store.Unlease(uuid)
+	if _, err := store.ReleaseImage(uuid); err != nil {
+		log.Println(err)
+	}
+}
+
+// writePostError answers a post refused by the rules of its thread, or one
+// that failed to save
+func writePostError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, services.ErrNoImage), errors.Is(err, services.ErrEmptyPost):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, services.ErrThreadNotFound):
+		http.Error(w, "thread not found", http.StatusNotFound)
+	case errors.Is(err, services.ErrImageLimit):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, services.ErrReservedName):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	default:
+		log.Println(err)
+		http.Error(w, "failed to save post", http.StatusInternalServerError)
+	}
 }
@@ -1,10 +1,18 @@
 package handlers
 
 import (
+	"errors"
 	"fmt"
 	"go-image-web/internal/services"
+	"go-image-web/internal/store"
+	"io"
+	"io/fs"
+	"log"
+	"mime"
 	"net/http"
-	"strings"
+	"os"
+	"path"
+	"strconv"
 
 	"github.com/gorilla/mux"
 )
@@ -17,33 +25,123 @@ func GetImageHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	varient, err := services.GetImage(vars["id"])
+	// a query with transform parameters asks for a signed transform of the
+	// original, any other query is ignored
+	if services.IsTransform(r.URL.Query()) {
+		serveTransform(w, r, vars["id"])
+		return
+	}
+
+	varient, err := services.GetImage(vars["id"], r.Header.Get("Accept"))
 	if err != nil {
 
 		http.Error(w, fmt.Sprintf("image not found: %v", err), http.StatusNotFound)
 		return
 	}
 
-	if cType := imageContentType(varient.Ext); cType != "" {
+	if cType := services.ContentType(varient.Ext); cType != "" {
+		w.Header().Set("Content-Type", cType)
+	}
+
+	// the encoding of a varient requested without an extension depends on
+	// Accept, caches must not hand a webp to a browser that didn't ask for one
+	w.Header().Add("Vary", "Accept")
+
+	serveStored(w, r, varient.Path)
+}
+
+// GetUploadHandler serves the upload kept of an image as a file named after it
+func GetUploadHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	upload, err := services.GetUpload(id)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("image not found: %v", err), http.StatusNotFound)
+		return
+	}
+
+	if cType := services.ContentType(upload.Ext); cType != "" {
 		w.Header().Set("Content-Type", cType)
 	}
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("inline", map[string]string{
+		"filename": id + "." + upload.Ext,
+	}))
+
+	serveStored(w, r, upload.Path)
+}
+
+// serveStored streams the file at key, with the Content-Type already set
+func serveStored(w http.ResponseWriter, r *http.Request, key string) {
+	rc, info, err := store.Backend.Get(r.Context(), key)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			http.Error(w, fmt.Sprintf("image not found: %v", err), http.StatusNotFound)
+			return
+		}
+		log.Println(err)
+		http.Error(w, "failed to read image", http.StatusInternalServerError)
+		return
+	}
+	defer rc.Close()
 
 	w.Header().Set("X-Content-Type-Options", "nosniff")
 	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
 
-	http.ServeFile(w, r, varient.Path)
+	// seekable readers (local files) get range and conditional requests for free
+	if rs, ok := rc.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, path.Base(info.Key), info.ModTime, rs)
+		return
+	}
 
+	if info.Size >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+	}
+	if !info.ModTime.IsZero() {
+		w.Header().Set("Last-Modified", info.ModTime.UTC().Format(http.TimeFormat))
+	}
+
+	if _, err := io.Copy(w, rc); err != nil {
+		log.Printf("error while streaming %s: %v", info.Key, err)
+	}
 }
 
-func imageContentType(ext string) string {
-	switch strings.ToLower(ext) {
-	case "gif":
-		return "image/gif"
-	case "jpg", "jpeg":
-		return "image/jpeg"
-	case "png":
-		return "image/png"
-	default:
-		return ""
+func serveTransform(w http.ResponseWriter, r *http.Request, id string) {
+	query := r.URL.Query()
+
+	t, err := services.ParseTransform(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	p, ext, err := services.TransformImage(id, t, query.Get("s"))
+	if err != nil {
+		if errors.Is(err, services.ErrBadSignature) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		http.Error(w, fmt.Sprintf("image not found: %v", err), http.StatusNotFound)
+		return
 	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "failed to read image", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "failed to read image", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", services.ContentType(ext))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+
+	http.ServeContent(w, r, path.Base(p), info.ModTime(), f)
 }
@@ -17,6 +17,7 @@ func SetupRouter() *mux.Router {
 
 	r.PathPrefix("/assets/").Handler(http.StripPrefix("/assets/", http.FileServer(http.Dir(assetsDir))))
 	r.HandleFunc("/img/{id}", GetImageHandler).Methods("GET")
+	r.HandleFunc("/img/{id}/original", GetUploadHandler).Methods("GET")
 
 	return r
 }
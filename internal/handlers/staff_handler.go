@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"errors"
+	"go-image-web/internal/services"
+	"log"
+	"net/http"
+	"time"
+)
+
+// cookie a staff session is kept in
+const staffCookie = "staff"
+
+type StaffHandler struct {
+	StaffService *services.StaffService
+}
+
+func NewStaffHandler(staffService *services.StaffService) *StaffHandler {
+	return &StaffHandler{
+		StaffService: staffService,
+	}
+}
+
+// staffPageModel is the login form, or the logout button once logged in
+type staffPageModel struct {
+	Enabled  bool
+	LoggedIn bool
+	Error    string
+}
+
+// isStaff reports whether r comes from a logged in staff session
+func isStaff(staff *services.StaffService, r *http.Request) bool {
+	c, err := r.Cookie(staffCookie)
+	return err == nil && staff.Authenticated(c.Value)
+}
+
+func (h *StaffHandler) render(w http.ResponseWriter, status int, page *staffPageModel) {
+	w.WriteHeader(status)
+	if err := parsePage("staff.html").ExecuteTemplate(w, "layout", page); err != nil {
+		log.Println(err)
+	}
+}
+
+// Page shows the staff login
+func (h *StaffHandler) Page(w http.ResponseWriter, r *http.Request) {
+	h.render(w, http.StatusOK, &staffPageModel{
+		Enabled:  h.StaffService.Enabled(),
+		LoggedIn: isStaff(h.StaffService, r),
+	})
+}
+
+// Login starts a staff session given the key, or ends it
+func (h *StaffHandler) Login(w http.ResponseWriter, r *http.Request) {
+	cookie := &http.Cookie{
+		Name:     staffCookie,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	}
+
+	if r.FormValue("logout") != "" {
+		if c, err := r.Cookie(staffCookie); err == nil {
+			h.StaffService.Logout(c.Value)
+		}
+		cookie.MaxAge = -1
+		http.SetCookie(w, cookie)
+		http.Redirect(w, r, "/staff", http.StatusSeeOther)
+		return
+	}
+
+	token, err := h.StaffService.Login(r.FormValue("key"))
+	if errors.Is(err, services.ErrStaffKey) {
+		h.render(w, http.StatusForbidden, &staffPageModel{
+			Enabled: h.StaffService.Enabled(),
+			Error:   err.Error(),
+		})
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "failed to start a session", http.StatusInternalServerError)
+		return
+	}
+
+	cookie.Value = token
+	cookie.MaxAge = int(services.StaffSessionAge / time.Second)
+	http.SetCookie(w, cookie)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
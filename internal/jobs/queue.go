@@ -0,0 +1,248 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"go-image-web/internal/models"
+	"go-image-web/internal/repo"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultWorkers     = 2
+	DefaultMaxAttempts = 5
+
+	// how often idle workers look for jobs whose backoff has passed
+	pollInterval = time.Second
+
+	// how often done jobs past their retention are deleted
+	pruneInterval = time.Hour
+
+	// retry delay doubles per attempt from baseBackoff up to maxBackoff
+	baseBackoff = 5 * time.Second
+	maxBackoff  = 10 * time.Minute
+)
+
+// Handler runs one job, the payload is the JSON it was enqueued with.
+// Returning an error schedules a retry until the job runs out of attempts
+type Handler func(ctx context.Context, payload []byte) error
+
+// Queue runs persisted jobs on a bounded pool of workers
+type Queue struct {
+	repo        *repo.JobRepo
+	workers     int
+	maxAttempts int
+	// how long done jobs are kept, 0 to keep them
+	retention time.Duration
+
+	mu       sync.RWMutex
+	handlers map[string]Handler
+
+	// nudges an idle worker when a job is enqueued
+	wake   chan struct{}
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func NewQueue(repo *repo.JobRepo, workers int, maxAttempts int, retention time.Duration) *Queue {
+	if workers < 1 {
+		workers = DefaultWorkers
+	}
+	if maxAttempts < 1 {
+		maxAttempts = DefaultMaxAttempts
+	}
+
+	return &Queue{
+		repo:        repo,
+		workers:     workers,
+		maxAttempts: maxAttempts,
+		retention:   retention,
+		handlers:    make(map[string]Handler),
+		wake:        make(chan struct{}, 1),
+	}
+}
+
+// Register sets the handler for a kind of job, before Start
+func (q *Queue) Register(kind string, h Handler) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.handlers[kind] = h
+}
+
+// Enqueue persists a job, it runs once a worker is free
+func (q *Queue) Enqueue(kind string, payload any) error {
+	buf, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("encode %s job: %w", kind, err)
+	}
+
+	if _, err := q.repo.InsertJob(kind, string(buf), q.maxAttempts); err != nil {
+		return err
+	}
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// Start requeues jobs interrupted by the last shutdown and starts the workers,
+// along with pruning done jobs when they have a retention
+func (q *Queue) Start(ctx context.Context) error {
+	n, err := q.repo.RequeueRunningJobs()
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		log.Printf("requeued %d interrupted jobs", n)
+	}
+
+	ctx, q.cancel = context.WithCancel(ctx)
+	for i := 0; i < q.workers; i++ {
+		q.wg.Add(1)
+		go q.work(ctx)
+	}
+	if q.retention > 0 {
+		q.wg.Add(1)
+		go q.prune(ctx)
+	}
+
+	return nil
+}
+
+// Stop signals the workers and waits for running jobs to return, jobs still
+// running when ctx expires are picked up again on the next Start
+func (q *Queue) Stop(ctx context.Context) {
+	if q.cancel == nil {
+		return
+	}
+	q.cancel()
+
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Println("stopped waiting for running jobs")
+	}
+}
+
+func (q *Queue) work(ctx context.Context) {
+	defer q.wg.Done()
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		// drain every due job before going idle
+		for ctx.Err() == nil {
+			job, err := q.repo.ClaimJob()
+			if err != nil {
+				log.Println(err)
+				break
+			}
+			if job == nil {
+				break
+			}
+			q.run(ctx, job)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-q.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// prune deletes done jobs older than the retention now and every
+// pruneInterval, failed ones are kept for inspection
+func (q *Queue) prune(ctx context.Context) {
+	defer q.wg.Done()
+
+	ticker := time.NewTicker(pruneInterval)
+	defer ticker.Stop()
+
+	for {
+		n, err := q.repo.PruneJobs(time.Now().Add(-q.retention))
+		if err != nil {
+			log.Println(err)
+		} else if n > 0 {
+			log.Printf("pruned %d done jobs", n)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (q *Queue) run(ctx context.Context, job *models.JobModel) {
+	q.mu.RLock()
+	h, ok := q.handlers[job.Kind]
+	q.mu.RUnlock()
+
+	var err error
+	if !ok {
+		err = fmt.Errorf("no handler for job kind %q", job.Kind)
+	} else {
+		err = call(ctx, h, job)
+	}
+
+	if err == nil {
+		if err := q.repo.CompleteJob(job.ID); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	retry := ok && job.Attempts < job.MaxAttempts
+	delay := Backoff(job.Attempts)
+	if err := q.repo.FailJob(job, err.Error(), retry, int(delay.Seconds())); err != nil {
+		log.Println(err)
+	}
+
+	if retry {
+		log.Printf("job %d (%s) attempt %d/%d failed, retrying in %s: %v", job.ID, job.Kind, job.Attempts, job.MaxAttempts, delay, err)
+	} else {
+		log.Printf("job %d (%s) failed after %d attempts: %v", job.ID, job.Kind, job.Attempts, err)
+	}
+}
+
+// call runs a handler, turning a panic into a failed attempt
+func call(ctx context.Context, h Handler, job *models.JobModel) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return h(ctx, []byte(job.Payload))
+}
+
+// Backoff returns the delay before retrying a job that has failed attempts times
+func Backoff(attempts int) time.Duration {
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	delay := baseBackoff
+	for i := 1; i < attempts; i++ {
+		delay *= 2
+		if delay >= maxBackoff {
+			return maxBackoff
+		}
+	}
+	return delay
+}
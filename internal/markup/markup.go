@@ -0,0 +1,345 @@
+// Package markup renders the messages of posts. Output is built from escaped
+// text and a fixed set of tags, a message can't add HTML of its own.
+//
+// A message supports, besides the references of ParseReferences:
+//
+//	>text             a greentext line
+//	[spoiler]x[/spoiler]
+//	[code]x[/code]    inline, or a block when it spans lines
+//	**bold** *italic*
+//	http://... https://...
+//
+// Everything but code blocks applies within a single line.
+package markup
+
+import (
+	"fmt"
+	"html/template"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// cap on the references a single message links
+const MaxReferences int = 20
+
+// Reference is a post a message links to, >>no on its own board or
+// >>>/board/no on any
+type Reference struct {
+	Board string
+	No    int
+}
+
+// Links maps the references stored for a message to the number of the
+// thread of the post they link to, 0 for a post that doesn't exist
+type Links map[Reference]int
+
+// Set records that the reference to no on board links into thread threadNo
+func (l Links) Set(board string, no int, threadNo int) {
+	l[Reference{Board: board, No: no}] = threadNo
+}
+
+var (
+	referencePattern = regexp.MustCompile(`^>>(?:>/([a-z0-9]{1,16})/)?([0-9]{1,9})`)
+	urlPattern       = regexp.MustCompile(`^https?://[^\s<>"]+`)
+	codePattern      = regexp.MustCompile(`(?s)\[code\](.*?)\[/code\]`)
+)
+
+// renderer walks a message once, writing its HTML and noting what it finds
+type renderer struct {
+	board string
+	links Links
+	b     strings.Builder
+
+	// references in the order they appear, code left out
+	refs []Reference
+	// offsets of the outermost constructs, in order
+	spans [][2]int
+	// how deep in a construct the walk is
+	depth int
+}
+
+func walk(board string, message string, links Links) *renderer {
+	r := &renderer{board: board, links: links}
+	r.message(message)
+	return r
+}
+
+// Render returns message, posted on board, as HTML. References in links are
+// linked to their post, struck through when it doesn't exist, others are
+// left as text
+func Render(board string, message string, links Links) template.HTML {
+	return template.HTML(walk(board, message, links).b.String())
+}
+
+// ParseReferences returns the posts message, posted on board, links to in
+// the order they appear, each once and at most MaxReferences. Those in code
+// aren't
+func ParseReferences(board string, message string) []Reference {
+	var refs []Reference
+	seen := make(map[Reference]bool)
+	for _, ref := range walk(board, message, nil).refs {
+		if len(refs) == MaxReferences {
+			break
+		}
+		if !seen[ref] {
+			seen[ref] = true
+			refs = append(refs, ref)
+		}
+	}
+	return refs
+}
+
+// Cut returns the largest offset up to n at which message can be cut
+// without splitting markup, so the rest of a spoiler never shows as text
+func Cut(message string, n int) int {
+	if n >= len(message) {
+		return len(message)
+	}
+	for _, span := range walk("", message, nil).spans {
+		if span[0] < n && n < span[1] {
+			n = span[0]
+			break
+		}
+	}
+	for n > 0 && !utf8.RuneStart(message[n]) {
+		n--
+	}
+	return n
+}
+
+// span notes a construct from start to end when it is an outermost one
+func (r *renderer) span(start int, end int) {
+	if r.depth == 0 {
+		r.spans = append(r.spans, [2]int{start, end})
+	}
+}
+
+func (r *renderer) text(s string) {
+	r.b.WriteString(template.HTMLEscapeString(s))
+}
+
+// message splits off code blocks, the rest goes line by line
+func (r *renderer) message(msg string) {
+	last := 0
+	for _, m := range codePattern.FindAllStringSubmatchIndex(msg, -1) {
+		code := msg[m[2]:m[3]]
+		if !strings.Contains(code, "\n") {
+			// inline, left to its line
+			continue
+		}
+
+		// the block breaks the lines around it itself
+		r.lines(strings.TrimSuffix(msg[last:m[0]], "\n"), last)
+		r.span(m[0], m[1])
+		code = strings.TrimPrefix(strings.TrimSuffix(code, "\n"), "\n")
+		r.b.WriteString(`<pre class="post-code">`)
+		r.text(code)
+		r.b.WriteString(`</pre>`)
+
+		last = m[1]
+		if strings.HasPrefix(msg[last:], "\n") {
+			last++
+		}
+	}
+	if last < len(msg) {
+		r.lines(msg[last:], last)
+	}
+}
+
+// lines renders s, at off in the message, a line at a time
+func (r *renderer) lines(s string, off int) {
+	for i, line := range strings.Split(s, "\n") {
+		if i > 0 {
+			r.b.WriteByte('\n')
+		}
+		if strings.HasPrefix(line, ">") && !referencePattern.MatchString(line) {
+			r.b.WriteString(`<span class="greentext">`)
+			r.inline(line, off)
+			r.b.WriteString(`</span>`)
+		} else {
+			r.inline(line, off)
+		}
+		off += len(line) + 1
+	}
+}
+
+// inline renders s, at off in the message, with the markup it holds
+func (r *renderer) inline(s string, off int) {
+	text := 0
+	for i := 0; i < len(s); i++ {
+		end, write := r.match(s, i, off)
+		if write == nil {
+			continue
+		}
+		r.text(s[text:i])
+		r.span(off+i, off+end)
+		write()
+		text = end
+		i = end - 1
+	}
+	r.text(s[text:])
+}
+
+// nested renders s, at off in the message, inside a construct
+func (r *renderer) nested(s string, off int) {
+	r.depth++
+	r.inline(s, off)
+	r.depth--
+}
+
+// match returns where the construct at s[i] ends and how it is written,
+// nil when there is none
+func (r *renderer) match(s string, i int, off int) (int, func()) {
+	rest := s[i:]
+
+	if strings.HasPrefix(rest, "[code]") {
+		if j := strings.Index(rest[6:], "[/code]"); j >= 0 {
+			code := rest[6 : 6+j]
+			return i + 6 + j + 7, func() {
+				r.b.WriteString(`<code class="post-code">`)
+				r.text(code)
+				r.b.WriteString(`</code>`)
+			}
+		}
+	}
+
+	if strings.HasPrefix(rest, "[spoiler]") {
+		if j := pairEnd(rest, "[spoiler]", "[/spoiler]"); j >= 0 {
+			return i + j + 10, func() {
+				r.b.WriteString(`<span class="spoiler">`)
+				r.nested(rest[9:j], off+i+9)
+				r.b.WriteString(`</span>`)
+			}
+		}
+	}
+
+	if strings.HasPrefix(rest, "**") {
+		if j := emphasis(s, i, 2); j >= 0 {
+			return j + 2, func() {
+				r.b.WriteString(`<strong>`)
+				r.nested(s[i+2:j], off+i+2)
+				r.b.WriteString(`</strong>`)
+			}
+		}
+	} else if rest[0] == '*' {
+		if j := emphasis(s, i, 1); j >= 0 {
+			return j + 1, func() {
+				r.b.WriteString(`<em>`)
+				r.nested(s[i+1:j], off+i+1)
+				r.b.WriteString(`</em>`)
+			}
+		}
+	}
+
+	if m := referencePattern.FindStringSubmatchIndex(rest); m != nil {
+		no, _ := strconv.Atoi(rest[m[4]:m[5]])
+		if no > 0 {
+			ref := Reference{Board: r.board, No: no}
+			if m[2] >= 0 {
+				ref.Board = rest[m[2]:m[3]]
+			}
+			r.refs = append(r.refs, ref)
+
+			// one not in links stays text, but isn't cut either
+			text := rest[:m[1]]
+			threadNo, linked := r.links[ref]
+			return i + m[1], func() {
+				switch {
+				case !linked:
+					r.text(text)
+				case threadNo == 0:
+					r.b.WriteString(`<s class="post-ref post-ref--dangling">`)
+					r.text(text)
+					r.b.WriteString(`</s>`)
+				default:
+					fmt.Fprintf(&r.b, `<a href="/%s/thread/%d#p%d" class="post-ref">`, ref.Board, threadNo, ref.No)
+					r.text(text)
+					r.b.WriteString(`</a>`)
+				}
+			}
+		}
+	}
+
+	if i == 0 || !isWordByte(s[i-1]) {
+		if url := urlPattern.FindString(rest); url != "" {
+			url = url[:urlEnd(url)]
+			if len(url) > strings.Index(url, "://")+3 {
+				return i + len(url), func() {
+					fmt.Fprintf(&r.b, `<a href="%s" rel="nofollow ugc noopener">`, template.HTMLEscapeString(url))
+					r.text(url)
+					r.b.WriteString(`</a>`)
+				}
+			}
+		}
+	}
+
+	return 0, nil
+}
+
+// pairEnd returns the offset in s of the tag closing open, which s starts
+// with, counting nested pairs, -1 when it isn't closed
+func pairEnd(s string, open string, close string) int {
+	depth := 0
+	for i := 0; i < len(s); {
+		switch {
+		case strings.HasPrefix(s[i:], open):
+			depth++
+			i += len(open)
+		case strings.HasPrefix(s[i:], close):
+			depth--
+			if depth == 0 {
+				return i
+			}
+			i += len(close)
+		default:
+			i++
+		}
+	}
+	return -1
+}
+
+func isWordByte(c byte) bool {
+	return c < utf8.RuneSelf && (unicode.IsLetter(rune(c)) || unicode.IsDigit(rune(c)))
+}
+
+// emphasis returns the offset in s of the delimiter closing the one of n
+// stars at s[i], -1 when it doesn't open or isn't closed. A delimiter opens
+// before text and not after a word, and closes the other way round
+func emphasis(s string, i int, n int) int {
+	if i > 0 && (isWordByte(s[i-1]) || s[i-1] == '*') {
+		return -1
+	}
+	if i+n >= len(s) || s[i+n] == ' ' || s[i+n] == '*' {
+		return -1
+	}
+	delim := strings.Repeat("*", n)
+	for j := i + n + 1; j+n <= len(s); j++ {
+		if s[j:j+n] != delim || s[j-1] == ' ' || s[j-1] == '*' {
+			continue
+		}
+		if j+n < len(s) && (isWordByte(s[j+n]) || s[j+n] == '*') {
+			continue
+		}
+		return j
+	}
+	return -1
+}
+
+// urlEnd trims the punctuation a sentence puts after a url
+func urlEnd(url string) int {
+	end := len(url)
+	for end > 0 {
+		c := url[end-1]
+		switch {
+		case strings.IndexByte(".,:;!?'", c) >= 0:
+		case c == ')' && strings.Count(url[:end], "(") < strings.Count(url[:end], ")"):
+		default:
+			return end
+		}
+		end--
+	}
+	return end
+}
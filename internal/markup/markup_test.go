@@ -0,0 +1,113 @@
+package markup
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestParseReferences(t *testing.T) {
+	refs := ParseReferences("b", ">>12 and >>>/g/7, >>12 again\n>>>>3 >>0 >>>/B/4 >>x")
+	want := []Reference{{"b", 12}, {"g", 7}, {"b", 3}}
+	if fmt.Sprint(refs) != fmt.Sprint(want) {
+		t.Errorf("Expected %v, got %v", want, refs)
+	}
+
+	var many strings.Builder
+	for i := 1; i <= MaxReferences+5; i++ {
+		fmt.Fprintf(&many, ">>%d ", i)
+	}
+	if refs := ParseReferences("b", many.String()); len(refs) != MaxReferences {
+		t.Errorf("Expected %d references, got %d", MaxReferences, len(refs))
+	}
+}
+
+func TestRender(t *testing.T) {
+	links := Links{}
+	links.Set("b", 12, 10)
+	links.Set("g", 7, 0)
+
+	got := string(Render("b", "<i>>>12</i> >>>/g/7 >>13 & done", links))
+	want := `&lt;i&gt;<a href="/b/thread/10#p12" class="post-ref">&gt;&gt;12</a>&lt;/i&gt; ` +
+		`<s class="post-ref post-ref--dangling">&gt;&gt;&gt;/g/7</s> &gt;&gt;13 &amp; done`
+	if got != want {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+
+	if got := string(Render("b", `"quoted" <b>`, nil)); got != "&#34;quoted&#34; &lt;b&gt;" {
+		t.Errorf("Expected the message escaped, got %s", got)
+	}
+}
+
+func TestRender_Markup(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		want    string
+	}{
+		{"greentext", ">be me\nnot green >here",
+			`<span class="greentext">&gt;be me</span>` + "\n" + `not green &gt;here`},
+		{"spoiler", "a [spoiler]b [spoiler]c[/spoiler][/spoiler] d",
+			`a <span class="spoiler">b <span class="spoiler">c</span></span> d`},
+		{"unclosed spoiler", "[spoiler]a\nb[/spoiler]",
+			"[spoiler]a\nb[/spoiler]"},
+		{"inline code", "run [code]**x** <y>[/code] now",
+			`run <code class="post-code">**x** &lt;y&gt;</code> now`},
+		{"code block", "before\n[code]\nif a < b {\n}\n[/code]\nafter",
+			"before" + `<pre class="post-code">if a &lt; b {` + "\n}</pre>after"},
+		{"bold and italic", "**bold** and *it **both** al*",
+			`<strong>bold</strong> and <em>it <strong>both</strong> al</em>`},
+		{"no emphasis", "2*3*4 and * spaced * and a**b**",
+			"2*3*4 and * spaced * and a**b**"},
+		{"url", "see https://example.com/a?b=1&c=(2). or http://x",
+			`see <a href="https://example.com/a?b=1&amp;c=(2)" rel="nofollow ugc noopener">https://example.com/a?b=1&amp;c=(2)</a>. or ` +
+				`<a href="http://x" rel="nofollow ugc noopener">http://x</a>`},
+		{"url not in a word", "xhttps://example.com", "xhttps://example.com"},
+		{"url quote", `https://a.b/"onmouseover="x`,
+			`<a href="https://a.b/" rel="nofollow ugc noopener">https://a.b/</a>&#34;onmouseover=&#34;x`},
+		{"markup in greentext", ">**a** [spoiler]b[/spoiler]",
+			`<span class="greentext">&gt;<strong>a</strong> <span class="spoiler">b</span></span>`},
+		{"html", `<script>alert("x")</script>`,
+			`&lt;script&gt;alert(&#34;x&#34;)&lt;/script&gt;`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(Render("b", tt.message, nil)); got != tt.want {
+				t.Errorf("Expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestParseReferences_Code(t *testing.T) {
+	refs := ParseReferences("b", "[code]>>1[/code] [spoiler]>>2[/spoiler]\n[code]\n>>3\n[/code]")
+	if want := []Reference{{"b", 2}}; fmt.Sprint(refs) != fmt.Sprint(want) {
+		t.Errorf("Expected %v, got %v", want, refs)
+	}
+}
+
+func TestCut(t *testing.T) {
+	tests := []struct {
+		message string
+		n       int
+		want    int
+	}{
+		{"short", 10, 5},
+		{"plain text", 5, 5},
+		{"ab [spoiler]secret[/spoiler] cd", 10, 3},
+		{"ab [spoiler]secret[/spoiler] cd", 28, 28},
+		{"ab **bold** cd", 6, 3},
+		{"ab >>123 cd", 6, 3},
+		{"ab https://example.com cd", 10, 3},
+		{"ab\n[code]\nx\n[/code]", 12, 3},
+		{"ab [spoiler]unclosed", 10, 10},
+		{"héllo", 2, 1},
+	}
+
+	for _, tt := range tests {
+		if got := Cut(tt.message, tt.n); got != tt.want {
+			t.Errorf("Cut(%q, %d): expected %d, got %d", tt.message, tt.n, tt.want, got)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package models
+
+import (
+	"slices"
+	"strings"
+	"time"
+)
+
+// formats an upload can have, in the order offered to the file picker
+var BoardFormats = []string{"jpeg", "png", "webp", "gif"}
+
+type Board struct {
+	Slug        string `db:"slug"`
+	Title       string `db:"title"`
+	Description string `db:"description"`
+	// comma separated formats uploads may have, empty for all of BoardFormats
+	Formats string `db:"formats"`
+	// cap on the size of uploads, 0 for the global one
+	MaxUploadBytes int64 `db:"max_upload_bytes"`
+	// whether opening posts need an image
+	ImageRequired bool   `db:"image_required"`
+	DefaultName   string `db:"default_name"`
+	NSFW          bool   `db:"nsfw"`
+	// warn, link or reject, what happens to an image already posted here
+	RepostPolicy string `db:"repost_policy"`
+	// last post number given out on the board
+	LastNo    int       `db:"last_no"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+// FormatList returns the formats uploads to the board may have
+func (b *Board) FormatList() []string {
+	if b.Formats == "" {
+		return BoardFormats
+	}
+	return strings.Split(b.Formats, ",")
+}
+
+// AllowsFormat reports whether uploads to the board may be in format
+func (b *Board) AllowsFormat(format string) bool {
+	return slices.Contains(b.FormatList(), format)
+}
+
+// Accept lists the formats of the board for the accept attribute of a file input
+func (b *Board) Accept() string {
+	types := make([]string, 0, len(BoardFormats))
+	for _, f := range b.FormatList() {
+		types = append(types, "image/"+f)
+	}
+	return strings.Join(types, ",")
+}
+
+// UploadLimit returns the size cap of uploads to the board, no more than max
+func (b *Board) UploadLimit(max int64) int64 {
+	if b.MaxUploadBytes > 0 && b.MaxUploadBytes < max {
+		return b.MaxUploadBytes
+	}
+	return max
+}
+
+// BoardPageModel is a board with a page of its threads, last bumped first
+type BoardPageModel struct {
+	Board *Board
+	Posts []*PostViewModel
+	// the threads listed come after Before, nil on the first page
+	Before *ThreadCursor
+	// where the next page starts, nil on the last
+	Next *ThreadCursor
+}
@@ -0,0 +1,22 @@
+package models
+
+import "time"
+
+// job statuses
+const (
+	JobPending string = "pending"
+	JobRunning string = "running"
+	JobDone    string = "done"
+	JobFailed  string = "failed"
+)
+
+type JobModel struct {
+	ID          int       `db:"id"`
+	Kind        string    `db:"kind"`
+	Payload     string    `db:"payload"`
+	Status      string    `db:"status"`
+	Attempts    int       `db:"attempts"`
+	MaxAttempts int       `db:"max_attempts"`
+	LastError   string    `db:"last_error"`
+	CreatedAt   time.Time `db:"created_at"`
+}
@@ -2,6 +2,7 @@ package models
 
 import (
 	"fmt"
+	"html/template"
 	"strings"
 	"sync"
 	"time"
@@ -22,6 +23,30 @@ type ImageModel struct {
 	Height    int
 	Timestamp time.Time
 	Size      int64
+	// the upload is kept as sent, linked to besides the display copy
+	HasUpload bool
+	// varients are still being generated, render the original
+	Pending bool
+	// width of the smallest varient, shown while pending, 0 when the
+	// original is no wider
+	PreviewWidth int
+
+	// stored varients in the encodings only some browsers take, best first,
+	// and in the one every browser takes
+	Sources  []ImageSource
+	Fallback ImageSource
+	// srcset of the animation for a GIF
+	AnimatedSrcset string
+
+	// CSS background shown until the image loads, empty when unknown
+	Placeholder template.CSS
+}
+
+// ImageSource lists the varients of an image in one encoding
+type ImageSource struct {
+	Type   string
+	Src    string
+	Srcset string
 }
 
 // ShortID returns the first 8 characters of the ID
@@ -33,6 +58,11 @@ func (m ImageModel) ShortID() string {
 	return parts[0]
 }
 
+// Animated reports whether the image is a GIF, shown as a still until expanded
+func (m ImageModel) Animated() bool {
+	return m.Extension == "gif"
+}
+
 func (m ImageModel) FormattedTime() string {
 	day := m.Timestamp.Day()
 	suffix := "th"
@@ -66,39 +96,96 @@ func (m ImageModel) FormattedSize() string {
 	}
 }
 
+// ImageMatch is an indexed image perceptually close to another
+type ImageMatch struct {
+	UUID     string
+	Distance int
+}
+
 type ImageVarient struct {
+	Width int    `db:"width"`
+	Path  string `db:"path"`
+	Ext   string `db:"ext"`
+	Size  int64  `db:"size"`
+	// hex encoded sha256 of the stored file, empty for varients stored before
+	// it was recorded
+	Checksum string `db:"checksum"`
+}
+
+// VarientID identifies a varient of an image, one width can have several encodings
+type VarientID struct {
 	Width int
-	Path  string
 	Ext   string
 }
 
+func (v ImageVarient) ID() VarientID {
+	return VarientID{Width: v.Width, Ext: v.Ext}
+}
+
+// ImageVarientRow is a single image_variants row with the image it belongs to
+type ImageVarientRow struct {
+	ImageUUID string `db:"image_uuid"`
+	ImageVarient
+}
+
 type ImageMetadata struct {
-	UUID         string
-	OriginalExt  string
-	OriginalPath string
-	ModifiedTime time.Time
-	OriginalSize int64
+	UUID         string    `db:"uuid"`
+	OriginalExt  string    `db:"ext"`
+	OriginalPath string    `db:"path"`
+	ModifiedTime time.Time `db:"created_at"`
+	OriginalSize int64     `db:"size"`
+
+	OriginalWidth  int `db:"width"`
+	OriginalHeight int `db:"height"`
+
+	// hex encoded sha256 of the uploaded bytes, empty for legacy images
+	SHA256 string `db:"sha256"`
+	// hex encoded sha256 of the upload less its metadata, which uploads
+	// differing only in metadata share, empty for images stored before it was
+	// recorded
+	ContentSHA256 string `db:"content_sha256"`
+	// hex encoded sha256 of the stored original, which differs from the
+	// upload once re-encoded, empty for images stored before it was recorded
+	Checksum string `db:"checksum"`
+	// the upload kept as sent less its metadata, served besides the display
+	// copy, empty unless uploads are kept
+	UploadPath string `db:"upload_path"`
+	UploadSize int64  `db:"upload_size"`
+	// hex encoded 64 bit perceptual hash, empty for legacy images
+	PHash string `db:"phash"`
 
-	OriginalWidth  int
-	OriginalHeight int
+	// the EXIF kept from the upload, the rest is stripped
+	TakenAt     *time.Time `db:"taken_at"`
+	CameraMake  string     `db:"camera_make"`
+	CameraModel string     `db:"camera_model"`
+
+	// BlurHash and dominant colour as #rrggbb, empty for legacy images
+	BlurHash string `db:"blurhash"`
+	Color    string `db:"color"`
 
 	VarientsMu sync.RWMutex
-	Varients   map[int]ImageVarient
+	Varients   map[VarientID]ImageVarient
 }
 
-func (m *ImageMetadata) SetVariant(width int, v ImageVarient) {
+func (m *ImageMetadata) SetVariant(v ImageVarient) {
 	m.VarientsMu.Lock()
 	defer m.VarientsMu.Unlock()
 	if m.Varients == nil {
-		m.Varients = make(map[int]ImageVarient)
+		m.Varients = make(map[VarientID]ImageVarient)
 	}
-	m.Varients[width] = v
+	m.Varients[v.ID()] = v
+}
+
+func (m *ImageMetadata) RemoveVariant(width int, ext string) {
+	m.VarientsMu.Lock()
+	defer m.VarientsMu.Unlock()
+	delete(m.Varients, VarientID{Width: width, Ext: ext})
 }
 
-func (m *ImageMetadata) GetVariant(width int) (ImageVarient, bool) {
+func (m *ImageMetadata) GetVariant(width int, ext string) (ImageVarient, bool) {
 	m.VarientsMu.RLock()
 	defer m.VarientsMu.RUnlock()
-	v, ok := m.Varients[width]
+	v, ok := m.Varients[VarientID{Width: width, Ext: ext}]
 	return v, ok
 }
 
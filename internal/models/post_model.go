@@ -1,29 +1,148 @@
 package models
 
 import (
+	"fmt"
+	"go-image-web/internal/markup"
+	"html/template"
+	"strconv"
 	"strings"
 	"time"
 )
 
-// POST upload binding
-type PostUploadModel struct {
-	Name    string
-	Subject string
-	Message string
-}
-
 type PostViewModel struct {
 	Post  *PostModel
 	Image *ImageModel
+	// the thread an opening post starts, set on the board's index
+	Thread *ThreadModel
+
+	// earlier posts of the same or a near identical image
+	Reposts      []Repost
+	RepostPolicy string
+
+	// the message with its references linked, in full and cut short
+	Message        template.HTML
+	MessagePreview template.HTML
+	// later posts referencing this one
+	Backlinks []Backlink
+
+	// whether the post is shown to staff, who may delete it
+	Staff bool
+}
+
+// PostReference is a reference in the message of post PostID to post No on
+// Board
+type PostReference struct {
+	PostID int    `db:"post_id"`
+	Board  string `db:"board"`
+	No     int    `db:"no"`
+	// thread of the post referenced, 0 when it doesn't exist
+	ThreadNo int `db:"thread_no"`
+}
+
+// Backlink is a post whose message references post TargetID
+type Backlink struct {
+	TargetID int    `db:"target_id"`
+	Board    string `db:"board"`
+	No       int    `db:"no"`
+	ThreadNo int    `db:"thread_no"`
+}
+
+// Repost links a post to an earlier post of the same or a near identical image
+type Repost struct {
+	PostID   int `db:"post_id"`
+	RepostOf int `db:"repost_of"`
+	Distance int `db:"distance"`
+	// number on the board of the earlier post
+	RepostNo int `db:"repost_no"`
 }
 
 type PostModel struct {
-	ID        int       `db:"id"`
-	Name      string    `db:"name"`
+	ID int `db:"id"`
+	// board the post is on and its number there
+	Board string `db:"board"`
+	No    int    `db:"no"`
+	Name  string `db:"name"`
+	// !hash or !!hash for a secure tripcode, empty without one
+	Tripcode string `db:"tripcode"`
+	// the reserved name staff posted under, empty for everyone else
+	Capcode   string    `db:"capcode"`
 	Subject   string    `db:"subject"`
 	Message   string    `db:"message"`
 	ImageUUID string    `db:"image_uuid"`
 	CreatedAt time.Time `db:"created_at"`
+
+	// id of the opening post of the thread, 0 for a new thread
+	ThreadID int `db:"thread_id"`
+	// id of the post replied to, 0 for an opening post
+	ParentID int `db:"parent_id"`
+	// numbers on the board of the opening post and of the post replied to
+	ThreadNo int `db:"thread_no"`
+	ParentNo int `db:"parent_no"`
+}
+
+// IsOpening reports whether the post starts its thread
+func (p *PostModel) IsOpening() bool {
+	return p.ThreadID == 0 || p.ThreadID == p.ID
+}
+
+// ThreadModel is an opening post with what was replied to it
+type ThreadModel struct {
+	PostModel
+	// last reply that bumped the thread, or the opening post
+	BumpedAt time.Time `db:"bumped_at"`
+	Replies  int       `db:"replies"`
+	// posts with an image, the opening post included
+	Images int `db:"images"`
+}
+
+// ThreadCursor is the place of a thread on its board, last bumped first, a
+// page of threads lists those after it
+type ThreadCursor struct {
+	BumpedAt time.Time
+	No       int
+}
+
+// String returns the cursor as it goes in ?before=
+func (c *ThreadCursor) String() string {
+	return fmt.Sprintf("%d-%d", c.BumpedAt.Unix(), c.No)
+}
+
+// ParseThreadCursor parses a cursor String returned
+func ParseThreadCursor(s string) (*ThreadCursor, error) {
+	bumpedStr, noStr, _ := strings.Cut(s, "-")
+	bumped, err := strconv.ParseInt(bumpedStr, 10, 64)
+	if err != nil || bumped < 0 {
+		return nil, fmt.Errorf("invalid cursor %q", s)
+	}
+	no, err := strconv.Atoi(noStr)
+	if err != nil || no < 1 {
+		return nil, fmt.Errorf("invalid cursor %q", s)
+	}
+	return &ThreadCursor{BumpedAt: time.Unix(bumped, 0).UTC(), No: no}, nil
+}
+
+// ThreadPageModel is a thread with all its posts, oldest first
+type ThreadPageModel struct {
+	Board  *Board
+	Thread *ThreadModel
+	Posts  []*PostViewModel
+	// number of the post the reply form answers
+	ReplyTo int
+
+	// past the bump limit replies no longer bump the thread, at the image
+	// limit they can't have an image
+	BumpLimit  int
+	ImageLimit int
+}
+
+// Bumpable reports whether a reply still bumps the thread
+func (m *ThreadPageModel) Bumpable() bool {
+	return m.Thread.Replies < m.BumpLimit
+}
+
+// TakesImages reports whether a reply may still have an image
+func (m *ThreadPageModel) TakesImages() bool {
+	return m.Thread.Images < m.ImageLimit
 }
 
 func (p *PostModel) FormattedTime() string {
@@ -40,20 +159,6 @@ func (p *PostModel) FormattedTime() string {
 	return p.CreatedAt.Format("Mon, 2") + suffix + p.CreatedAt.Format(" January 2006 15:04")
 }
 
-func (p *PostModel) NewPost(name string, subject string, msg string, uuid string) *PostModel {
-
-	if name == "" {
-		name = "Anon"
-	}
-
-	return &PostModel{
-		Name:      name,
-		Subject:   subject,
-		Message:   msg,
-		ImageUUID: uuid,
-	}
-}
-
 // NeedsExpand returns true if the message is long enough to need a "View more" toggle.
 // More tolerant threshold - only expand if content would exceed image height (~8 lines or 500 chars).
 func (p *PostModel) NeedsExpand() bool {
@@ -64,7 +169,8 @@ func (p *PostModel) NeedsExpand() bool {
 	return newlineCount > 8
 }
 
-// TruncatedMessage returns a truncated version of the message ending on a full word.
+// TruncatedMessage returns a truncated version of the message ending on a full word
+// and never inside markup, so a spoiler is either whole or left out.
 // Used for the preview when NeedsExpand() is true.
 func (p *PostModel) TruncatedMessage() string {
 	maxLen := 500
@@ -88,5 +194,7 @@ func (p *PostModel) TruncatedMessage() string {
 		}
 	}
 
+	msg = p.Message[:markup.Cut(p.Message, len(msg))]
+
 	return strings.TrimRight(msg, " \t\n")
 }
@@ -0,0 +1,116 @@
+package repo
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"go-image-web/internal/models"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// ErrBoardNotFound is returned for a board that doesn't exist
+var ErrBoardNotFound = errors.New("board not found")
+
+type BoardRepo struct {
+	db *sqlx.DB
+}
+
+func NewBoardRepo(db *sqlx.DB) *BoardRepo {
+	return &BoardRepo{
+		db: db,
+	}
+}
+
+const allBoardsQuery string = `
+SELECT boards.slug,
+       boards.title,
+       boards.description,
+       boards.formats,
+       boards.max_upload_bytes,
+       boards.image_required,
+       boards.default_name,
+       boards.nsfw,
+       boards.repost_policy,
+       boards.last_no,
+       boards.created_at
+FROM boards
+ORDER BY boards.slug;
+`
+
+// SelectBoards returns every board by slug
+func (r *BoardRepo) SelectBoards() ([]*models.Board, error) {
+	const op string = "repo.board.SelectBoards"
+
+	var boards []*models.Board
+	if err := r.db.Select(&boards, allBoardsQuery); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return boards, nil
+}
+
+const boardQuery string = `
+SELECT boards.slug,
+       boards.title,
+       boards.description,
+       boards.formats,
+       boards.max_upload_bytes,
+       boards.image_required,
+       boards.default_name,
+       boards.nsfw,
+       boards.repost_policy,
+       boards.last_no,
+       boards.created_at
+FROM boards
+WHERE boards.slug = ?;
+`
+
+// SelectBoard returns the board slug
+func (r *BoardRepo) SelectBoard(slug string) (*models.Board, error) {
+	const op string = "repo.board.SelectBoard"
+
+	var board models.Board
+	if err := r.db.Get(&board, boardQuery, slug); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("%s: %s: %w", op, slug, ErrBoardNotFound)
+		}
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return &board, nil
+}
+
+const upsertBoardQuery string = `
+INSERT INTO boards(slug, title, description, formats, max_upload_bytes, image_required, default_name, nsfw, repost_policy)
+VALUES (:slug,
+        :title,
+        :description,
+        :formats,
+        :max_upload_bytes,
+        :image_required,
+        :default_name,
+        :nsfw,
+        :repost_policy
+)
+ON CONFLICT(slug) DO UPDATE SET
+    title = excluded.title,
+    description = excluded.description,
+    formats = excluded.formats,
+    max_upload_bytes = excluded.max_upload_bytes,
+    image_required = excluded.image_required,
+    default_name = excluded.default_name,
+    nsfw = excluded.nsfw,
+    repost_policy = excluded.repost_policy;
+`
+
+// UpsertBoard creates a board or updates its settings, its numbering stays
+func (r *BoardRepo) UpsertBoard(board *models.Board) error {
+	const op string = "repo.board.UpsertBoard"
+
+	if _, err := r.db.NamedExec(upsertBoardQuery, board); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
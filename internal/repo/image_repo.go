@@ -0,0 +1,343 @@
+package repo
+
+import (
+	"fmt"
+	"go-image-web/internal/models"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type ImageRepo struct {
+	db *sqlx.DB
+}
+
+func NewImageRepo(db *sqlx.DB) *ImageRepo {
+	return &ImageRepo{
+		db: db,
+	}
+}
+
+const allImagesQuery string = `
+SELECT images.uuid,
+       images.ext,
+       images.path,
+       images.width,
+       images.height,
+       images.size,
+       images.created_at,
+       COALESCE(images.sha256, '') AS sha256,
+       COALESCE(images.content_sha256, '') AS content_sha256,
+       COALESCE(images.phash, '') AS phash,
+       images.taken_at,
+       images.camera_make,
+       images.camera_model,
+       images.blurhash,
+       images.color,
+       images.checksum,
+       images.upload_path,
+       images.upload_size
+FROM images;
+`
+
+func (r *ImageRepo) SelectAllImages() ([]*models.ImageMetadata, error) {
+	const op string = "repo.image.SelectAllImages"
+
+	var images []*models.ImageMetadata
+	if err := r.db.Select(&images, allImagesQuery); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return images, nil
+}
+
+const allVarientsQuery string = `
+SELECT image_variants.image_uuid,
+       image_variants.width,
+       image_variants.ext,
+       image_variants.path,
+       image_variants.size,
+       image_variants.checksum
+FROM image_variants
+ORDER BY image_variants.created_at;
+`
+
+func (r *ImageRepo) SelectAllVarients() ([]*models.ImageVarientRow, error) {
+	const op string = "repo.image.SelectAllVarients"
+
+	var varients []*models.ImageVarientRow
+	if err := r.db.Select(&varients, allVarientsQuery); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return varients, nil
+}
+
+const insertImageQuery string = `
+INSERT INTO images(uuid, ext, path, width, height, size, created_at, sha256, content_sha256, phash, taken_at, camera_make, camera_model, blurhash, color, checksum, upload_path, upload_size)
+VALUES (:uuid,
+        :ext,
+        :path,
+        :width,
+        :height,
+        :size,
+        :created_at,
+        NULLIF(:sha256, ''),
+        NULLIF(:content_sha256, ''),
+        NULLIF(:phash, ''),
+        :taken_at,
+        :camera_make,
+        :camera_model,
+        :blurhash,
+        :color,
+        :checksum,
+        :upload_path,
+        :upload_size
+);
+`
+
+func (r *ImageRepo) InsertImage(meta *models.ImageMetadata) error {
+	const op string = "repo.image.InsertImage"
+
+	if _, err := r.db.NamedExec(insertImageQuery, meta); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+const updateImageQuery string = `
+UPDATE images
+SET ext = :ext,
+    path = :path,
+    width = :width,
+    height = :height,
+    size = :size,
+    created_at = :created_at
+WHERE uuid = :uuid;
+`
+
+func (r *ImageRepo) UpdateImage(meta *models.ImageMetadata) error {
+	const op string = "repo.image.UpdateImage"
+
+	if _, err := r.db.NamedExec(updateImageQuery, meta); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+const insertVarientQuery string = `
+INSERT INTO image_variants(image_uuid, width, ext, path, size, checksum)
+VALUES (:image_uuid,
+        :width,
+        :ext,
+        :path,
+        :size,
+        :checksum
+)
+ON CONFLICT(image_uuid, width, ext) DO UPDATE
+SET path = excluded.path,
+    size = excluded.size,
+    checksum = excluded.checksum;
+`
+
+func (r *ImageRepo) InsertVarient(uuid string, varient *models.ImageVarient) error {
+	const op string = "repo.image.InsertVarient"
+
+	row := &models.ImageVarientRow{
+		ImageUUID:    uuid,
+		ImageVarient: *varient,
+	}
+
+	if _, err := r.db.NamedExec(insertVarientQuery, row); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+const deleteUnreferencedImageQuery string = `
+DELETE FROM images
+WHERE uuid = ? AND ref_count <= 0;
+`
+
+// DeleteUnreferencedImage removes the image and its varients only if no post
+// references it, reporting whether a row was deleted
+func (r *ImageRepo) DeleteUnreferencedImage(uuid string) (bool, error) {
+	const op string = "repo.image.DeleteUnreferencedImage"
+
+	res, err := r.db.Exec(deleteUnreferencedImageQuery, uuid)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return n > 0, nil
+}
+
+const deleteVarientQuery string = `
+DELETE FROM image_variants
+WHERE image_uuid = ? AND width = ? AND ext = ?;
+`
+
+func (r *ImageRepo) DeleteVarient(uuid string, width int, ext string) error {
+	const op string = "repo.image.DeleteVarient"
+
+	if _, err := r.db.Exec(deleteVarientQuery, uuid, width, ext); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+const unreferencedImagesQuery string = `
+SELECT images.uuid,
+       images.ext,
+       images.path,
+       images.created_at
+FROM images
+WHERE images.ref_count <= 0;
+`
+
+// SelectUnreferencedImages returns the images no post references
+func (r *ImageRepo) SelectUnreferencedImages() ([]*models.ImageMetadata, error) {
+	const op string = "repo.image.SelectUnreferencedImages"
+
+	var images []*models.ImageMetadata
+	if err := r.db.Select(&images, unreferencedImagesQuery); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return images, nil
+}
+
+const imagePostsQuery string = `
+SELECT posts.id
+FROM posts
+WHERE posts.image_uuid = ?
+ORDER BY posts.id;
+`
+
+// SelectImagePosts returns the ids of the posts referencing an image
+func (r *ImageRepo) SelectImagePosts(uuid string) ([]int, error) {
+	const op string = "repo.image.SelectImagePosts"
+
+	var ids []int
+	if err := r.db.Select(&ids, imagePostsQuery, uuid); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return ids, nil
+}
+
+const detachImageQuery string = `
+UPDATE posts
+SET image_uuid = NULL
+WHERE image_uuid = ?;
+`
+
+// DetachImage removes an image from every post referencing it, the posts
+// themselves are kept
+func (r *ImageRepo) DetachImage(uuid string) error {
+	const op string = "repo.image.DetachImage"
+
+	if _, err := r.db.Exec(detachImageQuery, uuid); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+const clearMissingImagesQuery string = `
+UPDATE images
+SET missing_since = NULL
+WHERE missing_since IS NOT NULL AND uuid NOT IN (?);
+`
+
+const markMissingImagesQuery string = `
+UPDATE images
+SET missing_since = COALESCE(missing_since, CURRENT_TIMESTAMP)
+WHERE uuid IN (?);
+`
+
+const missingImagesQuery string = `
+SELECT images.uuid,
+       images.missing_since
+FROM images
+WHERE images.uuid IN (?) AND images.missing_since IS NOT NULL;
+`
+
+// MarkImagesMissing records uuids as missing from storage, and the rest as
+// found again, returning when each of uuids was first recorded missing
+func (r *ImageRepo) MarkImagesMissing(uuids []string) (map[string]time.Time, error) {
+	const op string = "repo.image.MarkImagesMissing"
+
+	// NOT IN () isn't valid, and no uuid is empty
+	args := uuids
+	if len(args) == 0 {
+		args = []string{""}
+	}
+
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer tx.Rollback()
+
+	for _, q := range []string{clearMissingImagesQuery, markMissingImagesQuery} {
+		query, qargs, err := sqlx.In(q, args)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		if _, err := tx.Exec(tx.Rebind(query), qargs...); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+	}
+
+	query, qargs, err := sqlx.In(missingImagesQuery, args)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	var rows []struct {
+		UUID         string    `db:"uuid"`
+		MissingSince time.Time `db:"missing_since"`
+	}
+	if err := tx.Select(&rows, tx.Rebind(query), qargs...); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	since := make(map[string]time.Time, len(rows))
+	for _, row := range rows {
+		since[row.UUID] = row.MissingSince
+	}
+	return since, nil
+}
+
+const postImagesQuery string = `
+SELECT posts.id,
+       posts.image_uuid
+FROM posts
+WHERE posts.image_uuid IS NOT NULL
+ORDER BY posts.id;
+`
+
+// SelectPostImages returns the id and image uuid of every post with an image
+func (r *ImageRepo) SelectPostImages() ([]*models.PostModel, error) {
+	const op string = "repo.image.SelectPostImages"
+
+	var posts []*models.PostModel
+	if err := r.db.Select(&posts, postImagesQuery); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return posts, nil
+}
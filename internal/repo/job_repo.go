@@ -0,0 +1,172 @@
+package repo
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"go-image-web/internal/models"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type JobRepo struct {
+	db *sqlx.DB
+}
+
+func NewJobRepo(db *sqlx.DB) *JobRepo {
+	return &JobRepo{
+		db: db,
+	}
+}
+
+const insertJobQuery string = `
+INSERT INTO jobs(kind, payload, max_attempts)
+VALUES (?, ?, ?)
+RETURNING id;
+`
+
+func (r *JobRepo) InsertJob(kind string, payload string, maxAttempts int) (int, error) {
+	const op string = "repo.job.InsertJob"
+
+	var id int
+	if err := r.db.Get(&id, insertJobQuery, kind, payload, maxAttempts); err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return id, nil
+}
+
+// claim the oldest due job in a single statement so two workers never share one
+const claimJobQuery string = `
+UPDATE jobs
+SET status = 'running',
+    attempts = attempts + 1,
+    updated_at = CURRENT_TIMESTAMP
+WHERE id = (
+    SELECT id FROM jobs
+    WHERE status = 'pending' AND run_at <= CURRENT_TIMESTAMP
+    ORDER BY run_at, id
+    LIMIT 1
+)
+RETURNING id, kind, payload, status, attempts, max_attempts, COALESCE(last_error, '') AS last_error, created_at;
+`
+
+// ClaimJob marks the next due job as running and returns it, or nil when none are due
+func (r *JobRepo) ClaimJob() (*models.JobModel, error) {
+	const op string = "repo.job.ClaimJob"
+
+	var job models.JobModel
+	if err := r.db.Get(&job, claimJobQuery); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return &job, nil
+}
+
+const completeJobQuery string = `
+UPDATE jobs
+SET status = 'done',
+    updated_at = CURRENT_TIMESTAMP
+WHERE id = ?;
+`
+
+func (r *JobRepo) CompleteJob(id int) error {
+	const op string = "repo.job.CompleteJob"
+
+	if _, err := r.db.Exec(completeJobQuery, id); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+const insertJobFailureQuery string = `
+INSERT OR REPLACE INTO job_failures(job_id, attempt, error)
+VALUES (?, ?, ?);
+`
+
+// retry after delay seconds, or give up when retry is false
+const failJobQuery string = `
+UPDATE jobs
+SET status = CASE WHEN ? THEN 'pending' ELSE 'failed' END,
+    run_at = datetime('now', '+' || ? || ' seconds'),
+    last_error = ?,
+    updated_at = CURRENT_TIMESTAMP
+WHERE id = ?;
+`
+
+// FailJob records a failed attempt and either schedules a retry after
+// delaySeconds or marks the job failed for good
+func (r *JobRepo) FailJob(job *models.JobModel, jobErr string, retry bool, delaySeconds int) error {
+	const op string = "repo.job.FailJob"
+
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(insertJobFailureQuery, job.ID, job.Attempts, jobErr); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if _, err := tx.Exec(failJobQuery, retry, delaySeconds, jobErr, job.ID); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+const requeueRunningJobsQuery string = `
+UPDATE jobs
+SET status = 'pending',
+    updated_at = CURRENT_TIMESTAMP
+WHERE status = 'running';
+`
+
+// RequeueRunningJobs returns jobs left running by a previous process to the queue
+func (r *JobRepo) RequeueRunningJobs() (int64, error) {
+	const op string = "repo.job.RequeueRunningJobs"
+
+	res, err := r.db.Exec(requeueRunningJobsQuery)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return n, nil
+}
+
+// updated_at is stored as UTC text, the cutoff is bound the same way
+const pruneJobsQuery string = `
+DELETE FROM jobs
+WHERE status = 'done' AND updated_at < ?;
+`
+
+// PruneJobs deletes jobs done before the given time, returning how many
+func (r *JobRepo) PruneJobs(before time.Time) (int64, error) {
+	const op string = "repo.job.PruneJobs"
+
+	res, err := r.db.Exec(pruneJobsQuery, before.UTC().Format(time.DateTime))
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return n, nil
+}
@@ -1,13 +1,17 @@
 package repo
 
 import (
+	"database/sql"
+	"errors"
 	"fmt"
 	"go-image-web/internal/models"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 )
 
 const (
+	MaxNameChars    int = 50
 	MaxSubjectChars int = 70
 	MaxMessageChars int = 1500
 )
@@ -22,41 +26,208 @@ func NewRepo(db *sqlx.DB) *PostRepo {
 	}
 }
 
-const allPostsQuery string = `
-SELECT posts.id,
+// ErrThreadNotFound is returned for a reply to a thread that doesn't exist
+var ErrThreadNotFound = errors.New("thread not found")
+
+// ErrImageLimit is returned for a reply with an image to a thread that has
+// as many as it may
+var ErrImageLimit = errors.New("thread has reached its image limit")
+
+// columns of a post, with the numbers on its board of its thread and the
+// post it replies to
+const postColumns string = `
+       posts.id,
+       posts.board,
+       posts.no,
        posts.name,
+       posts.tripcode,
+       posts.capcode,
        posts.subject,
        posts.message,
-       posts.image_uuid,
-	   posts.created_at
+       COALESCE(posts.image_uuid, '') AS image_uuid,
+       posts.created_at,
+       posts.thread_id,
+       COALESCE(posts.parent_id, 0) AS parent_id,
+       (SELECT op.no FROM posts AS op WHERE op.id = posts.thread_id) AS thread_no,
+       COALESCE((SELECT parent.no FROM posts AS parent WHERE parent.id = posts.parent_id), 0) AS parent_no`
+
+// columns of a thread, those of its opening post and what was replied to it
+const threadColumns string = postColumns + `,
+       posts.bumped_at,
+       (SELECT COUNT(*) - 1 FROM posts AS replies WHERE replies.thread_id = posts.id) AS replies,
+       (SELECT COUNT(replies.image_uuid) FROM posts AS replies WHERE replies.thread_id = posts.id) AS images`
+
+const threadsQuery string = `
+SELECT` + threadColumns + `
+FROM posts
+WHERE posts.board = ? AND posts.thread_id = posts.id
+ORDER BY posts.bumped_at DESC, posts.no DESC
+LIMIT ?;
+`
+
+const threadsBeforeQuery string = `
+SELECT` + threadColumns + `
 FROM posts
-ORDER BY posts.created_at DESC;
+WHERE posts.board = ? AND posts.thread_id = posts.id AND (posts.bumped_at, posts.no) < (?, ?)
+ORDER BY posts.bumped_at DESC, posts.no DESC
+LIMIT ?;
 `
 
-func (r *PostRepo) SelectAllPosts() ([]*models.PostModel, error) {
+// SelectThreads returns up to limit threads on board, last bumped first,
+// starting after before unless it is nil
+func (r *PostRepo) SelectThreads(board string, before *models.ThreadCursor, limit int) ([]*models.ThreadModel, error) {
+	const op string = "repo.post.SelectThreads"
+
+	var threads []*models.ThreadModel
+	var err error
+	if before == nil {
+		err = r.db.Select(&threads, threadsQuery, board, limit)
+	} else {
+		// bumped_at is stored as CURRENT_TIMESTAMP formats it, compared as text
+		bumped := before.BumpedAt.UTC().Format(time.DateTime)
+		err = r.db.Select(&threads, threadsBeforeQuery, board, bumped, before.No, limit)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return threads, nil
+}
+
+const threadQuery string = `
+SELECT` + threadColumns + `
+FROM posts
+WHERE posts.board = ? AND posts.no = ? AND posts.thread_id = posts.id;
+`
+
+// SelectThread returns the thread opened by post no on board
+func (r *PostRepo) SelectThread(board string, no int) (*models.ThreadModel, error) {
+	const op string = "repo.post.SelectThread"
+
+	var thread models.ThreadModel
+	if err := r.db.Get(&thread, threadQuery, board, no); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("%s: /%s/%d: %w", op, board, no, ErrThreadNotFound)
+		}
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return &thread, nil
+}
+
+const threadPostsQuery string = `
+SELECT` + postColumns + `
+FROM posts
+WHERE posts.thread_id = ?
+ORDER BY posts.id;
+`
+
+// SelectThreadPosts returns the opening post of the thread with id and its
+// replies, oldest first
+func (r *PostRepo) SelectThreadPosts(id int) ([]*models.PostModel, error) {
+	const op string = "repo.post.SelectThreadPosts"
 
 	var posts []*models.PostModel
-	if err := r.db.Select(&posts, allPostsQuery); err != nil {
-		return nil, err
+	if err := r.db.Select(&posts, threadPostsQuery, id); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
 	}
 
 	return posts, nil
 }
 
+const postQuery string = `
+SELECT` + postColumns + `
+FROM posts
+WHERE posts.board = ? AND posts.no = ?;
+`
+
+// SelectPost returns post no on board, nil when there is none
+func (r *PostRepo) SelectPost(board string, no int) (*models.PostModel, error) {
+	const op string = "repo.post.SelectPost"
+
+	var post models.PostModel
+	if err := r.db.Get(&post, postQuery, board, no); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return &post, nil
+}
+
+const nextPostNoQuery string = `
+UPDATE boards
+SET last_no = last_no + 1
+WHERE slug = ?
+RETURNING last_no;
+`
+
 const insertPostQuery string = `
-INSERT INTO posts(name, subject, message, image_uuid)
-VALUES (:name,
+INSERT INTO posts(board, no, name, tripcode, capcode, subject, message, image_uuid, thread_id, parent_id)
+VALUES (:board,
+        :no,
+        :name,
+        :tripcode,
+        :capcode,
         :subject,
         :message,
-        :image_uuid
+        NULLIF(:image_uuid, ''),
+        NULLIF(:thread_id, 0),
+        -- replies to a post outside the thread answer its opening post
+        CASE WHEN :thread_id = 0 THEN NULL
+             ELSE COALESCE((SELECT id FROM posts WHERE board = :board AND no = :parent_no AND thread_id = :thread_id), :thread_id)
+        END
 )
-RETURNING id, name, subject, message, image_uuid;
+RETURNING id, board, no, name, tripcode, capcode, subject, message, COALESCE(image_uuid, '') AS image_uuid, created_at, COALESCE(thread_id, id) AS thread_id, COALESCE(parent_id, 0) AS parent_id;
 `
 
-func (r *PostRepo) InsertPost(entry *models.PostModel) (*models.PostModel, error) {
+const openThreadQuery string = `
+UPDATE posts
+SET thread_id = id,
+    bumped_at = created_at
+WHERE id = ?;
+`
+
+const threadCountsQuery string = `
+SELECT COALESCE((SELECT op.no FROM posts AS op WHERE op.id = ? AND op.thread_id = op.id), 0) AS thread_no,
+       COALESCE((SELECT parent.no FROM posts AS parent WHERE parent.id = ?), 0) AS parent_no,
+       COUNT(*) - 1 AS replies,
+       COUNT(posts.image_uuid) AS images
+FROM posts
+WHERE posts.thread_id = ?;
+`
+
+const bumpThreadQuery string = `
+UPDATE posts
+SET bumped_at = (SELECT reply.created_at FROM posts AS reply WHERE reply.id = ?)
+WHERE id = ?;
+`
+
+// ThreadLimits caps what replies do to a thread
+type ThreadLimits struct {
+	// replies after which the thread is no longer bumped
+	Bump int
+	// posts with an image a thread may have, the opening post included
+	Images int
+}
+
+const insertReferenceQuery string = `
+INSERT OR IGNORE INTO post_references(post_id, board, no)
+VALUES (:post_id, :board, :no);
+`
+
+// InsertPost numbers entry on entry.Board and opens a thread with it, or adds
+// it to the thread with id entry.ThreadID bumping it unless sage or past
+// limits.Bump. entry.ParentNo picks the post of the thread it answers, refs
+// are the posts its message references
+func (r *PostRepo) InsertPost(entry *models.PostModel, refs []models.PostReference, sage bool, limits ThreadLimits) (*models.PostModel, error) {
 	const op string = "repo.post.InsertPost"
 
-	// Enforce max length for subject and message
+	// Enforce max length for name, subject and message
+	if len(entry.Name) > MaxNameChars {
+		return &models.PostModel{}, fmt.Errorf("%s: name too long (max %d chars)", op, MaxNameChars)
+	}
 	if len(entry.Subject) > MaxSubjectChars {
 		return &models.PostModel{}, fmt.Errorf("%s: subject too long (max 100 chars)", op)
 	}
@@ -64,18 +235,256 @@ func (r *PostRepo) InsertPost(entry *models.PostModel) (*models.PostModel, error
 		return &models.PostModel{}, fmt.Errorf("%s: message too long (max 1500 chars)", op)
 	}
 
-	rows, err := r.db.NamedQuery(insertPostQuery, &entry)
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return &models.PostModel{}, fmt.Errorf("%s: %w", op, err)
+	}
+	defer tx.Rollback()
+
+	// numbering first takes the write lock, so the counts below can't be
+	// overtaken by a concurrent reply
+	post := *entry
+	if err := tx.Get(&post.No, nextPostNoQuery, entry.Board); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return &models.PostModel{}, fmt.Errorf("%s: %s: %w", op, entry.Board, ErrBoardNotFound)
+		}
+		return &models.PostModel{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	query, args, err := tx.BindNamed(insertPostQuery, &post)
 	if err != nil {
 		return &models.PostModel{}, fmt.Errorf("%s: %w", op, err)
 	}
-	defer rows.Close()
+	var out models.PostModel
+	if err := tx.Get(&out, query, args...); err != nil {
+		return &models.PostModel{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if entry.ThreadID == 0 {
+		if _, err := tx.Exec(openThreadQuery, out.ID); err != nil {
+			return &models.PostModel{}, fmt.Errorf("%s: %w", op, err)
+		}
+		out.ThreadNo = out.No
+	} else {
+		// counts include the reply
+		var counts struct {
+			ThreadNo int `db:"thread_no"`
+			ParentNo int `db:"parent_no"`
+			Replies  int `db:"replies"`
+			Images   int `db:"images"`
+		}
+		if err := tx.Get(&counts, threadCountsQuery, entry.ThreadID, out.ParentID, entry.ThreadID); err != nil {
+			return &models.PostModel{}, fmt.Errorf("%s: %w", op, err)
+		}
+		if counts.ThreadNo == 0 {
+			return &models.PostModel{}, fmt.Errorf("%s: %d: %w", op, entry.ThreadID, ErrThreadNotFound)
+		}
+		if entry.ImageUUID != "" && counts.Images > limits.Images {
+			return &models.PostModel{}, fmt.Errorf("%s: %d: %w", op, entry.ThreadID, ErrImageLimit)
+		}
+		out.ThreadNo, out.ParentNo = counts.ThreadNo, counts.ParentNo
+
+		if !sage && counts.Replies <= limits.Bump {
+			if _, err := tx.Exec(bumpThreadQuery, out.ID, entry.ThreadID); err != nil {
+				return &models.PostModel{}, fmt.Errorf("%s: %w", op, err)
+			}
+		}
+	}
+
+	for _, ref := range refs {
+		ref.PostID = out.ID
+		if _, err := tx.NamedExec(insertReferenceQuery, ref); err != nil {
+			return &models.PostModel{}, fmt.Errorf("%s: %w", op, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return &models.PostModel{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return &out, nil
+}
+
+const deletePostQuery string = `
+DELETE FROM posts
+WHERE id = ? OR thread_id = ?
+RETURNING COALESCE(image_uuid, '');
+`
+
+// DeletePost removes the post with id, along with its replies when it opens
+// a thread, and returns the uuids of the images they referenced
+func (r *PostRepo) DeletePost(id int) ([]string, error) {
+	const op string = "repo.post.DeletePost"
+
+	var uuids []string
+	if err := r.db.Select(&uuids, deletePostQuery, id, id); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	if len(uuids) == 0 {
+		return nil, fmt.Errorf("%s: post %d not found", op, id)
+	}
 
-	if rows.Next() {
-		var out models.PostModel
-		if err := rows.StructScan(&out); err != nil {
-			return &models.PostModel{}, fmt.Errorf("%s: scan: %w", op, err)
+	return uuids, nil
+}
+
+const postsByImagesQuery string = `
+SELECT` + postColumns + `
+FROM posts
+WHERE posts.board = ? AND posts.image_uuid IN (?)
+ORDER BY posts.id;
+`
+
+// SelectPostsByImages returns the posts on board referencing any of uuids,
+// oldest first
+func (r *PostRepo) SelectPostsByImages(board string, uuids []string) ([]*models.PostModel, error) {
+	const op string = "repo.post.SelectPostsByImages"
+
+	if len(uuids) == 0 {
+		return nil, nil
+	}
+
+	query, args, err := sqlx.In(postsByImagesQuery, board, uuids)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	var posts []*models.PostModel
+	if err := r.db.Select(&posts, r.db.Rebind(query), args...); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return posts, nil
+}
+
+const insertRepostQuery string = `
+INSERT OR IGNORE INTO post_reposts(post_id, repost_of, distance)
+VALUES (:post_id,
+        :repost_of,
+        :distance
+);
+`
+
+func (r *PostRepo) InsertReposts(reposts []models.Repost) error {
+	const op string = "repo.post.InsertReposts"
+
+	if len(reposts) == 0 {
+		return nil
+	}
+
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	defer tx.Rollback()
+
+	for _, rp := range reposts {
+		if _, err := tx.NamedExec(insertRepostQuery, rp); err != nil {
+			return fmt.Errorf("%s: %w", op, err)
 		}
-		return &out, nil
 	}
-	return &models.PostModel{}, fmt.Errorf("%s: no row returned", op)
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+const repostsByPostsQuery string = `
+SELECT post_reposts.post_id,
+       post_reposts.repost_of,
+       post_reposts.distance,
+       earlier.no AS repost_no
+FROM post_reposts
+JOIN posts AS earlier ON earlier.id = post_reposts.repost_of
+WHERE post_reposts.post_id IN (?)
+ORDER BY post_reposts.distance, post_reposts.repost_of;
+`
+
+// SelectReposts returns the earlier posts linked to each of ids
+func (r *PostRepo) SelectReposts(ids []int) ([]models.Repost, error) {
+	const op string = "repo.post.SelectReposts"
+
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	query, args, err := sqlx.In(repostsByPostsQuery, ids)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	var reposts []models.Repost
+	if err := r.db.Select(&reposts, r.db.Rebind(query), args...); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return reposts, nil
+}
+
+const referencesByPostsQuery string = `
+SELECT post_references.post_id,
+       post_references.board,
+       post_references.no,
+       COALESCE(op.no, 0) AS thread_no
+FROM post_references
+LEFT JOIN posts AS target ON target.board = post_references.board AND target.no = post_references.no
+LEFT JOIN posts AS op ON op.id = target.thread_id
+WHERE post_references.post_id IN (?);
+`
+
+// SelectReferences returns the references in the messages of each of ids
+func (r *PostRepo) SelectReferences(ids []int) ([]models.PostReference, error) {
+	const op string = "repo.post.SelectReferences"
+
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	query, args, err := sqlx.In(referencesByPostsQuery, ids)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	var refs []models.PostReference
+	if err := r.db.Select(&refs, r.db.Rebind(query), args...); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return refs, nil
+}
+
+const backlinksByPostsQuery string = `
+SELECT target.id AS target_id,
+       source.board,
+       source.no,
+       op.no AS thread_no
+FROM posts AS target
+JOIN post_references ON post_references.board = target.board AND post_references.no = target.no
+JOIN posts AS source ON source.id = post_references.post_id
+JOIN posts AS op ON op.id = source.thread_id
+WHERE target.id IN (?)
+ORDER BY source.id;
+`
+
+// SelectBacklinks returns the posts whose messages reference each of ids,
+// oldest first
+func (r *PostRepo) SelectBacklinks(ids []int) ([]models.Backlink, error) {
+	const op string = "repo.post.SelectBacklinks"
+
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	query, args, err := sqlx.In(backlinksByPostsQuery, ids)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	var backlinks []models.Backlink
+	if err := r.db.Select(&backlinks, r.db.Rebind(query), args...); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return backlinks, nil
 }
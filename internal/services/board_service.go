@@ -0,0 +1,89 @@
+package services
+
+import (
+	"fmt"
+	"go-image-web/internal/config"
+	"go-image-web/internal/models"
+	"go-image-web/internal/repo"
+	"go-image-web/internal/store"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+type BoardService struct {
+	repo *repo.BoardRepo
+	// repost policy of boards created without one
+	repostPolicy string
+}
+
+func NewBoardService(repo *repo.BoardRepo, repostPolicy string) *BoardService {
+	return &BoardService{
+		repo:         repo,
+		repostPolicy: repostPolicy,
+	}
+}
+
+var ErrBoardNotFound = repo.ErrBoardNotFound
+
+// slugs are a path segment of their own, /{slug}/
+var boardSlugPattern = regexp.MustCompile(`^[a-z0-9]{1,16}$`)
+
+// first path segments taken by other routes, see main.go and handlers.SetupRouter
+var reservedSlugs = []string{"img", "assets", "public", "upload", "staff"}
+
+// GetBoards returns every board by slug
+func (b *BoardService) GetBoards() ([]*models.Board, error) {
+	return b.repo.SelectBoards()
+}
+
+// GetBoard returns the board slug, ErrBoardNotFound when there is none
+func (b *BoardService) GetBoard(slug string) (*models.Board, error) {
+	return b.repo.SelectBoard(slug)
+}
+
+// SaveBoard checks the settings of board and creates or updates it
+func (b *BoardService) SaveBoard(board *models.Board) error {
+	if !boardSlugPattern.MatchString(board.Slug) {
+		return fmt.Errorf("invalid slug %q, expected 1 to 16 lowercase letters and digits", board.Slug)
+	}
+	if slices.Contains(reservedSlugs, board.Slug) {
+		return fmt.Errorf("slug %q is taken by another route", board.Slug)
+	}
+	if strings.TrimSpace(board.Title) == "" {
+		return fmt.Errorf("board /%s/ needs a title", board.Slug)
+	}
+
+	if board.Formats != "" {
+		formats := strings.Split(board.Formats, ",")
+		for i, f := range formats {
+			f = strings.ToLower(strings.TrimSpace(f))
+			if f == "jpg" {
+				f = "jpeg"
+			}
+			if !slices.Contains(models.BoardFormats, f) {
+				return fmt.Errorf("unsupported format %q, expected some of %s", f, strings.Join(models.BoardFormats, ", "))
+			}
+			formats[i] = f
+		}
+		board.Formats = strings.Join(formats, ",")
+	}
+
+	if board.MaxUploadBytes < 0 || board.MaxUploadBytes > store.MaxUploadBytes {
+		return fmt.Errorf("invalid max upload of %d bytes, expected 0 to %d", board.MaxUploadBytes, store.MaxUploadBytes)
+	}
+	if board.DefaultName == "" {
+		board.DefaultName = "Anonymous"
+	}
+
+	if board.RepostPolicy == "" {
+		board.RepostPolicy = b.repostPolicy
+	}
+	switch board.RepostPolicy {
+	case config.RepostWarn, config.RepostLink, config.RepostReject:
+	default:
+		return fmt.Errorf("invalid repost policy %q, expected warn, link or reject", board.RepostPolicy)
+	}
+
+	return b.repo.UpsertBoard(board)
+}
@@ -0,0 +1,76 @@
+package services
+
+import (
+	"go-image-web/internal/config"
+	"go-image-web/internal/db"
+	"go-image-web/internal/models"
+	"go-image-web/internal/repo"
+	"path/filepath"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// setupDB opens a migrated database in a temp dir
+func setupDB(t *testing.T) *sqlx.DB {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "storage.db")
+	xdb, err := sqlx.Open("sqlite3", path+"?_foreign_keys=on&_busy_timeout=5000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { xdb.Close() })
+
+	// migrations are found from the root of the module
+	t.Chdir("../..")
+	if err := db.EnsureSchema(xdb); err != nil {
+		t.Fatalf("EnsureSchema failed: %v", err)
+	}
+	return xdb
+}
+
+func TestSaveBoard(t *testing.T) {
+	boards := NewBoardService(repo.NewBoardRepo(setupDB(t)), config.RepostWarn)
+
+	for _, slug := range []string{"img", "staff", "assets", "public", "G", "a/b", ""} {
+		if err := boards.SaveBoard(&models.Board{Slug: slug, Title: "Taken"}); err == nil {
+			t.Errorf("Expected slug %q rejected", slug)
+		}
+	}
+	if err := boards.SaveBoard(&models.Board{Slug: "g", Title: "Technology", RepostPolicy: "ignore"}); err == nil {
+		t.Error("Expected an unknown repost policy rejected")
+	}
+
+	if err := boards.SaveBoard(&models.Board{Slug: "g", Title: "Technology", Formats: "png, JPG"}); err != nil {
+		t.Fatalf("SaveBoard failed: %v", err)
+	}
+	board, err := boards.GetBoard("g")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if board.Formats != "png,jpeg" {
+		t.Errorf("Expected formats png,jpeg, got %s", board.Formats)
+	}
+	// a new board takes the default
+	if board.RepostPolicy != config.RepostWarn {
+		t.Errorf("Expected repost policy %s, got %s", config.RepostWarn, board.RepostPolicy)
+	}
+
+	board.RepostPolicy = config.RepostReject
+	if err := boards.SaveBoard(board); err != nil {
+		t.Fatalf("SaveBoard failed: %v", err)
+	}
+	if board, err = boards.GetBoard("g"); err != nil {
+		t.Fatal(err)
+	}
+	if board.RepostPolicy != config.RepostReject {
+		t.Errorf("Expected repost policy %s, got %s", config.RepostReject, board.RepostPolicy)
+	}
+
+	// seeded by the migrations
+	if b, err := boards.GetBoard("b"); err != nil || b.RepostPolicy != config.RepostLink {
+		t.Errorf("Expected /b/ to link reposts, got %v, %v", b, err)
+	}
+}
@@ -0,0 +1,140 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"go-image-web/internal/store"
+	"image"
+	"image/color"
+
+	"golang.org/x/sync/semaphore"
+)
+
+var (
+	// ErrImageTooLarge is an image with more pixels than are decoded
+	ErrImageTooLarge = errors.New("image too large")
+	// ErrInvalidImage is an upload that isn't an image in an allowed format
+	ErrInvalidImage = errors.New("invalid image")
+	// ErrFormatNotAllowed is an image in a format its board doesn't take
+	ErrFormatNotAllowed = errors.New("format not allowed")
+)
+
+// limits on decoding, set by ConfigureDecoding
+var (
+	maxImagePixels int64 = 50_000_000
+
+	decodeBudgetBytes int64 = 1 << 30
+	decodeBudget            = semaphore.NewWeighted(decodeBudgetBytes)
+)
+
+// ConfigureDecoding caps the pixels of an image decoded, width times height,
+// and the bytes all decodes in progress may hold between them
+func ConfigureDecoding(maxPixels int64, budgetBytes int64) {
+	maxImagePixels = maxPixels
+	decodeBudgetBytes = budgetBytes
+	decodeBudget = semaphore.NewWeighted(budgetBytes)
+}
+
+// decodeImage decodes buf once its pixels are within the limits and there is
+// budget for them, the first frame for a GIF. release gives the budget back
+// and must be called once img is no longer used
+func decodeImage(ctx context.Context, buf []byte) (img image.Image, format string, release func(), err error) {
+	cfg, format, err := decodeConfig(buf)
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	cost, err := decodeCost(buf, cfg, format)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	release, err = reserveDecode(ctx, cost)
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	if format == "gif" {
+		_, img, err = store.DecodeGIF(buf)
+	} else {
+		img, _, err = image.Decode(bytes.NewReader(buf))
+	}
+	if err != nil {
+		release()
+		return nil, "", nil, fmt.Errorf("%w: %v", ErrInvalidImage, err)
+	}
+
+	return img, format, release, nil
+}
+
+// decodeConfig reads the header of buf, failing with ErrInvalidImage when
+// it isn't an image in one of the allowed formats
+func decodeConfig(buf []byte) (image.Config, string, error) {
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(buf))
+	if err != nil {
+		return image.Config{}, "", fmt.Errorf("%w: %v", ErrInvalidImage, err)
+	}
+
+	// check if format is trusted based on magic bit
+	if _, ok := allowedFormats[format]; !ok {
+		return image.Config{}, "", fmt.Errorf("%w: unsupported format %s", ErrInvalidImage, format)
+	}
+	return cfg, format, nil
+}
+
+// decodeCost returns the bytes held by a decode of buf, failing with
+// ErrImageTooLarge when it has too many pixels. Besides the decoded pixels
+// it counts the 4 byte per pixel copy resizing and rotating make, and for a
+// GIF every frame and the canvas they are composited on
+func decodeCost(buf []byte, cfg image.Config, format string) (int64, error) {
+	pixels := int64(cfg.Width) * int64(cfg.Height)
+	if pixels > maxImagePixels {
+		return 0, fmt.Errorf("%w: %dx%d is over %d pixels", ErrImageTooLarge, cfg.Width, cfg.Height, maxImagePixels)
+	}
+
+	if format != "gif" {
+		return pixels * (bytesPerPixel(cfg.ColorModel) + 4), nil
+	}
+
+	frames, err := store.CountGIFFrames(buf)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrInvalidImage, err)
+	}
+	// paletted frames, then the canvas, first frame and a copy at 4 bytes
+	return pixels * (int64(frames) + 12), nil
+}
+
+// bytesPerPixel is what the decoder allocates per pixel for a colour model
+func bytesPerPixel(m color.Model) int64 {
+	switch m {
+	case color.GrayModel:
+		return 1
+	case color.Gray16Model:
+		return 2
+	case color.YCbCrModel:
+		// 4:4:4 at most, jpeg and lossy webp are usually 4:2:0
+		return 3
+	case color.RGBA64Model, color.NRGBA64Model:
+		return 8
+	}
+	if _, ok := m.(color.Palette); ok {
+		return 1
+	}
+	// RGBA, NRGBA, CMYK and NYCbCrA
+	return 4
+}
+
+// reserveDecode waits until cost bytes of the decode budget are free and
+// returns a func giving them back
+func reserveDecode(ctx context.Context, cost int64) (func(), error) {
+	if cost > decodeBudgetBytes {
+		return nil, fmt.Errorf("%w: decoding needs %d bytes, more than the %d allowed", ErrImageTooLarge, cost, decodeBudgetBytes)
+	}
+
+	budget := decodeBudget
+	if err := budget.Acquire(ctx, cost); err != nil {
+		return nil, err
+	}
+	return func() { budget.Release(cost) }, nil
+}
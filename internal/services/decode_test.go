@@ -0,0 +1,90 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"testing"
+	"time"
+)
+
+// createBombPNG returns the start of a PNG declaring w x h pixels, enough
+// for image.DecodeConfig
+func createBombPNG(w, h uint32) []byte {
+	ihdr := []byte("IHDR")
+	ihdr = binary.BigEndian.AppendUint32(ihdr, w)
+	ihdr = binary.BigEndian.AppendUint32(ihdr, h)
+	// 8 bit RGBA, no interlace
+	ihdr = append(ihdr, 8, 6, 0, 0, 0)
+
+	buf := []byte("\x89PNG\r\n\x1a\n")
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(ihdr)-4))
+	buf = append(buf, ihdr...)
+	return binary.BigEndian.AppendUint32(buf, crc32.ChecksumIEEE(ihdr))
+}
+
+func TestDecodeImage_PixelLimit(t *testing.T) {
+	_, _, _, err := decodeImage(context.Background(), createBombPNG(50000, 50000))
+	if !errors.Is(err, ErrImageTooLarge) {
+		t.Errorf("Expected ErrImageTooLarge, got %v", err)
+	}
+
+	_, _, _, err = decodeImage(context.Background(), []byte("not an image"))
+	if !errors.Is(err, ErrInvalidImage) {
+		t.Errorf("Expected ErrInvalidImage, got %v", err)
+	}
+}
+
+func TestDecodeImage_ReleasesBudget(t *testing.T) {
+	defer ConfigureDecoding(maxImagePixels, decodeBudgetBytes)
+	ConfigureDecoding(1000, 10*10*8)
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewNRGBA(image.Rect(0, 0, 10, 10))); err != nil {
+		t.Fatalf("png.Encode failed: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	// each decode needs the whole budget
+	for i := 0; i < 3; i++ {
+		_, _, release, err := decodeImage(ctx, buf.Bytes())
+		if err != nil {
+			t.Fatalf("decodeImage failed: %v", err)
+		}
+		release()
+	}
+}
+
+func TestReserveDecode(t *testing.T) {
+	defer ConfigureDecoding(maxImagePixels, decodeBudgetBytes)
+	ConfigureDecoding(1000, 100)
+
+	if _, err := reserveDecode(context.Background(), 101); !errors.Is(err, ErrImageTooLarge) {
+		t.Errorf("Expected ErrImageTooLarge over the budget, got %v", err)
+	}
+
+	release, err := reserveDecode(context.Background(), 60)
+	if err != nil {
+		t.Fatalf("reserveDecode failed: %v", err)
+	}
+
+	// a second decode waits for the first
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := reserveDecode(ctx, 60); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected to wait for the budget, got %v", err)
+	}
+
+	release()
+	release, err = reserveDecode(context.Background(), 60)
+	if err != nil {
+		t.Fatalf("Expected the budget back after release, got %v", err)
+	}
+	release()
+}
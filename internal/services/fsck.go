@@ -0,0 +1,286 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"go-image-web/internal/models"
+	"go-image-web/internal/store"
+	"image"
+	"io"
+	"io/fs"
+	"sort"
+)
+
+// kinds of problem Fsck reports
+const (
+	// recorded but not in storage
+	FsckMissing string = "missing"
+	// doesn't decode
+	FsckCorrupt string = "corrupt"
+	// has more pixels than are decoded, so it can't be checked
+	FsckTooLarge string = "too_large"
+	// the stored bytes aren't those recorded
+	FsckChecksum string = "checksum_mismatch"
+	// stored under the extension of another format, see fix-extensions
+	FsckFormat string = "format_mismatch"
+	// decodes to a size other than recorded
+	FsckDimensions string = "dimensions_mismatch"
+	// isn't as many bytes as recorded
+	FsckSize string = "size_mismatch"
+	// a post whose image isn't recorded
+	FsckDanglingPost string = "dangling_post"
+)
+
+// FsckProblem is something wrong with a stored file or a post
+type FsckProblem struct {
+	Kind string `json:"kind"`
+	UUID string `json:"uuid"`
+	// storage key of the original, upload or varient, empty for a post
+	Path   string `json:"path,omitempty"`
+	PostID int    `json:"post_id,omitempty"`
+	Detail string `json:"detail,omitempty"`
+	// what a repair did about it, empty when it was left alone
+	Repair   string `json:"repair,omitempty"`
+	Repaired bool   `json:"repaired"`
+}
+
+// FsckReport lists what Fsck checked and the problems it found
+type FsckReport struct {
+	Originals int           `json:"originals"`
+	Uploads   int           `json:"uploads"`
+	Varients  int           `json:"varients"`
+	Posts     int           `json:"posts"`
+	Problems  []FsckProblem `json:"problems"`
+}
+
+// Unrepaired counts the problems still standing
+func (r *FsckReport) Unrepaired() int {
+	var n int
+	for _, p := range r.Problems {
+		if !p.Repaired {
+			n++
+		}
+	}
+	return n
+}
+
+// Fsck decodes every stored original, kept upload and varient, checking its
+// checksum where recorded, its format against its extension and its size
+// against its metadata, and that the image of every post is recorded. With
+// repair, corrupt files are quarantined and recorded varients that are
+// missing or bad are generated again from the original
+func Fsck(ctx context.Context, repair bool) (*FsckReport, error) {
+	report := &FsckReport{Problems: []FsckProblem{}}
+
+	store.ImageIndexMu.RLock()
+	metas := make([]*models.ImageMetadata, 0, len(store.ImageIndex))
+	for _, meta := range store.ImageIndex {
+		metas = append(metas, meta)
+	}
+	store.ImageIndexMu.RUnlock()
+
+	sort.Slice(metas, func(i, j int) bool {
+		return metas[i].UUID < metas[j].UUID
+	})
+
+	for _, meta := range metas {
+		report.Originals++
+
+		p, err := checkStored(ctx, meta.OriginalPath, meta.OriginalExt, meta.Checksum, meta.OriginalSize, meta.OriginalWidth, meta.OriginalHeight)
+		if err != nil {
+			return report, err
+		}
+
+		// varients are only generated again from a sound original
+		usable := true
+		if p != nil {
+			p.UUID = meta.UUID
+			switch p.Kind {
+			case FsckMissing, FsckTooLarge:
+				usable = false
+			case FsckCorrupt, FsckChecksum:
+				usable = false
+				if repair {
+					quarantine(ctx, p)
+				}
+			}
+			report.Problems = append(report.Problems, *p)
+		}
+
+		// an upload may still need turning upright, so its dimensions aren't
+		// those of the original
+		if meta.UploadPath != "" {
+			report.Uploads++
+
+			p, err := checkStored(ctx, meta.UploadPath, meta.OriginalExt, "", meta.UploadSize, 0, 0)
+			if err != nil {
+				return report, err
+			}
+			if p != nil {
+				p.UUID = meta.UUID
+				if repair && (p.Kind == FsckCorrupt || p.Kind == FsckSize) {
+					quarantine(ctx, p)
+				}
+				report.Problems = append(report.Problems, *p)
+			}
+		}
+
+		meta.VarientsMu.RLock()
+		vs := make([]models.ImageVarient, 0, len(meta.Varients))
+		for _, v := range meta.Varients {
+			vs = append(vs, v)
+		}
+		meta.VarientsMu.RUnlock()
+
+		sort.Slice(vs, func(i, j int) bool {
+			return vs[i].Path < vs[j].Path
+		})
+
+		for _, v := range vs {
+			report.Varients++
+
+			// the height of a varient follows from its width, only that is recorded
+			p, err := checkStored(ctx, v.Path, v.Ext, v.Checksum, v.Size, v.Width, 0)
+			if err != nil {
+				return report, err
+			}
+			if p == nil {
+				continue
+			}
+			p.UUID = meta.UUID
+
+			if repair {
+				repairVarient(ctx, meta, v, p, usable)
+			}
+			report.Problems = append(report.Problems, *p)
+		}
+	}
+
+	posts, err := store.PostImages()
+	if err != nil {
+		return report, err
+	}
+	for _, post := range posts {
+		report.Posts++
+		if store.GetGuidImageMetadata(post.ImageUUID) == nil {
+			report.Problems = append(report.Problems, FsckProblem{
+				Kind:   FsckDanglingPost,
+				UUID:   post.ImageUUID,
+				PostID: post.ID,
+				Detail: "image is not recorded",
+			})
+		}
+	}
+
+	return report, nil
+}
+
+// checkStored reads and decodes the file at key, returning the first problem
+// with it or nil. size is not checked when 0, height neither and width
+// neither when also 0
+func checkStored(ctx context.Context, key string, ext string, checksum string, size int64, width int, height int) (*FsckProblem, error) {
+	problem := func(kind string, format string, args ...any) (*FsckProblem, error) {
+		return &FsckProblem{Kind: kind, Path: key, Detail: fmt.Sprintf(format, args...)}, nil
+	}
+
+	rc, _, err := store.Backend.Get(ctx, key)
+	if errors.Is(err, fs.ErrNotExist) {
+		return problem(FsckMissing, "not in storage")
+	}
+	if err != nil {
+		return nil, err
+	}
+	buf, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(buf))
+	if err != nil {
+		return problem(FsckCorrupt, "%v", err)
+	}
+
+	_, _, release, err := decodeImage(ctx, buf)
+	switch {
+	case errors.Is(err, ErrImageTooLarge):
+		return problem(FsckTooLarge, "%v", err)
+	case errors.Is(err, ErrInvalidImage):
+		return problem(FsckCorrupt, "%v", err)
+	case err != nil:
+		return nil, err
+	}
+	release()
+
+	if sum := sha256.Sum256(buf); checksum != "" && hex.EncodeToString(sum[:]) != checksum {
+		return problem(FsckChecksum, "sha256 is %x, recorded %s", sum, checksum)
+	}
+	if size != 0 && int64(len(buf)) != size {
+		return problem(FsckSize, "%d bytes, recorded %d", len(buf), size)
+	}
+
+	if ext == "jpg" {
+		ext = "jpeg"
+	}
+	if format != ext {
+		return problem(FsckFormat, "stored as %s, sniffed %s", ext, format)
+	}
+
+	if width == 0 {
+		return nil, nil
+	}
+	if height == 0 && cfg.Width != width {
+		return problem(FsckDimensions, "decodes to width %d, recorded %d", cfg.Width, width)
+	}
+	if height != 0 && (cfg.Width != width || cfg.Height != height) {
+		return problem(FsckDimensions, "decodes to %dx%d, recorded %dx%d", cfg.Width, cfg.Height, width, height)
+	}
+
+	return nil, nil
+}
+
+// quarantine moves the file of a problem out of the way
+func quarantine(ctx context.Context, p *FsckProblem) bool {
+	to, err := store.Quarantine(ctx, p.Path)
+	if err != nil {
+		p.Repair = fmt.Sprintf("quarantine failed: %v", err)
+		return false
+	}
+	p.Repair = "quarantined to " + to
+	p.Repaired = true
+	return true
+}
+
+// repairVarient quarantines a bad varient, forgets it and generates it again
+// if the original is usable
+func repairVarient(ctx context.Context, meta *models.ImageMetadata, v models.ImageVarient, p *FsckProblem, usable bool) {
+	if p.Kind != FsckMissing && !quarantine(ctx, p) {
+		return
+	}
+
+	note := func(s string, repaired bool) {
+		if p.Repair != "" {
+			s = p.Repair + ", " + s
+		}
+		p.Repair, p.Repaired = s, repaired
+	}
+
+	if err := store.RemoveVarient(meta.UUID, v); err != nil {
+		note(fmt.Sprintf("removing its record failed: %v", err), false)
+		return
+	}
+	if !usable {
+		note("removed as the original is unusable", true)
+		return
+	}
+
+	if _, err := ensureVarient(ctx, meta, v.Width, v.Ext, nil); err != nil {
+		note(fmt.Sprintf("regenerating failed: %v", err), false)
+		return
+	}
+	note("regenerated", true)
+}
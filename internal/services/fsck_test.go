@@ -0,0 +1,168 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"go-image-web/internal/models"
+	"go-image-web/internal/store"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func solidImage(w, h int, c color.Color) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, c)
+		}
+	}
+	return img
+}
+
+// setupStore stores images in a temp dir with an empty index
+func setupStore(t *testing.T) {
+	t.Helper()
+
+	origBackend := store.Backend
+	dir := t.TempDir()
+	store.Configure(store.NewLocalStorage(dir), filepath.Join(dir, "tmp"))
+	store.ImageIndexMu.Lock()
+	store.ImageIndex = make(map[string]*models.ImageMetadata)
+	store.ImageIndexMu.Unlock()
+
+	t.Cleanup(func() { store.Backend = origBackend })
+}
+
+func TestFsck_Repair(t *testing.T) {
+	setupStore(t)
+
+	ctx := context.Background()
+	img := solidImage(1000, 800, color.RGBA{255, 0, 0, 255})
+	meta := &models.ImageMetadata{UUID: "fsck", OriginalExt: "jpeg", OriginalWidth: 1000, OriginalHeight: 800}
+	if err := store.SaveOriginalImage(img, meta); err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []struct {
+		width  int
+		format string
+	}{{600, "jpeg"}, {600, "webp"}, {800, "jpeg"}} {
+		if err := store.SaveVarientImage(meta.UUID, img, v.width, v.format); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report, err := Fsck(ctx, false)
+	if err != nil {
+		t.Fatalf("Fsck failed: %v", err)
+	}
+	if report.Originals != 1 || report.Varients != 3 || len(report.Problems) != 0 {
+		t.Fatalf("Expected 1 original, 3 varients and no problems, got %+v", report)
+	}
+
+	// truncate one varient, swap another for a different image and lose a third
+	put := func(key string, buf []byte) {
+		if err := store.Backend.Put(ctx, key, bytes.NewReader(buf), int64(len(buf))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var other bytes.Buffer
+	jpeg.Encode(&other, solidImage(600, 480, color.RGBA{0, 0, 255, 255}), nil)
+	put(store.VarientKey(meta.UUID, 600, "jpeg"), []byte("not an image"))
+	put(store.VarientKey(meta.UUID, 600, "webp"), other.Bytes())
+	if err := store.Backend.Delete(ctx, store.VarientKey(meta.UUID, 800, "jpeg")); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err = Fsck(ctx, false)
+	if err != nil {
+		t.Fatalf("Fsck failed: %v", err)
+	}
+	want := []string{FsckCorrupt, FsckChecksum, FsckMissing}
+	if len(report.Problems) != len(want) {
+		t.Fatalf("Expected %d problems, got %+v", len(want), report.Problems)
+	}
+	for i, p := range report.Problems {
+		if p.Kind != want[i] || p.Repaired {
+			t.Errorf("Expected unrepaired %s, got %+v", want[i], p)
+		}
+	}
+
+	report, err = Fsck(ctx, true)
+	if err != nil {
+		t.Fatalf("Fsck --repair failed: %v", err)
+	}
+	if n := report.Unrepaired(); n != 0 {
+		t.Errorf("Expected every problem repaired, got %d left: %+v", n, report.Problems)
+	}
+	for _, p := range report.Problems[:2] {
+		if !strings.HasPrefix(p.Repair, "quarantined to "+store.QuarantinePrefix+"/") {
+			t.Errorf("Expected %s quarantined, got %q", p.Path, p.Repair)
+		}
+	}
+	if _, err := store.Backend.Stat(ctx, store.QuarantinePrefix+"/"+store.VarientKey(meta.UUID, 600, "jpeg")); err != nil {
+		t.Errorf("Expected the corrupt varient kept in quarantine, got %v", err)
+	}
+
+	report, err = Fsck(ctx, false)
+	if err != nil {
+		t.Fatalf("Fsck failed: %v", err)
+	}
+	if len(report.Problems) != 0 || report.Varients != 3 {
+		t.Errorf("Expected 3 sound varients after repair, got %+v", report)
+	}
+}
+
+func TestFsck_Upload(t *testing.T) {
+	setupStore(t)
+
+	ctx := context.Background()
+	img := solidImage(400, 300, color.RGBA{0, 255, 0, 255})
+	var raw bytes.Buffer
+	if err := jpeg.Encode(&raw, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	meta := &models.ImageMetadata{UUID: "kept", OriginalExt: "jpeg", OriginalWidth: 400, OriginalHeight: 300}
+	if err := store.SaveUpload(meta, raw.Bytes(), img, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SaveOriginalImage(img, meta); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Fsck(ctx, false)
+	if err != nil {
+		t.Fatalf("Fsck failed: %v", err)
+	}
+	if report.Uploads != 1 || len(report.Problems) != 0 {
+		t.Fatalf("Expected 1 upload and no problems, got %+v", report)
+	}
+
+	// a sound image, but not the one recorded
+	var other bytes.Buffer
+	jpeg.Encode(&other, solidImage(400, 300, color.RGBA{0, 0, 255, 255}), &jpeg.Options{Quality: 10})
+	if err := store.Backend.Put(ctx, meta.UploadPath, bytes.NewReader(other.Bytes()), int64(other.Len())); err != nil {
+		t.Fatal(err)
+	}
+	report, err = Fsck(ctx, false)
+	if err != nil {
+		t.Fatalf("Fsck failed: %v", err)
+	}
+	if len(report.Problems) != 1 || report.Problems[0].Kind != FsckSize || report.Problems[0].Path != meta.UploadPath {
+		t.Errorf("Expected a size mismatch of the upload, got %+v", report.Problems)
+	}
+
+	if err := store.Backend.Delete(ctx, meta.UploadPath); err != nil {
+		t.Fatal(err)
+	}
+	report, err = Fsck(ctx, false)
+	if err != nil {
+		t.Fatalf("Fsck failed: %v", err)
+	}
+	if len(report.Problems) != 1 || report.Problems[0].Kind != FsckMissing || report.Problems[0].Path != meta.UploadPath {
+		t.Errorf("Expected the upload missing, got %+v", report.Problems)
+	}
+}
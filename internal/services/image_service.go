@@ -1,17 +1,23 @@
 package services
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"go-image-web/internal/jobs"
 	"go-image-web/internal/models"
 	"go-image-web/internal/store"
 	"image"
 	"io"
 	"log"
-	"math"
 	"mime/multipart"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 
 	_ "image/jpeg" // Register JPEG decoder
 	_ "image/png"  // Register PNG decoder
@@ -19,82 +25,377 @@ import (
 	_ "golang.org/x/image/webp"
 
 	"github.com/google/uuid"
+	"golang.org/x/sync/singleflight"
 )
 
-var imageWidths = []int{600, 800, 1200, 1600}
-var allowedFormats = map[string]struct{}{"jpeg": {}, "png": {}, "jpg": {}, "webp": {}}
+// deduplicates concurrent on demand generation of the same varient
+var varientGroup singleflight.Group
+
+// VarientsJob generates the configured varients of a newly stored image
+const VarientsJob string = "image.varients"
+
+type varientsPayload struct {
+	UUID string `json:"uuid"`
+}
+
+// queue for varient generation, when nil SaveImage generates them before returning
+var jobQueue *jobs.Queue
+
+// uuids with a varients job enqueued by this process
+var pendingVarients sync.Map
+
+var allowedFormats = map[string]struct{}{"jpeg": {}, "png": {}, "jpg": {}, "webp": {}, "gif": {}}
 
 const (
 	MaxImageHeight = 2560
 	MaxImageWidth  = 2560
 )
 
-// returns 4 types of errors(fileSize, decoding/format, whitelisted format, save original image, save varient image)
-func SaveImage(file multipart.File, filename string) (string, error) {
+// returns 4 types of errors(fileSize, decoding/format, whitelisted format, save original image, save varient image),
+// ErrInvalidImage and ErrImageTooLarge for uploads that can't be decoded,
+// ErrFormatNotAllowed for one in a format allowed refuses, nil for any. The image
+// returned is leased, the caller calls store.Unlease once a post
+// references it or it is released
+func SaveImage(ctx context.Context, file multipart.File, filename string, allowed func(format string) bool) (string, error) {
 
 	// generate new uuid for file
 	id := uuid.New().String()
 
 	// create temp file to process
-	tmpPath, err := store.CreateTmpFile(id, file)
+	tmpPath, sum, err := store.CreateTmpFile(id, file)
 	if err != nil {
 		return "", err
 	}
 	defer os.Remove(tmpPath)
 
-	// re-open tmp save
-	srcFile, err := os.Open(tmpPath)
+	// uploads are capped at MaxUploadBytes, read it once
+	raw, err := os.ReadFile(tmpPath)
 	if err != nil {
 		return "", err
 	}
-	defer srcFile.Close()
 
-	// cheap load of image config
-	cfg, format, err := image.DecodeConfig(srcFile)
+	// the format is sniffed from the header, nothing is stored before
+	_, format, err := decodeConfig(raw)
 	if err != nil {
 		return "", err
 	}
-
-	// check if format is trusted based on magic bit
-	if _, ok := allowedFormats[format]; !ok {
-		return "", fmt.Errorf("unsupported format: %s", format)
+	if allowed != nil && !allowed(format) {
+		return "", fmt.Errorf("%w: %s", ErrFormatNotAllowed, format)
 	}
 
-	log.Printf("format: %s, %dx%d", format, cfg.Width, cfg.Height)
-
-	// // validate image config
-	// if cfg.Width > MaxImageWidth || cfg.Height > MaxImageHeight {
-	// 	return "", fmt.Errorf("dimensions exeed limits of: %dx%d", MaxImageWidth, MaxImageHeight)
-	// }
+	// identical upload already stored, reference it instead. Only a fast
+	// check, uploads are deduplicated on their content below
+	if existing := store.LeaseImageByHash(sum); existing != nil {
+		log.Printf("duplicate upload of %s", existing.UUID)
+		return existing.UUID, nil
+	}
 
-	// Rewind file for full decode
-	if _, err := srcFile.Seek(0, 0); err != nil {
-		return "", err
+	// the same image uploaded with other metadata is stored once
+	md := store.ReadMetadata(raw, format)
+	contentSum, err := store.ContentHash(raw, format, md.Orientation)
+	if err != nil {
+		log.Printf("no content hash for %s: %v", id, err)
+	}
+	if existing := store.LeaseImageByHash(contentSum); existing != nil {
+		log.Printf("duplicate content of %s", existing.UUID)
+		return existing.UUID, nil
 	}
 
-	img, _, err := image.Decode(srcFile)
+	// the size is checked from the header before any pixels are decoded
+	img, format, release, err := decodeImage(ctx, raw)
 	if err != nil {
 		return "", err
 	}
+	defer release()
+
+	log.Printf("format: %s, %dx%d", format, img.Bounds().Dx(), img.Bounds().Dy())
+
+	// turn the pixels upright, then none of the metadata is needed
+	img = store.Orient(img, md.Orientation)
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	logMetadata(id, md)
+
+	// placeholders for the page while the image loads
+	blurHash, color := store.Placeholder(img)
 
 	// save original image
-	if err := store.SaveOriginalImage(img, cfg, id, format); err != nil {
+	meta := &models.ImageMetadata{
+		UUID:           id,
+		OriginalExt:    format,
+		OriginalWidth:  width,
+		OriginalHeight: height,
+		SHA256:         sum,
+		ContentSHA256:  contentSum,
+		PHash:          store.FormatPHash(store.PerceptualHash(img)),
+		TakenAt:        md.TakenAt,
+		CameraMake:     md.CameraMake,
+		CameraModel:    md.CameraModel,
+		BlurHash:       blurHash,
+		Color:          color,
+	}
+	// held from before the image is indexed, an identical upload may find it
+	store.Lease(id)
+
+	// the original of a GIF is already its upload less metadata
+	if store.KeepUploads && format != "gif" {
+		if err := store.SaveUpload(meta, raw, img, md.Orientation); err != nil {
+			store.Unlease(id)
+			return "", err
+		}
+	}
+	if format == "gif" {
+		err = store.SaveOriginalGIF(raw, meta)
+	} else {
+		err = store.SaveOriginalImage(img, meta)
+	}
+	if err != nil {
+		store.Unlease(id)
+		if meta.UploadPath != "" {
+			if err := store.Backend.Delete(ctx, meta.UploadPath); err != nil {
+				log.Print(err)
+			}
+		}
+		// lost a race against an identical upload
+		if existing := store.LeaseImageByHash(sum); existing != nil {
+			return existing.UUID, nil
+		}
+		if existing := store.LeaseImageByHash(contentSum); existing != nil {
+			return existing.UUID, nil
+		}
 		return "", err
 	}
 
-	// re encode new varients for original image
-	for _, wpx := range imageWidths {
+	// the original is safe, generate varients in the background
+	if jobQueue != nil {
+		pendingVarients.Store(id, struct{}{})
+		err := jobQueue.Enqueue(VarientsJob, varientsPayload{UUID: id})
+		if err == nil {
+			return id, nil
+		}
+		pendingVarients.Delete(id)
+		log.Printf("failed to enqueue varients for %s, generating now: %v", id, err)
+	}
+
+	if err := generateVarients(ctx, meta, img); err != nil {
+		log.Printf("error while saving varient images for %s: %v", id, err)
+	}
+
+	return id, nil
+}
+
+// logMetadata records what was stripped from an upload
+func logMetadata(id string, md store.Metadata) {
+	if md.Orientation > 1 {
+		log.Printf("applied orientation %d to %s", md.Orientation, id)
+	}
+	if len(md.Removed) == 0 {
+		log.Printf("no metadata removed from %s", id)
+		return
+	}
+	log.Printf("metadata removed from %s: %s", id, strings.Join(md.Removed, ", "))
+}
 
-		if err := store.SaveVarientImage(id, img, wpx, format); err != nil {
-			log.Printf("error while saving varient image: %s_%d.%s", id, wpx, format)
+// RegisterImageJobs hands varient generation for new uploads to q
+func RegisterImageJobs(q *jobs.Queue) {
+	jobQueue = q
+	q.Register(VarientsJob, runVarientsJob)
+}
+
+// VarientsPending reports whether an image is still waiting on its varients job
+func VarientsPending(uuid string) bool {
+	_, ok := pendingVarients.Load(uuid)
+	return ok
+}
+
+func runVarientsJob(ctx context.Context, payload []byte) error {
+	var p varientsPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return fmt.Errorf("decode varients job: %w", err)
+	}
+
+	// an image deleted before its job ran needs nothing
+	meta := store.GetGuidImageMetadata(p.UUID)
+	if meta == nil {
+		pendingVarients.Delete(p.UUID)
+		return nil
+	}
+
+	if err := generateVarients(ctx, meta, nil); err != nil {
+		return err
+	}
+
+	pendingVarients.Delete(p.UUID)
+	return nil
+}
+
+// generateVarients creates every varient of the active profile still
+// missing, img is the decoded original or nil to load it from storage
+func generateVarients(ctx context.Context, meta *models.ImageMetadata, img image.Image) error {
+	var errs []error
+	for _, id := range profileVarients(meta) {
+		if _, ok := meta.GetVariant(id.Width, id.Ext); ok {
 			continue
 		}
+		if img == nil && id.Ext != "gif" {
+			var release func()
+			var err error
+			if img, release, err = decodeOriginal(ctx, meta); err != nil {
+				return err
+			}
+			defer release()
+		}
+		if _, err := ensureVarient(ctx, meta, id.Width, id.Ext, img); err != nil {
+			errs = append(errs, err)
+		}
 	}
 
-	return id, nil
+	return errors.Join(errs...)
 }
 
-func GetImage(id string) (*models.ImageVarient, error) {
+// profileVarients are the varients the active profile wants of an image,
+// those narrower than it, as images are only scaled down and the original
+// covers the rest
+func profileVarients(meta *models.ImageMetadata) []models.VarientID {
+	var ids []models.VarientID
+	for _, wpx := range store.ActiveVarientProfile().Widths {
+		if wpx >= meta.OriginalWidth {
+			continue
+		}
+
+		for _, format := range VarientFormats(meta) {
+			ids = append(ids, models.VarientID{Width: wpx, Ext: format})
+		}
+		if meta.OriginalExt == "gif" {
+			ids = append(ids, models.VarientID{Width: wpx, Ext: "gif"})
+		}
+	}
+	return ids
+}
+
+// ensureVarient generates a varient unless it exists, sharing the work with
+// any request generating the same one
+func ensureVarient(ctx context.Context, meta *models.ImageMetadata, width int, ext string, img image.Image) (models.ImageVarient, error) {
+	v, err, _ := varientGroup.Do(fmt.Sprintf("%s_%d.%s", meta.UUID, width, ext), func() (any, error) {
+		return generateVarient(ctx, meta, width, ext, img)
+	})
+	if err != nil {
+		return models.ImageVarient{}, err
+	}
+	return v.(models.ImageVarient), nil
+}
+
+// VarientFormats are the encodings of an image's still varients in the
+// active profile, the first is served to browsers that take none of the
+// others. A GIF gets a static first frame thumbnail that expands to the
+// animation
+func VarientFormats(meta *models.ImageMetadata) []string {
+	base := meta.OriginalExt
+	if base == "gif" {
+		base = "png"
+	}
+
+	var formats []string
+	for _, f := range store.ActiveVarientProfile().Formats {
+		if f == store.FormatOriginal {
+			f = base
+		}
+		if !slices.Contains(formats, f) {
+			formats = append(formats, f)
+		}
+	}
+	return formats
+}
+
+// ContentType returns the media type of an image extension, empty if unknown
+func ContentType(ext string) string {
+	switch strings.ToLower(ext) {
+	case "gif":
+		return "image/gif"
+	case "jpg", "jpeg":
+		return "image/jpeg"
+	case "png":
+		return "image/png"
+	case "webp":
+		return "image/webp"
+	default:
+		return ""
+	}
+}
+
+// negotiateFormat picks the format the Accept header rates highest, ties go
+// to the format named more specifically and then to the earlier format
+func negotiateFormat(accept string, formats []string) string {
+	best, bestQ, bestSpec := formats[0], 0.0, -1
+	for _, f := range formats {
+		q, spec := acceptQuality(accept, ContentType(f))
+		if q > bestQ || q == bestQ && q > 0 && spec > bestSpec {
+			best, bestQ, bestSpec = f, q, spec
+		}
+	}
+	return best
+}
+
+// acceptQuality returns the q value Accept gives mediaType from its most
+// specific matching range, and that specificity: 2 for the exact type, 1 for
+// type/* and 0 for */*. A missing header accepts anything
+func acceptQuality(accept string, mediaType string) (float64, int) {
+	if strings.TrimSpace(accept) == "" {
+		return 1, 0
+	}
+
+	q, spec := 0.0, -1
+	for _, part := range strings.Split(accept, ",") {
+		rng, params, _ := strings.Cut(part, ";")
+		rng = strings.ToLower(strings.TrimSpace(rng))
+
+		s := -1
+		switch {
+		case rng == mediaType:
+			s = 2
+		case rng == "*/*":
+			s = 0
+		case strings.HasSuffix(rng, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(rng, "*")):
+			s = 1
+		}
+		if s <= spec {
+			continue
+		}
+
+		spec, q = s, 1
+		for _, p := range strings.Split(params, ";") {
+			k, v, _ := strings.Cut(p, "=")
+			if strings.TrimSpace(k) != "q" {
+				continue
+			}
+			if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+				q = f
+			}
+		}
+	}
+
+	return q, spec
+}
+
+// GetUpload returns the upload kept of the image uuid, as sent less its
+// metadata, see store.KeepUploads. A GIF is always kept as its original
+func GetUpload(uuid string) (*models.ImageVarient, error) {
+	meta := store.GetGuidImageMetadata(uuid)
+	switch {
+	case meta == nil:
+		return nil, fmt.Errorf("no image found for %s", uuid)
+	case meta.UploadPath != "":
+		return &models.ImageVarient{Path: meta.UploadPath, Ext: meta.OriginalExt}, nil
+	case meta.OriginalExt == "gif":
+		return &models.ImageVarient{Path: meta.OriginalPath, Ext: meta.OriginalExt}, nil
+	default:
+		return nil, fmt.Errorf("no upload kept of %s", uuid)
+	}
+}
+
+// GetImage returns the original or a varient by id, {uuid} or
+// {uuid}_{width} with an optional .{ext}. Without one the encoding is
+// negotiated from accept
+func GetImage(id string, accept string) (*models.ImageVarient, error) {
 
 	originalMeta := store.GetGuidImageMetadata(id)
 	if originalMeta != nil {
@@ -110,47 +411,139 @@ func GetImage(id string) (*models.ImageVarient, error) {
 		return nil, fmt.Errorf("invalid image id format %s", id)
 	}
 
+	// an explicit extension picks the encoding, uuid_600.gif is animated
 	uuid := parts[0]
-	width, err := strconv.Atoi(parts[1])
+	widthPart, ext, _ := strings.Cut(parts[1], ".")
+	width, err := strconv.Atoi(widthPart)
 	if err != nil {
 		return nil, fmt.Errorf("invalid width in id %s", id)
 	}
 
-	// return exact match if exists
 	meta := store.GetGuidImageMetadata(uuid)
-	if varient, ok := meta.GetVariant(width); ok {
+	if meta == nil {
+		return nil, fmt.Errorf("no image found for %s", uuid)
+	}
+
+	formats := VarientFormats(meta)
+	if ext == "" {
+		ext = negotiateFormat(accept, formats)
+	}
+
+	// return exact match if exists
+	if varient, ok := meta.GetVariant(width, ext); ok {
+		store.TouchVarient(varient)
 		return &varient, nil
 	}
 
-	var (
-		closest *models.ImageVarient
-		minDiff int = math.MaxInt
-	)
+	// only generate the sizes of the active profile
+	if !slices.Contains(store.ActiveVarientProfile().Widths, width) {
+		return nil, fmt.Errorf("unsupported width %d for %s", width, uuid)
+	}
+
+	if !slices.Contains(formats, ext) && !(ext == "gif" && meta.OriginalExt == "gif") {
+		return nil, fmt.Errorf("unsupported format %s for %s", ext, uuid)
+	}
+
+	// never scale up, the original is the largest size
+	if width >= meta.OriginalWidth {
+		return &models.ImageVarient{
+			Path: meta.OriginalPath,
+			Ext:  meta.OriginalExt,
+		}, nil
+	}
 
-	// find min diff value using linear search
-	meta.VarientsMu.RLock()
-	for w, v := range meta.Varients {
-		diff := abs(w - width)
-		if diff < minDiff {
-			minDiff = diff
-			vCopy := v
-			closest = &vCopy
+	// concurrent requests for the same missing varient share one generation
+	varient, err := ensureVarient(context.Background(), meta, width, ext, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &varient, nil
+}
+
+// generateVarient creates a missing varient from the original, img is the
+// decoded original or nil to load it from storage
+func generateVarient(ctx context.Context, meta *models.ImageMetadata, width int, ext string, img image.Image) (models.ImageVarient, error) {
+	// another request may have finished it while this one waited
+	if varient, ok := meta.GetVariant(width, ext); ok {
+		return varient, nil
+	}
+
+	if ext == "gif" {
+		if err := generateVarientGIF(ctx, meta, width); err != nil {
+			return models.ImageVarient{}, err
+		}
+	} else {
+		if img == nil {
+			var release func()
+			var err error
+			if img, release, err = decodeOriginal(ctx, meta); err != nil {
+				return models.ImageVarient{}, err
+			}
+			defer release()
 		}
+		if err := store.SaveVarientImage(meta.UUID, img, width, ext); err != nil {
+			return models.ImageVarient{}, err
+		}
+	}
+
+	varient, ok := meta.GetVariant(width, ext)
+	if !ok {
+		return models.ImageVarient{}, fmt.Errorf("varient %s_%d.%s missing after generation", meta.UUID, width, ext)
 	}
-	meta.VarientsMu.RUnlock()
 
-	if closest != nil {
-		return closest, nil
+	log.Printf("generated varient: %s", varient.Path)
+	return varient, nil
+}
+
+func readOriginal(meta *models.ImageMetadata) ([]byte, error) {
+	rc, _, err := store.Backend.Get(context.Background(), meta.OriginalPath)
+	if err != nil {
+		return nil, err
 	}
+	defer rc.Close()
 
-	return nil, fmt.Errorf("no varients found for %s", uuid)
+	return io.ReadAll(rc)
 }
 
-func abs(x int) int {
-	if x < 0 {
-		return -x
+// generateVarientGIF stores an animated varient, every frame is decoded so
+// it counts against the decode budget
+func generateVarientGIF(ctx context.Context, meta *models.ImageMetadata, width int) error {
+	buf, err := readOriginal(meta)
+	if err != nil {
+		return err
+	}
+
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(buf))
+	if err != nil {
+		return fmt.Errorf("decode original %s: %w", meta.UUID, err)
+	}
+	cost, err := decodeCost(buf, cfg, format)
+	if err != nil {
+		return fmt.Errorf("decode original %s: %w", meta.UUID, err)
+	}
+	release, err := reserveDecode(ctx, cost)
+	if err != nil {
+		return fmt.Errorf("decode original %s: %w", meta.UUID, err)
+	}
+	defer release()
+
+	return store.SaveVarientGIF(meta.UUID, buf, width)
+}
+
+// decodeOriginal decodes the stored original, the first frame for a GIF,
+// release gives back its share of the decode budget
+func decodeOriginal(ctx context.Context, meta *models.ImageMetadata) (image.Image, func(), error) {
+	buf, err := readOriginal(meta)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	img, _, release, err := decodeImage(ctx, buf)
+	if err != nil {
+		return nil, nil, fmt.Errorf("decode original %s: %w", meta.UUID, err)
 	}
-	return x
+	return img, release, nil
 }
 
 func readUpload(file multipart.File) ([]byte, error) {
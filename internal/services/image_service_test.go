@@ -0,0 +1,264 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"go-image-web/internal/config"
+	"go-image-web/internal/models"
+	"go-image-web/internal/repo"
+	"go-image-web/internal/store"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestNegotiateFormat(t *testing.T) {
+	tests := []struct {
+		name   string
+		accept string
+		want   string
+	}{
+		{"no header", "", "jpeg"},
+		{"anything", "*/*", "jpeg"},
+		{"chrome", "image/avif,image/webp,image/apng,image/svg+xml,image/*,*/*;q=0.8", "webp"},
+		{"old safari", "image/png,image/svg+xml,image/*;q=0.8,video/*;q=0.8,*/*;q=0.5", "jpeg"},
+		{"webp only", "image/webp", "webp"},
+		{"webp refused", "image/webp;q=0,*/*", "jpeg"},
+		{"jpeg preferred", "image/webp;q=0.5, image/jpeg", "jpeg"},
+		{"nothing acceptable", "text/html", "jpeg"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := negotiateFormat(tt.accept, []string{"jpeg", "webp"}); got != tt.want {
+				t.Errorf("Expected %s for %q, got %s", tt.want, tt.accept, got)
+			}
+		})
+	}
+}
+
+func TestProfileVarients_NeverUpscale(t *testing.T) {
+	setupStore(t)
+	defer store.SetVarientProfile(store.ActiveVarientProfile())
+	store.SetVarientProfile(store.VarientProfile{Widths: []int{300, 600, 1200}, Formats: []string{store.FormatOriginal, "webp"}, Quality: 90, Filter: "box"})
+
+	meta := &models.ImageMetadata{UUID: "small", OriginalExt: "gif", OriginalPath: "original/small_original.gif", OriginalWidth: 600, OriginalHeight: 400}
+	got := profileVarients(meta)
+	want := []models.VarientID{{Width: 300, Ext: "png"}, {Width: 300, Ext: "webp"}, {Width: 300, Ext: "gif"}}
+	if !slices.Equal(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+
+	store.AddImageMetadata(meta)
+	for _, id := range []string{"small_600.webp", "small_1200.png", "small_1200.gif"} {
+		v, err := GetImage(id, "")
+		if err != nil {
+			t.Fatalf("GetImage(%s) failed: %v", id, err)
+		}
+		if v.Path != meta.OriginalPath {
+			t.Errorf("Expected the original for %s, got %s", id, v.Path)
+		}
+	}
+}
+
+func TestSaveImage_Dedup(t *testing.T) {
+	setupStore(t)
+	xdb := setupDB(t)
+	if err := store.LoadImages(repo.NewImageRepo(xdb)); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.SetImageRepo(nil) })
+
+	path := filepath.Join(t.TempDir(), "upload.png")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := png.Encode(f, solidImage(200, 150, color.RGBA{0, 128, 255, 255})); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	ctx := context.Background()
+	upload := func() string {
+		t.Helper()
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		uuid, err := SaveImage(ctx, f, "upload.png", nil)
+		if err != nil {
+			t.Fatalf("SaveImage failed: %v", err)
+		}
+		return uuid
+	}
+	stored := func() int {
+		t.Helper()
+		objects, err := store.Backend.List(ctx, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(objects)
+	}
+
+	first := upload()
+	files := stored()
+	if files == 0 {
+		t.Fatal("Expected the upload stored")
+	}
+	if second := upload(); second != first {
+		t.Errorf("Expected the same uuid %s, got %s", first, second)
+	}
+
+	// an upload handed the image keeps it until it lets go
+	store.Unlease(first)
+	if deleted, err := store.ReleaseImage(first); err != nil || deleted {
+		t.Errorf("Expected the leased image kept, got %v, %v", deleted, err)
+	}
+	store.Unlease(first)
+	if got := stored(); got != files {
+		t.Errorf("Expected %d stored files, got %d", files, got)
+	}
+
+	// two threads share the image
+	posts := NewPostService(repo.NewRepo(xdb), &config.Config{TripcodeSecret: "secret", BumpLimit: 300, ImageLimit: 150})
+	board := &models.Board{Slug: "b", ImageRequired: true, DefaultName: "Anonymous", RepostPolicy: config.RepostLink}
+	var ids []int
+	for range 2 {
+		post, err := posts.SavePost(board, &models.PostModel{ImageUUID: first}, false)
+		if err != nil {
+			t.Fatalf("SavePost failed: %v", err)
+		}
+		ids = append(ids, post.ID)
+	}
+
+	refCount := func() int {
+		t.Helper()
+		var n int
+		if err := xdb.Get(&n, "SELECT COALESCE(SUM(ref_count), 0) FROM images WHERE uuid = ?", first); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	if n := refCount(); n != 2 {
+		t.Fatalf("Expected ref_count 2, got %d", n)
+	}
+
+	if err := posts.DeletePost(ids[0]); err != nil {
+		t.Fatalf("DeletePost failed: %v", err)
+	}
+	if n := refCount(); n != 1 {
+		t.Errorf("Expected ref_count 1, got %d", n)
+	}
+	if got := stored(); got != files || store.GetGuidImageMetadata(first) == nil {
+		t.Errorf("Expected the image kept for its other post, %d of %d files left", got, files)
+	}
+
+	if err := posts.DeletePost(ids[1]); err != nil {
+		t.Fatalf("DeletePost failed: %v", err)
+	}
+	if n := refCount(); n != 0 {
+		t.Errorf("Expected ref_count 0, got %d", n)
+	}
+	if got := stored(); got != 0 || store.GetGuidImageMetadata(first) != nil {
+		t.Errorf("Expected the image deleted with its last post, %d files left", got)
+	}
+}
+
+func TestSaveImage_DedupContent(t *testing.T) {
+	setupStore(t)
+	xdb := setupDB(t)
+	if err := store.LoadImages(repo.NewImageRepo(xdb)); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.SetImageRepo(nil) })
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, solidImage(200, 150, color.RGBA{255, 128, 0, 255}), nil); err != nil {
+		t.Fatal(err)
+	}
+	plain := buf.Bytes()
+
+	// the same image with a comment, XMP and bytes after its end
+	segment := func(marker byte, data string) []byte {
+		return append([]byte{0xff, marker, 0, byte(len(data) + 2)}, data...)
+	}
+	tagged := slices.Concat(plain[:2],
+		segment(0xfe, "taken with my phone"),
+		segment(0xe1, "http://ns.adobe.com/xap/1.0/\x00<x:xmpmeta/>"),
+		plain[2:], []byte("trailing"))
+
+	ctx := context.Background()
+	upload := func(b []byte) string {
+		t.Helper()
+		path := filepath.Join(t.TempDir(), "upload.jpg")
+		if err := os.WriteFile(path, b, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		uuid, err := SaveImage(ctx, f, "upload.jpg", nil)
+		if err != nil {
+			t.Fatalf("SaveImage failed: %v", err)
+		}
+		return uuid
+	}
+
+	first := upload(plain)
+	if second := upload(tagged); second != first {
+		t.Errorf("Expected the same uuid %s, got %s", first, second)
+	}
+	store.Unlease(first)
+	store.Unlease(first)
+
+	var n int
+	if err := xdb.Get(&n, "SELECT COUNT(*) FROM images"); err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("Expected 1 stored image, got %d", n)
+	}
+	if meta := store.GetGuidImageMetadata(first); meta == nil || meta.ContentSHA256 == "" {
+		t.Errorf("Expected the content hash recorded, got %+v", meta)
+	}
+}
+
+func TestSaveImage_FormatNotAllowed(t *testing.T) {
+	setupStore(t)
+
+	path := filepath.Join(t.TempDir(), "upload.png")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := png.Encode(f, solidImage(200, 150, color.RGBA{0, 128, 255, 255})); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	if f, err = os.Open(path); err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	jpegOnly := func(format string) bool { return format == "jpeg" }
+	if _, err := SaveImage(context.Background(), f, "upload.png", jpegOnly); !errors.Is(err, ErrFormatNotAllowed) {
+		t.Errorf("Expected ErrFormatNotAllowed, got %v", err)
+	}
+
+	objects, err := store.Backend.List(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 0 {
+		t.Errorf("Expected nothing stored, got %v", objects)
+	}
+}
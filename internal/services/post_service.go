@@ -1,52 +1,429 @@
 package services
 
 import (
+	"errors"
 	"fmt"
+	"go-image-web/internal/config"
+	"go-image-web/internal/markup"
 	"go-image-web/internal/models"
 	"go-image-web/internal/repo"
+	"go-image-web/internal/store"
+	"go-image-web/internal/tripcode"
 	"log"
+	"sort"
+	"strings"
+	"unicode"
 )
 
 type PostService struct {
 	repo *repo.PostRepo
+	cfg  *config.Config
+	// key of secure tripcodes
+	tripcodeSecret []byte
 }
 
-func NewPostService(repo *repo.PostRepo) *PostService {
+func NewPostService(repo *repo.PostRepo, cfg *config.Config) *PostService {
+	secret := []byte(cfg.TripcodeSecret)
+	if len(secret) == 0 {
+		log.Print("TRIPCODE_SECRET is not set, secure tripcodes will change on restart")
+		secret = randomSigningKey()
+	}
+
 	return &PostService{
-		repo: repo,
+		repo:           repo,
+		cfg:            cfg,
+		tripcodeSecret: secret,
 	}
 }
 
 const (
-	DefaultPagePosts int    = 100
-	DefaultPostName  string = "Anonymous"
+	// threads on a page of a board
+	DefaultPagePosts int = 100
+
+	// cap on earlier posts linked from a single repost
+	MaxRepostLinks int = 10
+)
+
+var ErrRepost = errors.New("this image was already posted")
+
+var (
+	// ErrNoImage is returned for an opening post without an image
+	ErrNoImage = errors.New("an opening post on this board must have an image")
+	// ErrEmptyPost is returned for a post with neither a message nor an image
+	ErrEmptyPost = errors.New("a post must have a message or an image")
+
+	// ErrReservedName is returned for a reserved name given by anyone but staff
+	ErrReservedName = errors.New("this name is reserved for staff")
+
+	ErrThreadNotFound = repo.ErrThreadNotFound
+	ErrImageLimit     = repo.ErrImageLimit
 )
 
-func (p *PostService) GetPosts() ([]*models.PostModel, error) {
-	posts, err := p.repo.SelectAllPosts()
+// BumpLimit is the number of replies after which a thread is no longer bumped
+func (p *PostService) BumpLimit() int {
+	return p.cfg.BumpLimit
+}
+
+// ImageLimit is the number of posts with an image a thread may have
+func (p *PostService) ImageLimit() int {
+	return p.cfg.ImageLimit
+}
+
+// GetThreads returns a page of DefaultPagePosts threads on board, last
+// bumped first, starting after before unless it is nil, and where the next
+// page starts, nil on the last
+func (p *PostService) GetThreads(board string, before *models.ThreadCursor) ([]*models.ThreadModel, *models.ThreadCursor, error) {
+	// one more than a page tells whether there is a next one
+	threads, err := p.repo.SelectThreads(board, before, DefaultPagePosts+1)
+	if err != nil {
+		log.Printf("failed to select threads %v", err)
+		return nil, nil, fmt.Errorf("failed to retrieve threads")
+	}
+
+	if len(threads) <= DefaultPagePosts {
+		return threads, nil, nil
+	}
+	threads = threads[:DefaultPagePosts]
+	last := threads[len(threads)-1]
+	return threads, &models.ThreadCursor{BumpedAt: last.BumpedAt, No: last.No}, nil
+}
+
+// GetThread returns the thread opened by post no on board and all its
+// posts, oldest first
+func (p *PostService) GetThread(board string, no int) (*models.ThreadModel, []*models.PostModel, error) {
+	thread, err := p.repo.SelectThread(board, no)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	posts, err := p.repo.SelectThreadPosts(thread.ID)
 	if err != nil {
-		log.Printf("failed to select all posts %v", err)
-		return nil, fmt.Errorf("failed to retrieve posts")
+		return nil, nil, err
 	}
 
-	// var postMap = make(map[int]*models.PostModel)
-	// for _, v := range posts {
-	// 	postMap[v.ID] = &v
-	// }
+	return thread, posts, nil
+}
 
-	return posts, nil
+// GetPost returns post no on board, nil when there is none
+func (p *PostService) GetPost(board string, no int) (*models.PostModel, error) {
+	return p.repo.SelectPost(board, no)
 }
 
-func (p *PostService) SavePost(model *models.PostModel) (int, error) {
+// SignName splits field, the name a poster gave, into the name shown and its
+// tripcode. A reserved name is only taken from staff, whose posts are
+// capcoded with it, ErrReservedName otherwise
+func (p *PostService) SignName(field string, staff bool) (name string, trip string, capcode string, err error) {
+	name, trip = tripcode.Parse(field, p.tripcodeSecret)
+	name = cleanName(name)
+
+	// compared as they look, not by code point
+	key := nameSkeleton(name)
+	for _, reserved := range p.cfg.ReservedNames {
+		if key != "" && key == nameSkeleton(reserved) {
+			if !staff {
+				return "", "", "", ErrReservedName
+			}
+			capcode = reserved
+			break
+		}
+	}
+
+	return name, trip, capcode, nil
+}
+
+// cleanName drops the invisible characters of a name and collapses its
+// whitespace, of any kind, to single spaces
+func cleanName(name string) string {
+	var b strings.Builder
+	space := false
+	for _, r := range name {
+		switch {
+		case unicode.IsSpace(r):
+			space = true
+		case !unicode.IsPrint(r), unicode.Is(unicode.Variation_Selector, r), blanks[r]:
+		default:
+			if space && b.Len() > 0 {
+				b.WriteByte(' ')
+			}
+			space = false
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// letters drawn blank that unicode counts as printable
+var blanks = map[rune]bool{
+	'\u115f': true, '\u1160': true, '\u2800': true, '\u3164': true, '\uffa0': true,
+}
+
+// letters from other scripts drawn like latin ones, looked up as given and
+// then in lower case
+var confusables = map[rune]rune{
+	// greek
+	'\u0391': 'a', '\u0392': 'b', '\u0395': 'e', '\u0396': 'z', '\u0397': 'h', '\u0399': 'l', '\u039a': 'k',
+	'\u039c': 'm', '\u039d': 'n', '\u039f': 'o', '\u03a1': 'p', '\u03a4': 't', '\u03a5': 'y', '\u03a7': 'x',
+	'\u03b1': 'a', '\u03b9': 'l', '\u03ba': 'k', '\u03bd': 'v', '\u03bf': 'o', '\u03c1': 'p', '\u03c5': 'u',
+	// cyrillic
+	'\u0410': 'a', '\u0412': 'b', '\u0415': 'e', '\u041a': 'k', '\u041c': 'm', '\u041d': 'h', '\u041e': 'o',
+	'\u0420': 'p', '\u0421': 'c', '\u0422': 't', '\u0425': 'x', '\u0406': 'l', '\u0408': 'j', '\u0405': 's',
+	'\u0430': 'a', '\u0435': 'e', '\u043e': 'o', '\u0440': 'p', '\u0441': 'c', '\u0443': 'y', '\u0445': 'x',
+	'\u0456': 'l', '\u0458': 'j', '\u0455': 's', '\u0501': 'd', '\u04cf': 'l', '\u051b': 'q', '\u051d': 'w',
+	// drawn alike in most fonts
+	'0': 'o', '1': 'l', 'i': 'l',
+}
+
+// nameSkeleton reduces a name to how it reads, its letters and digits in
+// lower case with lookalikes folded to latin, so names that only differ in
+// spacing, punctuation, marks, width or script compare equal
+func nameSkeleton(name string) string {
+	var b strings.Builder
+	for _, r := range name {
+		switch {
+		case r >= 0xff01 && r <= 0xff5e:
+			// fullwidth ascii
+			r -= 0xfee0
+		case r >= 0x1d400 && r <= 0x1d6a3:
+			// mathematical bold, italic, script and so on, upper case first
+			if n := (r - 0x1d400) % 52; n < 26 {
+				r = 'a' + n
+			} else {
+				r = 'a' + n - 26
+			}
+		case r >= 0x1d7ce && r <= 0x1d7ff:
+			r = '0' + (r-0x1d7ce)%10
+		case r >= 0x24b6 && r <= 0x24e9:
+			// circled letters
+			r = 'a' + (r-0x24b6)%26
+		}
+		if c, ok := confusables[r]; ok {
+			r = c
+		} else if c, ok := confusables[unicode.ToLower(r)]; ok {
+			r = c
+		} else {
+			r = unicode.ToLower(r)
+		}
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// CheckPost returns why a post to thread no threadNo on board, 0 for a new
+// thread, can't be made, before its image is stored. SavePost checks the
+// limits again
+func (p *PostService) CheckPost(board *models.Board, threadNo int, hasImage bool, message string) error {
+	_, err := p.checkPost(board, threadNo, hasImage, message)
+	return err
+}
+
+// checkPost returns the thread a valid post goes to, nil for a new one
+func (p *PostService) checkPost(board *models.Board, threadNo int, hasImage bool, message string) (*models.ThreadModel, error) {
+	if threadNo == 0 && board.ImageRequired && !hasImage {
+		return nil, ErrNoImage
+	}
+	if !hasImage && strings.TrimSpace(message) == "" {
+		return nil, ErrEmptyPost
+	}
+	if threadNo == 0 {
+		return nil, nil
+	}
+
+	thread, err := p.repo.SelectThread(board.Slug, threadNo)
+	if err != nil {
+		return nil, err
+	}
+	if hasImage && thread.Images >= p.cfg.ImageLimit {
+		return nil, fmt.Errorf("%w (%d)", ErrImageLimit, p.cfg.ImageLimit)
+	}
+
+	return thread, nil
+}
+
+// SavePost numbers model on board and opens a thread with it, or replies to
+// thread no model.ThreadNo bumping it unless sage or past the bump limit.
+// It returns the post as saved
+func (p *PostService) SavePost(board *models.Board, model *models.PostModel, sage bool) (*models.PostModel, error) {
 
 	if model == nil {
-		return 0, fmt.Errorf("nil reference passed to SavePost")
+		return nil, fmt.Errorf("nil reference passed to SavePost")
+	}
+
+	thread, err := p.checkPost(board, model.ThreadNo, model.ImageUUID != "", model.Message)
+	if err != nil {
+		return nil, err
+	}
+
+	model.Board = board.Slug
+	if thread != nil {
+		model.ThreadID = thread.ID
+	}
+	if model.Name == "" {
+		model.Name = board.DefaultName
 	}
 
-	createdModel, err := p.repo.InsertPost(model)
+	var refs []models.PostReference
+	for _, ref := range markup.ParseReferences(board.Slug, model.Message) {
+		refs = append(refs, models.PostReference{Board: ref.Board, No: ref.No})
+	}
+
+	createdModel, err := p.repo.InsertPost(model, refs, sage, repo.ThreadLimits{
+		Bump:   p.cfg.BumpLimit,
+		Images: p.cfg.ImageLimit,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// link to earlier posts of the same image, failure here only loses the notice
+	if model.ImageUUID != "" {
+		reposts, err := p.FindReposts(board.Slug, model.ImageUUID, createdModel.ID)
+		if err != nil {
+			log.Printf("failed to find reposts of post %d: %v", createdModel.ID, err)
+		} else if err := p.repo.InsertReposts(reposts); err != nil {
+			log.Printf("failed to link reposts of post %d: %v", createdModel.ID, err)
+		}
+	}
+
+	return createdModel, nil
+}
+
+// FindReposts returns posts on board older than postID whose image is
+// identical or perceptually close to uuid, closest first. A postID of 0
+// matches every post.
+func (p *PostService) FindReposts(board string, uuid string, postID int) ([]models.Repost, error) {
+	distances := map[string]int{uuid: 0}
+	if meta := store.GetGuidImageMetadata(uuid); meta != nil {
+		if hash, ok := store.ParsePHash(meta.PHash); ok {
+			for _, m := range store.FindSimilarImages(uuid, hash, p.cfg.RepostMaxDistance) {
+				distances[m.UUID] = m.Distance
+			}
+		}
+	}
+
+	uuids := make([]string, 0, len(distances))
+	for id := range distances {
+		uuids = append(uuids, id)
+	}
+
+	posts, err := p.repo.SelectPostsByImages(board, uuids)
+	if err != nil {
+		return nil, err
+	}
+
+	var reposts []models.Repost
+	for _, post := range posts {
+		if postID != 0 && post.ID >= postID {
+			continue
+		}
+		reposts = append(reposts, models.Repost{
+			PostID:   postID,
+			RepostOf: post.ID,
+			Distance: distances[post.ImageUUID],
+			RepostNo: post.No,
+		})
+	}
+
+	sort.SliceStable(reposts, func(i, j int) bool {
+		return reposts[i].Distance < reposts[j].Distance
+	})
+	if len(reposts) > MaxRepostLinks {
+		reposts = reposts[:MaxRepostLinks]
+	}
+
+	return reposts, nil
+}
+
+// CheckRepost returns ErrRepost when board rejects reposts and uuid has
+// already been posted on it
+func (p *PostService) CheckRepost(board *models.Board, uuid string) error {
+	if board.RepostPolicy != config.RepostReject {
+		return nil
+	}
+
+	reposts, err := p.FindReposts(board.Slug, uuid, 0)
 	if err != nil {
-		return 0, err
+		return err
+	}
+
+	if len(reposts) > 0 {
+		return fmt.Errorf("%w (>>%d)", ErrRepost, reposts[0].RepostNo)
+	}
+
+	return nil
+}
+
+// GetReposts returns the linked earlier posts for each of ids
+func (p *PostService) GetReposts(ids []int) (map[int][]models.Repost, error) {
+	reposts, err := p.repo.SelectReposts(ids)
+	if err != nil {
+		return nil, err
+	}
+
+	byPost := make(map[int][]models.Repost)
+	for _, rp := range reposts {
+		byPost[rp.PostID] = append(byPost[rp.PostID], rp)
+	}
+
+	return byPost, nil
+}
+
+// GetReferences returns the links of the references in the message of each
+// of ids
+func (p *PostService) GetReferences(ids []int) (map[int]markup.Links, error) {
+	refs, err := p.repo.SelectReferences(ids)
+	if err != nil {
+		return nil, err
+	}
+
+	byPost := make(map[int]markup.Links)
+	for _, ref := range refs {
+		if byPost[ref.PostID] == nil {
+			byPost[ref.PostID] = make(markup.Links)
+		}
+		byPost[ref.PostID].Set(ref.Board, ref.No, ref.ThreadNo)
+	}
+
+	return byPost, nil
+}
+
+// GetBacklinks returns the posts referencing each of ids, oldest first
+func (p *PostService) GetBacklinks(ids []int) (map[int][]models.Backlink, error) {
+	backlinks, err := p.repo.SelectBacklinks(ids)
+	if err != nil {
+		return nil, err
+	}
+
+	byPost := make(map[int][]models.Backlink)
+	for _, bl := range backlinks {
+		byPost[bl.TargetID] = append(byPost[bl.TargetID], bl)
+	}
+
+	return byPost, nil
+}
+
+// DeletePost removes a post, or a whole thread given its opening post. Image
+// files are only removed along with the last post referencing them
+func (p *PostService) DeletePost(id int) error {
+	uuids, err := p.repo.DeletePost(id)
+	if err != nil {
+		return err
+	}
+
+	for _, uuid := range uuids {
+		if uuid == "" {
+			continue
+		}
+
+		deleted, err := store.ReleaseImage(uuid)
+		if err != nil {
+			return err
+		}
+		if deleted {
+			log.Printf("deleted image %s with its last post %d", uuid, id)
+		}
 	}
 
-	return createdModel.ID, nil
+	return nil
 }
@@ -0,0 +1,138 @@
+package services
+
+import (
+	"context"
+	"go-image-web/internal/models"
+	"go-image-web/internal/store"
+	"image"
+	"log"
+	"sort"
+)
+
+// RegenOptions say what Regen may change besides creating missing varients
+type RegenOptions struct {
+	// delete the varients the active profile no longer has
+	DeleteRetired bool
+	// encode the varients it still has again, after a change of quality,
+	// filter or sharpening
+	Force bool
+	// only count what would change
+	DryRun bool
+}
+
+// RegenResult counts what Regen changed
+type RegenResult struct {
+	Images  int
+	Created int
+	Deleted int
+	Failed  int
+}
+
+// Regen brings the varients of every image in line with the active profile,
+// creating the missing ones and, as opts allow, deleting retired ones and
+// encoding the rest again. Progress is logged as it goes
+func Regen(ctx context.Context, opts RegenOptions) (RegenResult, error) {
+	var res RegenResult
+
+	store.ImageIndexMu.RLock()
+	metas := make([]*models.ImageMetadata, 0, len(store.ImageIndex))
+	for _, meta := range store.ImageIndex {
+		metas = append(metas, meta)
+	}
+	store.ImageIndexMu.RUnlock()
+
+	sort.Slice(metas, func(i, j int) bool {
+		return metas[i].ModifiedTime.Before(metas[j].ModifiedTime)
+	})
+
+	for i, meta := range metas {
+		if err := ctx.Err(); err != nil {
+			return res, err
+		}
+
+		created, deleted, failed := regenImage(ctx, meta, opts)
+		res.Images++
+		res.Created += created
+		res.Deleted += deleted
+		res.Failed += failed
+
+		if created+deleted+failed > 0 {
+			log.Printf("regen: [%d/%d] %s: %d created, %d deleted, %d failed", i+1, len(metas), meta.UUID, created, deleted, failed)
+		} else if (i+1)%100 == 0 {
+			log.Printf("regen: [%d/%d]", i+1, len(metas))
+		}
+	}
+
+	return res, nil
+}
+
+// regenImage brings the varients of one image in line with the active profile
+func regenImage(ctx context.Context, meta *models.ImageMetadata, opts RegenOptions) (created int, deleted int, failed int) {
+	wanted := profileVarients(meta)
+
+	meta.VarientsMu.RLock()
+	existing := make(map[models.VarientID]models.ImageVarient, len(meta.Varients))
+	for id, v := range meta.Varients {
+		existing[id] = v
+	}
+	meta.VarientsMu.RUnlock()
+
+	if opts.DeleteRetired {
+		keep := make(map[models.VarientID]bool, len(wanted))
+		for _, id := range wanted {
+			keep[id] = true
+		}
+		for id, v := range existing {
+			if keep[id] {
+				continue
+			}
+			if !opts.DryRun {
+				if err := store.RemoveVarient(meta.UUID, v); err != nil {
+					log.Printf("regen: delete %s: %v", v.Path, err)
+					failed++
+					continue
+				}
+			}
+			deleted++
+		}
+	}
+
+	// decoded once for every still varient of the image
+	var img image.Image
+	for _, id := range wanted {
+		old, exists := existing[id]
+		if exists && !opts.Force {
+			continue
+		}
+		if opts.DryRun {
+			created++
+			continue
+		}
+
+		if img == nil && id.Ext != "gif" {
+			decoded, release, err := decodeOriginal(ctx, meta)
+			if err != nil {
+				log.Printf("regen: %v", err)
+				return created, deleted, failed + 1
+			}
+			defer release()
+			img = decoded
+		}
+
+		// the new file replaces the old under the same key
+		if exists {
+			meta.RemoveVariant(id.Width, id.Ext)
+		}
+		if _, err := ensureVarient(ctx, meta, id.Width, id.Ext, img); err != nil {
+			log.Printf("regen: %v", err)
+			if exists {
+				meta.SetVariant(old)
+			}
+			failed++
+			continue
+		}
+		created++
+	}
+
+	return created, deleted, failed
+}
@@ -0,0 +1,73 @@
+package services
+
+import (
+	"context"
+	"go-image-web/internal/models"
+	"go-image-web/internal/store"
+	"image/color"
+	"testing"
+)
+
+func TestRegen_FollowsProfile(t *testing.T) {
+	setupStore(t)
+	defer store.SetVarientProfile(store.ActiveVarientProfile())
+
+	ctx := context.Background()
+	img := solidImage(1000, 800, color.RGBA{0, 255, 0, 255})
+	meta := &models.ImageMetadata{UUID: "regen", OriginalExt: "png", OriginalWidth: 1000, OriginalHeight: 800}
+	if err := store.SaveOriginalImage(img, meta); err != nil {
+		t.Fatal(err)
+	}
+
+	store.SetVarientProfile(store.VarientProfile{Name: "a", Widths: []int{200, 400}, Formats: []string{store.FormatOriginal}, Quality: 90, Filter: "box"})
+	if err := generateVarients(ctx, meta, img); err != nil {
+		t.Fatal(err)
+	}
+
+	// 400 stays, 200 retires, 300 and the webp encodings are new
+	store.SetVarientProfile(store.VarientProfile{Name: "b", Widths: []int{300, 400}, Formats: []string{store.FormatOriginal, "webp"}, Quality: 90, Filter: "box"})
+
+	res, err := Regen(ctx, RegenOptions{DeleteRetired: true, DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Created != 3 || res.Deleted != 1 || meta.GetVarientLen() != 2 {
+		t.Errorf("Expected a dry run to count 3 created and 1 deleted and change nothing, got %+v and %d varients", res, meta.GetVarientLen())
+	}
+
+	res, err = Regen(ctx, RegenOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Created != 3 || res.Deleted != 0 || res.Failed != 0 {
+		t.Errorf("Expected 3 created, got %+v", res)
+	}
+	if _, ok := meta.GetVariant(200, "png"); !ok {
+		t.Error("Expected the retired varient kept without DeleteRetired")
+	}
+
+	res, err = Regen(ctx, RegenOptions{DeleteRetired: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Created != 0 || res.Deleted != 1 {
+		t.Errorf("Expected only the retired varient deleted, got %+v", res)
+	}
+	if _, err := store.Backend.Stat(ctx, store.VarientKey(meta.UUID, 200, "png")); err == nil {
+		t.Error("Expected the retired varient's file deleted")
+	}
+
+	for _, id := range []models.VarientID{{Width: 300, Ext: "png"}, {Width: 300, Ext: "webp"}, {Width: 400, Ext: "png"}, {Width: 400, Ext: "webp"}} {
+		if _, ok := meta.GetVariant(id.Width, id.Ext); !ok {
+			t.Errorf("Expected varient %v", id)
+		}
+	}
+
+	res, err = Regen(ctx, RegenOptions{Force: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Created != 4 || meta.GetVarientLen() != 4 {
+		t.Errorf("Expected every varient encoded again, got %+v and %d varients", res, meta.GetVarientLen())
+	}
+}
@@ -0,0 +1,94 @@
+package services
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+)
+
+// how long a staff session lasts
+const StaffSessionAge = 7 * 24 * time.Hour
+
+// StaffService checks who is staff, those who know the key set in STAFF_KEY
+type StaffService struct {
+	// sha256 of the key, nil when nobody can log in
+	keyHash []byte
+
+	// when each session token expires, sessions end with the process
+	mu       sync.Mutex
+	sessions map[string]time.Time
+}
+
+func NewStaffService(key string) *StaffService {
+	s := &StaffService{sessions: make(map[string]time.Time)}
+	if key != "" {
+		sum := sha256.Sum256([]byte(key))
+		s.keyHash = sum[:]
+	}
+	return s
+}
+
+var ErrStaffKey = errors.New("wrong staff key")
+
+// Enabled reports whether there is a key to log in with
+func (s *StaffService) Enabled() bool {
+	return s.keyHash != nil
+}
+
+// Login starts a staff session for key, returning its token, ErrStaffKey
+// when the key is wrong. Each login gets a token of its own
+func (s *StaffService) Login(key string) (string, error) {
+	if !s.Enabled() || key == "" {
+		return "", ErrStaffKey
+	}
+
+	// hashed so the comparison takes as long whatever the key
+	sum := sha256.Sum256([]byte(key))
+	if !hmac.Equal(sum[:], s.keyHash) {
+		return "", ErrStaffKey
+	}
+
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(buf)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// forget sessions that ran out
+	now := time.Now()
+	for t, expires := range s.sessions {
+		if !now.Before(expires) {
+			delete(s.sessions, t)
+		}
+	}
+	s.sessions[token] = now.Add(StaffSessionAge)
+
+	return token, nil
+}
+
+// Logout ends the session of token
+func (s *StaffService) Logout(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, token)
+}
+
+// Authenticated reports whether token is that of a staff session that
+// hasn't ended or run out
+func (s *StaffService) Authenticated(token string) bool {
+	if !s.Enabled() || token == "" {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	expires, ok := s.sessions[token]
+	return ok && time.Now().Before(expires)
+}
@@ -0,0 +1,117 @@
+package services
+
+import (
+	"errors"
+	"go-image-web/internal/config"
+	"go-image-web/internal/tripcode"
+	"testing"
+	"time"
+)
+
+func TestStaffService(t *testing.T) {
+	staff := NewStaffService("key")
+
+	if _, err := staff.Login("wrong"); !errors.Is(err, ErrStaffKey) {
+		t.Errorf("Expected ErrStaffKey, got %v", err)
+	}
+	token, err := staff.Login("key")
+	if err != nil {
+		t.Fatalf("Login failed: %v", err)
+	}
+	if token == "key" {
+		t.Error("Expected the token not to be the key")
+	}
+	if !staff.Authenticated(token) || staff.Authenticated("") || staff.Authenticated("key") {
+		t.Error("Expected only the token authenticated")
+	}
+
+	// every login is a session of its own
+	other, err := staff.Login("key")
+	if err != nil {
+		t.Fatalf("Login failed: %v", err)
+	}
+	if other == token {
+		t.Error("Expected a new token per login")
+	}
+	staff.Logout(token)
+	if staff.Authenticated(token) || !staff.Authenticated(other) {
+		t.Error("Expected only the logged out session ended")
+	}
+
+	staff.sessions[other] = time.Now().Add(-time.Second)
+	if staff.Authenticated(other) {
+		t.Error("Expected an expired session ended")
+	}
+
+	// without a key nobody is staff
+	none := NewStaffService("")
+	if _, err := none.Login(""); !errors.Is(err, ErrStaffKey) {
+		t.Errorf("Expected ErrStaffKey, got %v", err)
+	}
+	if none.Authenticated("") {
+		t.Error("Expected nobody authenticated without a key")
+	}
+}
+
+func TestSignName(t *testing.T) {
+	posts := NewPostService(nil, &config.Config{
+		TripcodeSecret: "secret",
+		ReservedNames:  []string{"Mod"},
+	})
+
+	name, trip, capcode, err := posts.SignName(" Anon #test", false)
+	if err != nil || name != "Anon" || trip != "!"+tripcode.Classic("test") || capcode != "" {
+		t.Errorf("Expected Anon with a tripcode, got %q %q %q %v", name, trip, capcode, err)
+	}
+
+	if _, _, _, err := posts.SignName("mod##pass", false); !errors.Is(err, ErrReservedName) {
+		t.Errorf("Expected ErrReservedName, got %v", err)
+	}
+
+	name, trip, capcode, err = posts.SignName("mod##pass", true)
+	if err != nil || name != "mod" || trip != "!!"+tripcode.Secure("pass", []byte("secret")) || capcode != "Mod" {
+		t.Errorf("Expected a capcoded Mod, got %q %q %q %v", name, trip, capcode, err)
+	}
+}
+
+func TestSignName_Lookalikes(t *testing.T) {
+	posts := NewPostService(nil, &config.Config{
+		TripcodeSecret: "secret",
+		ReservedNames:  []string{"Admin", "Site Mod"},
+	})
+
+	for _, field := range []string{
+		"Admin\u200b",                    // zero width space
+		"Ad\u200dmin",                    // zero width joiner
+		"\u00a0Admin\u00a0",              // no-break spaces
+		"\u3000Admin",                    // ideographic space
+		"Admin\ufe0f",                    // variation selector
+		"\u0391dmin",                     // greek capital alpha
+		"\u0410dm\u0456n",                // cyrillic a and i
+		"\uff21\uff24\uff2d\uff29\uff2e", // fullwidth
+		"\U0001d400dmin",                 // mathematical bold A
+		"\u24b6dmin",                     // circled A
+		"Adm1n",
+		"A.d.m.i.n",
+		"Adm\u0301in", // combining acute
+		"Site  Mod",
+		"site mod",
+		"SiteMod",
+	} {
+		if _, _, _, err := posts.SignName(field, false); !errors.Is(err, ErrReservedName) {
+			t.Errorf("Expected %q reserved, got %v", field, err)
+		}
+	}
+
+	for _, field := range []string{"Adminton", "Modest", "Anonymous", "!!!"} {
+		if _, _, _, err := posts.SignName(field, false); err != nil {
+			t.Errorf("Expected %q allowed, got %v", field, err)
+		}
+	}
+
+	// what is shown loses the invisible characters and extra spaces
+	name, _, _, err := posts.SignName("\u00a0Some\u200b \u3000 one\u2800", false)
+	if err != nil || name != "Some one" {
+		t.Errorf("Expected Some one, got %q %v", name, err)
+	}
+}
@@ -0,0 +1,272 @@
+package services
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"go-image-web/internal/store"
+	"log"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var (
+	// ErrInvalidTransform is a transform query that can't be applied
+	ErrInvalidTransform = errors.New("invalid transform")
+	// ErrBadSignature is a transform query not signed with the server's key
+	ErrBadSignature = errors.New("bad transform signature")
+)
+
+// query parameters of a transform, see ParseTransform
+const (
+	paramWidth     = "w"
+	paramHeight    = "h"
+	paramFit       = "fit"
+	paramGravity   = "g"
+	paramQuality   = "q"
+	paramFormat    = "f"
+	paramSignature = "s"
+)
+
+var transformParams = []string{paramWidth, paramHeight, paramFit, paramGravity, paramQuality, paramFormat, paramSignature}
+
+// bytes of the HMAC kept in a signature
+const signatureBytes = 16
+
+// key transform URLs are signed with, see SetSigningKey
+var signingKey = randomSigningKey()
+
+// SetSigningKey sets the secret transform URLs are signed with. Without one a
+// random key is used, and URLs signed before a restart stop working
+func SetSigningKey(key string) {
+	if key == "" {
+		log.Print("IMAGE_SIGNING_KEY is not set, transform URLs will change on restart")
+		signingKey = randomSigningKey()
+		return
+	}
+	signingKey = []byte(key)
+}
+
+func randomSigningKey() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		log.Fatal(err)
+	}
+	return key
+}
+
+// IsTransform reports whether query asks for a transform, holding any of
+// its parameters or a signature
+func IsTransform(query url.Values) bool {
+	for _, name := range transformParams {
+		if query.Has(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseTransform reads a transform from the query of /img/{id}:
+//
+//	w, h  width and height in pixels, either may be left out to keep the
+//	      aspect ratio
+//	fit   cover, contain (the default) or fill when both are given
+//	g     the part of the image cover keeps, center by default
+//	q     quality of lossy formats, 1 to 100
+//	f     jpeg, png or webp, the format of the varients by default
+//
+// The result is normalised, so equivalent queries give the same transform.
+// The signature s is not checked here, other parameters, like a cache
+// buster, are ignored
+func ParseTransform(query url.Values) (store.Transform, error) {
+	var t store.Transform
+
+	for name, values := range query {
+		if !slices.Contains(transformParams, name) {
+			continue
+		}
+		if len(values) != 1 {
+			return t, fmt.Errorf("%w: %s given %d times", ErrInvalidTransform, name, len(values))
+		}
+		v := values[0]
+
+		var err error
+		switch name {
+		case paramWidth:
+			t.Width, err = transformInt(name, v, 1, MaxImageWidth)
+		case paramHeight:
+			t.Height, err = transformInt(name, v, 1, MaxImageHeight)
+		case paramQuality:
+			t.Quality, err = transformInt(name, v, 1, 100)
+		case paramFit:
+			t.Fit = strings.ToLower(v)
+		case paramGravity:
+			t.Gravity = strings.ToLower(v)
+		case paramFormat:
+			t.Format = strings.ToLower(v)
+		}
+		if err != nil {
+			return t, err
+		}
+	}
+
+	switch t.Fit {
+	case "", store.FitCover, store.FitContain, store.FitFill:
+	default:
+		return t, fmt.Errorf("%w: unknown fit %s", ErrInvalidTransform, t.Fit)
+	}
+	if _, ok := store.Gravities[t.Gravity]; t.Gravity != "" && !ok {
+		return t, fmt.Errorf("%w: unknown gravity %s", ErrInvalidTransform, t.Gravity)
+	}
+
+	switch t.Format {
+	case "", "jpeg", "png", "webp":
+	case "jpg":
+		t.Format = "jpeg"
+	default:
+		return t, fmt.Errorf("%w: unsupported format %s", ErrInvalidTransform, t.Format)
+	}
+
+	// fit and gravity only mean anything with both sides given
+	switch {
+	case t.Width == 0 || t.Height == 0:
+		t.Fit, t.Gravity = "", ""
+	case t.Fit == "":
+		t.Fit = store.FitContain
+	}
+	if t.Fit == store.FitCover && t.Gravity == "" {
+		t.Gravity = "center"
+	} else if t.Fit != store.FitCover {
+		t.Gravity = ""
+	}
+
+	if t == (store.Transform{}) {
+		return t, fmt.Errorf("%w: nothing to do", ErrInvalidTransform)
+	}
+
+	return t, nil
+}
+
+func transformInt(name string, v string, lo int, hi int) (int, error) {
+	n, err := strconv.Atoi(v)
+	if err != nil || n < lo || n > hi {
+		return 0, fmt.Errorf("%w: %s must be %d to %d", ErrInvalidTransform, name, lo, hi)
+	}
+	return n, nil
+}
+
+// transformQuery is the canonical query of a normalised transform, its
+// parameters sorted by name and the unset ones left out
+func transformQuery(t store.Transform) url.Values {
+	q := url.Values{}
+	set := func(name string, v string) {
+		if v != "" && v != "0" {
+			q.Set(name, v)
+		}
+	}
+	set(paramWidth, strconv.Itoa(t.Width))
+	set(paramHeight, strconv.Itoa(t.Height))
+	set(paramFit, t.Fit)
+	set(paramGravity, t.Gravity)
+	set(paramQuality, strconv.Itoa(t.Quality))
+	set(paramFormat, t.Format)
+	return q
+}
+
+// signTransform returns the signature of a transform of the image id
+func signTransform(id string, t store.Transform) string {
+	mac := hmac.New(sha256.New, signingKey)
+	mac.Write([]byte(id + "?" + transformQuery(t).Encode()))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:signatureBytes])
+}
+
+// validSignature reports whether sig is the signature of a transform
+func validSignature(id string, t store.Transform, sig string) bool {
+	return hmac.Equal([]byte(sig), []byte(signTransform(id, t)))
+}
+
+// transformKey names a transform in the cache, it doesn't depend on the key
+// so the cache outlives a change of key
+func transformKey(id string, t store.Transform) string {
+	sum := sha256.Sum256([]byte(id + "?" + transformQuery(t).Encode()))
+	return hex.EncodeToString(sum[:])
+}
+
+// TransformURL returns the signed URL of a transform of the image id, params
+// are name=value pairs as ParseTransform reads them, e.g. "w=300" "h=300"
+// "fit=cover". Templates call it as imageURL
+func TransformURL(id string, params ...string) (string, error) {
+	query := url.Values{}
+	for _, p := range params {
+		name, value, ok := strings.Cut(p, "=")
+		if !ok {
+			return "", fmt.Errorf("%w: %q is not name=value", ErrInvalidTransform, p)
+		}
+		query.Add(name, value)
+	}
+
+	t, err := ParseTransform(query)
+	if err != nil {
+		return "", err
+	}
+
+	q := transformQuery(t)
+	q.Set(paramSignature, signTransform(id, t))
+	return "/img/" + url.PathEscape(id) + "?" + q.Encode(), nil
+}
+
+// TransformImage returns the cached file of a signed transform of the image
+// id and its format, generating it first if needed
+func TransformImage(id string, t store.Transform, sig string) (string, string, error) {
+	if !validSignature(id, t, sig) {
+		return "", "", ErrBadSignature
+	}
+
+	meta := store.GetGuidImageMetadata(id)
+	if meta == nil {
+		return "", "", fmt.Errorf("no image found for %s", id)
+	}
+
+	// leaving the format out gets the varients', png for a gif
+	if t.Format == "" {
+		t.Format = VarientFormats(meta)[0]
+	}
+
+	// taken with the format filled in, so naming the default format shares
+	// the cached file
+	key := transformKey(id, t)
+	if p, ok := store.CachedTransform(id, key, t.Format); ok {
+		return p, t.Format, nil
+	}
+
+	p, err, _ := varientGroup.Do("transform:"+key, func() (any, error) {
+		if p, ok := store.CachedTransform(id, key, t.Format); ok {
+			return p, nil
+		}
+
+		img, release, err := decodeOriginal(context.Background(), meta)
+		if err != nil {
+			return "", err
+		}
+		defer release()
+
+		p, err := store.SaveTransform(id, key, img, t)
+		if err != nil {
+			return "", err
+		}
+		log.Printf("generated transform: %s", p)
+		return p, nil
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	return p.(string), t.Format, nil
+}
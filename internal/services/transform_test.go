@@ -0,0 +1,116 @@
+package services
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+)
+
+func TestParseTransform_Normalises(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		want  string
+	}{
+		{"width only", "w=300", "w=300"},
+		{"fit dropped without both sides", "w=300&fit=cover&g=top", "w=300"},
+		{"default fit", "w=300&h=200", "fit=contain&h=200&w=300"},
+		{"default gravity", "w=300&h=200&fit=cover", "fit=cover&g=center&h=200&w=300"},
+		{"gravity dropped without cover", "w=300&h=200&fit=fill&g=top", "fit=fill&h=200&w=300"},
+		{"names are case sensitive", "W=1", ""},
+		{"format alias", "f=JPG&q=080", "f=jpeg&q=80"},
+		{"cache buster ignored", "w=300&v=2&v=3", "w=300"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, _ := url.ParseQuery(tt.query)
+			tr, err := ParseTransform(query)
+			if tt.want == "" {
+				if !errors.Is(err, ErrInvalidTransform) {
+					t.Fatalf("Expected ErrInvalidTransform, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseTransform failed: %v", err)
+			}
+			if got := transformQuery(tr).Encode(); got != tt.want {
+				t.Errorf("Expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestParseTransform_Invalid(t *testing.T) {
+	for _, query := range []string{
+		"", "s=abc", "w=0", "w=-5", "w=99999", "w=abc", "w=1&w=2",
+		"q=101", "fit=squash&w=1&h=1", "g=middle&w=1&h=1", "f=gif", "v=1",
+	} {
+		values, _ := url.ParseQuery(query)
+		if _, err := ParseTransform(values); !errors.Is(err, ErrInvalidTransform) {
+			t.Errorf("Expected ErrInvalidTransform for %q, got %v", query, err)
+		}
+	}
+}
+
+func TestIsTransform(t *testing.T) {
+	for query, want := range map[string]bool{
+		"":          false,
+		"v=2":       false,
+		"W=300":     false,
+		"w=300":     true,
+		"f=webp":    true,
+		"s=abc":     true,
+		"v=2&h=100": true,
+	} {
+		values, _ := url.ParseQuery(query)
+		if got := IsTransform(values); got != want {
+			t.Errorf("Expected %v for %q, got %v", want, query, got)
+		}
+	}
+}
+
+func TestTransformURL_Signed(t *testing.T) {
+	SetSigningKey("test key")
+
+	u, err := TransformURL("some-uuid", "h=200", "w=300", "fit=cover")
+	if err != nil {
+		t.Fatalf("TransformURL failed: %v", err)
+	}
+	parsed, err := url.Parse(u)
+	if err != nil {
+		t.Fatalf("url.Parse failed: %v", err)
+	}
+	if parsed.Path != "/img/some-uuid" {
+		t.Errorf("Expected path /img/some-uuid, got %s", parsed.Path)
+	}
+
+	query := parsed.Query()
+	tr, err := ParseTransform(query)
+	if err != nil {
+		t.Fatalf("ParseTransform failed: %v", err)
+	}
+	if !validSignature("some-uuid", tr, query.Get("s")) {
+		t.Error("Expected the signature to verify")
+	}
+
+	// equivalent parameters carry the same signature
+	same, _ := ParseTransform(url.Values{"w": {"300"}, "h": {"200"}, "fit": {"cover"}, "g": {"center"}})
+	if !validSignature("some-uuid", same, query.Get("s")) {
+		t.Error("Expected the signature to verify for equivalent parameters")
+	}
+
+	bigger := tr
+	bigger.Width = 301
+	if validSignature("some-uuid", bigger, query.Get("s")) {
+		t.Error("Expected the signature to fail for other parameters")
+	}
+	if validSignature("other-uuid", tr, query.Get("s")) {
+		t.Error("Expected the signature to fail for another image")
+	}
+
+	SetSigningKey("another key")
+	if validSignature("some-uuid", tr, query.Get("s")) {
+		t.Error("Expected the signature to fail with another key")
+	}
+}
@@ -0,0 +1,268 @@
+package store
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// components of the BlurHash of an image, more across than down as most
+// images are landscape
+const (
+	blurHashX = 4
+	blurHashY = 3
+)
+
+// width the placeholders are computed from and rendered at, they are blurred
+// to a few components so more pixels add nothing
+const placeholderWidth = 32
+
+// Placeholder returns the BlurHash of img, https://blurha.sh, and its
+// dominant colour as #rrggbb, both stand in for the image while it loads
+func Placeholder(img image.Image) (string, string) {
+	b := img.Bounds()
+	if b.Empty() {
+		return "", ""
+	}
+	h := max(1, b.Dy()*placeholderWidth/b.Dx())
+	small := imaging.Resize(img, placeholderWidth, h, imaging.Box)
+
+	return encodeBlurHash(small, blurHashX, blurHashY), dominantColor(small)
+}
+
+const base83Chars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+func encodeBase83(sb *strings.Builder, v int, length int) {
+	divisor := 1
+	for i := 1; i < length; i++ {
+		divisor *= 83
+	}
+	for ; divisor > 0; divisor /= 83 {
+		sb.WriteByte(base83Chars[v/divisor%83])
+	}
+}
+
+func decodeBase83(s string) (int, error) {
+	v := 0
+	for i := 0; i < len(s); i++ {
+		digit := strings.IndexByte(base83Chars, s[i])
+		if digit < 0 {
+			return 0, fmt.Errorf("blurhash: invalid character %q", s[i])
+		}
+		v = v*83 + digit
+	}
+	return v, nil
+}
+
+func srgbToLinear(v uint8) float64 {
+	f := float64(v) / 255
+	if f <= 0.04045 {
+		return f / 12.92
+	}
+	return math.Pow((f+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(v float64) int {
+	v = max(0, min(1, v))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+// signPow raises the magnitude of v to exp, keeping its sign
+func signPow(v float64, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(v), exp), v)
+}
+
+// encodeBlurHash follows the reference encoder, cx by cy cosine components
+// of the image in linear light
+func encodeBlurHash(img *image.NRGBA, cx int, cy int) string {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+
+	factors := make([][3]float64, 0, cx*cy)
+	for j := 0; j < cy; j++ {
+		for i := 0; i < cx; i++ {
+			norm := 2.0
+			if i == 0 && j == 0 {
+				norm = 1
+			}
+
+			var f [3]float64
+			for y := 0; y < h; y++ {
+				for x := 0; x < w; x++ {
+					basis := math.Cos(math.Pi*float64(i*x)/float64(w)) * math.Cos(math.Pi*float64(j*y)/float64(h))
+					p := img.Pix[img.PixOffset(x, y):]
+					f[0] += basis * srgbToLinear(p[0])
+					f[1] += basis * srgbToLinear(p[1])
+					f[2] += basis * srgbToLinear(p[2])
+				}
+			}
+
+			scale := norm / float64(w*h)
+			factors = append(factors, [3]float64{f[0] * scale, f[1] * scale, f[2] * scale})
+		}
+	}
+
+	var sb strings.Builder
+	encodeBase83(&sb, (cx-1)+(cy-1)*9, 1)
+
+	maxValue := 1.0
+	if len(factors) > 1 {
+		var actual float64
+		for _, f := range factors[1:] {
+			actual = max(actual, math.Abs(f[0]), math.Abs(f[1]), math.Abs(f[2]))
+		}
+		quantised := int(max(0, min(82, math.Floor(actual*166-0.5))))
+		maxValue = float64(quantised+1) / 166
+		encodeBase83(&sb, quantised, 1)
+	} else {
+		encodeBase83(&sb, 0, 1)
+	}
+
+	dc := factors[0]
+	encodeBase83(&sb, linearToSRGB(dc[0])<<16+linearToSRGB(dc[1])<<8+linearToSRGB(dc[2]), 4)
+
+	for _, f := range factors[1:] {
+		quant := func(v float64) int {
+			return int(max(0, min(18, math.Floor(signPow(v/maxValue, 0.5)*9+9.5))))
+		}
+		encodeBase83(&sb, quant(f[0])*19*19+quant(f[1])*19+quant(f[2]), 2)
+	}
+
+	return sb.String()
+}
+
+// decodeBlurHash renders a BlurHash at w by h pixels
+func decodeBlurHash(hash string, w int, h int) (*image.NRGBA, error) {
+	if len(hash) < 6 {
+		return nil, fmt.Errorf("blurhash: too short")
+	}
+
+	flag, err := decodeBase83(hash[:1])
+	if err != nil {
+		return nil, err
+	}
+	cx, cy := flag%9+1, flag/9+1
+	if len(hash) != 4+2*cx*cy {
+		return nil, fmt.Errorf("blurhash: expected %d characters, got %d", 4+2*cx*cy, len(hash))
+	}
+
+	quantised, err := decodeBase83(hash[1:2])
+	if err != nil {
+		return nil, err
+	}
+	maxValue := float64(quantised+1) / 166
+
+	colors := make([][3]float64, cx*cy)
+	for i := range colors {
+		if i == 0 {
+			v, err := decodeBase83(hash[2:6])
+			if err != nil {
+				return nil, err
+			}
+			colors[0] = [3]float64{srgbToLinear(uint8(v >> 16)), srgbToLinear(uint8(v >> 8)), srgbToLinear(uint8(v))}
+			continue
+		}
+
+		v, err := decodeBase83(hash[4+2*i : 6+2*i])
+		if err != nil {
+			return nil, err
+		}
+		ac := func(q int) float64 {
+			return signPow(float64(q-9)/9, 2) * maxValue
+		}
+		colors[i] = [3]float64{ac(v / (19 * 19)), ac(v / 19 % 19), ac(v % 19)}
+	}
+
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var c [3]float64
+			for j := 0; j < cy; j++ {
+				for i := 0; i < cx; i++ {
+					basis := math.Cos(math.Pi*float64(x*i)/float64(w)) * math.Cos(math.Pi*float64(y*j)/float64(h))
+					f := colors[j*cx+i]
+					c[0] += f[0] * basis
+					c[1] += f[1] * basis
+					c[2] += f[2] * basis
+				}
+			}
+			img.SetNRGBA(x, y, color.NRGBA{
+				R: uint8(linearToSRGB(c[0])),
+				G: uint8(linearToSRGB(c[1])),
+				B: uint8(linearToSRGB(c[2])),
+				A: 255,
+			})
+		}
+	}
+
+	return img, nil
+}
+
+// PlaceholderURI renders a BlurHash as a tiny PNG data URI with the aspect
+// ratio of a width by height image, for use as a CSS background
+func PlaceholderURI(hash string, width int, height int) (string, error) {
+	if width <= 0 || height <= 0 {
+		return "", fmt.Errorf("blurhash: invalid size %dx%d", width, height)
+	}
+
+	// the browser scales it up smoothly, a few pixels are enough
+	w := placeholderWidth / 2
+	h := max(1, min(4*w, height*w/width))
+	img, err := decodeBlurHash(hash, w, h)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return "", err
+	}
+	return "data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// dominantColor returns the average of the most common of 4096 colour
+// buckets, ignoring transparent pixels, as #rrggbb
+func dominantColor(img *image.NRGBA) string {
+	type bucket struct {
+		n       int
+		r, g, b int
+	}
+	buckets := make(map[int]*bucket)
+
+	var best *bucket
+	for i := 0; i+3 < len(img.Pix); i += 4 {
+		p := img.Pix[i : i+4]
+		if p[3] < 128 {
+			continue
+		}
+
+		key := int(p[0]>>4)<<8 | int(p[1]>>4)<<4 | int(p[2]>>4)
+		bk, ok := buckets[key]
+		if !ok {
+			bk = &bucket{}
+			buckets[key] = bk
+		}
+		bk.n++
+		bk.r += int(p[0])
+		bk.g += int(p[1])
+		bk.b += int(p[2])
+
+		if best == nil || bk.n > best.n {
+			best = bk
+		}
+	}
+
+	if best == nil {
+		return ""
+	}
+	return fmt.Sprintf("#%02x%02x%02x", best.r/best.n, best.g/best.n, best.b/best.n)
+}
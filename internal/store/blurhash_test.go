@@ -0,0 +1,91 @@
+package store
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	"image/color"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+func TestPlaceholder_Solid(t *testing.T) {
+	hash, dominant := Placeholder(createTestImage(100, 50))
+
+	if len(hash) != 28 {
+		t.Fatalf("Expected a 28 character hash, got %q", hash)
+	}
+	if dominant != "#ff0000" {
+		t.Errorf("Expected dominant colour #ff0000, got %s", dominant)
+	}
+
+	img, err := decodeBlurHash(hash, 8, 4)
+	if err != nil {
+		t.Fatalf("decodeBlurHash failed: %v", err)
+	}
+	for i := 0; i < len(img.Pix); i += 4 {
+		if c := img.Pix[i : i+3]; c[0] < 235 || c[1] > 10 || c[2] > 10 {
+			t.Fatalf("Expected red, got %v", c)
+		}
+	}
+}
+
+func TestPlaceholder_Halves(t *testing.T) {
+	// blue on the left third, red on the rest
+	img := image.NewNRGBA(image.Rect(0, 0, 90, 30))
+	for y := 0; y < 30; y++ {
+		for x := 0; x < 90; x++ {
+			c := color.NRGBA{R: 255, A: 255}
+			if x < 30 {
+				c = color.NRGBA{B: 255, A: 255}
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+
+	hash, dominant := Placeholder(img)
+	if dominant != "#ff0000" {
+		t.Errorf("Expected dominant colour #ff0000, got %s", dominant)
+	}
+
+	out, err := decodeBlurHash(hash, 9, 3)
+	if err != nil {
+		t.Fatalf("decodeBlurHash failed: %v", err)
+	}
+	left, right := out.NRGBAAt(0, 1), out.NRGBAAt(8, 1)
+	if left.B <= left.R || right.R <= right.B {
+		t.Errorf("Expected blue on the left and red on the right, got %v and %v", left, right)
+	}
+}
+
+func TestPlaceholderURI(t *testing.T) {
+	hash, _ := Placeholder(createTestImage(100, 50))
+
+	uri, err := PlaceholderURI(hash, 100, 50)
+	if err != nil {
+		t.Fatalf("PlaceholderURI failed: %v", err)
+	}
+
+	data, ok := strings.CutPrefix(uri, "data:image/png;base64,")
+	if !ok {
+		t.Fatalf("Expected a png data URI, got %q", uri)
+	}
+	buf, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		t.Fatalf("DecodeString failed: %v", err)
+	}
+	cfg, err := png.DecodeConfig(bytes.NewReader(buf))
+	if err != nil {
+		t.Fatalf("DecodeConfig failed: %v", err)
+	}
+	if cfg.Width != 16 || cfg.Height != 8 {
+		t.Errorf("Expected 16x8, got %dx%d", cfg.Width, cfg.Height)
+	}
+
+	for _, bad := range []string{"", "L00000", hash[:27], "!" + hash[1:]} {
+		if _, err := PlaceholderURI(bad, 100, 50); err == nil {
+			t.Errorf("Expected an error for %q", bad)
+		}
+	}
+}
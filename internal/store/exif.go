@@ -0,0 +1,226 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// EXIF tags this package acts on
+const (
+	tagMake             = 0x010f
+	tagModel            = 0x0110
+	tagOrientation      = 0x0112
+	tagExifIFD          = 0x8769
+	tagGPSIFD           = 0x8825
+	tagInteropIFD       = 0xa005
+	tagDateTimeOriginal = 0x9003
+)
+
+// names of the tags most worth knowing were removed, the rest are logged by number
+var exifTagNames = map[uint16]string{
+	0x010e: "ImageDescription",
+	0x011a: "XResolution",
+	0x011b: "YResolution",
+	0x0128: "ResolutionUnit",
+	0x0131: "Software",
+	0x0132: "DateTime",
+	0x013b: "Artist",
+	0x013c: "HostComputer",
+	0x0213: "YCbCrPositioning",
+	0x8298: "Copyright",
+	0x829a: "ExposureTime",
+	0x829d: "FNumber",
+	0x8822: "ExposureProgram",
+	0x8827: "ISOSpeedRatings",
+	0x9000: "ExifVersion",
+	0x9004: "DateTimeDigitized",
+	0x9010: "OffsetTime",
+	0x9011: "OffsetTimeOriginal",
+	0x9012: "OffsetTimeDigitized",
+	0x9201: "ShutterSpeedValue",
+	0x9202: "ApertureValue",
+	0x9204: "ExposureBiasValue",
+	0x9207: "MeteringMode",
+	0x9209: "Flash",
+	0x920a: "FocalLength",
+	0x927c: "MakerNote",
+	0x9286: "UserComment",
+	0x9290: "SubSecTime",
+	0x9291: "SubSecTimeOriginal",
+	0x9292: "SubSecTimeDigitized",
+	0xa000: "FlashpixVersion",
+	0xa001: "ColorSpace",
+	0xa002: "PixelXDimension",
+	0xa003: "PixelYDimension",
+	0xa402: "ExposureMode",
+	0xa403: "WhiteBalance",
+	0xa405: "FocalLengthIn35mmFilm",
+	0xa406: "SceneCaptureType",
+	0xa420: "ImageUniqueID",
+	0xa430: "CameraOwnerName",
+	0xa431: "BodySerialNumber",
+	0xa432: "LensSpecification",
+	0xa433: "LensMake",
+	0xa434: "LensModel",
+	0xa435: "LensSerialNumber",
+}
+
+var gpsTagNames = map[uint16]string{
+	0x00: "GPSVersionID",
+	0x01: "GPSLatitudeRef",
+	0x02: "GPSLatitude",
+	0x03: "GPSLongitudeRef",
+	0x04: "GPSLongitude",
+	0x05: "GPSAltitudeRef",
+	0x06: "GPSAltitude",
+	0x07: "GPSTimeStamp",
+	0x0c: "GPSSpeedRef",
+	0x0d: "GPSSpeed",
+	0x10: "GPSImgDirectionRef",
+	0x11: "GPSImgDirection",
+	0x12: "GPSMapDatum",
+	0x1b: "GPSProcessingMethod",
+	0x1d: "GPSDateStamp",
+}
+
+// byte size of one value of each TIFF field type
+var tiffTypeSizes = [...]int{0, 1, 1, 2, 4, 8, 1, 1, 2, 4, 8, 4, 8}
+
+// the most IFDs and entries read, real files have a handful of each
+const (
+	maxIFDs       = 16
+	maxIFDEntries = 512
+)
+
+type exifReader struct {
+	data    []byte
+	order   binary.ByteOrder
+	m       *Metadata
+	visited map[uint32]bool
+}
+
+// readExif reads a TIFF structure of EXIF tags, the payload of an APP1
+// segment after its header or of a PNG or WebP EXIF chunk
+func readExif(data []byte, m *Metadata) {
+	// some writers keep the JPEG header in PNG and WebP chunks
+	data = bytes.TrimPrefix(data, exifHeader)
+	if len(data) < 8 {
+		return
+	}
+
+	r := &exifReader{data: data, m: m, visited: make(map[uint32]bool)}
+	switch string(data[:2]) {
+	case "II":
+		r.order = binary.LittleEndian
+	case "MM":
+		r.order = binary.BigEndian
+	default:
+		return
+	}
+	if r.order.Uint16(data[2:]) != 42 {
+		return
+	}
+
+	next := r.readIFD(r.order.Uint32(data[4:]), "")
+	if next != 0 {
+		// IFD1 only holds a thumbnail, dropped whole
+		m.remove("EXIF:Thumbnail")
+	}
+}
+
+// readIFD reads the entries of the IFD at off, ifd is "" for IFD0, "Exif",
+// "GPS" or "Interop", and returns the offset of the next IFD
+func (r *exifReader) readIFD(off uint32, ifd string) uint32 {
+	if r.visited[off] || len(r.visited) >= maxIFDs || int64(off)+2 > int64(len(r.data)) {
+		return 0
+	}
+	r.visited[off] = true
+
+	n := int(r.order.Uint16(r.data[off:]))
+	if n > maxIFDEntries {
+		return 0
+	}
+	start := int(off) + 2
+	for i := 0; i < n; i++ {
+		e := start + 12*i
+		if e+12 > len(r.data) {
+			return 0
+		}
+		r.readEntry(r.data[e:e+12], ifd)
+	}
+
+	if end := start + 12*n; end+4 <= len(r.data) {
+		return r.order.Uint32(r.data[end:])
+	}
+	return 0
+}
+
+func (r *exifReader) readEntry(entry []byte, ifd string) {
+	tag := r.order.Uint16(entry)
+	typ := int(r.order.Uint16(entry[2:]))
+	count := int64(r.order.Uint32(entry[4:]))
+
+	value := r.value(entry, typ, count)
+	switch {
+	case ifd == "" && tag == tagOrientation && len(value) >= 2:
+		if o := int(r.order.Uint16(value)); o >= 1 && o <= 8 {
+			r.m.Orientation = o
+		}
+	case ifd == "" && tag == tagMake:
+		r.m.CameraMake = exifString(value)
+	case ifd == "" && tag == tagModel:
+		r.m.CameraModel = exifString(value)
+	case ifd == "Exif" && tag == tagDateTimeOriginal:
+		if t, err := time.Parse("2006:01:02 15:04:05", exifString(value)); err == nil {
+			r.m.TakenAt = &t
+		}
+	case tag == tagExifIFD && len(value) >= 4:
+		r.readIFD(r.order.Uint32(value), "Exif")
+	case tag == tagGPSIFD && len(value) >= 4:
+		r.readIFD(r.order.Uint32(value), "GPS")
+	case tag == tagInteropIFD && len(value) >= 4:
+		r.readIFD(r.order.Uint32(value), "Interop")
+	default:
+		r.m.remove("EXIF:" + exifTagName(tag, ifd))
+	}
+}
+
+// value returns the bytes of an entry's value, stored in the entry itself
+// when it fits in 4 bytes, nil when it is out of bounds
+func (r *exifReader) value(entry []byte, typ int, count int64) []byte {
+	if typ <= 0 || typ >= len(tiffTypeSizes) {
+		return nil
+	}
+	size := int64(tiffTypeSizes[typ]) * count
+	if size <= 4 {
+		return entry[8 : 8+size]
+	}
+	off := int64(r.order.Uint32(entry[8:]))
+	if off+size > int64(len(r.data)) {
+		return nil
+	}
+	return r.data[off : off+size]
+}
+
+func exifTagName(tag uint16, ifd string) string {
+	names := exifTagNames
+	if ifd == "GPS" {
+		names = gpsTagNames
+	}
+	if name, ok := names[tag]; ok {
+		return name
+	}
+	if ifd == "GPS" {
+		return fmt.Sprintf("GPS0x%04x", tag)
+	}
+	return fmt.Sprintf("0x%04x", tag)
+}
+
+// exifString returns an ASCII value without its terminator and padding
+func exifString(value []byte) string {
+	s, _, _ := strings.Cut(string(value), "\x00")
+	return strings.TrimSpace(printable(s))
+}
@@ -0,0 +1,168 @@
+package store
+
+import (
+	"context"
+	"go-image-web/internal/models"
+	"log"
+)
+
+// ExtensionFix is a stored file whose extension did not match its contents
+type ExtensionFix struct {
+	UUID    string
+	OldPath string
+	NewPath string
+	Format  string
+}
+
+// FixExtensions renames originals and varients stored under the extension of
+// a format they are not in, such as the jpegs once written for webp uploads,
+// updating the database and index to match. With dryRun it only reports them
+func FixExtensions(ctx context.Context, dryRun bool) ([]ExtensionFix, error) {
+	ImageIndexMu.RLock()
+	metas := make([]*models.ImageMetadata, 0, len(ImageIndex))
+	for _, meta := range ImageIndex {
+		metas = append(metas, meta)
+	}
+	ImageIndexMu.RUnlock()
+
+	var fixes []ExtensionFix
+	for _, meta := range metas {
+		fix, err := fixOriginalExtension(ctx, meta, dryRun)
+		if err != nil {
+			return fixes, err
+		}
+		if fix != nil {
+			fixes = append(fixes, *fix)
+		}
+
+		meta.VarientsMu.RLock()
+		vs := make([]models.ImageVarient, 0, len(meta.Varients))
+		for _, v := range meta.Varients {
+			vs = append(vs, v)
+		}
+		meta.VarientsMu.RUnlock()
+
+		for _, v := range vs {
+			fix, err := fixVarientExtension(ctx, meta, v, dryRun)
+			if err != nil {
+				return fixes, err
+			}
+			if fix != nil {
+				fixes = append(fixes, *fix)
+			}
+		}
+	}
+
+	return fixes, nil
+}
+
+func fixOriginalExtension(ctx context.Context, meta *models.ImageMetadata, dryRun bool) (*ExtensionFix, error) {
+	format, ok := mislabelled(meta.OriginalPath, meta.OriginalExt)
+	if !ok {
+		return nil, nil
+	}
+
+	fix := &ExtensionFix{
+		UUID:    meta.UUID,
+		OldPath: meta.OriginalPath,
+		NewPath: OriginalKey(meta.UUID, format),
+		Format:  format,
+	}
+	if dryRun {
+		return fix, nil
+	}
+
+	if err := copyObject(ctx, fix.OldPath, fix.NewPath); err != nil {
+		return nil, err
+	}
+
+	ImageIndexMu.Lock()
+	meta.OriginalExt = format
+	meta.OriginalPath = fix.NewPath
+	ImageIndexMu.Unlock()
+
+	if imageRepo != nil {
+		if err := imageRepo.UpdateImage(meta); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := Backend.Delete(ctx, fix.OldPath); err != nil {
+		log.Print(err)
+	}
+
+	return fix, nil
+}
+
+func fixVarientExtension(ctx context.Context, meta *models.ImageMetadata, v models.ImageVarient, dryRun bool) (*ExtensionFix, error) {
+	format, ok := mislabelled(v.Path, v.Ext)
+	if !ok {
+		return nil, nil
+	}
+
+	fixed := v
+	fixed.Ext = format
+	fixed.Path = VarientKey(meta.UUID, v.Width, format)
+
+	fix := &ExtensionFix{UUID: meta.UUID, OldPath: v.Path, NewPath: fixed.Path, Format: format}
+	if dryRun {
+		return fix, nil
+	}
+
+	// a correctly labelled copy already exists, the mislabelled one is spare
+	if _, ok := meta.GetVariant(fixed.Width, fixed.Ext); ok {
+		untrackVarient(v.Path)
+		return fix, deleteVarient(meta.UUID, v)
+	}
+
+	if err := copyObject(ctx, v.Path, fixed.Path); err != nil {
+		return nil, err
+	}
+
+	if imageRepo != nil {
+		if err := imageRepo.InsertVarient(meta.UUID, &fixed); err != nil {
+			return nil, err
+		}
+		if err := imageRepo.DeleteVarient(meta.UUID, v.Width, v.Ext); err != nil {
+			return nil, err
+		}
+	}
+
+	meta.RemoveVariant(v.Width, v.Ext)
+	untrackVarient(v.Path)
+	addVarient(meta.UUID, &fixed)
+
+	if err := Backend.Delete(ctx, v.Path); err != nil {
+		log.Print(err)
+	}
+
+	return fix, nil
+}
+
+// mislabelled returns the format of the stored file at key when it is not ext
+func mislabelled(key string, ext string) (string, bool) {
+	_, format, err := decodeStoredConfig(key)
+	if err != nil {
+		log.Printf("failed to read %s: %v", key, err)
+		return "", false
+	}
+	return format, normalizeFormat(format) != normalizeFormat(ext)
+}
+
+func normalizeFormat(format string) string {
+	if format == "jpg" {
+		return "jpeg"
+	}
+	return format
+}
+
+// copyObject copies a stored file to a new key, leaving the old one in place
+func copyObject(ctx context.Context, from string, to string) error {
+	rc, info, err := Backend.Get(ctx, from)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	return Backend.Put(ctx, to, rc, info.Size)
+}
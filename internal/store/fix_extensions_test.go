@@ -0,0 +1,100 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"go-image-web/internal/models"
+	"image/jpeg"
+	"io/fs"
+	"testing"
+)
+
+// saveMislabelled stores a jpeg original and varient under webp names, as
+// uploads in webp used to be
+func saveMislabelled(t *testing.T, uuid string) *models.ImageMetadata {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, createTestImage(20, 20), nil); err != nil {
+		t.Fatalf("jpeg.Encode failed: %v", err)
+	}
+
+	meta := &models.ImageMetadata{UUID: uuid, OriginalExt: "webp", OriginalWidth: 20, OriginalHeight: 20}
+	if err := saveOriginal(meta, buf.Bytes()); err != nil {
+		t.Fatalf("saveOriginal failed: %v", err)
+	}
+	if err := saveVarient(uuid, 10, "webp", buf.Bytes()); err != nil {
+		t.Fatalf("saveVarient failed: %v", err)
+	}
+	return meta
+}
+
+func TestFixExtensions_DryRun(t *testing.T) {
+	cleanup := setupTestDirs(t)
+	defer cleanup()
+	resetVarientCache()
+
+	uuid := "test-uuid-dry"
+	saveMislabelled(t, uuid)
+
+	fixes, err := FixExtensions(context.Background(), true)
+	if err != nil {
+		t.Fatalf("FixExtensions failed: %v", err)
+	}
+	if len(fixes) != 2 {
+		t.Fatalf("Expected 2 fixes, got %d", len(fixes))
+	}
+
+	if _, err := Backend.Stat(context.Background(), OriginalKey(uuid, "webp")); err != nil {
+		t.Errorf("Dry run moved the original: %v", err)
+	}
+	if meta := GetGuidImageMetadata(uuid); meta.OriginalExt != "webp" {
+		t.Errorf("Dry run changed the extension to %s", meta.OriginalExt)
+	}
+}
+
+func TestFixExtensions_Renames(t *testing.T) {
+	cleanup := setupTestDirs(t)
+	defer cleanup()
+	resetVarientCache()
+
+	uuid := "test-uuid-fix"
+	saveMislabelled(t, uuid)
+
+	// correctly labelled files are left alone
+	if err := SaveOriginalImage(createTestImage(20, 20), &models.ImageMetadata{UUID: "test-uuid-ok", OriginalExt: "png", OriginalWidth: 20, OriginalHeight: 20}); err != nil {
+		t.Fatalf("SaveOriginalImage failed: %v", err)
+	}
+
+	fixes, err := FixExtensions(context.Background(), false)
+	if err != nil {
+		t.Fatalf("FixExtensions failed: %v", err)
+	}
+	if len(fixes) != 2 {
+		t.Fatalf("Expected 2 fixes, got %d", len(fixes))
+	}
+
+	ctx := context.Background()
+	for _, key := range []string{OriginalKey(uuid, "webp"), VarientKey(uuid, 10, "webp")} {
+		if _, err := Backend.Stat(ctx, key); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("Expected %s to be removed, got %v", key, err)
+		}
+	}
+	for _, key := range []string{OriginalKey(uuid, "jpeg"), VarientKey(uuid, 10, "jpeg")} {
+		if _, err := Backend.Stat(ctx, key); err != nil {
+			t.Errorf("Expected %s to exist: %v", key, err)
+		}
+	}
+
+	meta := GetGuidImageMetadata(uuid)
+	if meta.OriginalExt != "jpeg" || meta.OriginalPath != OriginalKey(uuid, "jpeg") {
+		t.Errorf("Unexpected original: %s at %s", meta.OriginalExt, meta.OriginalPath)
+	}
+	if _, ok := meta.GetVariant(10, "webp"); ok {
+		t.Error("Expected the webp varient to be gone")
+	}
+	if v, ok := meta.GetVariant(10, "jpeg"); !ok || v.Path != VarientKey(uuid, 10, "jpeg") {
+		t.Errorf("Expected a jpeg varient, got %+v", v)
+	}
+}
@@ -0,0 +1,35 @@
+package store
+
+import (
+	"context"
+	"go-image-web/internal/models"
+)
+
+// prefix of the storage keys corrupt files are moved under, out of sight of
+// CheckConsistency and GC
+const QuarantinePrefix = "quarantine"
+
+// Quarantine moves a stored file under QuarantinePrefix so it is kept for
+// inspection but never served, returning its new key
+func Quarantine(ctx context.Context, key string) (string, error) {
+	to := QuarantinePrefix + "/" + key
+	if err := copyObject(ctx, key, to); err != nil {
+		return "", err
+	}
+	return to, Backend.Delete(ctx, key)
+}
+
+// RemoveVarient forgets a varient in the index, database and varient cache
+// and deletes its file if still stored
+func RemoveVarient(uuid string, v models.ImageVarient) error {
+	untrackVarient(v.Path)
+	return deleteVarient(uuid, v)
+}
+
+// PostImages returns the id and image uuid of every post with an image
+func PostImages() ([]*models.PostModel, error) {
+	if imageRepo == nil {
+		return nil, nil
+	}
+	return imageRepo.SelectPostImages()
+}
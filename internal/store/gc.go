@@ -0,0 +1,253 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// kinds of garbage GC collects
+const (
+	// a recorded image no post references
+	GarbageImage string = "unreferenced_image"
+	// a stored original or varient no image records, such as a partial write
+	GarbageFile string = "orphan_file"
+	// an upload left in the temp directory by a crash
+	GarbageTmpFile string = "tmp_file"
+	// cached transforms of an image that is gone
+	GarbageTransforms string = "orphan_transforms"
+	// a post whose image is missing from storage, it loses the image when
+	// detaching
+	GarbagePost string = "broken_post"
+)
+
+// ErrStorageEmpty is returned by GC when storage holds no originals while
+// images are recorded, as with a wrong or unmounted storage directory
+var ErrStorageEmpty = errors.New("gc: no originals in storage but images are recorded, check the storage settings")
+
+// Garbage is something GC found to remove
+type Garbage struct {
+	Kind   string
+	UUID   string
+	Path   string
+	PostID int
+}
+
+func (g Garbage) String() string {
+	if g.Kind == GarbagePost {
+		return fmt.Sprintf("%s: post=%d uuid=%q", g.Kind, g.PostID, g.UUID)
+	}
+	return fmt.Sprintf("%s: uuid=%q path=%q", g.Kind, g.UUID, g.Path)
+}
+
+// GC finds images no post references, stored files no image records, stale
+// temp files and posts whose image is missing, leaving anything newer than
+// grace alone as it may still be in use by an upload. Unless dryRun, it
+// removes what it finds. Posts are only reported unless detach, then they
+// are detached from their image once it has been missing for grace
+func GC(ctx context.Context, grace time.Duration, dryRun bool, detach bool) ([]Garbage, error) {
+	cutoff := time.Now().Add(-grace)
+
+	// storage that lost everything is more likely misconfigured than emptied
+	originals, err := listKeys(OriginalPrefix + "/")
+	if err != nil {
+		return nil, err
+	}
+	ImageIndexMu.RLock()
+	indexed := len(ImageIndex)
+	ImageIndexMu.RUnlock()
+	if len(originals) == 0 && indexed > 0 {
+		return nil, ErrStorageEmpty
+	}
+
+	problems, err := CheckConsistency()
+	if err != nil {
+		return nil, err
+	}
+
+	var found []Garbage
+
+	// images to delete, by uuid
+	images := make(map[string]string)
+
+	if imageRepo != nil {
+		// grace runs from when an original was first seen missing, not from
+		// its upload
+		var missing []string
+		for _, p := range problems {
+			if p.Kind == MissingOriginal {
+				missing = append(missing, p.UUID)
+			}
+		}
+		since, err := imageRepo.MarkImagesMissing(missing)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, p := range problems {
+			if p.Kind != MissingOriginal {
+				continue
+			}
+			if t, ok := since[p.UUID]; !ok || !t.Before(cutoff) {
+				continue
+			}
+
+			ids, err := imageRepo.SelectImagePosts(p.UUID)
+			if err != nil {
+				return found, err
+			}
+			for _, id := range ids {
+				found = append(found, Garbage{Kind: GarbagePost, UUID: p.UUID, PostID: id})
+			}
+			if !detach {
+				continue
+			}
+			if !dryRun && len(ids) > 0 {
+				if err := imageRepo.DetachImage(p.UUID); err != nil {
+					return found, err
+				}
+			}
+
+			// with its posts detached nothing references it
+			images[p.UUID] = p.Path
+		}
+
+		unreferenced, err := imageRepo.SelectUnreferencedImages()
+		if err != nil {
+			return found, err
+		}
+		for _, meta := range unreferenced {
+			if meta.ModifiedTime.Before(cutoff) {
+				images[meta.UUID] = meta.OriginalPath
+			}
+		}
+	}
+
+	for uuid, key := range images {
+		// a post may have taken it since it was listed
+		if !dryRun {
+			deleted, err := releaseImageRecord(uuid)
+			if err != nil {
+				return found, err
+			}
+			if !deleted {
+				continue
+			}
+		}
+		found = append(found, Garbage{Kind: GarbageImage, UUID: uuid, Path: key})
+	}
+
+	for _, p := range problems {
+		if p.Kind != ExtraFile || !p.ModTime.Before(cutoff) {
+			continue
+		}
+		found = append(found, Garbage{Kind: GarbageFile, UUID: p.UUID, Path: p.Path})
+		if !dryRun {
+			if err := Backend.Delete(ctx, p.Path); err != nil {
+				return found, err
+			}
+		}
+	}
+
+	tmp, err := staleEntries(TmpImageDir, cutoff, func(name string) bool { return true })
+	if err != nil {
+		return found, err
+	}
+	for _, p := range tmp {
+		found = append(found, Garbage{Kind: GarbageTmpFile, UUID: filepath.Base(p), Path: p})
+	}
+
+	transforms, err := staleEntries(TransformCacheDir, cutoff, func(name string) bool {
+		return GetGuidImageMetadata(name) == nil
+	})
+	if err != nil {
+		return found, err
+	}
+	for _, p := range transforms {
+		found = append(found, Garbage{Kind: GarbageTransforms, UUID: filepath.Base(p), Path: p})
+	}
+
+	if !dryRun {
+		for _, p := range append(tmp, transforms...) {
+			if err := os.RemoveAll(p); err != nil {
+				return found, err
+			}
+		}
+	}
+
+	return found, nil
+}
+
+// releaseImageRecord deletes an unreferenced image, including placeholder
+// rows never imported into the index
+func releaseImageRecord(uuid string) (bool, error) {
+	if GetGuidImageMetadata(uuid) != nil {
+		return ReleaseImage(uuid)
+	}
+	return imageRepo.DeleteUnreferencedImage(uuid)
+}
+
+// staleEntries returns the entries of a local directory last modified
+// before cutoff whose names match
+func staleEntries(dir string, cutoff time.Time, match func(name string) bool) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var stale []string
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		if info.ModTime().Before(cutoff) && match(e.Name()) {
+			stale = append(stale, filepath.Join(dir, e.Name()))
+		}
+	}
+	return stale, nil
+}
+
+// RunGC collects garbage straight away and then every interval until ctx is
+// done, logging what it removed. Posts whose image is missing are only
+// logged, the gc command detaches them
+func RunGC(ctx context.Context, interval time.Duration, grace time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		found, err := GC(ctx, grace, false, false)
+		var removed, broken int
+		for _, g := range found {
+			if g.Kind == GarbagePost {
+				broken++
+				log.Printf("gc: %s, left for the gc command", g)
+				continue
+			}
+			removed++
+			log.Printf("gc: %s", g)
+		}
+		if err != nil {
+			log.Printf("gc: %v", err)
+		}
+		if removed > 0 {
+			log.Printf("gc: removed %d items", removed)
+		}
+		if broken > 0 {
+			log.Printf("gc: %d posts have a missing image, run gc to detach them", broken)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"go-image-web/internal/db"
+	"go-image-web/internal/models"
+	"go-image-web/internal/repo"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// putAged stores a file at key last modified age ago
+func putAged(t *testing.T, root string, key string, age time.Duration) {
+	t.Helper()
+
+	if err := Backend.Put(context.Background(), key, bytes.NewReader([]byte("x")), 1); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	old := time.Now().Add(-age)
+	if err := os.Chtimes(filepath.Join(root, filepath.FromSlash(key)), old, old); err != nil {
+		t.Fatalf("Chtimes failed: %v", err)
+	}
+}
+
+func TestGC(t *testing.T) {
+	cleanup := setupTestDirs(t)
+	defer cleanup()
+
+	root := t.TempDir()
+	Backend = NewLocalStorage(root)
+	TmpImageDir = filepath.Join(root, "tmp")
+	origCache := TransformCacheDir
+	defer func() { TransformCacheDir = origCache }()
+	ConfigureTransformCache(filepath.Join(root, "cache"))
+
+	// a recorded image and its varient are kept however old
+	meta := &models.ImageMetadata{UUID: "kept", OriginalExt: "png", OriginalPath: OriginalKey("kept", "png")}
+	meta.SetVariant(models.ImageVarient{Width: 600, Ext: "png", Path: VarientKey("kept", 600, "png")})
+	AddImageMetadata(meta)
+	putAged(t, root, meta.OriginalPath, 48*time.Hour)
+	putAged(t, root, VarientKey("kept", 600, "png"), 48*time.Hour)
+
+	// varients of an image that is gone, one too new to touch
+	putAged(t, root, VarientKey("gone", 600, "png"), 48*time.Hour)
+	putAged(t, root, VarientKey("uploading", 600, "png"), time.Minute)
+
+	os.MkdirAll(TmpImageDir, os.ModePerm)
+	stale := filepath.Join(TmpImageDir, "crashed")
+	os.WriteFile(stale, []byte("x"), 0o644)
+	old := time.Now().Add(-48 * time.Hour)
+	os.Chtimes(stale, old, old)
+	os.WriteFile(filepath.Join(TmpImageDir, "in-progress"), []byte("x"), 0o644)
+
+	for _, uuid := range []string{"kept", "gone"} {
+		dir := filepath.Join(TransformCacheDir, uuid)
+		os.MkdirAll(dir, os.ModePerm)
+		os.Chtimes(dir, old, old)
+	}
+
+	want := []string{
+		"orphan_file: uuid=\"gone\" path=\"varient/gone_600.png\"",
+		"tmp_file: uuid=\"crashed\" path=\"" + stale + "\"",
+		"orphan_transforms: uuid=\"gone\" path=\"" + filepath.Join(TransformCacheDir, "gone") + "\"",
+	}
+
+	for _, dryRun := range []bool{true, false} {
+		found, err := GC(context.Background(), time.Hour, dryRun, true)
+		if err != nil {
+			t.Fatalf("GC failed: %v", err)
+		}
+		var got []string
+		for _, g := range found {
+			got = append(got, g.String())
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("dry run %v: expected %q, got %q", dryRun, want, got)
+		}
+	}
+
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Error("Expected the stale temp file to be removed")
+	}
+	if _, err := os.Stat(filepath.Join(TransformCacheDir, "gone")); !os.IsNotExist(err) {
+		t.Error("Expected the orphaned transforms to be removed")
+	}
+	for _, key := range []string{meta.OriginalPath, VarientKey("kept", 600, "png"), VarientKey("uploading", 600, "png")} {
+		if _, err := Backend.Stat(context.Background(), key); err != nil {
+			t.Errorf("Expected %s to be kept, got %v", key, err)
+		}
+	}
+	if _, err := Backend.Stat(context.Background(), VarientKey("gone", 600, "png")); err == nil {
+		t.Error("Expected the orphaned varient to be removed")
+	}
+
+	// nothing left the second time round
+	found, err := GC(context.Background(), time.Hour, false, true)
+	if err != nil || len(found) != 0 {
+		t.Errorf("Expected nothing left, got %v, %v", found, err)
+	}
+}
+
+// setupTestDB records images in a migrated database in a temp dir
+func setupTestDB(t *testing.T) *sqlx.DB {
+	t.Helper()
+
+	xdb, err := sqlx.Open("sqlite3", filepath.Join(t.TempDir(), "storage.db")+"?_foreign_keys=on&_busy_timeout=5000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { xdb.Close() })
+
+	// migrations are found from the root of the module
+	t.Chdir("../..")
+	if err := db.EnsureSchema(xdb); err != nil {
+		t.Fatalf("EnsureSchema failed: %v", err)
+	}
+	SetImageRepo(repo.NewImageRepo(xdb))
+	t.Cleanup(func() { SetImageRepo(nil) })
+	return xdb
+}
+
+func TestGC_MissingOriginals(t *testing.T) {
+	cleanup := setupTestDirs(t)
+	defer cleanup()
+	xdb := setupTestDB(t)
+	ctx := context.Background()
+
+	posts := repo.NewRepo(xdb)
+	for _, uuid := range []string{"kept", "lost"} {
+		meta := &models.ImageMetadata{UUID: uuid, OriginalExt: "png", OriginalWidth: 10, OriginalHeight: 10}
+		if err := SaveOriginalImage(createTestImage(10, 10), meta); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := posts.InsertPost(&models.PostModel{Board: "b", ImageUUID: uuid}, nil, false, repo.ThreadLimits{Bump: 300, Images: 150}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// uploaded long ago, which says nothing about when a file went missing
+	xdb.MustExec("UPDATE images SET created_at = datetime('now', '-2 days')")
+	withImage := func() int {
+		t.Helper()
+		var n int
+		if err := xdb.Get(&n, "SELECT COUNT(*) FROM posts WHERE image_uuid IS NOT NULL"); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	// a wrong or unmounted storage directory
+	backend := Backend
+	Backend = NewLocalStorage(filepath.Join(t.TempDir(), "unmounted"))
+	if _, err := GC(ctx, time.Hour, false, true); !errors.Is(err, ErrStorageRootMissing) {
+		t.Errorf("Expected ErrStorageRootMissing, got %v", err)
+	}
+	Backend = NewLocalStorage(t.TempDir())
+	if _, err := GC(ctx, time.Hour, false, true); !errors.Is(err, ErrStorageEmpty) {
+		t.Errorf("Expected ErrStorageEmpty, got %v", err)
+	}
+	Backend = backend
+	if n := withImage(); n != 2 {
+		t.Fatalf("Expected both posts to keep their image, got %d", n)
+	}
+
+	if err := Backend.Delete(ctx, OriginalKey("lost", "png")); err != nil {
+		t.Fatal(err)
+	}
+
+	// missing since just now, however old the upload
+	for _, detach := range []bool{false, true} {
+		found, err := GC(ctx, time.Hour, false, detach)
+		if err != nil {
+			t.Fatalf("GC failed: %v", err)
+		}
+		if len(found) != 0 {
+			t.Errorf("Expected nothing collected within grace, got %v", found)
+		}
+	}
+
+	// the periodic run only reports
+	xdb.MustExec("UPDATE images SET missing_since = datetime('now', '-2 hours') WHERE uuid = 'lost'")
+	found, err := GC(ctx, time.Hour, false, false)
+	if err != nil {
+		t.Fatalf("GC failed: %v", err)
+	}
+	if len(found) != 1 || found[0].Kind != GarbagePost {
+		t.Errorf("Expected the broken post reported, got %v", found)
+	}
+	if n := withImage(); n != 2 {
+		t.Errorf("Expected the periodic run never to detach, got %d posts with an image", n)
+	}
+
+	found, err = GC(ctx, time.Hour, false, true)
+	if err != nil {
+		t.Fatalf("GC failed: %v", err)
+	}
+	if len(found) != 2 || found[0].Kind != GarbagePost || found[1].Kind != GarbageImage {
+		t.Errorf("Expected the post detached and the image removed, got %v", found)
+	}
+	if n := withImage(); n != 1 || GetGuidImageMetadata("lost") != nil {
+		t.Errorf("Expected only the lost image detached, got %d posts with an image", n)
+	}
+}
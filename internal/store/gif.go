@@ -0,0 +1,312 @@
+package store
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+
+	"github.com/disintegration/imaging"
+)
+
+// DecodeGIF decodes every frame of a GIF and returns it along with its first
+// frame as it is displayed, for thumbnails and hashing
+func DecodeGIF(buf []byte) (*gif.GIF, image.Image, error) {
+	g, err := gif.DecodeAll(bytes.NewReader(buf))
+	if err != nil {
+		return nil, nil, fmt.Errorf("decode gif: %w", err)
+	}
+
+	var first image.Image
+	err = compositeGIF(g, func(i int, canvas *image.RGBA) bool {
+		first = imaging.Clone(canvas)
+		return false
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return g, first, nil
+}
+
+// compositeGIF draws each frame over the ones before it on the full logical
+// screen, applying the disposal of the previous frame first, and calls fn
+// with the canvas as it is displayed until fn returns false. The canvas is
+// reused between calls
+func compositeGIF(g *gif.GIF, fn func(i int, canvas *image.RGBA) bool) error {
+	if len(g.Image) == 0 {
+		return fmt.Errorf("decode gif: no frames")
+	}
+
+	// some encoders leave the logical screen empty
+	bounds := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+	if bounds.Empty() {
+		for _, frame := range g.Image {
+			bounds = bounds.Union(frame.Bounds())
+		}
+	}
+
+	canvas := image.NewRGBA(bounds)
+	var previous *image.RGBA
+
+	for i, frame := range g.Image {
+		disposal := byte(gif.DisposalNone)
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+
+		// keep what was under the frame to restore it afterwards
+		if disposal == gif.DisposalPrevious {
+			if previous == nil {
+				previous = image.NewRGBA(bounds)
+			}
+			copy(previous.Pix, canvas.Pix)
+		}
+
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+
+		if !fn(i, canvas) {
+			return nil
+		}
+
+		switch disposal {
+		case gif.DisposalBackground:
+			// browsers clear to transparent rather than the background colour
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			copy(canvas.Pix, previous.Pix)
+		}
+	}
+
+	return nil
+}
+
+// SaveVarientGIF stores an animated varient wpx wide, narrower than the
+// original, keeping the aspect ratio, frame delays and loop count of the
+// original
+func SaveVarientGIF(uuid string, buf []byte, wpx int) error {
+	g, err := gif.DecodeAll(bytes.NewReader(buf))
+	if err != nil {
+		return fmt.Errorf("decode gif: %w", err)
+	}
+	if wpx >= g.Config.Width {
+		return fmt.Errorf("varient %s_%d.gif would not be smaller than the %dpx original", uuid, wpx, g.Config.Width)
+	}
+
+	out, err := resizeGIF(g, wpx)
+	if err != nil {
+		return err
+	}
+
+	var enc bytes.Buffer
+	if err := gif.EncodeAll(&enc, out); err != nil {
+		return err
+	}
+
+	return saveVarient(uuid, wpx, "gif", enc.Bytes())
+}
+
+// resizeGIF scales every displayed frame of g to wpx wide
+func resizeGIF(g *gif.GIF, wpx int) (*gif.GIF, error) {
+	out := &gif.GIF{
+		Delay:     make([]int, 0, len(g.Image)),
+		LoopCount: g.LoopCount,
+	}
+
+	err := compositeGIF(g, func(i int, canvas *image.RGBA) bool {
+		// height from the aspect ratio of the whole canvas, not the frame
+		b := canvas.Bounds()
+		hpx := max(1, (b.Dy()*wpx+b.Dx()/2)/b.Dx())
+
+		resized := ActiveVarientProfile().resize(canvas, wpx, hpx)
+
+		// nearest colour from the frame's own palette, dithering flickers
+		// between frames
+		paletted := image.NewPaletted(resized.Bounds(), gifPalette(g, i))
+		draw.Draw(paletted, paletted.Bounds(), resized, image.Point{}, draw.Src)
+
+		delay := 0
+		if i < len(g.Delay) {
+			delay = g.Delay[i]
+		}
+
+		out.Image = append(out.Image, paletted)
+		out.Delay = append(out.Delay, delay)
+		// frames are complete, clear each before drawing the next so
+		// transparent areas don't show the last one
+		out.Disposal = append(out.Disposal, gif.DisposalBackground)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	out.Config = image.Config{
+		Width:  out.Image[0].Bounds().Dx(),
+		Height: out.Image[0].Bounds().Dy(),
+	}
+
+	return out, nil
+}
+
+// gifPalette returns the palette of frame i, with a transparent entry so
+// areas no frame has drawn over stay transparent
+func gifPalette(g *gif.GIF, i int) color.Palette {
+	p := g.Image[i].Palette
+	if len(p) == 0 {
+		if global, ok := g.Config.ColorModel.(color.Palette); ok {
+			p = global
+		}
+	}
+
+	for _, c := range p {
+		if _, _, _, a := c.RGBA(); a == 0 {
+			return p
+		}
+	}
+
+	if len(p) < 256 {
+		return append(append(color.Palette{}, p...), color.Transparent)
+	}
+	// full palette, give up the last entry for transparency
+	return append(append(color.Palette{}, p[:255]...), color.Transparent)
+}
+
+// GIF application extensions that only control playback
+var gifPlaybackApps = map[string]bool{"NETSCAPE2.0": true, "ANIMEXTS1.0": true}
+
+// stripGIFMetadata returns buf without its comment and application
+// extensions, such as XMP, other than the loop count, and what was removed
+func stripGIFMetadata(buf []byte) ([]byte, []string, error) {
+	if len(buf) < 13 || !bytes.HasPrefix(buf, []byte("GIF8")) {
+		return nil, nil, fmt.Errorf("strip gif: not a gif")
+	}
+
+	// header, logical screen descriptor and global colour table
+	pos := 13
+	if flags := buf[10]; flags&0x80 != 0 {
+		pos += 3 << (flags&7 + 1)
+	}
+	if pos > len(buf) {
+		return nil, nil, fmt.Errorf("strip gif: truncated colour table")
+	}
+
+	out := append(make([]byte, 0, len(buf)), buf[:pos]...)
+	var removed []string
+	for pos < len(buf) {
+		start := pos
+		switch buf[pos] {
+		case 0x3b:
+			return append(out, 0x3b), removed, nil
+		case 0x2c:
+			if pos+10 > len(buf) {
+				return nil, nil, fmt.Errorf("strip gif: truncated image descriptor")
+			}
+			// descriptor, local colour table and LZW code size
+			pos += 10
+			if flags := buf[pos-1]; flags&0x80 != 0 {
+				pos += 3 << (flags&7 + 1)
+			}
+			pos++
+		case 0x21:
+			if pos+2 > len(buf) {
+				return nil, nil, fmt.Errorf("strip gif: truncated extension")
+			}
+			label := buf[pos+1]
+			pos += 2
+
+			name := ""
+			switch {
+			case label == 0xfe:
+				name = "GIF:Comment"
+			case label == 0xff && pos+12 <= len(buf) && buf[pos] == 11:
+				app := string(buf[pos+1 : pos+12])
+				switch {
+				case gifPlaybackApps[app]:
+				case app == "XMP DataXMP":
+					name = "XMP"
+				default:
+					name = "GIF:" + printable(app)
+				}
+			}
+			if name != "" {
+				end, err := skipGIFSubBlocks(buf, pos)
+				if err != nil {
+					return nil, nil, err
+				}
+				pos = end
+				removed = append(removed, name)
+				continue
+			}
+		default:
+			return nil, nil, fmt.Errorf("strip gif: unexpected block 0x%02x", buf[pos])
+		}
+
+		end, err := skipGIFSubBlocks(buf, pos)
+		if err != nil {
+			return nil, nil, err
+		}
+		pos = end
+		out = append(out, buf[start:pos]...)
+	}
+
+	// some encoders leave off the trailer
+	return append(out, 0x3b), removed, nil
+}
+
+// CountGIFFrames counts the frames of a GIF without decoding them, to size
+// a decode before committing to it
+func CountGIFFrames(buf []byte) (int, error) {
+	if len(buf) < 13 || !bytes.HasPrefix(buf, []byte("GIF8")) {
+		return 0, fmt.Errorf("count gif frames: not a gif")
+	}
+
+	pos := 13
+	if flags := buf[10]; flags&0x80 != 0 {
+		pos += 3 << (flags&7 + 1)
+	}
+
+	frames := 0
+	for pos < len(buf) {
+		switch buf[pos] {
+		case 0x3b:
+			return frames, nil
+		case 0x2c:
+			if pos+10 > len(buf) {
+				return 0, fmt.Errorf("count gif frames: truncated image descriptor")
+			}
+			pos += 10
+			if flags := buf[pos-1]; flags&0x80 != 0 {
+				pos += 3 << (flags&7 + 1)
+			}
+			pos++
+			frames++
+		case 0x21:
+			pos += 2
+		default:
+			return 0, fmt.Errorf("count gif frames: unexpected block 0x%02x", buf[pos])
+		}
+
+		end, err := skipGIFSubBlocks(buf, pos)
+		if err != nil {
+			return 0, err
+		}
+		pos = end
+	}
+
+	return frames, nil
+}
+
+// skipGIFSubBlocks returns the position after the data sub-blocks at pos
+func skipGIFSubBlocks(buf []byte, pos int) (int, error) {
+	for pos < len(buf) {
+		n := int(buf[pos])
+		pos += 1 + n
+		if n == 0 {
+			return pos, nil
+		}
+	}
+	return 0, fmt.Errorf("strip gif: truncated data")
+}
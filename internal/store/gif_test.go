@@ -0,0 +1,175 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"go-image-web/internal/models"
+	"image"
+	"image/color"
+	"image/gif"
+	"io"
+	"testing"
+)
+
+var (
+	testRed  = color.RGBA{R: 255, A: 255}
+	testBlue = color.RGBA{B: 255, A: 255}
+)
+
+// createTestGIF returns a 40x20 animation of a red background and a blue
+// square drawn over its top left corner by a smaller second frame
+func createTestGIF(t *testing.T) []byte {
+	t.Helper()
+
+	palette := color.Palette{testRed, testBlue}
+
+	bg := image.NewPaletted(image.Rect(0, 0, 40, 20), palette)
+	square := image.NewPaletted(image.Rect(0, 0, 10, 10), palette)
+	for i := range square.Pix {
+		square.Pix[i] = 1
+	}
+
+	g := &gif.GIF{
+		Image:     []*image.Paletted{bg, square},
+		Delay:     []int{7, 9},
+		Disposal:  []byte{gif.DisposalNone, gif.DisposalNone},
+		LoopCount: 3,
+		Config:    image.Config{Width: 40, Height: 20},
+	}
+
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		t.Fatalf("EncodeAll failed: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestSaveOriginalGIF_KeepsBytes(t *testing.T) {
+	cleanup := setupTestDirs(t)
+	defer cleanup()
+
+	buf := createTestGIF(t)
+	meta := &models.ImageMetadata{UUID: "test-uuid-gif", OriginalExt: "gif", OriginalWidth: 40, OriginalHeight: 20}
+	if err := SaveOriginalGIF(buf, meta); err != nil {
+		t.Fatalf("SaveOriginalGIF failed: %v", err)
+	}
+
+	rc, _, err := Backend.Get(context.Background(), meta.OriginalPath)
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	defer rc.Close()
+
+	stored, _ := io.ReadAll(rc)
+	if !bytes.Equal(stored, buf) {
+		t.Error("Expected the original GIF to be stored unchanged")
+	}
+}
+
+func TestSaveVarientGIF(t *testing.T) {
+	cleanup := setupTestDirs(t)
+	defer cleanup()
+
+	uuid := "test-uuid-gif"
+	AddImageMetadata(&models.ImageMetadata{UUID: uuid, OriginalExt: "gif"})
+
+	if err := SaveVarientGIF(uuid, createTestGIF(t), 20); err != nil {
+		t.Fatalf("SaveVarientGIF failed: %v", err)
+	}
+
+	v, ok := GetGuidImageMetadata(uuid).GetVariant(20, "gif")
+	if !ok {
+		t.Fatal("Expected gif varient metadata")
+	}
+
+	rc, _, err := Backend.Get(context.Background(), v.Path)
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	defer rc.Close()
+
+	g, err := gif.DecodeAll(rc)
+	if err != nil {
+		t.Fatalf("DecodeAll failed: %v", err)
+	}
+
+	if g.Config.Width != 20 || g.Config.Height != 10 {
+		t.Errorf("Expected 20x10, got %dx%d", g.Config.Width, g.Config.Height)
+	}
+	if len(g.Image) != 2 || g.Delay[0] != 7 || g.Delay[1] != 9 {
+		t.Errorf("Expected 2 frames with delays [7 9], got %d frames with %v", len(g.Image), g.Delay)
+	}
+	if g.LoopCount != 3 {
+		t.Errorf("Expected loop count 3, got %d", g.LoopCount)
+	}
+
+	// the second frame only covered the corner, the rest shows the first
+	frame := g.Image[1]
+	if frame.Bounds() != image.Rect(0, 0, 20, 10) {
+		t.Errorf("Expected full size frames, got %v", frame.Bounds())
+	}
+	if c := frame.At(2, 2); c != color.Color(testBlue) {
+		t.Errorf("Expected blue corner, got %v", c)
+	}
+	if c := frame.At(15, 5); c != color.Color(testRed) {
+		t.Errorf("Expected red background kept under the second frame, got %v", c)
+	}
+}
+
+func TestDecodeGIF_FirstFrameDisposal(t *testing.T) {
+	palette := color.Palette{testRed, testBlue}
+	frames := []*image.Paletted{
+		image.NewPaletted(image.Rect(0, 0, 10, 10), palette),
+		image.NewPaletted(image.Rect(10, 0, 20, 10), palette),
+	}
+	g := &gif.GIF{
+		Image:    frames,
+		Delay:    []int{0, 0},
+		Disposal: []byte{gif.DisposalBackground, gif.DisposalNone},
+		Config:   image.Config{Width: 20, Height: 10},
+	}
+
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		t.Fatalf("EncodeAll failed: %v", err)
+	}
+
+	decoded, first, err := DecodeGIF(buf.Bytes())
+	if err != nil {
+		t.Fatalf("DecodeGIF failed: %v", err)
+	}
+	if first.Bounds() != image.Rect(0, 0, 20, 10) {
+		t.Errorf("Expected first frame on the full canvas, got %v", first.Bounds())
+	}
+	if _, _, _, a := first.At(15, 5).RGBA(); a != 0 {
+		t.Error("Expected area outside the first frame to be transparent")
+	}
+
+	// the first frame is cleared before the second is drawn
+	var second *image.RGBA
+	compositeGIF(decoded, func(i int, canvas *image.RGBA) bool {
+		if i == 1 {
+			second = canvas
+		}
+		return true
+	})
+	if _, _, _, a := second.At(5, 5).RGBA(); a != 0 {
+		t.Error("Expected background disposal to clear the first frame")
+	}
+}
+
+func TestCountGIFFrames(t *testing.T) {
+	buf := createTestGIF(t)
+
+	frames, err := CountGIFFrames(buf)
+	if err != nil {
+		t.Fatalf("CountGIFFrames failed: %v", err)
+	}
+	if frames != 2 {
+		t.Errorf("Expected 2 frames, got %d", frames)
+	}
+
+	if _, err := CountGIFFrames(buf[:len(buf)/2]); err == nil {
+		t.Error("Expected an error for a truncated gif")
+	}
+}
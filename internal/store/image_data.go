@@ -2,11 +2,15 @@ package store
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"go-image-web/internal/models"
+	"go-image-web/internal/repo"
+	"go-image-web/internal/webp"
 	"image"
-	"image/gif"
 	_ "image/jpeg" // Register JPEG decoder
 	_ "image/png"  // Register PNG decoder
 	"io"
@@ -14,7 +18,6 @@ import (
 	"mime/multipart"
 	"os"
 	"path/filepath"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -24,26 +27,38 @@ import (
 	"github.com/disintegration/imaging"
 )
 
-const MaxUploadBytes = 15 << 20 // 10MB
+const MaxUploadBytes = 15 << 20 // 15MiB
 
-var (
-	VarientImageDir  string = "data/img/varient"
-	OriginalImageDir string = "data/img/original"
-	TmpImageDir      string = "data/img/tmp"
-)
+// local scratch directory for uploads being processed, set by Configure
+var TmpImageDir string = "data/img/tmp"
 
-// in memory storage for image metadata
+// in memory storage for image metadata, HashIndex is keyed by both the
+// sha256 of the upload and that of its content and shares ImageIndexMu with
+// ImageIndex
 var (
 	ImageIndex   = map[string]*models.ImageMetadata{}
+	HashIndex    = map[string]*models.ImageMetadata{}
 	ImageIndexMu sync.RWMutex
 )
 
-func init() {
-	CheckCreateDir(VarientImageDir)
-	CheckCreateDir(OriginalImageDir)
+// uploads handed an image no post references yet, keyed by uuid, which
+// ReleaseImage leaves alone. Guarded by ImageIndexMu
+var leases = map[string]int{}
+
+// persistent image metadata, set by LoadImages
+var imageRepo *repo.ImageRepo
+
+// SetImageRepo records images in r from now on without loading those it
+// holds, nil keeps them in the index alone
+func SetImageRepo(r *repo.ImageRepo) {
+	imageRepo = r
+}
+
+// Configure sets the storage backend for images and the local temp directory
+func Configure(backend Storage, tmpDir string) {
+	Backend = backend
+	TmpImageDir = tmpDir
 	CheckCreateDir(TmpImageDir)
-	// load images from filesystem
-	loadImages()
 }
 
 // add new metadata to index
@@ -51,6 +66,32 @@ func AddImageMetadata(meta *models.ImageMetadata) {
 	ImageIndexMu.Lock()
 	defer ImageIndexMu.Unlock()
 	ImageIndex[meta.UUID] = meta
+	if meta.SHA256 != "" {
+		HashIndex[meta.SHA256] = meta
+	}
+	if meta.ContentSHA256 != "" {
+		HashIndex[meta.ContentSHA256] = meta
+	}
+	if hash, ok := ParsePHash(meta.PHash); ok {
+		phashIndex[meta.UUID] = hash
+	}
+}
+
+// remove metadata from index
+func RemoveImageMetadata(uuid string) {
+	ImageIndexMu.Lock()
+	defer ImageIndexMu.Unlock()
+	removeImageMetadata(uuid)
+}
+
+// removeImageMetadata is RemoveImageMetadata with ImageIndexMu held
+func removeImageMetadata(uuid string) {
+	if meta, ok := ImageIndex[uuid]; ok {
+		delete(HashIndex, meta.SHA256)
+		delete(HashIndex, meta.ContentSHA256)
+		delete(phashIndex, uuid)
+		delete(ImageIndex, uuid)
+	}
 }
 
 // retrieve all metadata
@@ -67,188 +108,180 @@ func GetGuidImageMetadata(uuid string) *models.ImageMetadata {
 	return ImageIndex[uuid]
 }
 
+// retrieve image metadata by the hash of its upload or of its content
+func GetImageByHash(sum string) *models.ImageMetadata {
+	ImageIndexMu.RLock()
+	defer ImageIndexMu.RUnlock()
+	return HashIndex[sum]
+}
+
+// LeaseImageByHash is GetImageByHash taking a lease on the image found, so
+// it outlives a release until Unlease
+func LeaseImageByHash(sum string) *models.ImageMetadata {
+	ImageIndexMu.Lock()
+	defer ImageIndexMu.Unlock()
+	meta := HashIndex[sum]
+	if meta != nil {
+		leases[meta.UUID]++
+	}
+	return meta
+}
+
+// Lease keeps ReleaseImage from deleting uuid until Unlease, taken by an
+// upload until its post references the image
+func Lease(uuid string) {
+	ImageIndexMu.Lock()
+	defer ImageIndexMu.Unlock()
+	leases[uuid]++
+}
+
+// Unlease drops a lease taken by Lease or LeaseImageByHash
+func Unlease(uuid string) {
+	ImageIndexMu.Lock()
+	defer ImageIndexMu.Unlock()
+	if leases[uuid] <= 1 {
+		delete(leases, uuid)
+		return
+	}
+	leases[uuid]--
+}
+
 // append varient to existing image metadata
 func AddVarientMetadata(uuid string, varient *models.ImageVarient) {
 	ImageIndexMu.Lock()
 	defer ImageIndexMu.Unlock()
 
 	if v, ok := ImageIndex[uuid]; ok {
-		v.SetVariant(varient.Width, *varient)
+		v.SetVariant(*varient)
 	}
 }
 
-// Create a temp file before processing
-func CreateTmpFile(uuid string, file multipart.File) (string, error) {
+// record a new varient in the index and the cache, outside the index lock
+// because tracking may evict
+func addVarient(uuid string, varient *models.ImageVarient) {
+	AddVarientMetadata(uuid, varient)
+	trackVarient(uuid, *varient)
+}
+
+// Create a temp file before processing, returns its path and the hex
+// encoded sha256 of the copied bytes
+func CreateTmpFile(uuid string, file multipart.File) (string, string, error) {
 	path := filepath.Join(TmpImageDir, uuid)
 	tmpFile, err := os.Create(path)
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 	defer tmpFile.Close()
 
-	if _, err := io.Copy(tmpFile, file); err != nil {
+	// hash while copying so the upload is only read once
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmpFile, h), file); err != nil {
 		tmpFile.Close()
 		os.Remove(path)
-		return "", err
+		return "", "", err
 	}
 
-	return path, nil
+	return path, hex.EncodeToString(h.Sum(nil)), nil
 }
 
-func loadImages() {
-	// load images from original directory
-	originalImages, err := os.ReadDir(OriginalImageDir)
-	if err != nil {
-		log.Fatal(err)
+// ReleaseImage deletes an image, its varients and their files once no post
+// references it and no upload holds a lease on it, reporting whether
+// anything was deleted
+func ReleaseImage(uuid string) (bool, error) {
+	ImageIndexMu.Lock()
+	meta := ImageIndex[uuid]
+	if meta == nil || imageRepo == nil || leases[uuid] > 0 {
+		ImageIndexMu.Unlock()
+		return false, nil
 	}
-
-	// create original image metadata on server init
-	for _, i := range originalImages {
-
-		// check file info
-		fi, err := i.Info()
-		if err != nil {
-			log.Println(err)
-			continue
-		}
-
-		// check file naming convention
-		parts := strings.Split(fi.Name(), "_")
-		if len(parts) != 2 {
-			log.Println("invalid filename")
-			continue
-		}
-
-		// open file to decode config
-		srcPath := filepath.Join(OriginalImageDir, fi.Name())
-		srcFile, err := os.Open(srcPath)
-		if err != nil {
-			log.Print(err)
-			continue
-		}
-		defer srcFile.Close()
-
-		// check config and format is valid
-		cfg, format, err := image.DecodeConfig(srcFile)
-		if err != nil {
-			log.Print(err)
-			continue
-		}
-
-		uuid := parts[0]
-		meta := &models.ImageMetadata{
-			UUID:         uuid,
-			OriginalExt:  format,
-			OriginalPath: srcPath,
-			ModifiedTime: fi.ModTime(),
-			OriginalSize: fi.Size(),
-
-			OriginalWidth:  cfg.Width,
-			OriginalHeight: cfg.Height,
-
-			Varients: make(map[int]models.ImageVarient),
-		}
-
-		ImageIndex[uuid] = meta
+	// drop from the index first so new uploads can't dedupe against it
+	removeImageMetadata(uuid)
+	ImageIndexMu.Unlock()
+
+	// a post may have taken it since, the row goes only while ref_count is 0
+	deleted, err := imageRepo.DeleteUnreferencedImage(uuid)
+	if err != nil || !deleted {
+		AddImageMetadata(meta)
+		return false, err
 	}
-	log.Printf("loaded: %d original images from: %s", len(ImageIndex), OriginalImageDir)
 
-	varientImages, err := os.ReadDir(VarientImageDir)
-	if err != nil {
-		log.Fatal(err)
+	ctx := context.Background()
+	if err := Backend.Delete(ctx, meta.OriginalPath); err != nil {
+		log.Print(err)
 	}
-
-	for _, varient := range varientImages {
-		fn := varient.Name()
-
-		// open varient file
-		srcPath := filepath.Join(VarientImageDir, fn)
-		srcFile, err := os.Open(srcPath)
-		if err != nil {
+	if meta.UploadPath != "" {
+		if err := Backend.Delete(ctx, meta.UploadPath); err != nil {
 			log.Print(err)
-			continue
 		}
-		defer srcFile.Close()
+	}
 
-		// load image config for valid extension/format
-		_, format, err := image.DecodeConfig(srcFile)
-		if err != nil {
+	meta.VarientsMu.RLock()
+	for _, v := range meta.Varients {
+		untrackVarient(v.Path)
+		if err := Backend.Delete(ctx, v.Path); err != nil {
 			log.Print(err)
-			continue
-		}
-
-		// strip .jpg etc extension from filename
-		base := StripExtension(fn)
-		parts := strings.Split(base, "_")
-		if len(parts) != 2 {
-			log.Println("invalid filename")
-			continue
-		}
-
-		// collect the 2 parts
-		uuid := parts[0]
-		width, err := strconv.Atoi(parts[1])
-		if err != nil {
-			log.Println("invalid filename")
-			continue
-		}
-
-		// set index[uuid] to the varient metadata
-		if meta, ok := ImageIndex[uuid]; ok {
-			meta.Varients[width] = models.ImageVarient{
-				Width: width,
-				Path:  srcPath,
-				Ext:   format,
-			}
 		}
 	}
+	meta.VarientsMu.RUnlock()
 
-	// conut varients created
-	var varientCount int = 0
-	for _, v := range ImageIndex {
-		varientCount += len(v.Varients)
+	if err := removeTransforms(uuid); err != nil {
+		log.Print(err)
 	}
 
-	log.Printf("loaded: %d varient images from: %s", varientCount, VarientImageDir)
-
+	return true, nil
 }
 
-func SaveOriginalImage(img image.Image, cfg image.Config, uuid string, format string) error {
-	// create new filename
-	fn := fmt.Sprintf("%s_original.%s", uuid, format)
-	// create filepath
-	savePath := filepath.Join(OriginalImageDir, fn)
-	// create system file
-	saveFile, err := os.Create(savePath)
-	if err != nil {
+// quality originals in a lossy format are encoded at, set from ORIGINAL_QUALITY
+var OriginalQuality int = 75
+
+// SaveOriginalImage encodes img and records meta, the caller fills in UUID,
+// OriginalExt and the dimensions, along with SHA256 when known. Only pixels
+// are encoded, no metadata of the upload reaches storage
+func SaveOriginalImage(img image.Image, meta *models.ImageMetadata) error {
+	// encode image in memory so a failed encode never reaches storage
+	var buf bytes.Buffer
+	if err := encodeImage(&buf, img, meta.OriginalExt, OriginalQuality, losslessWebP(img)); err != nil {
 		return err
 	}
-	defer saveFile.Close()
 
-	encFmt := GetEncodeFormat(format)
+	return saveOriginal(meta, buf.Bytes())
+}
 
-	// encode image and remove if fail
-	if err := imaging.Encode(saveFile, img, encFmt, imaging.JPEGQuality(75)); err != nil {
-		os.Remove(savePath)
+// SaveOriginalGIF stores an uploaded GIF so its animation survives, only
+// comments and metadata extensions are stripped. meta is filled in as for
+// SaveOriginalImage
+func SaveOriginalGIF(buf []byte, meta *models.ImageMetadata) error {
+	stripped, _, err := stripGIFMetadata(buf)
+	if err != nil {
 		return err
 	}
+	return saveOriginal(meta, stripped)
+}
+
+// saveOriginal stores the encoded original and records its metadata
+func saveOriginal(meta *models.ImageMetadata, buf []byte) error {
+	ctx := context.Background()
 
-	// create image metadata
-	meta := &models.ImageMetadata{
-		UUID:           uuid,
-		OriginalExt:    format,
-		OriginalPath:   savePath,
-		OriginalWidth:  cfg.Width,
-		OriginalHeight: cfg.Height,
-		ModifiedTime:   time.Now(),
+	// storage key original/{uuid}_original.{format}
+	key := OriginalKey(meta.UUID, meta.OriginalExt)
 
-		Varients: make(map[int]models.ImageVarient),
+	size := int64(len(buf))
+	if err := Backend.Put(ctx, key, bytes.NewReader(buf), size); err != nil {
+		return err
 	}
 
-	if err := saveFile.Sync(); err == nil {
-		fi, err := saveFile.Stat()
-		if err == nil {
-			meta.OriginalSize = fi.Size()
+	// complete image metadata
+	meta.OriginalPath = key
+	meta.OriginalSize = size
+	meta.Checksum = hexSHA256(buf)
+	meta.ModifiedTime = time.Now()
+	meta.Varients = make(map[models.VarientID]models.ImageVarient)
+
+	// persist metadata, the file is useless without a record of it
+	if imageRepo != nil {
+		if err := imageRepo.InsertImage(meta); err != nil {
+			Backend.Delete(ctx, key)
+			return err
 		}
 	}
 
@@ -257,77 +290,61 @@ func SaveOriginalImage(img image.Image, cfg image.Config, uuid string, format st
 	return nil
 }
 
+// SaveVarientImage stores img wpx wide in format as the active profile
+// describes, wpx must be narrower than img
 func SaveVarientImage(uuid string, img image.Image, wpx int, format string) error {
+	if w := img.Bounds().Dx(); wpx >= w {
+		return fmt.Errorf("varient %s_%d.%s would not be smaller than the %dpx original", uuid, wpx, format, w)
+	}
 
-	// craft filename {uuid}_{width}.{format}
-	fn := fmt.Sprintf("%s_%d.%s", uuid, wpx, format)
+	p := ActiveVarientProfile()
 
-	// resize image with imaging
-	resized := imaging.Resize(img, wpx, 0, imaging.Lanczos)
+	// resizing loses the decoder's type, so look at it first
+	lossless := losslessWebP(img)
 
-	// craft os path
-	savePath := filepath.Join(VarientImageDir, fn)
+	resized := p.resize(img, wpx, 0)
 
-	// create the file
-	f, err := os.Create(savePath)
-	if err != nil {
+	// encode the new image, returns error if fail
+	var buf bytes.Buffer
+	if err := encodeImage(&buf, resized, format, p.Quality, lossless); err != nil {
 		return err
 	}
-	defer f.Close()
 
-	encFmt := GetEncodeFormat(format)
+	return saveVarient(uuid, wpx, format, buf.Bytes())
+}
 
-	// save the new image file after encoding, returns error if fail
-	if err := imaging.Encode(f, resized, encFmt); err != nil {
-		os.Remove(savePath)
-		return err
-	}
+// saveVarient stores an encoded varient and records its metadata
+func saveVarient(uuid string, wpx int, format string, buf []byte) error {
+	ctx := context.Background()
 
-	// save metadata for varient image
-	AddVarientMetadata(uuid, &models.ImageVarient{
-		Width: wpx,
-		Path:  savePath,
-		Ext:   format,
-	})
+	// craft storage key varient/{uuid}_{width}.{format}
+	key := VarientKey(uuid, wpx, format)
 
-	return nil
-}
+	size := int64(len(buf))
+	if err := Backend.Put(ctx, key, bytes.NewReader(buf), size); err != nil {
+		return err
+	}
 
-func SaveVarientGIF(uuid string, buf []byte, wpx int) error {
-	// Decode the full GIF with all frames
-	g, err := gif.DecodeAll(bytes.NewReader(buf))
-	if err != nil {
-		return fmt.Errorf("decode gif: %w", err)
+	varient := &models.ImageVarient{
+		Width:    wpx,
+		Path:     key,
+		Ext:      format,
+		Size:     size,
+		Checksum: hexSHA256(buf),
 	}
 
-	// Resize each frame
-	for i, frame := range g.Image {
-		resized := imaging.Resize(frame, wpx, 0, imaging.Lanczos)
-		// Convert back to paletted image
-		bounds := resized.Bounds()
-		palettedImg := image.NewPaletted(bounds, frame.Palette)
-		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
-			for x := bounds.Min.X; x < bounds.Max.X; x++ {
-				palettedImg.Set(x, y, resized.At(x, y))
-			}
+	// persist varient metadata
+	if imageRepo != nil {
+		if err := imageRepo.InsertVarient(uuid, varient); err != nil {
+			Backend.Delete(ctx, key)
+			return err
 		}
-		g.Image[i] = palettedImg
 	}
 
-	// Update config dimensions
-	g.Config.Width = wpx
-	g.Config.Height = 0 // Will be set by aspect ratio
-
-	fn := fmt.Sprintf("%s_%d.gif", uuid, wpx)
-	savePath := filepath.Join(VarientImageDir, fn)
-
-	f, err := os.Create(savePath)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
+	// save metadata for varient image and count it against the cache budget
+	addVarient(uuid, varient)
 
-	return gif.EncodeAll(f, g)
+	return nil
 }
 
 func CheckCreateDir(path string) {
@@ -343,15 +360,30 @@ func StripExtension(file string) string {
 	return strings.TrimSuffix(file, filepath.Ext(file))
 }
 
-func GetEncodeFormat(format string) imaging.Format {
-	var encFmt imaging.Format
+// encodeImage writes img in format, quality applies to the lossy formats
+// and lossless only to webp
+func encodeImage(w io.Writer, img image.Image, format string, quality int, lossless bool) error {
 	switch format {
-	case "jpeg", "jpg", "webp":
-		encFmt = imaging.JPEG
+	case "jpeg", "jpg":
+		return imaging.Encode(w, img, imaging.JPEG, imaging.JPEGQuality(quality))
 	case "png":
-		encFmt = imaging.PNG
+		return imaging.Encode(w, img, imaging.PNG)
+	case "gif":
+		return imaging.Encode(w, img, imaging.GIF)
+	case "webp":
+		return webp.Encode(w, img, &webp.Options{Lossless: lossless, Quality: float32(quality)})
+	default:
+		return fmt.Errorf("unsupported encode format: %s", format)
+	}
+}
+
+// losslessWebP reports whether img should stay lossless when encoded as
+// webp, the decoder returns YCbCr only for lossy webp
+func losslessWebP(img image.Image) bool {
+	switch img.(type) {
+	case *image.YCbCr, *image.NYCbCrA:
+		return false
 	default:
-		encFmt = imaging.JPEG
+		return true
 	}
-	return encFmt
 }
@@ -1,10 +1,12 @@
 package store
 
 import (
+	"context"
+	"errors"
 	"go-image-web/internal/models"
 	"image"
 	"image/color"
-	"os"
+	"io/fs"
 	"path/filepath"
 	"testing"
 )
@@ -22,27 +24,21 @@ func createTestImage(width, height int) image.Image {
 func setupTestDirs(t *testing.T) func() {
 	t.Helper()
 
-	origOriginalDir := OriginalImageDir
-	origVarientDir := VarientImageDir
+	origBackend := Backend
 	origTmpDir := TmpImageDir
 
 	tmpDir := t.TempDir()
-	OriginalImageDir = filepath.Join(tmpDir, "original")
-	VarientImageDir = filepath.Join(tmpDir, "varient")
-	TmpImageDir = filepath.Join(tmpDir, "tmp")
-
-	CheckCreateDir(OriginalImageDir)
-	CheckCreateDir(VarientImageDir)
-	CheckCreateDir(TmpImageDir)
+	Configure(NewLocalStorage(tmpDir), filepath.Join(tmpDir, "tmp"))
 
 	// Clear ImageIndex
 	ImageIndexMu.Lock()
 	ImageIndex = make(map[string]*models.ImageMetadata)
+	HashIndex = make(map[string]*models.ImageMetadata)
+	phashIndex = make(map[string]uint64)
 	ImageIndexMu.Unlock()
 
 	return func() {
-		OriginalImageDir = origOriginalDir
-		VarientImageDir = origVarientDir
+		Backend = origBackend
 		TmpImageDir = origTmpDir
 	}
 }
@@ -52,20 +48,20 @@ func TestSaveOriginalImage_JPEG(t *testing.T) {
 	defer cleanup()
 
 	img := createTestImage(100, 100)
-	cfg := image.Config{Width: 100, Height: 100}
 	uuid := "test-uuid-jpeg"
+	meta := &models.ImageMetadata{UUID: uuid, OriginalExt: "jpeg", OriginalWidth: 100, OriginalHeight: 100}
 
-	err := SaveOriginalImage(img, cfg, uuid, "jpeg")
+	err := SaveOriginalImage(img, meta)
 	if err != nil {
 		t.Fatalf("SaveOriginalImage failed: %v", err)
 	}
 
-	expectedPath := filepath.Join(OriginalImageDir, uuid+"_original.jpeg")
-	if _, err := os.Stat(expectedPath); os.IsNotExist(err) {
-		t.Errorf("Expected file not created: %s", expectedPath)
+	expectedKey := OriginalKey(uuid, "jpeg")
+	if _, err := Backend.Stat(context.Background(), expectedKey); errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected file not created: %s", expectedKey)
 	}
 
-	meta := GetGuidImageMetadata(uuid)
+	meta = GetGuidImageMetadata(uuid)
 	if meta == nil {
 		t.Fatal("Metadata not added to ImageIndex")
 	}
@@ -79,20 +75,20 @@ func TestSaveOriginalImage_PNG(t *testing.T) {
 	defer cleanup()
 
 	img := createTestImage(50, 50)
-	cfg := image.Config{Width: 50, Height: 50}
 	uuid := "test-uuid-png"
+	meta := &models.ImageMetadata{UUID: uuid, OriginalExt: "png", OriginalWidth: 50, OriginalHeight: 50}
 
-	err := SaveOriginalImage(img, cfg, uuid, "png")
+	err := SaveOriginalImage(img, meta)
 	if err != nil {
 		t.Fatalf("SaveOriginalImage failed: %v", err)
 	}
 
-	expectedPath := filepath.Join(OriginalImageDir, uuid+"_original.png")
-	if _, err := os.Stat(expectedPath); os.IsNotExist(err) {
-		t.Errorf("Expected file not created: %s", expectedPath)
+	expectedKey := OriginalKey(uuid, "png")
+	if _, err := Backend.Stat(context.Background(), expectedKey); errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected file not created: %s", expectedKey)
 	}
 
-	meta := GetGuidImageMetadata(uuid)
+	meta = GetGuidImageMetadata(uuid)
 	if meta == nil {
 		t.Fatal("Metadata not added to ImageIndex")
 	}
@@ -106,36 +102,59 @@ func TestSaveOriginalImage_GIF(t *testing.T) {
 	defer cleanup()
 
 	img := createTestImage(30, 30)
-	cfg := image.Config{Width: 30, Height: 30}
 	uuid := "test-uuid-gif"
+	meta := &models.ImageMetadata{UUID: uuid, OriginalExt: "gif", OriginalWidth: 30, OriginalHeight: 30}
 
-	err := SaveOriginalImage(img, cfg, uuid, "gif")
+	err := SaveOriginalImage(img, meta)
 	if err != nil {
 		t.Fatalf("SaveOriginalImage failed: %v", err)
 	}
 
-	expectedPath := filepath.Join(OriginalImageDir, uuid+"_original.gif")
-	if _, err := os.Stat(expectedPath); os.IsNotExist(err) {
-		t.Errorf("Expected file not created: %s", expectedPath)
+	expectedKey := OriginalKey(uuid, "gif")
+	if _, err := Backend.Stat(context.Background(), expectedKey); errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected file not created: %s", expectedKey)
 	}
 }
 
-func TestSaveOriginalImage_DefaultFormat(t *testing.T) {
+func TestSaveOriginalImage_UnsupportedFormat(t *testing.T) {
 	cleanup := setupTestDirs(t)
 	defer cleanup()
 
 	img := createTestImage(20, 20)
-	cfg := image.Config{Width: 20, Height: 20}
 	uuid := "test-uuid-default"
+	meta := &models.ImageMetadata{UUID: uuid, OriginalExt: "unknown", OriginalWidth: 20, OriginalHeight: 20}
 
-	err := SaveOriginalImage(img, cfg, uuid, "unknown")
-	if err != nil {
+	if err := SaveOriginalImage(img, meta); err == nil {
+		t.Fatal("Expected an error for an unsupported format")
+	}
+
+	expectedKey := OriginalKey(uuid, "unknown")
+	if _, err := Backend.Stat(context.Background(), expectedKey); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected no file for unsupported format, got %v", err)
+	}
+}
+
+func TestSaveOriginalImage_WebP(t *testing.T) {
+	cleanup := setupTestDirs(t)
+	defer cleanup()
+
+	img := createTestImage(40, 30)
+	uuid := "test-uuid-webp"
+	meta := &models.ImageMetadata{UUID: uuid, OriginalExt: "webp", OriginalWidth: 40, OriginalHeight: 30}
+
+	if err := SaveOriginalImage(img, meta); err != nil {
 		t.Fatalf("SaveOriginalImage failed: %v", err)
 	}
 
-	expectedPath := filepath.Join(OriginalImageDir, uuid+"_original.unknown")
-	if _, err := os.Stat(expectedPath); os.IsNotExist(err) {
-		t.Errorf("Expected file not created: %s", expectedPath)
+	cfg, format, err := decodeStoredConfig(OriginalKey(uuid, "webp"))
+	if err != nil {
+		t.Fatalf("Stored original does not decode: %v", err)
+	}
+	if format != "webp" {
+		t.Errorf("Expected webp bytes, got %s", format)
+	}
+	if cfg.Width != 40 || cfg.Height != 30 {
+		t.Errorf("Unexpected dimensions: %dx%d", cfg.Width, cfg.Height)
 	}
 }
 
@@ -144,15 +163,15 @@ func TestSaveOriginalImage_MetadataFields(t *testing.T) {
 	defer cleanup()
 
 	img := createTestImage(200, 150)
-	cfg := image.Config{Width: 200, Height: 150}
 	uuid := "test-uuid-meta"
+	meta := &models.ImageMetadata{UUID: uuid, OriginalExt: "jpeg", OriginalWidth: 200, OriginalHeight: 150}
 
-	err := SaveOriginalImage(img, cfg, uuid, "jpeg")
+	err := SaveOriginalImage(img, meta)
 	if err != nil {
 		t.Fatalf("SaveOriginalImage failed: %v", err)
 	}
 
-	meta := GetGuidImageMetadata(uuid)
+	meta = GetGuidImageMetadata(uuid)
 	if meta == nil {
 		t.Fatal("Metadata not found")
 	}
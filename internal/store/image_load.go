@@ -0,0 +1,294 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"go-image-web/internal/models"
+	"go-image-web/internal/repo"
+	"image"
+	"log"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// kinds of inconsistency between the database and the image directories
+const (
+	MissingOriginal string = "missing_original"
+	MissingVarient  string = "missing_varient"
+	MissingUpload   string = "missing_upload"
+	ExtraFile       string = "extra_file"
+)
+
+// Inconsistency describes a file that is recorded but missing, or present but unrecorded
+type Inconsistency struct {
+	Kind string
+	UUID string
+	Path string
+	// when the image was recorded, or the extra file last written
+	ModTime time.Time
+}
+
+func (i Inconsistency) String() string {
+	return fmt.Sprintf("%s: uuid=%q path=%q", i.Kind, i.UUID, i.Path)
+}
+
+// LoadImages builds the in memory index from the database and reports any
+// difference between the recorded images and the files on disk
+func LoadImages(r *repo.ImageRepo) error {
+	start := time.Now()
+	imageRepo = r
+
+	images, err := r.SelectAllImages()
+	if err != nil {
+		return err
+	}
+
+	varients, err := r.SelectAllVarients()
+	if err != nil {
+		return err
+	}
+
+	index := make(map[string]*models.ImageMetadata, len(images))
+	hashes := make(map[string]*models.ImageMetadata, len(images))
+	phashes := make(map[string]uint64, len(images))
+	var pending []*models.ImageMetadata
+	for _, meta := range images {
+		meta.Varients = make(map[models.VarientID]models.ImageVarient)
+
+		// placeholder rows created by the images migration
+		if meta.OriginalExt == "" {
+			pending = append(pending, meta)
+			continue
+		}
+
+		index[meta.UUID] = meta
+		if meta.SHA256 != "" {
+			hashes[meta.SHA256] = meta
+		}
+		if meta.ContentSHA256 != "" {
+			hashes[meta.ContentSHA256] = meta
+		}
+		if hash, ok := ParsePHash(meta.PHash); ok {
+			phashes[meta.UUID] = hash
+		}
+	}
+
+	// varients come oldest first, so the newest end up most recently served
+	resetVarientCache()
+	var varientCount int
+	for _, v := range varients {
+		if meta, ok := index[v.ImageUUID]; ok {
+			meta.Varients[v.ID()] = v.ImageVarient
+			trackVarient(v.ImageUUID, v.ImageVarient)
+			varientCount++
+		}
+	}
+
+	ImageIndexMu.Lock()
+	ImageIndex = index
+	HashIndex = hashes
+	phashIndex = phashes
+	ImageIndexMu.Unlock()
+
+	log.Printf("loaded: %d original images and %d varient images in %s", len(index), varientCount, time.Since(start))
+
+	// one off import of images uploaded before metadata was persisted
+	if len(pending) > 0 {
+		importLegacyImages(pending)
+	}
+
+	problems, err := CheckConsistency()
+	if err != nil {
+		return err
+	}
+	for _, p := range problems {
+		log.Printf("inconsistency: %s", p)
+	}
+	if len(problems) > 0 {
+		log.Printf("found %d inconsistencies between database and storage", len(problems))
+	}
+
+	return nil
+}
+
+// CheckConsistency compares the index against a listing of the storage
+// backend without decoding any file
+func CheckConsistency() ([]Inconsistency, error) {
+	originals, err := listKeys(OriginalPrefix + "/")
+	if err != nil {
+		return nil, err
+	}
+	varients, err := listKeys(VarientPrefix + "/")
+	if err != nil {
+		return nil, err
+	}
+	uploads, err := listKeys(UploadPrefix + "/")
+	if err != nil {
+		return nil, err
+	}
+
+	var problems []Inconsistency
+	known := make(map[string]struct{})
+
+	ImageIndexMu.RLock()
+	for uuid, meta := range ImageIndex {
+		known[meta.OriginalPath] = struct{}{}
+		if _, ok := originals[meta.OriginalPath]; !ok {
+			problems = append(problems, Inconsistency{Kind: MissingOriginal, UUID: uuid, Path: meta.OriginalPath, ModTime: meta.ModifiedTime})
+		}
+		if meta.UploadPath != "" {
+			known[meta.UploadPath] = struct{}{}
+			if _, ok := uploads[meta.UploadPath]; !ok {
+				problems = append(problems, Inconsistency{Kind: MissingUpload, UUID: uuid, Path: meta.UploadPath, ModTime: meta.ModifiedTime})
+			}
+		}
+
+		meta.VarientsMu.RLock()
+		for _, v := range meta.Varients {
+			known[v.Path] = struct{}{}
+			if _, ok := varients[v.Path]; !ok {
+				problems = append(problems, Inconsistency{Kind: MissingVarient, UUID: uuid, Path: v.Path, ModTime: meta.ModifiedTime})
+			}
+		}
+		meta.VarientsMu.RUnlock()
+	}
+	ImageIndexMu.RUnlock()
+
+	// recorded uuids that could not be imported from disk
+	if imageRepo != nil {
+		images, err := imageRepo.SelectAllImages()
+		if err != nil {
+			return nil, err
+		}
+		for _, meta := range images {
+			if meta.OriginalExt == "" {
+				problems = append(problems, Inconsistency{Kind: MissingOriginal, UUID: meta.UUID, ModTime: meta.ModifiedTime})
+			}
+		}
+	}
+
+	for _, files := range []map[string]ObjectInfo{originals, varients, uploads} {
+		for key, info := range files {
+			if _, ok := known[key]; !ok {
+				problems = append(problems, Inconsistency{Kind: ExtraFile, UUID: uuidFromFilename(path.Base(key)), Path: key, ModTime: info.ModTime})
+			}
+		}
+	}
+
+	return problems, nil
+}
+
+// importLegacyImages fills in placeholder rows by decoding the matching stored files
+func importLegacyImages(pending []*models.ImageMetadata) {
+	originals, err := listKeys(OriginalPrefix + "/")
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	varients, err := listKeys(VarientPrefix + "/")
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	// group files by the uuid prefix of their name
+	originalsByUUID := make(map[string]string)
+	for key := range originals {
+		originalsByUUID[uuidFromFilename(path.Base(key))] = key
+	}
+	varientsByUUID := make(map[string][]string)
+	for key := range varients {
+		uuid := uuidFromFilename(path.Base(key))
+		varientsByUUID[uuid] = append(varientsByUUID[uuid], key)
+	}
+
+	var imported int
+	for _, meta := range pending {
+		srcKey, ok := originalsByUUID[meta.UUID]
+		if !ok {
+			continue
+		}
+
+		cfg, format, err := decodeStoredConfig(srcKey)
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+
+		meta.OriginalExt = format
+		meta.OriginalPath = srcKey
+		meta.OriginalWidth = cfg.Width
+		meta.OriginalHeight = cfg.Height
+		meta.OriginalSize = originals[srcKey].Size
+		meta.ModifiedTime = originals[srcKey].ModTime
+
+		if err := imageRepo.UpdateImage(meta); err != nil {
+			log.Print(err)
+			continue
+		}
+
+		for _, key := range varientsByUUID[meta.UUID] {
+			// {uuid}_{width}.{ext}
+			parts := strings.Split(StripExtension(path.Base(key)), "_")
+			if len(parts) != 2 {
+				continue
+			}
+			width, err := strconv.Atoi(parts[1])
+			if err != nil {
+				continue
+			}
+
+			_, format, err := decodeStoredConfig(key)
+			if err != nil {
+				log.Print(err)
+				continue
+			}
+
+			varient := models.ImageVarient{Width: width, Path: key, Ext: format, Size: varients[key].Size}
+
+			if err := imageRepo.InsertVarient(meta.UUID, &varient); err != nil {
+				log.Print(err)
+				continue
+			}
+			meta.Varients[varient.ID()] = varient
+			trackVarient(meta.UUID, varient)
+		}
+
+		AddImageMetadata(meta)
+		imported++
+	}
+
+	log.Printf("imported: %d of %d legacy images from storage", imported, len(pending))
+}
+
+// listKeys returns the stored objects under prefix keyed by their key
+func listKeys(prefix string) (map[string]ObjectInfo, error) {
+	objects, err := Backend.List(context.Background(), prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]ObjectInfo, len(objects))
+	for _, o := range objects {
+		keys[o.Key] = o
+	}
+	return keys, nil
+}
+
+func decodeStoredConfig(key string) (image.Config, string, error) {
+	rc, _, err := Backend.Get(context.Background(), key)
+	if err != nil {
+		return image.Config{}, "", err
+	}
+	defer rc.Close()
+
+	return image.DecodeConfig(rc)
+}
+
+// uuidFromFilename returns the part of an image filename before the first underscore
+func uuidFromFilename(fn string) string {
+	uuid, _, _ := strings.Cut(fn, "_")
+	return uuid
+}
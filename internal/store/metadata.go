@@ -0,0 +1,208 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"strings"
+	"time"
+
+	"github.com/disintegration/imaging"
+)
+
+// Metadata is what an upload says about itself besides its pixels. Only the
+// fields here are kept, everything else is dropped when the image is stored
+type Metadata struct {
+	// EXIF orientation, 1 to 8, 0 when absent
+	Orientation int
+
+	// non identifying tags worth showing
+	TakenAt     *time.Time
+	CameraMake  string
+	CameraModel string
+
+	// every other tag or block found, e.g. "EXIF:GPSLatitude" or "XMP"
+	Removed []string
+}
+
+func (m *Metadata) remove(name string) {
+	for _, r := range m.Removed {
+		if r == name {
+			return
+		}
+	}
+	m.Removed = append(m.Removed, name)
+}
+
+// ReadMetadata finds the EXIF, XMP and IPTC blocks of an encoded image,
+// format is the name image.DecodeConfig gave it
+func ReadMetadata(buf []byte, format string) Metadata {
+	var m Metadata
+	switch format {
+	case "jpeg":
+		readJPEGMetadata(buf, &m)
+	case "png":
+		readPNGMetadata(buf, &m)
+	case "webp":
+		readWebPMetadata(buf, &m)
+	case "gif":
+		_, m.Removed, _ = stripGIFMetadata(buf)
+	}
+	return m
+}
+
+// Orient rotates and flips img so it displays upright without its EXIF
+// orientation, section 4.6.4 of the EXIF 2.3 specification
+func Orient(img image.Image, orientation int) image.Image {
+	switch orientation {
+	case 2:
+		return imaging.FlipH(img)
+	case 3:
+		return imaging.Rotate180(img)
+	case 4:
+		return imaging.FlipV(img)
+	case 5:
+		return imaging.Transpose(img)
+	case 6:
+		return imaging.Rotate270(img)
+	case 7:
+		return imaging.Transverse(img)
+	case 8:
+		return imaging.Rotate90(img)
+	default:
+		return img
+	}
+}
+
+var (
+	exifHeader    = []byte("Exif\x00\x00")
+	xmpHeader     = []byte("http://ns.adobe.com/xap/1.0/\x00")
+	xmpExtHeader  = []byte("http://ns.adobe.com/xmp/extension/\x00")
+	iptcHeader    = []byte("Photoshop 3.0\x00")
+	iccHeader     = []byte("ICC_PROFILE\x00")
+	pngSignature  = []byte("\x89PNG\r\n\x1a\n")
+	pngXMPKeyword = "XML:com.adobe.xmp"
+)
+
+// readJPEGMetadata walks the segments before the image data
+func readJPEGMetadata(buf []byte, m *Metadata) {
+	if len(buf) < 2 || buf[0] != 0xff || buf[1] != 0xd8 {
+		return
+	}
+
+	for i := 2; i+4 <= len(buf); {
+		if buf[i] != 0xff {
+			return
+		}
+		marker := buf[i+1]
+		switch {
+		case marker == 0xff:
+			// fill byte
+			i++
+			continue
+		case marker == 0x01 || marker >= 0xd0 && marker <= 0xd7:
+			i += 2
+			continue
+		case marker == 0xda || marker == 0xd9:
+			// the entropy coded data follows, no metadata after it matters
+			return
+		}
+
+		n := int(binary.BigEndian.Uint16(buf[i+2:]))
+		if n < 2 || i+2+n > len(buf) {
+			return
+		}
+		seg := buf[i+4 : i+2+n]
+		i += 2 + n
+
+		switch {
+		case marker == 0xe1 && bytes.HasPrefix(seg, exifHeader):
+			readExif(seg[len(exifHeader):], m)
+		case marker == 0xe1 && (bytes.HasPrefix(seg, xmpHeader) || bytes.HasPrefix(seg, xmpExtHeader)):
+			m.remove("XMP")
+		case marker == 0xed && bytes.HasPrefix(seg, iptcHeader):
+			m.remove("IPTC")
+		case marker == 0xe2 && bytes.HasPrefix(seg, iccHeader):
+			m.remove("ICC")
+		case marker == 0xfe:
+			m.remove("JPEG:Comment")
+		case marker >= 0xe1 && marker <= 0xef && marker != 0xee:
+			// APP0 (JFIF) and APP14 (Adobe) only describe the encoding
+			m.remove(fmt.Sprintf("JPEG:APP%d", marker-0xe0))
+		}
+	}
+}
+
+// readPNGMetadata walks the chunks of a PNG
+func readPNGMetadata(buf []byte, m *Metadata) {
+	if !bytes.HasPrefix(buf, pngSignature) {
+		return
+	}
+
+	for i := len(pngSignature); i+12 <= len(buf); {
+		n := int(binary.BigEndian.Uint32(buf[i:]))
+		typ := string(buf[i+4 : i+8])
+		if n < 0 || i+12+n > len(buf) || typ == "IEND" {
+			return
+		}
+		data := buf[i+8 : i+8+n]
+		i += 12 + n
+
+		switch typ {
+		case "eXIf":
+			readExif(data, m)
+		case "tEXt", "zTXt", "iTXt":
+			keyword, _, _ := bytes.Cut(data, []byte{0})
+			if string(keyword) == pngXMPKeyword {
+				m.remove("XMP")
+			} else {
+				m.remove("PNG:" + printable(string(keyword)))
+			}
+		case "tIME":
+			m.remove("PNG:tIME")
+		case "iCCP":
+			m.remove("ICC")
+		}
+	}
+}
+
+// readWebPMetadata walks the chunks of a WebP
+func readWebPMetadata(buf []byte, m *Metadata) {
+	if len(buf) < 12 || string(buf[:4]) != "RIFF" || string(buf[8:12]) != "WEBP" {
+		return
+	}
+
+	for i := 12; i+8 <= len(buf); {
+		fourCC := string(buf[i : i+4])
+		n := int(binary.LittleEndian.Uint32(buf[i+4:]))
+		if n < 0 || i+8+n > len(buf) {
+			return
+		}
+		data := buf[i+8 : i+8+n]
+		i += 8 + n + n&1
+
+		switch fourCC {
+		case "EXIF":
+			readExif(data, m)
+		case "XMP ":
+			m.remove("XMP")
+		case "ICCP":
+			m.remove("ICC")
+		}
+	}
+}
+
+// printable keeps names from uploads safe and short enough to log
+func printable(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if r < 0x20 || r > 0x7e {
+			return -1
+		}
+		return r
+	}, s)
+	if len(s) > 64 {
+		s = s[:64]
+	}
+	return s
+}
@@ -0,0 +1,184 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"go-image-web/internal/models"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"slices"
+	"testing"
+)
+
+type exifEntry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	data  []byte
+	// entries of the IFD this one points to
+	sub []exifEntry
+}
+
+func exifASCII(tag uint16, s string) exifEntry {
+	return exifEntry{tag: tag, typ: 2, count: uint32(len(s) + 1), data: append([]byte(s), 0)}
+}
+
+// writeIFD appends an IFD and its values to buf, returning its offset
+func writeIFD(buf *[]byte, entries []exifEntry) uint32 {
+	le := binary.LittleEndian
+	off := uint32(len(*buf))
+	*buf = append(*buf, make([]byte, 2+12*len(entries)+4)...)
+	le.PutUint16((*buf)[off:], uint16(len(entries)))
+
+	for i, e := range entries {
+		p := off + 2 + 12*uint32(i)
+		value := e.data
+		if e.sub != nil {
+			e.typ, e.count = 4, 1
+			value = le.AppendUint32(nil, writeIFD(buf, e.sub))
+		}
+		le.PutUint16((*buf)[p:], e.tag)
+		le.PutUint16((*buf)[p+2:], e.typ)
+		le.PutUint32((*buf)[p+4:], e.count)
+		if len(value) <= 4 {
+			copy((*buf)[p+8:], value)
+			continue
+		}
+		le.PutUint32((*buf)[p+8:], uint32(len(*buf)))
+		*buf = append(*buf, value...)
+	}
+	return off
+}
+
+// createTestExif returns the EXIF of a phone photo taken sideways, with a
+// location and serial number
+func createTestExif() []byte {
+	buf := []byte("II*\x00\x08\x00\x00\x00")
+	writeIFD(&buf, []exifEntry{
+		exifASCII(tagMake, "Canon"),
+		exifASCII(tagModel, "EOS R5"),
+		{tag: tagOrientation, typ: 3, count: 1, data: []byte{6, 0}},
+		exifASCII(0x0131, "Firmware 1.0"),
+		{tag: tagExifIFD, sub: []exifEntry{
+			exifASCII(tagDateTimeOriginal, "2024:05:06 07:08:09"),
+			exifASCII(0xa431, "0123456789"),
+		}},
+		{tag: tagGPSIFD, sub: []exifEntry{
+			exifASCII(0x01, "N"),
+			{tag: 0x02, typ: 5, count: 3, data: make([]byte, 24)},
+		}},
+	})
+	return buf
+}
+
+// createTestJPEG returns a w x h JPEG carrying EXIF and XMP segments
+func createTestJPEG(t *testing.T, w, h int) []byte {
+	t.Helper()
+
+	var enc bytes.Buffer
+	if err := jpeg.Encode(&enc, createTestImage(w, h), nil); err != nil {
+		t.Fatalf("jpeg.Encode failed: %v", err)
+	}
+
+	segment := func(marker byte, data []byte) []byte {
+		seg := []byte{0xff, marker, 0, 0}
+		binary.BigEndian.PutUint16(seg[2:], uint16(len(data)+2))
+		return append(seg, data...)
+	}
+
+	out := append([]byte{}, enc.Bytes()[:2]...)
+	out = append(out, segment(0xe1, append(append([]byte{}, exifHeader...), createTestExif()...))...)
+	out = append(out, segment(0xe1, append(append([]byte{}, xmpHeader...), "<x:xmpmeta/>"...))...)
+	return append(out, enc.Bytes()[2:]...)
+}
+
+func TestReadMetadata_JPEG(t *testing.T) {
+	md := ReadMetadata(createTestJPEG(t, 30, 20), "jpeg")
+
+	if md.Orientation != 6 {
+		t.Errorf("Expected orientation 6, got %d", md.Orientation)
+	}
+	if md.CameraMake != "Canon" || md.CameraModel != "EOS R5" {
+		t.Errorf("Unexpected camera: %q %q", md.CameraMake, md.CameraModel)
+	}
+	if md.TakenAt == nil || md.TakenAt.Format("2006-01-02 15:04:05") != "2024-05-06 07:08:09" {
+		t.Errorf("Unexpected capture date: %v", md.TakenAt)
+	}
+
+	for _, name := range []string{"EXIF:GPSLatitude", "EXIF:GPSLatitudeRef", "EXIF:BodySerialNumber", "EXIF:Software", "XMP"} {
+		if !slices.Contains(md.Removed, name) {
+			t.Errorf("Expected %s to be removed, got %v", name, md.Removed)
+		}
+	}
+	for _, name := range []string{"EXIF:Make", "EXIF:Model", "EXIF:DateTimeOriginal"} {
+		if slices.Contains(md.Removed, name) {
+			t.Errorf("Expected %s to be kept", name)
+		}
+	}
+}
+
+func TestReadMetadata_Truncated(t *testing.T) {
+	buf := createTestJPEG(t, 10, 10)
+	// every prefix must parse without panicking
+	for i := range buf[:400] {
+		ReadMetadata(buf[:i], "jpeg")
+	}
+}
+
+func TestOrient(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 30, 20))
+	img.Set(0, 0, color.White)
+
+	// orientation 6 is stored rotated 90 degrees anticlockwise
+	out := Orient(img, 6)
+	if out.Bounds().Dx() != 20 || out.Bounds().Dy() != 30 {
+		t.Fatalf("Expected 20x30, got %v", out.Bounds())
+	}
+	if r, _, _, _ := out.At(19, 0).RGBA(); r != 0xffff {
+		t.Error("Expected the top left corner to turn to the top right")
+	}
+
+	if Orient(img, 1) != image.Image(img) {
+		t.Error("Expected orientation 1 to leave the image alone")
+	}
+}
+
+func TestSaveOriginalGIF_StripsMetadata(t *testing.T) {
+	cleanup := setupTestDirs(t)
+	defer cleanup()
+
+	buf := createTestGIF(t)
+
+	// a comment and an XMP packet before the trailer
+	tagged := append([]byte{}, buf[:len(buf)-1]...)
+	tagged = append(tagged, 0x21, 0xfe, 7)
+	tagged = append(tagged, "secret!"...)
+	tagged = append(tagged, 0, 0x21, 0xff, 11)
+	tagged = append(tagged, "XMP DataXMP"...)
+	tagged = append(tagged, 12)
+	tagged = append(tagged, "<x:xmpmeta/>"...)
+	tagged = append(tagged, 0, 0x3b)
+
+	if md := ReadMetadata(tagged, "gif"); !slices.Equal(md.Removed, []string{"GIF:Comment", "XMP"}) {
+		t.Errorf("Unexpected removed metadata: %v", md.Removed)
+	}
+
+	meta := &models.ImageMetadata{UUID: "test-uuid-gif-meta", OriginalExt: "gif", OriginalWidth: 40, OriginalHeight: 20}
+	if err := SaveOriginalGIF(tagged, meta); err != nil {
+		t.Fatalf("SaveOriginalGIF failed: %v", err)
+	}
+
+	rc, _, err := Backend.Get(context.Background(), meta.OriginalPath)
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	defer rc.Close()
+	stored, _ := io.ReadAll(rc)
+
+	if !bytes.Equal(stored, buf) {
+		t.Error("Expected the stored gif to equal the untagged one")
+	}
+}
@@ -0,0 +1,73 @@
+package store
+
+import (
+	"go-image-web/internal/models"
+	"image"
+	"math/bits"
+	"sort"
+	"strconv"
+
+	"github.com/disintegration/imaging"
+)
+
+// parsed perceptual hashes keyed by uuid, guarded by ImageIndexMu
+var phashIndex = map[string]uint64{}
+
+// PerceptualHash returns a 64 bit difference hash (dHash) of img. Resized or
+// re-encoded copies of an image differ from the original in only a few bits.
+func PerceptualHash(img image.Image) uint64 {
+	// 9x8 so each row gives 8 horizontal gradients
+	small := imaging.Resize(img, 9, 8, imaging.Box)
+
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			hash <<= 1
+			if luma(small, x, y) > luma(small, x+1, y) {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+func luma(img *image.NRGBA, x, y int) int {
+	i := img.PixOffset(x, y)
+	r, g, b := int(img.Pix[i]), int(img.Pix[i+1]), int(img.Pix[i+2])
+	return (299*r + 587*g + 114*b) / 1000
+}
+
+func FormatPHash(hash uint64) string {
+	return strconv.FormatUint(hash, 16)
+}
+
+func ParsePHash(s string) (uint64, bool) {
+	if s == "" {
+		return 0, false
+	}
+	hash, err := strconv.ParseUint(s, 16, 64)
+	return hash, err == nil
+}
+
+// FindSimilarImages returns indexed images other than uuid whose perceptual
+// hash is within maxDistance bits of hash, closest first
+func FindSimilarImages(uuid string, hash uint64, maxDistance int) []models.ImageMatch {
+	ImageIndexMu.RLock()
+	defer ImageIndexMu.RUnlock()
+
+	var matches []models.ImageMatch
+	for id, other := range phashIndex {
+		if id == uuid {
+			continue
+		}
+		if d := bits.OnesCount64(hash ^ other); d <= maxDistance {
+			matches = append(matches, models.ImageMatch{UUID: id, Distance: d})
+		}
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i].Distance < matches[j].Distance
+	})
+
+	return matches
+}
@@ -0,0 +1,59 @@
+package store
+
+import (
+	"image"
+	"image/color"
+	"math/bits"
+	"testing"
+
+	"github.com/disintegration/imaging"
+)
+
+func createGradientImage(width, height int, flip bool) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			v := uint8(x * 255 / width)
+			if flip {
+				v = 255 - v
+			}
+			img.Set(x, y, color.RGBA{R: v, G: uint8(y * 255 / height), B: 128, A: 255})
+		}
+	}
+	return img
+}
+
+func TestPerceptualHash_ResizedCopyIsClose(t *testing.T) {
+	img := createGradientImage(400, 300, false)
+	resized := imaging.Resize(img, 120, 0, imaging.Lanczos)
+
+	d := bits.OnesCount64(PerceptualHash(img) ^ PerceptualHash(resized))
+	if d > 4 {
+		t.Errorf("Expected resized copy within 4 bits, got %d", d)
+	}
+}
+
+func TestPerceptualHash_DifferentImageIsFar(t *testing.T) {
+	a := PerceptualHash(createGradientImage(400, 300, false))
+	b := PerceptualHash(createGradientImage(400, 300, true))
+
+	if d := bits.OnesCount64(a ^ b); d < 20 {
+		t.Errorf("Expected different images to be far apart, got %d bits", d)
+	}
+}
+
+func TestFindSimilarImages(t *testing.T) {
+	cleanup := setupTestDirs(t)
+	defer cleanup()
+
+	ImageIndexMu.Lock()
+	phashIndex["same"] = 0xff00
+	phashIndex["close"] = 0xff01
+	phashIndex["far"] = 0x00ff
+	ImageIndexMu.Unlock()
+
+	matches := FindSimilarImages("same", 0xff00, 4)
+	if len(matches) != 1 || matches[0].UUID != "close" || matches[0].Distance != 1 {
+		t.Errorf("Unexpected matches: %+v", matches)
+	}
+}
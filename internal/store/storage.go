@@ -0,0 +1,65 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+	"time"
+)
+
+// key prefixes for each kind of stored image
+const (
+	OriginalPrefix string = "original"
+	VarientPrefix  string = "varient"
+	UploadPrefix   string = "upload"
+)
+
+// ObjectInfo describes a single stored object
+type ObjectInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// Storage is a flat object store for image files. Keys are slash separated
+// and relative, e.g. "original/{uuid}_original.jpeg". Missing objects are
+// reported with an error wrapping fs.ErrNotExist.
+type Storage interface {
+	// Put stores the contents of r under key, size may be -1 when unknown
+	Put(ctx context.Context, key string, r io.Reader, size int64) error
+	// Get opens key for streaming, the caller must close the reader
+	Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error)
+	Stat(ctx context.Context, key string) (ObjectInfo, error)
+	// Delete removes key, deleting a missing key is not an error
+	Delete(ctx context.Context, key string) error
+	// List returns every object whose key starts with prefix
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+}
+
+// Backend is the storage used for originals and varients, set by Configure
+var Backend Storage = NewLocalStorage("data/img")
+
+// OriginalKey returns the storage key of an original image
+func OriginalKey(uuid string, ext string) string {
+	return path.Join(OriginalPrefix, fmt.Sprintf("%s_original.%s", uuid, ext))
+}
+
+// VarientKey returns the storage key of a resized varient
+func VarientKey(uuid string, width int, ext string) string {
+	return path.Join(VarientPrefix, fmt.Sprintf("%s_%d.%s", uuid, width, ext))
+}
+
+// validKey rejects keys that could escape the storage root
+func validKey(key string) error {
+	if key == "" || path.IsAbs(key) || path.Clean(key) != key || strings.HasPrefix(key, "../") || key == ".." {
+		return fmt.Errorf("invalid storage key %q: %w", key, fs.ErrInvalid)
+	}
+	return nil
+}
+
+func notExist(key string) error {
+	return fmt.Errorf("storage key %q: %w", key, fs.ErrNotExist)
+}
@@ -0,0 +1,90 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// failingReader returns some bytes and then an error, like an upload cut off
+type failingReader struct {
+	r io.Reader
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	if err == io.EOF {
+		return n, errors.New("connection reset")
+	}
+	return n, err
+}
+
+func TestLocalStorage_PutAtomic(t *testing.T) {
+	root := t.TempDir()
+	s := NewLocalStorage(root)
+	ctx := context.Background()
+	key := "original/abc_original.png"
+
+	put := func(r io.Reader, size int64) error {
+		return s.Put(ctx, key, r, size)
+	}
+	contents := func() string {
+		t.Helper()
+		b, err := os.ReadFile(filepath.Join(root, filepath.FromSlash(key)))
+		if err != nil {
+			t.Fatalf("Expected the object to exist, got %v", err)
+		}
+		return string(b)
+	}
+	noTemps := func() {
+		t.Helper()
+		entries, err := os.ReadDir(filepath.Join(root, "original"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range entries {
+			if strings.HasPrefix(e.Name(), ".") {
+				t.Errorf("Expected no temp files, got %s", e.Name())
+			}
+		}
+	}
+
+	if err := put(strings.NewReader("first"), 5); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if got := contents(); got != "first" {
+		t.Errorf("Expected first, got %q", got)
+	}
+	noTemps()
+
+	// a failed write leaves the previous object whole
+	if err := put(&failingReader{r: strings.NewReader("second")}, 6); err == nil {
+		t.Error("Expected an error from a failing reader")
+	}
+	if got := contents(); got != "first" {
+		t.Errorf("Expected first after a failed write, got %q", got)
+	}
+	noTemps()
+
+	// so does a short one
+	if err := put(bytes.NewReader([]byte("sec")), 6); err == nil {
+		t.Error("Expected an error from a short write")
+	}
+	if got := contents(); got != "first" {
+		t.Errorf("Expected first after a short write, got %q", got)
+	}
+	noTemps()
+
+	if err := put(strings.NewReader("second"), -1); err != nil {
+		t.Fatalf("Put with an unknown size failed: %v", err)
+	}
+	if got := contents(); got != "second" {
+		t.Errorf("Expected second, got %q", got)
+	}
+	noTemps()
+}
@@ -0,0 +1,133 @@
+package store
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"os"
+	"path/filepath"
+
+	"github.com/disintegration/imaging"
+)
+
+// how a transform with both a width and a height treats the aspect ratio
+const (
+	// scale to cover the box and crop what's outside it
+	FitCover string = "cover"
+	// scale to fit inside the box
+	FitContain string = "contain"
+	// stretch to the box
+	FitFill string = "fill"
+)
+
+// Gravities are the parts of an image FitCover can keep
+var Gravities = map[string]imaging.Anchor{
+	"center":      imaging.Center,
+	"top":         imaging.Top,
+	"bottom":      imaging.Bottom,
+	"left":        imaging.Left,
+	"right":       imaging.Right,
+	"topleft":     imaging.TopLeft,
+	"topright":    imaging.TopRight,
+	"bottomleft":  imaging.BottomLeft,
+	"bottomright": imaging.BottomRight,
+}
+
+// quality of lossy transforms that don't ask for one
+const DefaultTransformQuality int = 85
+
+// Transform is a resized and re-encoded rendition of an original
+type Transform struct {
+	// either may be 0 to keep the aspect ratio, both to keep the size
+	Width  int
+	Height int
+	// only used with both a width and a height
+	Fit     string
+	Gravity string
+	// jpeg, png or webp
+	Format  string
+	Quality int
+}
+
+// Apply scales img as t describes
+func (t Transform) Apply(img image.Image) image.Image {
+	switch {
+	case t.Width == 0 && t.Height == 0:
+		return img
+	case t.Width == 0 || t.Height == 0:
+		return imaging.Resize(img, t.Width, t.Height, imaging.Lanczos)
+	case t.Fit == FitCover:
+		return imaging.Fill(img, t.Width, t.Height, Gravities[t.Gravity], imaging.Lanczos)
+	case t.Fit == FitFill:
+		return imaging.Resize(img, t.Width, t.Height, imaging.Lanczos)
+	default:
+		return imaging.Fit(img, t.Width, t.Height, imaging.Lanczos)
+	}
+}
+
+// local directory of transformed images, set by ConfigureTransformCache.
+// Transforms are cheap to redo, so they never go to the storage backend
+var TransformCacheDir string = "data/img/cache"
+
+// ConfigureTransformCache sets the local directory transforms are cached in
+func ConfigureTransformCache(dir string) {
+	TransformCacheDir = dir
+	CheckCreateDir(TransformCacheDir)
+}
+
+// transformPath returns where a transform of the image uuid is cached, key
+// is a hex digest of its parameters
+func transformPath(uuid string, key string, format string) (string, error) {
+	if uuid == "" || filepath.Base(uuid) != uuid || key == "" || filepath.Base(key) != key {
+		return "", fmt.Errorf("invalid transform %s/%s", uuid, key)
+	}
+	return filepath.Join(TransformCacheDir, uuid, key+"."+format), nil
+}
+
+// CachedTransform returns the path of a transform of the image uuid if it
+// is cached
+func CachedTransform(uuid string, key string, format string) (string, bool) {
+	p, err := transformPath(uuid, key, format)
+	if err != nil {
+		return "", false
+	}
+	if _, err := os.Stat(p); err != nil {
+		return "", false
+	}
+	return p, true
+}
+
+// SaveTransform applies t to img, the decoded original of the image uuid,
+// and caches the result under key, returning its path
+func SaveTransform(uuid string, key string, img image.Image, t Transform) (string, error) {
+	p, err := transformPath(uuid, key, t.Format)
+	if err != nil {
+		return "", err
+	}
+
+	// a lossless source stays lossless unless a quality was asked for
+	lossless := losslessWebP(img) && t.Quality == 0
+	quality := t.Quality
+	if quality == 0 {
+		quality = DefaultTransformQuality
+	}
+
+	var buf bytes.Buffer
+	if err := encodeImage(&buf, t.Apply(img), t.Format, quality, lossless); err != nil {
+		return "", err
+	}
+
+	if err := writeFileAtomic(p, &buf, int64(buf.Len())); err != nil {
+		return "", err
+	}
+
+	return p, nil
+}
+
+// removeTransforms deletes every cached transform of the image uuid
+func removeTransforms(uuid string) error {
+	if uuid == "" || filepath.Base(uuid) != uuid {
+		return fmt.Errorf("invalid transform %s", uuid)
+	}
+	return os.RemoveAll(filepath.Join(TransformCacheDir, uuid))
+}
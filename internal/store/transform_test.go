@@ -0,0 +1,83 @@
+package store
+
+import (
+	"image"
+	"os"
+	"testing"
+)
+
+func TestTransform_Apply(t *testing.T) {
+	img := createTestImage(200, 100)
+
+	tests := []struct {
+		name string
+		t    Transform
+		want image.Point
+	}{
+		{"nothing", Transform{Format: "png"}, image.Pt(200, 100)},
+		{"width only", Transform{Width: 100}, image.Pt(100, 50)},
+		{"height only", Transform{Height: 50}, image.Pt(100, 50)},
+		{"contain", Transform{Width: 50, Height: 50, Fit: FitContain}, image.Pt(50, 25)},
+		{"cover", Transform{Width: 50, Height: 50, Fit: FitCover, Gravity: "left"}, image.Pt(50, 50)},
+		{"fill", Transform{Width: 50, Height: 80, Fit: FitFill}, image.Pt(50, 80)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.t.Apply(img).Bounds().Size(); got != tt.want {
+				t.Errorf("Expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestSaveTransform(t *testing.T) {
+	orig := TransformCacheDir
+	defer func() { TransformCacheDir = orig }()
+	ConfigureTransformCache(t.TempDir())
+
+	uuid := "test-uuid-transform"
+	tr := Transform{Width: 40, Format: "webp"}
+	if _, ok := CachedTransform(uuid, "abcd", "webp"); ok {
+		t.Fatal("Expected nothing cached yet")
+	}
+
+	p, err := SaveTransform(uuid, "abcd", createTestImage(80, 60), tr)
+	if err != nil {
+		t.Fatalf("SaveTransform failed: %v", err)
+	}
+	if cached, ok := CachedTransform(uuid, "abcd", "webp"); !ok || cached != p {
+		t.Errorf("Expected %s to be cached, got %q", p, cached)
+	}
+
+	format, cfg := decodeFile(t, p)
+	if format != "webp" || cfg.Width != 40 || cfg.Height != 30 {
+		t.Errorf("Expected a 40x30 webp, got a %dx%d %s", cfg.Width, cfg.Height, format)
+	}
+
+	if _, err := SaveTransform("../escape", "abcd", createTestImage(8, 8), tr); err == nil {
+		t.Error("Expected an error for a uuid outside the cache")
+	}
+
+	if err := removeTransforms(uuid); err != nil {
+		t.Fatalf("removeTransforms failed: %v", err)
+	}
+	if _, ok := CachedTransform(uuid, "abcd", "webp"); ok {
+		t.Error("Expected the transform to be removed")
+	}
+}
+
+func decodeFile(t *testing.T, p string) (string, image.Config) {
+	t.Helper()
+
+	f, err := os.Open(p)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer f.Close()
+
+	cfg, format, err := image.DecodeConfig(f)
+	if err != nil {
+		t.Fatalf("DecodeConfig failed: %v", err)
+	}
+	return format, cfg
+}
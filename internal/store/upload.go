@@ -0,0 +1,294 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"go-image-web/internal/models"
+	"image"
+	"path"
+)
+
+// whether uploads are kept as sent besides the display copy, set from
+// KEEP_UPLOADS
+var KeepUploads bool
+
+// UploadKey returns the storage key of the upload kept of an image
+func UploadKey(uuid string, ext string) string {
+	return path.Join(UploadPrefix, fmt.Sprintf("%s_upload.%s", uuid, ext))
+}
+
+// SaveUpload keeps buf, the upload of the image meta describes, with its
+// metadata stripped and its image data untouched. A PNG that needs turning
+// upright is re-encoded losslessly from img, the decoded upload turned
+// upright, as browsers don't agree on its orientation. It fills in the
+// upload of meta and must come before the original is saved, which records
+// it
+func SaveUpload(meta *models.ImageMetadata, buf []byte, img image.Image, orientation int) error {
+	var out []byte
+	if meta.OriginalExt == "png" && orientation > 1 {
+		var enc bytes.Buffer
+		if err := encodeImage(&enc, img, "png", 0, true); err != nil {
+			return err
+		}
+		out = enc.Bytes()
+	} else {
+		var err error
+		if out, err = StripMetadata(buf, meta.OriginalExt, orientation); err != nil {
+			return err
+		}
+	}
+
+	key := UploadKey(meta.UUID, meta.OriginalExt)
+	size := int64(len(out))
+	if err := Backend.Put(context.Background(), key, bytes.NewReader(out), size); err != nil {
+		return err
+	}
+
+	meta.UploadPath = key
+	meta.UploadSize = size
+	return nil
+}
+
+// ContentHash returns the hex encoded sha256 an upload of format is
+// deduplicated on, that of buf less its metadata. Uploads of the same image
+// differing only in metadata or bytes after its end share it. The
+// orientation is hashed along as a PNG keeps none
+func ContentHash(buf []byte, format string, orientation int) (string, error) {
+	stripped, err := StripMetadata(buf, format, orientation)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	h.Write(stripped)
+	if orientation > 1 {
+		fmt.Fprintf(h, "orientation %d", orientation)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// StripMetadata returns buf without the metadata ReadMetadata reports,
+// leaving the image data byte for byte. Colour profiles stay as they change
+// how the pixels look, and a JPEG or WebP keeps an EXIF block with only its
+// orientation, 0 or 1 for none
+func StripMetadata(buf []byte, format string, orientation int) ([]byte, error) {
+	switch format {
+	case "jpeg":
+		return stripJPEGMetadata(buf, orientation)
+	case "png":
+		return stripPNGMetadata(buf)
+	case "webp":
+		return stripWebPMetadata(buf, orientation)
+	case "gif":
+		out, _, err := stripGIFMetadata(buf)
+		return out, err
+	default:
+		return nil, fmt.Errorf("strip metadata: unsupported format %s", format)
+	}
+}
+
+// orientationExif is a big endian TIFF structure holding only an EXIF
+// orientation
+func orientationExif(orientation int) []byte {
+	b := []byte("MM\x00\x2a\x00\x00\x00\x08")
+	b = binary.BigEndian.AppendUint16(b, 1)
+	b = binary.BigEndian.AppendUint16(b, tagOrientation)
+	// one SHORT, padded to the 4 bytes of the value field
+	b = binary.BigEndian.AppendUint16(b, 3)
+	b = binary.BigEndian.AppendUint32(b, 1)
+	b = binary.BigEndian.AppendUint16(b, uint16(orientation))
+	b = append(b, 0, 0)
+	// no next IFD
+	return binary.BigEndian.AppendUint32(b, 0)
+}
+
+// stripJPEGMetadata copies the segments of a JPEG other than comments and
+// the APPn segments besides JFIF, Adobe and ICC, then the image data up to
+// the end of image, dropping anything appended after it
+func stripJPEGMetadata(buf []byte, orientation int) ([]byte, error) {
+	if len(buf) < 2 || buf[0] != 0xff || buf[1] != 0xd8 {
+		return nil, fmt.Errorf("strip jpeg: not a jpeg")
+	}
+
+	out := append(make([]byte, 0, len(buf)), 0xff, 0xd8)
+	exifPending := orientation > 1
+
+	for i := 2; ; {
+		// a truncated image ends with its last scan
+		if i == len(buf) {
+			return out, nil
+		}
+		if i+2 > len(buf) || buf[i] != 0xff {
+			return nil, fmt.Errorf("strip jpeg: bad marker at %d", i)
+		}
+		marker := buf[i+1]
+		switch {
+		case marker == 0xff:
+			// fill byte
+			i++
+			continue
+		case marker == 0x01 || marker >= 0xd0 && marker <= 0xd7:
+			out = append(out, buf[i:i+2]...)
+			i += 2
+			continue
+		case marker == 0xd9:
+			return append(out, 0xff, 0xd9), nil
+		}
+
+		if i+4 > len(buf) {
+			return nil, fmt.Errorf("strip jpeg: truncated segment at %d", i)
+		}
+		n := int(binary.BigEndian.Uint16(buf[i+2:]))
+		if n < 2 || i+2+n > len(buf) {
+			return nil, fmt.Errorf("strip jpeg: bad segment length at %d", i)
+		}
+		seg := buf[i : i+2+n]
+		i += 2 + n
+
+		// the orientation goes straight after JFIF, which must come first
+		if exifPending && marker != 0xe0 {
+			app1 := append(append([]byte{}, exifHeader...), orientationExif(orientation)...)
+			out = append(out, 0xff, 0xe1)
+			out = binary.BigEndian.AppendUint16(out, uint16(len(app1)+2))
+			out = append(out, app1...)
+			exifPending = false
+		}
+
+		keep := true
+		switch {
+		case marker == 0xe0 || marker == 0xee:
+		case marker == 0xe2 && bytes.HasPrefix(seg[4:], iccHeader):
+		case marker >= 0xe1 && marker <= 0xef, marker == 0xfe:
+			keep = false
+		}
+		if keep {
+			out = append(out, seg...)
+		}
+
+		// the scan is copied byte for byte, the segments between the scans
+		// of a progressive jpeg are filtered like those before the first
+		if marker == 0xda {
+			end := jpegScanEnd(buf, i)
+			out = append(out, buf[i:end]...)
+			i = end
+		}
+	}
+}
+
+// jpegScanEnd returns the offset of the marker ending the entropy coded data
+// of a scan starting at i, or the length of buf when it is missing
+func jpegScanEnd(buf []byte, i int) int {
+	for i+1 < len(buf) {
+		if buf[i] != 0xff {
+			i++
+			continue
+		}
+
+		marker := buf[i+1]
+		switch {
+		case marker == 0x00 || marker >= 0xd0 && marker <= 0xd7:
+			// stuffed byte or restart marker
+			i += 2
+		case marker == 0xff:
+			// fill bytes before a marker
+			i++
+		default:
+			return i
+		}
+	}
+	return len(buf)
+}
+
+// chunks a stripped PNG keeps, those needed to show it as sent
+var pngKeptChunks = map[string]bool{
+	"IHDR": true, "PLTE": true, "IDAT": true, "IEND": true,
+	"tRNS": true, "bKGD": true, "pHYs": true, "sBIT": true,
+	"gAMA": true, "cHRM": true, "sRGB": true, "iCCP": true, "cICP": true,
+	// animated PNG
+	"acTL": true, "fcTL": true, "fdAT": true,
+}
+
+// stripPNGMetadata copies the chunks of a PNG needed to show it
+func stripPNGMetadata(buf []byte) ([]byte, error) {
+	if !bytes.HasPrefix(buf, pngSignature) {
+		return nil, fmt.Errorf("strip png: not a png")
+	}
+
+	out := append(make([]byte, 0, len(buf)), pngSignature...)
+	for i := len(pngSignature); ; {
+		if i+12 > len(buf) {
+			return nil, fmt.Errorf("strip png: truncated chunk at %d", i)
+		}
+		n := binary.BigEndian.Uint32(buf[i:])
+		typ := string(buf[i+4 : i+8])
+		if uint64(n) > uint64(len(buf)-i-12) {
+			return nil, fmt.Errorf("strip png: bad %s chunk length at %d", printable(typ), i)
+		}
+		end := i + 12 + int(n)
+
+		if pngKeptChunks[typ] {
+			out = append(out, buf[i:end]...)
+		}
+		if typ == "IEND" {
+			return out, nil
+		}
+		i = end
+	}
+}
+
+// flags of the VP8X chunk of a WebP
+const (
+	webpFlagEXIF = 0x08
+	webpFlagXMP  = 0x04
+)
+
+// stripWebPMetadata copies the chunks of a WebP other than EXIF and XMP
+func stripWebPMetadata(buf []byte, orientation int) ([]byte, error) {
+	if len(buf) < 12 || string(buf[:4]) != "RIFF" || string(buf[8:12]) != "WEBP" {
+		return nil, fmt.Errorf("strip webp: not a webp")
+	}
+
+	out := append(make([]byte, 0, len(buf)), buf[:12]...)
+	// offset of the VP8X flags in out, only the extended format has metadata
+	flags := -1
+	for i := 12; i < len(buf); {
+		if i+8 > len(buf) {
+			return nil, fmt.Errorf("strip webp: truncated chunk at %d", i)
+		}
+		fourCC := string(buf[i : i+4])
+		n := binary.LittleEndian.Uint32(buf[i+4:])
+		if uint64(n) > uint64(len(buf)-i-8) {
+			return nil, fmt.Errorf("strip webp: bad %s chunk length at %d", printable(fourCC), i)
+		}
+		// chunks are padded to an even size, the last one sometimes isn't
+		end := min(i+8+int(n)+int(n&1), len(buf))
+
+		switch fourCC {
+		case "EXIF", "XMP ":
+		case "VP8X":
+			flags = len(out) + 8
+			fallthrough
+		default:
+			out = append(out, buf[i:end]...)
+		}
+		i = end
+	}
+
+	if flags >= 0 && flags < len(out) {
+		out[flags] &^= webpFlagEXIF | webpFlagXMP
+		if orientation > 1 {
+			exif := orientationExif(orientation)
+			out = append(out, "EXIF"...)
+			out = binary.LittleEndian.AppendUint32(out, uint32(len(exif)))
+			out = append(out, exif...)
+			out[flags] |= webpFlagEXIF
+		}
+	}
+
+	binary.LittleEndian.PutUint32(out[4:], uint32(len(out)-8))
+	return out, nil
+}
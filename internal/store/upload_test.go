@@ -0,0 +1,206 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"go-image-web/internal/models"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"io"
+	"testing"
+)
+
+// pngChunk encodes a PNG chunk
+func pngChunk(typ string, data []byte) []byte {
+	out := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+	out = append(out, typ...)
+	out = append(out, data...)
+	return binary.BigEndian.AppendUint32(out, crc32.ChecksumIEEE(out[4:]))
+}
+
+func TestStripMetadata_JPEG(t *testing.T) {
+	buf := createTestJPEG(t, 30, 20)
+	// appended after the end of image, like the hidden files of some uploads
+	buf = append(buf, "PK\x03\x04 trailing"...)
+
+	out, err := StripMetadata(buf, "jpeg", 6)
+	if err != nil {
+		t.Fatalf("StripMetadata failed: %v", err)
+	}
+
+	md := ReadMetadata(out, "jpeg")
+	if len(md.Removed) != 0 || md.CameraMake != "" || md.TakenAt != nil {
+		t.Errorf("Expected only the orientation left, got %+v", md)
+	}
+	if md.Orientation != 6 {
+		t.Errorf("Expected orientation 6, got %d", md.Orientation)
+	}
+	if !bytes.HasSuffix(out, []byte{0xff, 0xd9}) {
+		t.Error("Expected the data after the end of image dropped")
+	}
+
+	// the image data is copied, not encoded again
+	sos := bytes.Index(buf, []byte{0xff, 0xda})
+	if !bytes.Contains(out, buf[sos:bytes.LastIndex(buf, []byte{0xff, 0xd9})]) {
+		t.Error("Expected the image data byte for byte")
+	}
+	want, _, err := image.Decode(bytes.NewReader(buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _, err := image.Decode(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("Stripped JPEG doesn't decode: %v", err)
+	}
+	if !bytes.Equal(got.(*image.YCbCr).Y, want.(*image.YCbCr).Y) {
+		t.Error("Expected identical pixels")
+	}
+}
+
+func TestStripMetadata_JPEGAfterScan(t *testing.T) {
+	plain := createTestJPEG(t, 30, 20)
+
+	// segments may follow any scan of a progressive jpeg, here the only one
+	eoi := len(plain) - 2
+	var buf []byte
+	buf = append(buf, plain[:eoi]...)
+	buf = append(buf, jpegSegment(0xe1, append([]byte("Exif\x00\x00"), createTestExif()...))...)
+	buf = append(buf, jpegSegment(0xfe, []byte("hidden comment"))...)
+	buf = append(buf, plain[eoi:]...)
+
+	want, err := StripMetadata(plain, "jpeg", 0)
+	if err != nil {
+		t.Fatalf("StripMetadata failed: %v", err)
+	}
+	out, err := StripMetadata(buf, "jpeg", 0)
+	if err != nil {
+		t.Fatalf("StripMetadata failed: %v", err)
+	}
+	if !bytes.Equal(out, want) {
+		t.Errorf("Expected the segments after the scan dropped, got %d bytes for %d", len(out), len(want))
+	}
+	if bytes.Contains(out, []byte("Exif")) || bytes.Contains(out, []byte("hidden comment")) {
+		t.Error("Expected no metadata left")
+	}
+	if _, _, err := image.Decode(bytes.NewReader(out)); err != nil {
+		t.Fatalf("Stripped JPEG doesn't decode: %v", err)
+	}
+}
+
+// jpegSegment encodes a marker segment holding data
+func jpegSegment(marker byte, data []byte) []byte {
+	seg := []byte{0xff, marker, byte((len(data) + 2) >> 8), byte(len(data) + 2)}
+	return append(seg, data...)
+}
+
+func TestStripMetadata_PNG(t *testing.T) {
+	var enc bytes.Buffer
+	if err := png.Encode(&enc, createTestImage(30, 20)); err != nil {
+		t.Fatal(err)
+	}
+	plain := enc.Bytes()
+
+	// text and EXIF before the image data, a timestamp after it
+	iend := len(plain) - 12
+	idat := bytes.Index(plain, []byte("IDAT")) - 4
+	var buf []byte
+	buf = append(buf, plain[:idat]...)
+	buf = append(buf, pngChunk("tEXt", []byte("Author\x00someone"))...)
+	buf = append(buf, pngChunk("eXIf", createTestExif())...)
+	buf = append(buf, plain[idat:iend]...)
+	buf = append(buf, pngChunk("tIME", make([]byte, 7))...)
+	buf = append(buf, plain[iend:]...)
+
+	if md := ReadMetadata(buf, "png"); len(md.Removed) == 0 {
+		t.Fatal("Expected the test PNG to carry metadata")
+	}
+
+	out, err := StripMetadata(buf, "png", 0)
+	if err != nil {
+		t.Fatalf("StripMetadata failed: %v", err)
+	}
+	if !bytes.Equal(out, plain) {
+		t.Errorf("Expected the PNG as encoded, got %d bytes, want %d", len(out), len(plain))
+	}
+}
+
+func TestStripMetadata_WebP(t *testing.T) {
+	var enc bytes.Buffer
+	if err := encodeImage(&enc, createTestImage(30, 20), "webp", 90, false); err != nil {
+		t.Fatal(err)
+	}
+	simple := enc.Bytes()
+
+	// the extended format with the EXIF and XMP flags set, XMP and EXIF
+	// around the image data
+	chunk := func(fourCC string, data []byte) []byte {
+		out := append([]byte(fourCC), binary.LittleEndian.AppendUint32(nil, uint32(len(data)))...)
+		out = append(out, data...)
+		if len(data)%2 == 1 {
+			out = append(out, 0)
+		}
+		return out
+	}
+	vp8x := []byte{webpFlagEXIF | webpFlagXMP, 0, 0, 0, 29, 0, 0, 19, 0, 0}
+	buf := []byte("RIFF\x00\x00\x00\x00WEBP")
+	buf = append(buf, chunk("VP8X", vp8x)...)
+	buf = append(buf, chunk("XMP ", []byte("<x:xmpmeta/>"))...)
+	buf = append(buf, simple[12:]...)
+	buf = append(buf, chunk("EXIF", createTestExif())...)
+	binary.LittleEndian.PutUint32(buf[4:], uint32(len(buf)-8))
+
+	out, err := StripMetadata(buf, "webp", 0)
+	if err != nil {
+		t.Fatalf("StripMetadata failed: %v", err)
+	}
+
+	if md := ReadMetadata(out, "webp"); len(md.Removed) != 0 || md.Orientation > 1 {
+		t.Errorf("Expected no metadata left, got %+v", md)
+	}
+	if out[20]&(webpFlagEXIF|webpFlagXMP) != 0 {
+		t.Errorf("Expected the metadata flags cleared, got %#x", out[20])
+	}
+	if size := binary.LittleEndian.Uint32(out[4:]); int(size) != len(out)-8 {
+		t.Errorf("Expected RIFF size %d, got %d", len(out)-8, size)
+	}
+	if !bytes.Contains(out, simple[12:]) {
+		t.Error("Expected the image data byte for byte")
+	}
+
+	// the orientation is kept on its own
+	out, err = StripMetadata(buf, "webp", 6)
+	if err != nil {
+		t.Fatalf("StripMetadata failed: %v", err)
+	}
+	if md := ReadMetadata(out, "webp"); len(md.Removed) != 0 || md.Orientation != 6 {
+		t.Errorf("Expected only orientation 6, got %+v", md)
+	}
+}
+
+func TestSaveUpload(t *testing.T) {
+	defer setupTestDirs(t)()
+
+	buf := createTestJPEG(t, 30, 20)
+	meta := &models.ImageMetadata{UUID: "upload", OriginalExt: "jpeg"}
+	if err := SaveUpload(meta, buf, nil, 1); err != nil {
+		t.Fatalf("SaveUpload failed: %v", err)
+	}
+	if meta.UploadPath != UploadKey("upload", "jpeg") {
+		t.Errorf("Expected upload at %s, got %s", UploadKey("upload", "jpeg"), meta.UploadPath)
+	}
+
+	rc, info, err := Backend.Get(context.Background(), meta.UploadPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	stored, _ := io.ReadAll(rc)
+	if info.Size != meta.UploadSize || int64(len(stored)) != meta.UploadSize {
+		t.Errorf("Expected %d bytes stored, got %d", meta.UploadSize, len(stored))
+	}
+	if md := ReadMetadata(stored, "jpeg"); len(md.Removed) != 0 || md.CameraMake != "" {
+		t.Errorf("Expected the stored upload stripped, got %+v", md)
+	}
+}
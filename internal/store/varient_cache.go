@@ -0,0 +1,137 @@
+package store
+
+import (
+	"container/list"
+	"context"
+	"go-image-web/internal/models"
+	"log"
+	"sync"
+)
+
+// varientCache tracks generated varients in least recently served order and
+// evicts from the back once their total size exceeds the budget. Originals
+// are never tracked, so never evicted.
+type varientCache struct {
+	mu     sync.Mutex
+	budget int64
+	used   int64
+	order  *list.List // front is most recently served
+	items  map[string]*list.Element
+}
+
+type cacheEntry struct {
+	uuid    string
+	varient models.ImageVarient
+}
+
+var varients = &varientCache{
+	order: list.New(),
+	items: make(map[string]*list.Element),
+}
+
+// SetVarientCacheBudget caps the total bytes of stored varients, 0 disables the cap
+func SetVarientCacheBudget(bytes int64) {
+	varients.mu.Lock()
+	varients.budget = bytes
+	varients.mu.Unlock()
+
+	evictVarients()
+}
+
+// VarientCacheUsage returns the bytes used by varients and the budget
+func VarientCacheUsage() (int64, int64) {
+	varients.mu.Lock()
+	defer varients.mu.Unlock()
+	return varients.used, varients.budget
+}
+
+// TouchVarient marks a varient as just served
+func TouchVarient(v models.ImageVarient) {
+	varients.mu.Lock()
+	defer varients.mu.Unlock()
+
+	if el, ok := varients.items[v.Path]; ok {
+		varients.order.MoveToFront(el)
+	}
+}
+
+// trackVarient adds a stored varient to the cache, most recently served first
+func trackVarient(uuid string, v models.ImageVarient) {
+	varients.mu.Lock()
+	if el, ok := varients.items[v.Path]; ok {
+		varients.used -= el.Value.(*cacheEntry).varient.Size
+		varients.order.Remove(el)
+	}
+	varients.items[v.Path] = varients.order.PushFront(&cacheEntry{uuid: uuid, varient: v})
+	varients.used += v.Size
+	varients.mu.Unlock()
+
+	evictVarients()
+}
+
+// untrackVarient forgets a varient without deleting it
+func untrackVarient(key string) {
+	varients.mu.Lock()
+	defer varients.mu.Unlock()
+
+	if el, ok := varients.items[key]; ok {
+		varients.used -= el.Value.(*cacheEntry).varient.Size
+		varients.order.Remove(el)
+		delete(varients.items, key)
+	}
+}
+
+// resetVarientCache empties the cache without deleting anything
+func resetVarientCache() {
+	varients.mu.Lock()
+	defer varients.mu.Unlock()
+
+	varients.order.Init()
+	varients.items = make(map[string]*list.Element)
+	varients.used = 0
+}
+
+// evictVarients deletes least recently served varients until usage fits the budget
+func evictVarients() {
+	for {
+		varients.mu.Lock()
+		if varients.budget <= 0 || varients.used <= varients.budget {
+			varients.mu.Unlock()
+			return
+		}
+
+		// never evict the varient that was just served
+		el := varients.order.Back()
+		if el == nil || el == varients.order.Front() {
+			varients.mu.Unlock()
+			return
+		}
+		entry := el.Value.(*cacheEntry)
+		varients.used -= entry.varient.Size
+		varients.order.Remove(el)
+		delete(varients.items, entry.varient.Path)
+		varients.mu.Unlock()
+
+		if err := deleteVarient(entry.uuid, entry.varient); err != nil {
+			log.Printf("failed to evict varient %s: %v", entry.varient.Path, err)
+			continue
+		}
+		log.Printf("evicted varient %s (%d bytes)", entry.varient.Path, entry.varient.Size)
+	}
+}
+
+// deleteVarient removes a varient from the index, database and storage,
+// it is regenerated on the next request
+func deleteVarient(uuid string, v models.ImageVarient) error {
+	if meta := GetGuidImageMetadata(uuid); meta != nil {
+		meta.RemoveVariant(v.Width, v.Ext)
+	}
+
+	if imageRepo != nil {
+		if err := imageRepo.DeleteVarient(uuid, v.Width, v.Ext); err != nil {
+			return err
+		}
+	}
+
+	return Backend.Delete(context.Background(), v.Path)
+}
@@ -0,0 +1,52 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"go-image-web/internal/models"
+	"io/fs"
+	"testing"
+)
+
+func TestVarientCache_EvictsLeastRecentlyServed(t *testing.T) {
+	cleanup := setupTestDirs(t)
+	defer cleanup()
+	resetVarientCache()
+	defer SetVarientCacheBudget(0)
+
+	img := createTestImage(100, 100)
+	uuid := "test-uuid-cache"
+	if err := SaveOriginalImage(img, &models.ImageMetadata{UUID: uuid, OriginalExt: "png", OriginalWidth: 100, OriginalHeight: 100}); err != nil {
+		t.Fatalf("SaveOriginalImage failed: %v", err)
+	}
+
+	for _, w := range []int{10, 20, 30} {
+		if err := SaveVarientImage(uuid, img, w, "png"); err != nil {
+			t.Fatalf("SaveVarientImage failed: %v", err)
+		}
+	}
+
+	// serve the oldest so the middle one becomes least recently served
+	meta := GetGuidImageMetadata(uuid)
+	v10, _ := meta.GetVariant(10, "png")
+	TouchVarient(v10)
+
+	used, _ := VarientCacheUsage()
+	v20, _ := meta.GetVariant(20, "png")
+	SetVarientCacheBudget(used - 1)
+
+	if _, ok := meta.GetVariant(20, "png"); ok {
+		t.Error("Expected least recently served varient to be evicted")
+	}
+	if _, err := Backend.Stat(context.Background(), v20.Path); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected evicted varient file to be deleted, got %v", err)
+	}
+	for _, w := range []int{10, 30} {
+		if _, ok := meta.GetVariant(w, "png"); !ok {
+			t.Errorf("Expected varient %d to be kept", w)
+		}
+	}
+	if _, err := Backend.Stat(context.Background(), meta.OriginalPath); err != nil {
+		t.Errorf("Expected original to be kept, got %v", err)
+	}
+}
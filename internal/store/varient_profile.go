@@ -0,0 +1,156 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"os"
+	"slices"
+
+	"github.com/disintegration/imaging"
+)
+
+// FormatOriginal in a profile's formats stands for the format of the
+// original, png for a GIF
+const FormatOriginal string = "original"
+
+// VarientProfile describes the varients generated of every image
+type VarientProfile struct {
+	Name string `json:"-"`
+	// widths in pixels, animations also get those narrower than the original
+	Widths []int `json:"widths"`
+	// encodings of still varients, the first is served to browsers that
+	// take none of the others
+	Formats []string `json:"formats"`
+	// quality of the lossy formats, 1 to 100
+	Quality int `json:"quality"`
+	// resampling filter, a key of ResampleFilters
+	Filter string `json:"filter"`
+	// sigma of an unsharp mask applied after resizing, 0 for none
+	Sharpen float64 `json:"sharpen"`
+}
+
+// ResampleFilters are the filters a profile can resize with
+var ResampleFilters = map[string]imaging.ResampleFilter{
+	"lanczos":    imaging.Lanczos,
+	"catmullrom": imaging.CatmullRom,
+	"mitchell":   imaging.MitchellNetravali,
+	"linear":     imaging.Linear,
+	"box":        imaging.Box,
+	"nearest":    imaging.NearestNeighbor,
+}
+
+// DefaultVarientProfile is used when no profile is configured
+var DefaultVarientProfile = VarientProfile{
+	Name:    "default",
+	Widths:  []int{600, 800, 1200, 1600},
+	Formats: []string{FormatOriginal, "webp"},
+	Quality: 95,
+	Filter:  "lanczos",
+}
+
+// profile varients are generated with, set by SetVarientProfile
+var varientProfile = DefaultVarientProfile
+
+// SetVarientProfile sets the profile new varients are generated with
+func SetVarientProfile(p VarientProfile) {
+	varientProfile = p
+}
+
+// ActiveVarientProfile returns the profile new varients are generated with
+func ActiveVarientProfile() VarientProfile {
+	return varientProfile
+}
+
+// LoadVarientProfile returns the profile called name from the JSON file at
+// path, an object of profiles by name. Settings a profile leaves out are
+// taken from DefaultVarientProfile, which is also what "default" means
+// unless the file has its own
+func LoadVarientProfile(path string, name string) (VarientProfile, error) {
+	profiles := map[string]VarientProfile{}
+	if path != "" {
+		buf, err := os.ReadFile(path)
+		if err != nil {
+			return VarientProfile{}, fmt.Errorf("varient profiles: %w", err)
+		}
+		if err := json.Unmarshal(buf, &profiles); err != nil {
+			return VarientProfile{}, fmt.Errorf("varient profiles %s: %w", path, err)
+		}
+	}
+
+	p, ok := profiles[name]
+	switch {
+	case ok:
+	case name == DefaultVarientProfile.Name:
+		return DefaultVarientProfile, nil
+	default:
+		return VarientProfile{}, fmt.Errorf("varient profile %q not found in %q", name, path)
+	}
+
+	p.Name = name
+	if p.Widths == nil {
+		p.Widths = DefaultVarientProfile.Widths
+	}
+	if p.Formats == nil {
+		p.Formats = DefaultVarientProfile.Formats
+	}
+	if p.Quality == 0 {
+		p.Quality = DefaultVarientProfile.Quality
+	}
+	if p.Filter == "" {
+		p.Filter = DefaultVarientProfile.Filter
+	}
+
+	if err := p.validate(); err != nil {
+		return VarientProfile{}, fmt.Errorf("varient profile %q: %w", name, err)
+	}
+
+	p.Widths = slices.Clone(p.Widths)
+	slices.Sort(p.Widths)
+	p.Widths = slices.Compact(p.Widths)
+	return p, nil
+}
+
+func (p VarientProfile) validate() error {
+	if len(p.Widths) == 0 {
+		return fmt.Errorf("no widths")
+	}
+	for _, w := range p.Widths {
+		if w < 1 {
+			return fmt.Errorf("invalid width %d", w)
+		}
+	}
+
+	if len(p.Formats) == 0 {
+		return fmt.Errorf("no formats")
+	}
+	for _, f := range p.Formats {
+		switch f {
+		case FormatOriginal, "jpeg", "png", "webp":
+		default:
+			return fmt.Errorf("unsupported format %q, expected original, jpeg, png or webp", f)
+		}
+	}
+
+	if p.Quality < 1 || p.Quality > 100 {
+		return fmt.Errorf("invalid quality %d, expected 1 to 100", p.Quality)
+	}
+	if _, ok := ResampleFilters[p.Filter]; !ok {
+		return fmt.Errorf("unknown filter %q", p.Filter)
+	}
+	if p.Sharpen < 0 {
+		return fmt.Errorf("invalid sharpen %g", p.Sharpen)
+	}
+
+	return nil
+}
+
+// resize scales img to wpx by hpx with the profile's filter and sharpening,
+// hpx 0 keeps the aspect ratio
+func (p VarientProfile) resize(img image.Image, wpx int, hpx int) *image.NRGBA {
+	resized := imaging.Resize(img, wpx, hpx, ResampleFilters[p.Filter])
+	if p.Sharpen > 0 {
+		resized = imaging.Sharpen(resized, p.Sharpen)
+	}
+	return resized
+}
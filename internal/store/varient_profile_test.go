@@ -0,0 +1,46 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestLoadVarientProfile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "profiles.json")
+	err := os.WriteFile(path, []byte(`{
+		"small": {"widths": [640, 320, 640], "sharpen": 0.5},
+		"bad": {"formats": ["avif"]}
+	}`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := LoadVarientProfile(path, "small")
+	if err != nil {
+		t.Fatalf("LoadVarientProfile failed: %v", err)
+	}
+	if !slices.Equal(p.Widths, []int{320, 640}) {
+		t.Errorf("Expected widths [320 640], got %v", p.Widths)
+	}
+	if p.Quality != DefaultVarientProfile.Quality || p.Filter != DefaultVarientProfile.Filter {
+		t.Errorf("Expected unset settings from the default profile, got %+v", p)
+	}
+	if p.Sharpen != 0.5 || p.Name != "small" {
+		t.Errorf("Expected small with sharpen 0.5, got %+v", p)
+	}
+
+	// the default needs no file
+	p, err = LoadVarientProfile("", "default")
+	if err != nil || !slices.Equal(p.Widths, DefaultVarientProfile.Widths) {
+		t.Errorf("Expected the default profile, got %+v, %v", p, err)
+	}
+
+	if _, err := LoadVarientProfile(path, "bad"); err == nil {
+		t.Error("Expected an error for an unsupported format")
+	}
+	if _, err := LoadVarientProfile(path, "missing"); err == nil {
+		t.Error("Expected an error for an unknown profile")
+	}
+}
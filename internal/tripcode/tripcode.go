@@ -0,0 +1,72 @@
+// Package tripcode makes the tripcodes posters sign their names with, so
+// others can tell them apart without accounts. A tripcode is a hash of a
+// password given with the name as Name#password, or Name##password for a
+// secure one.
+package tripcode
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+)
+
+// characters of a tripcode after its ! or !!
+const Length int = 10
+
+// Parse splits field, the name a poster gave, into the name shown and its
+// tripcode, empty without a password. Secure tripcodes are keyed with
+// secret
+func Parse(field string, secret []byte) (name string, trip string) {
+	name, password, found := strings.Cut(field, "#")
+	if !found {
+		return field, ""
+	}
+
+	if secure, ok := strings.CutPrefix(password, "#"); ok {
+		if secure == "" {
+			return name, ""
+		}
+		return name, "!!" + Secure(secure, secret)
+	}
+	if password == "" {
+		return name, ""
+	}
+	return name, "!" + Classic(password)
+}
+
+// futaba escaped names before making tripcodes of them, so the same
+// password gives the same tripcode here as on boards that still do
+var futabaEscaper = strings.NewReplacer("&", "&amp;", "\"", "&quot;", "<", "&lt;", ">", "&gt;")
+
+// the characters outside '.' to 'z' a salt may have, and what they become
+var saltReplacer = strings.NewReplacer(
+	":", "A", ";", "B", "<", "C", "=", "D", ">", "E", "?", "F", "@", "G",
+	"[", "a", "\\", "b", "]", "c", "^", "d", "_", "e", "`", "f",
+)
+
+// Classic returns the tripcode of password as imageboards have long made
+// them, from the crypt(3) of its first 8 bytes salted with its second and
+// third. Passwords are taken as UTF-8, those outside ASCII don't match the
+// tripcodes of boards using Shift JIS
+func Classic(password string) string {
+	password = futabaEscaper.Replace(password)
+
+	salt := []byte((password + "H..")[1:3])
+	for i, c := range salt {
+		if c < '.' || c > 'z' {
+			salt[i] = '.'
+		}
+	}
+
+	hash := crypt(password, saltReplacer.Replace(string(salt)))
+	return hash[len(hash)-Length:]
+}
+
+// Secure returns the tripcode of password keyed with secret, which can't
+// be found from the password alone like a classic one can
+func Secure(password string, secret []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(password))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))[:Length]
+}
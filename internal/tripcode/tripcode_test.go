@@ -0,0 +1,69 @@
+package tripcode
+
+import "testing"
+
+func TestCrypt(t *testing.T) {
+	// from crypt(3)
+	tests := [][3]string{
+		{"test", "es", "esH.CzKQna1OU"},
+		{"password", "as", "as1ozOtJW9BFA"},
+		{"", "..", "..X8NBuQ4l6uQ"},
+		{"longerthan8chars", "zz", "zz6XwEAsbAWcE"},
+		{"!@#$%^&*", "AB", "ABMIoUtQc7UFI"},
+	}
+	for _, tt := range tests {
+		if got := crypt(tt[0], tt[1]); got != tt[2] {
+			t.Errorf("crypt(%q, %q): expected %s, got %s", tt[0], tt[1], tt[2], got)
+		}
+	}
+}
+
+func TestClassic(t *testing.T) {
+	tests := map[string]string{
+		"test":  ".CzKQna1OU",
+		"x":     "sJh8mwqDUo",
+		"a&b":   "vbZwEe8/SY",
+		"pass:": "eWHktZdnhM",
+		"c[]d":  "iKOT9Z0/eM",
+	}
+	for password, want := range tests {
+		if got := Classic(password); got != want {
+			t.Errorf("Classic(%q): expected %s, got %s", password, want, got)
+		}
+	}
+}
+
+func TestSecure(t *testing.T) {
+	a := Secure("password", []byte("one"))
+	if len(a) != Length {
+		t.Errorf("Expected %d characters, got %q", Length, a)
+	}
+	if b := Secure("password", []byte("one")); a != b {
+		t.Errorf("Expected the same tripcode, got %s and %s", a, b)
+	}
+	if b := Secure("password", []byte("two")); a == b {
+		t.Error("Expected another secret to give another tripcode")
+	}
+}
+
+func TestParse(t *testing.T) {
+	secret := []byte("secret")
+	tests := []struct {
+		field, name, trip string
+	}{
+		{"Anon", "Anon", ""},
+		{"Anon#test", "Anon", "!.CzKQna1OU"},
+		{"#test", "", "!.CzKQna1OU"},
+		{"Anon##test", "Anon", "!!" + Secure("test", secret)},
+		{"##test", "", "!!" + Secure("test", secret)},
+		{"Anon#", "Anon", ""},
+		{"Anon##", "Anon", ""},
+		{"Anon#a#b", "Anon", "!" + Classic("a#b")},
+	}
+	for _, tt := range tests {
+		name, trip := Parse(tt.field, secret)
+		if name != tt.name || trip != tt.trip {
+			t.Errorf("Parse(%q): expected %q %q, got %q %q", tt.field, tt.name, tt.trip, name, trip)
+		}
+	}
+}
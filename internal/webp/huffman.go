@@ -0,0 +1,295 @@
+package webp
+
+import (
+	"cmp"
+	"math/bits"
+	"slices"
+)
+
+const (
+	// longest code the VP8L decoder accepts
+	maxCodeLength = 15
+	// code lengths are themselves coded with lengths of 3 bits
+	maxCodeLengthCodeLength = 7
+)
+
+// the order code length code lengths are written in, section 5.2.2
+var codeLengthCodeOrder = [19]uint8{
+	17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15,
+}
+
+// bitWriter packs values least significant bit first, as VP8L reads them
+type bitWriter struct {
+	buf  []byte
+	bits uint64
+	n    uint
+}
+
+// write appends the low n bits of v, n is at most 32
+func (b *bitWriter) write(v uint32, n uint) {
+	b.bits |= uint64(v) << b.n
+	b.n += n
+	for b.n >= 8 {
+		b.buf = append(b.buf, byte(b.bits))
+		b.bits >>= 8
+		b.n -= 8
+	}
+}
+
+// append writes everything written to o
+func (b *bitWriter) append(o *bitWriter) {
+	for _, c := range o.buf {
+		b.write(uint32(c), 8)
+	}
+	b.write(uint32(o.bits), o.n)
+}
+
+// len returns the number of bits written
+func (b *bitWriter) len() int {
+	return 8*len(b.buf) + int(b.n)
+}
+
+// bytes flushes any partial byte and returns the written bytes
+func (b *bitWriter) bytes() []byte {
+	if b.n > 0 {
+		b.buf = append(b.buf, byte(b.bits))
+		b.bits, b.n = 0, 0
+	}
+	return b.buf
+}
+
+// huffmanCode holds the canonical code of each symbol, bit reversed so it
+// can be written least significant bit first
+type huffmanCode struct {
+	codes []uint16
+	bits  []uint8
+}
+
+func newHuffmanCode(lengths []uint8) huffmanCode {
+	c := huffmanCode{
+		codes: make([]uint16, len(lengths)),
+		bits:  make([]uint8, len(lengths)),
+	}
+
+	// a lone symbol takes no bits at all
+	used := 0
+	for _, l := range lengths {
+		if l > 0 {
+			used++
+		}
+	}
+	if used < 2 {
+		return c
+	}
+
+	var count [maxCodeLength + 1]uint16
+	for _, l := range lengths {
+		count[l]++
+	}
+	count[0] = 0
+
+	var next [maxCodeLength + 2]uint16
+	for l := 1; l <= maxCodeLength; l++ {
+		next[l+1] = (next[l] + count[l]) << 1
+	}
+
+	for s, l := range lengths {
+		if l == 0 {
+			continue
+		}
+		code := next[l]
+		next[l]++
+		c.codes[s] = bits.Reverse16(code) >> (16 - l)
+		c.bits[s] = l
+	}
+
+	return c
+}
+
+func (c *huffmanCode) write(bw *bitWriter, symbol int) {
+	bw.write(uint32(c.codes[symbol]), uint(c.bits[symbol]))
+}
+
+// huffmanLengths returns optimal code lengths for the symbol counts, no
+// longer than limit
+func huffmanLengths(counts []uint32, limit int) []uint8 {
+	lengths := make([]uint8, len(counts))
+
+	var symbols []int
+	for s, c := range counts {
+		if c > 0 {
+			symbols = append(symbols, s)
+		}
+	}
+	switch len(symbols) {
+	case 0:
+		return lengths
+	case 1:
+		lengths[symbols[0]] = 1
+		return lengths
+	}
+
+	// flatten the distribution until the tree is shallow enough
+	for floor := uint32(1); ; floor *= 2 {
+		if buildLengths(counts, symbols, floor, lengths) <= limit {
+			return lengths
+		}
+	}
+}
+
+// buildLengths fills in the depth of each symbol in a Huffman tree built
+// from counts raised to at least floor, returning the deepest
+func buildLengths(counts []uint32, symbols []int, floor uint32, lengths []uint8) int {
+	type node struct {
+		weight      uint64
+		left, right int // children, or -1 and the symbol for a leaf
+	}
+
+	nodes := make([]node, 0, 2*len(symbols)-1)
+	for _, s := range symbols {
+		nodes = append(nodes, node{weight: uint64(max(counts[s], floor)), left: -1, right: s})
+	}
+	slices.SortStableFunc(nodes, func(a, b node) int {
+		return cmp.Compare(a.weight, b.weight)
+	})
+
+	// merged nodes are created in order of weight, so two queues replace a heap
+	leaves := len(nodes)
+	i, j := 0, leaves
+	pick := func() int {
+		if i < leaves && (j >= len(nodes) || nodes[i].weight <= nodes[j].weight) {
+			i++
+			return i - 1
+		}
+		j++
+		return j - 1
+	}
+	for k := 1; k < leaves; k++ {
+		a, b := pick(), pick()
+		nodes = append(nodes, node{weight: nodes[a].weight + nodes[b].weight, left: a, right: b})
+	}
+
+	deepest := 0
+	var walk func(n, depth int)
+	walk = func(n, depth int) {
+		if nodes[n].left < 0 {
+			lengths[nodes[n].right] = uint8(depth)
+			deepest = max(deepest, depth)
+			return
+		}
+		walk(nodes[n].left, depth+1)
+		walk(nodes[n].right, depth+1)
+	}
+	walk(len(nodes)-1, 0)
+
+	return deepest
+}
+
+// writeHuffmanCode writes the code lengths of an alphabet, section 5.2.2
+func writeHuffmanCode(bw *bitWriter, lengths []uint8) {
+	var symbols []int
+	for s, l := range lengths {
+		if l > 0 {
+			symbols = append(symbols, s)
+		}
+	}
+
+	// up to two small symbols are listed directly
+	if len(symbols) <= 2 && (len(symbols) == 0 || symbols[len(symbols)-1] < 256) {
+		if len(symbols) == 0 {
+			symbols = []int{0}
+		}
+		bw.write(1, 1)
+		bw.write(uint32(len(symbols)-1), 1)
+		if symbols[0] < 2 {
+			bw.write(0, 1)
+			bw.write(uint32(symbols[0]), 1)
+		} else {
+			bw.write(1, 1)
+			bw.write(uint32(symbols[0]), 8)
+		}
+		if len(symbols) == 2 {
+			bw.write(uint32(symbols[1]), 8)
+		}
+		return
+	}
+
+	bw.write(0, 1)
+
+	tokens := codeLengthTokens(lengths)
+	var counts [19]uint32
+	for _, t := range tokens {
+		counts[t.code]++
+	}
+	clLengths := huffmanLengths(counts[:], maxCodeLengthCodeLength)
+	clCode := newHuffmanCode(clLengths)
+
+	n := len(codeLengthCodeOrder)
+	for n > 4 && clLengths[codeLengthCodeOrder[n-1]] == 0 {
+		n--
+	}
+	bw.write(uint32(n-4), 4)
+	for _, s := range codeLengthCodeOrder[:n] {
+		bw.write(uint32(clLengths[s]), 3)
+	}
+
+	bw.write(0, 1) // lengths for the whole alphabet follow
+	for _, t := range tokens {
+		clCode.write(bw, int(t.code))
+		switch t.code {
+		case 16:
+			bw.write(uint32(t.extra), 2)
+		case 17:
+			bw.write(uint32(t.extra), 3)
+		case 18:
+			bw.write(uint32(t.extra), 7)
+		}
+	}
+}
+
+type codeLengthToken struct {
+	code  uint8
+	extra uint8
+}
+
+// codeLengthTokens run length encodes code lengths: 16 repeats the previous
+// length 3-6 times, 17 and 18 are runs of 3-10 and 11-138 zeros
+func codeLengthTokens(lengths []uint8) []codeLengthToken {
+	var tokens []codeLengthToken
+	for i := 0; i < len(lengths); {
+		l := lengths[i]
+		run := 1
+		for i+run < len(lengths) && lengths[i+run] == l {
+			run++
+		}
+		i += run
+
+		if l == 0 {
+			for run >= 11 {
+				n := min(run, 138)
+				tokens = append(tokens, codeLengthToken{18, uint8(n - 11)})
+				run -= n
+			}
+			if run >= 3 {
+				tokens = append(tokens, codeLengthToken{17, uint8(run - 3)})
+				run = 0
+			}
+			for ; run > 0; run-- {
+				tokens = append(tokens, codeLengthToken{0, 0})
+			}
+			continue
+		}
+
+		tokens = append(tokens, codeLengthToken{l, 0})
+		run--
+		for run >= 3 {
+			n := min(run, 6)
+			tokens = append(tokens, codeLengthToken{16, uint8(n - 3)})
+			run -= n
+		}
+		for ; run > 0; run-- {
+			tokens = append(tokens, codeLengthToken{l, 0})
+		}
+	}
+	return tokens
+}
@@ -0,0 +1,626 @@
+package webp
+
+import (
+	"image"
+	"slices"
+)
+
+// The VP8L lossless bitstream is specified at
+// https://developers.google.com/speed/webp/docs/webp_lossless_bitstream_specification
+
+const (
+	transformPredictor     = 0
+	transformSubtractGreen = 2
+	transformColorIndexing = 3
+
+	// predictor modes are chosen per 16x16 tile
+	predictorBits = 4
+	nPredictors   = 14
+
+	nLiteralCodes  = 256
+	nLengthCodes   = 24
+	nDistanceCodes = 40
+
+	colorCacheBits       = 10
+	colorCacheMultiplier = 0x1e35a7bd
+
+	// backward references
+	minMatch    = 3
+	maxMatch    = 4096
+	maxDistance = 1<<20 - 120
+	hashBits    = 18
+	maxChain    = 32
+)
+
+// the 2D neighbourhood short distance codes map to, section 4.2.2
+var distanceMapTable = [120]uint8{
+	0x18, 0x07, 0x17, 0x19, 0x28, 0x06, 0x27, 0x29, 0x16, 0x1a,
+	0x26, 0x2a, 0x38, 0x05, 0x37, 0x39, 0x15, 0x1b, 0x36, 0x3a,
+	0x25, 0x2b, 0x48, 0x04, 0x47, 0x49, 0x14, 0x1c, 0x35, 0x3b,
+	0x46, 0x4a, 0x24, 0x2c, 0x58, 0x45, 0x4b, 0x34, 0x3c, 0x03,
+	0x57, 0x59, 0x13, 0x1d, 0x56, 0x5a, 0x23, 0x2d, 0x44, 0x4c,
+	0x55, 0x5b, 0x33, 0x3d, 0x68, 0x02, 0x67, 0x69, 0x12, 0x1e,
+	0x66, 0x6a, 0x22, 0x2e, 0x54, 0x5c, 0x43, 0x4d, 0x65, 0x6b,
+	0x32, 0x3e, 0x78, 0x01, 0x77, 0x79, 0x53, 0x5d, 0x11, 0x1f,
+	0x64, 0x6c, 0x42, 0x4e, 0x76, 0x7a, 0x21, 0x2f, 0x75, 0x7b,
+	0x31, 0x3f, 0x63, 0x6d, 0x52, 0x5e, 0x00, 0x74, 0x7c, 0x41,
+	0x4f, 0x10, 0x20, 0x62, 0x6e, 0x30, 0x73, 0x7d, 0x51, 0x5f,
+	0x40, 0x72, 0x7e, 0x61, 0x6f, 0x50, 0x71, 0x7f, 0x60, 0x70,
+}
+
+// encodeLossless returns the VP8L chunk for img
+func encodeLossless(img *image.NRGBA) []byte {
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+
+	argb := make([]uint32, w*h)
+	hasAlpha := false
+	for i := range argb {
+		p := img.Pix[4*i : 4*i+4]
+		if p[3] != 0xff {
+			hasAlpha = true
+		}
+		// the colour of an invisible pixel doesn't matter, zero compresses best
+		if p[3] != 0 {
+			argb[i] = uint32(p[3])<<24 | uint32(p[0])<<16 | uint32(p[1])<<8 | uint32(p[2])
+		}
+	}
+
+	bw := &bitWriter{}
+	bw.write(0x2f, 8)
+	bw.write(uint32(w-1), 14)
+	bw.write(uint32(h-1), 14)
+	bw.write(btou(hasAlpha), 1)
+	bw.write(0, 3) // version
+	bw.append(writeImage(argb, w, h, true))
+
+	return bw.bytes()
+}
+
+// encodeAlpha returns the ALPH chunk for img, its alpha values compressed as
+// the green channel of a headerless VP8L image
+func encodeAlpha(img *image.NRGBA) []byte {
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+
+	argb := make([]uint32, w*h)
+	for i := range argb {
+		argb[i] = uint32(img.Pix[4*i+3]) << 8
+	}
+
+	// no pre-processing, no filtering, lossless compression
+	bw := &bitWriter{buf: []byte{1}}
+	bw.append(writeImage(argb, w, h, false))
+
+	return bw.bytes()
+}
+
+// writeImage returns the transforms and entropy coded pixels of an image,
+// indexed by a palette when it has few enough colours and that comes out
+// smaller than prediction. subtractGreen decorrelates the colour channels,
+// it only helps when there are any
+func writeImage(argb []uint32, w, h int, subtractGreen bool) *bitWriter {
+	best := writePredicted(argb, w, h, subtractGreen)
+
+	if palette, ok := buildPalette(argb); ok {
+		if indexed := writeIndexed(argb, w, h, palette); indexed.len() < best.len() {
+			best = indexed
+		}
+	}
+
+	return best
+}
+
+// writePredicted codes each pixel as its difference from a prediction made
+// from the pixels above and to the left
+func writePredicted(argb []uint32, w, h int, subtractGreen bool) *bitWriter {
+	bw := &bitWriter{}
+
+	pix := slices.Clone(argb)
+	if subtractGreen {
+		for i, p := range pix {
+			g := p >> 8 & 0xff
+			pix[i] = p&0xff00ff00 | (p>>16-g)&0xff<<16 | (p-g)&0xff
+		}
+		bw.write(1, 1)
+		bw.write(transformSubtractGreen, 2)
+	}
+
+	modes, residuals := predict(pix, w, h)
+	bw.write(1, 1)
+	bw.write(transformPredictor, 2)
+	bw.write(predictorBits-2, 3)
+	writePixels(bw, modes, nTiles(w, predictorBits), nTiles(h, predictorBits), false)
+
+	bw.write(0, 1) // no more transforms
+	writePixels(bw, residuals, w, h, true)
+
+	return bw
+}
+
+// writeIndexed codes each pixel as an index into palette, packing several
+// to a pixel when the palette is small
+func writeIndexed(argb []uint32, w, h int, palette []uint32) *bitWriter {
+	bw := &bitWriter{}
+	bw.write(1, 1)
+	bw.write(transformColorIndexing, 2)
+	bw.write(uint32(len(palette)-1), 8)
+
+	// the palette is coded as differences from the previous entry
+	deltas := make([]uint32, len(palette))
+	deltas[0] = palette[0]
+	for i := 1; i < len(palette); i++ {
+		deltas[i] = subPixels(palette[i], palette[i-1])
+	}
+	writePixels(bw, deltas, len(palette), 1, false)
+	bw.write(0, 1) // no more transforms
+
+	index := make(map[uint32]uint32, len(palette))
+	for i, c := range palette {
+		index[c] = uint32(i)
+	}
+
+	var xBits uint
+	switch {
+	case len(palette) <= 2:
+		xBits = 3
+	case len(palette) <= 4:
+		xBits = 2
+	case len(palette) <= 16:
+		xBits = 1
+	}
+	bitsPerPixel := 8 >> xBits
+	pw := nTiles(w, xBits)
+
+	packed := make([]uint32, pw*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			shift := 8 + bitsPerPixel*(x&(1<<xBits-1))
+			packed[y*pw+x>>xBits] |= index[argb[y*w+x]] << shift
+		}
+	}
+	writePixels(bw, packed, pw, h, true)
+
+	return bw
+}
+
+// buildPalette returns the distinct colours of argb when there are at most 256
+func buildPalette(argb []uint32) ([]uint32, bool) {
+	seen := make(map[uint32]struct{})
+	for _, p := range argb {
+		if _, ok := seen[p]; ok {
+			continue
+		}
+		if len(seen) == 256 {
+			return nil, false
+		}
+		seen[p] = struct{}{}
+	}
+
+	palette := make([]uint32, 0, len(seen))
+	for c := range seen {
+		palette = append(palette, c)
+	}
+	slices.Sort(palette)
+
+	return palette, true
+}
+
+// predict picks the predictor for each tile with the smallest residuals and
+// returns the tile modes along with the residuals
+func predict(pix []uint32, w, h int) ([]uint32, []uint32) {
+	tw, th := nTiles(w, predictorBits), nTiles(h, predictorBits)
+	modes := make([]uint32, tw*th)
+	residuals := make([]uint32, len(pix))
+
+	for ty := 0; ty < th; ty++ {
+		for tx := 0; tx < tw; tx++ {
+			x0, y0 := tx<<predictorBits, ty<<predictorBits
+			x1, y1 := min(x0+1<<predictorBits, w), min(y0+1<<predictorBits, h)
+
+			// the first row and column have fixed predictors
+			best, bestCost := 0, -1
+			for mode := 0; mode < nPredictors; mode++ {
+				cost := 0
+				for y := max(y0, 1); y < y1 && (bestCost < 0 || cost < bestCost); y++ {
+					for x := max(x0, 1); x < x1; x++ {
+						i := y*w + x
+						cost += residualCost(subPixels(pix[i], predictPixel(mode, pix, i, w)))
+					}
+				}
+				if bestCost < 0 || cost < bestCost {
+					best, bestCost = mode, cost
+				}
+			}
+			modes[ty*tw+tx] = uint32(best) << 8
+		}
+	}
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			i := y*w + x
+			var pred uint32
+			switch {
+			case x == 0 && y == 0:
+				pred = 0xff000000
+			case y == 0:
+				pred = pix[i-1]
+			case x == 0:
+				pred = pix[i-w]
+			default:
+				mode := modes[(y>>predictorBits)*tw+x>>predictorBits] >> 8
+				pred = predictPixel(int(mode), pix, i, w)
+			}
+			residuals[i] = subPixels(pix[i], pred)
+		}
+	}
+
+	return modes, residuals
+}
+
+// predictPixel predicts pix[i] from its neighbours, not in the first row or
+// column. Top right of the last column wraps to the start of the row, as the
+// decoder does
+func predictPixel(mode int, pix []uint32, i, w int) uint32 {
+	l, t, tl, tr := pix[i-1], pix[i-w], pix[i-w-1], pix[i-w+1]
+
+	switch mode {
+	case 0:
+		return 0xff000000
+	case 1:
+		return l
+	case 2:
+		return t
+	case 3:
+		return tr
+	case 4:
+		return tl
+	case 5:
+		return avg2(avg2(l, tr), t)
+	case 6:
+		return avg2(l, tl)
+	case 7:
+		return avg2(l, t)
+	case 8:
+		return avg2(tl, t)
+	case 9:
+		return avg2(t, tr)
+	case 10:
+		return avg2(avg2(l, tl), avg2(t, tr))
+	case 11:
+		return selectPixel(l, t, tl)
+	case 12:
+		return mapChannels(func(a, b, c int32) int32 { return a + b - c }, l, t, tl)
+	default:
+		return mapChannels(func(a, b, _ int32) int32 { return a + (a-b)/2 }, avg2(l, t), tl, 0)
+	}
+}
+
+// avg2 averages each channel, rounding down
+func avg2(a, b uint32) uint32 {
+	return ((a^b)&0xfefefefe)>>1 + a&b
+}
+
+func selectPixel(l, t, tl uint32) uint32 {
+	var pl, pt int32
+	for s := 0; s < 32; s += 8 {
+		c := int32(tl >> s & 0xff)
+		pl += abs(c - int32(t>>s&0xff))
+		pt += abs(c - int32(l>>s&0xff))
+	}
+	if pl < pt {
+		return l
+	}
+	return t
+}
+
+// mapChannels applies fn to each channel of a, b and c, clamping the result
+func mapChannels(fn func(a, b, c int32) int32, a, b, c uint32) uint32 {
+	var out uint32
+	for s := 0; s < 32; s += 8 {
+		v := fn(int32(a>>s&0xff), int32(b>>s&0xff), int32(c>>s&0xff))
+		out |= uint32(min(max(v, 0), 255)) << s
+	}
+	return out
+}
+
+// subPixels subtracts each channel modulo 256
+func subPixels(a, b uint32) uint32 {
+	ag := 0x00ff00ff + a&0xff00ff00 - b&0xff00ff00
+	rb := 0xff00ff00 + a&0x00ff00ff - b&0x00ff00ff
+	return ag&0xff00ff00 | rb&0x00ff00ff
+}
+
+// residualCost estimates the bits of a residual by the size of its channels
+// as signed bytes
+func residualCost(p uint32) int {
+	cost := 0
+	for s := 0; s < 32; s += 8 {
+		v := int(int8(p >> s))
+		cost += max(v, -v)
+	}
+	return cost
+}
+
+// ref is one coded run of pixels, a literal when length is zero, otherwise a
+// copy of length pixels from the distance code dist
+type ref struct {
+	length uint32
+	dist   uint32
+}
+
+// backwardRefs finds repeated runs of pixels with a hash chain over pairs
+func backwardRefs(argb []uint32, w int) []ref {
+	n := len(argb)
+	refs := make([]ref, 0, n/2)
+
+	head := make([]int32, 1<<hashBits)
+	for i := range head {
+		head[i] = -1
+	}
+	chain := make([]int32, n)
+
+	hash := func(i int) uint32 {
+		return (argb[i]*colorCacheMultiplier ^ argb[i+1]*0x9e3779b1) >> (32 - hashBits)
+	}
+	insert := func(i int) {
+		if i+1 < n {
+			k := hash(i)
+			chain[i] = head[k]
+			head[k] = int32(i)
+		}
+	}
+	matchLen := func(i, j, limit int) int {
+		k := 0
+		for k < limit && argb[i+k] == argb[j+k] {
+			k++
+		}
+		return k
+	}
+
+	codes := distanceCodes(w)
+
+	for i := 0; i < n; {
+		limit := min(maxMatch, n-i)
+		bestLen, bestDist := 0, 0
+
+		// the pixel to the left and the one above have the cheapest codes
+		for _, d := range []int{1, w} {
+			if d <= i {
+				if l := matchLen(i, i-d, limit); l > bestLen {
+					bestLen, bestDist = l, d
+				}
+			}
+		}
+
+		if i+1 < n {
+			for j, steps := head[hash(i)], 0; j >= 0 && steps < maxChain && i-int(j) <= maxDistance; j, steps = chain[j], steps+1 {
+				if l := matchLen(i, int(j), limit); l > bestLen {
+					bestLen, bestDist = l, i-int(j)
+					if l == limit {
+						break
+					}
+				}
+			}
+		}
+
+		if bestLen < minMatch {
+			refs = append(refs, ref{})
+			insert(i)
+			i++
+			continue
+		}
+
+		code := uint32(bestDist) + 120
+		if bestDist < len(codes) && codes[bestDist] != 0 {
+			code = uint32(codes[bestDist])
+		}
+		refs = append(refs, ref{length: uint32(bestLen), dist: code})
+		for k := 0; k < bestLen; k++ {
+			insert(i + k)
+		}
+		i += bestLen
+	}
+
+	return refs
+}
+
+// distanceCodes maps the distances of the nearby pixels in the distance map
+// to their short codes
+func distanceCodes(w int) []uint16 {
+	codes := make([]uint16, 7*w+9)
+	for i, dc := range distanceMapTable {
+		d := int(dc>>4)*w + 8 - int(dc&0xf)
+		if d >= 1 && codes[d] == 0 {
+			codes[d] = uint16(i + 1)
+		}
+	}
+	return codes
+}
+
+// writePixels entropy codes an image with backward references, a colour
+// cache when it pays off and a single group of Huffman codes
+func writePixels(bw *bitWriter, argb []uint32, w, h int, topLevel bool) {
+	refs := backwardRefs(argb, w)
+
+	var best *histogram
+	var bestCache []int16
+	for _, bits := range []int{0, colorCacheBits} {
+		cache := cacheHits(argb, refs, bits)
+		hist := newHistogram(argb, refs, cache, bits)
+		if best == nil || hist.cost() < best.cost() {
+			best, bestCache = hist, cache
+		}
+	}
+
+	if best.cacheBits > 0 {
+		bw.write(1, 1)
+		bw.write(uint32(best.cacheBits), 4)
+	} else {
+		bw.write(0, 1)
+	}
+	if topLevel {
+		bw.write(0, 1) // one Huffman group for the whole image
+	}
+
+	var codes [5]huffmanCode
+	for i := range codes {
+		codes[i] = newHuffmanCode(best.lengths[i])
+		writeHuffmanCode(bw, best.lengths[i])
+	}
+
+	pos := 0
+	for r, ref := range refs {
+		if ref.length == 0 {
+			p := argb[pos]
+			if c := bestCache[r]; c >= 0 {
+				codes[0].write(bw, nLiteralCodes+nLengthCodes+int(c))
+			} else {
+				codes[0].write(bw, int(p>>8&0xff))
+				codes[1].write(bw, int(p>>16&0xff))
+				codes[2].write(bw, int(p&0xff))
+				codes[3].write(bw, int(p>>24))
+			}
+			pos++
+			continue
+		}
+
+		sym, extra, v := prefixEncode(ref.length)
+		codes[0].write(bw, nLiteralCodes+sym)
+		bw.write(v, extra)
+
+		sym, extra, v = prefixEncode(ref.dist)
+		codes[4].write(bw, sym)
+		bw.write(v, extra)
+
+		pos += int(ref.length)
+	}
+}
+
+// cacheHits returns for each literal ref its colour cache index when the
+// decoder's cache would hold it, otherwise -1
+func cacheHits(argb []uint32, refs []ref, bits int) []int16 {
+	hits := make([]int16, len(refs))
+	if bits == 0 {
+		for i := range hits {
+			hits[i] = -1
+		}
+		return hits
+	}
+
+	cache := make([]uint32, 1<<bits)
+	shift := 32 - bits
+	pos := 0
+	for r, ref := range refs {
+		hits[r] = -1
+		if ref.length == 0 {
+			p := argb[pos]
+			k := p * colorCacheMultiplier >> shift
+			if cache[k] == p {
+				hits[r] = int16(k)
+			}
+			cache[k] = p
+			pos++
+			continue
+		}
+		for end := pos + int(ref.length); pos < end; pos++ {
+			p := argb[pos]
+			cache[p*colorCacheMultiplier>>shift] = p
+		}
+	}
+
+	return hits
+}
+
+// histogram counts the symbols of each of the five alphabets
+type histogram struct {
+	cacheBits int
+	counts    [5][]uint32
+	lengths   [5][]uint8
+}
+
+func newHistogram(argb []uint32, refs []ref, cache []int16, cacheBits int) *histogram {
+	h := &histogram{cacheBits: cacheBits}
+	green := nLiteralCodes + nLengthCodes
+	if cacheBits > 0 {
+		green += 1 << cacheBits
+	}
+	h.counts[0] = make([]uint32, green)
+	for i := 1; i < 4; i++ {
+		h.counts[i] = make([]uint32, nLiteralCodes)
+	}
+	h.counts[4] = make([]uint32, nDistanceCodes)
+
+	pos := 0
+	for r, ref := range refs {
+		if ref.length == 0 {
+			p := argb[pos]
+			if c := cache[r]; c >= 0 {
+				h.counts[0][nLiteralCodes+nLengthCodes+int(c)]++
+			} else {
+				h.counts[0][p>>8&0xff]++
+				h.counts[1][p>>16&0xff]++
+				h.counts[2][p&0xff]++
+				h.counts[3][p>>24]++
+			}
+			pos++
+			continue
+		}
+		sym, _, _ := prefixEncode(ref.length)
+		h.counts[0][nLiteralCodes+sym]++
+		sym, _, _ = prefixEncode(ref.dist)
+		h.counts[4][sym]++
+		pos += int(ref.length)
+	}
+
+	for i := range h.counts {
+		h.lengths[i] = huffmanLengths(h.counts[i], maxCodeLength)
+	}
+
+	return h
+}
+
+// cost is the bits taken by the coded symbols, leaving out extra bits which
+// don't depend on the codes
+func (h *histogram) cost() int {
+	total := 0
+	for i := range h.counts {
+		for s, c := range h.counts[i] {
+			total += int(c) * int(h.lengths[i][s])
+		}
+	}
+	return total
+}
+
+// prefixEncode splits a length or distance code into a prefix symbol and
+// extra bits, section 4.2.2
+func prefixEncode(v uint32) (int, uint, uint32) {
+	d := v - 1
+	if d < 4 {
+		return int(d), 0, 0
+	}
+	hb := uint(31)
+	for d>>hb == 0 {
+		hb--
+	}
+	second := d >> (hb - 1) & 1
+	extra := hb - 1
+	return int(2*hb + uint(second)), extra, d & (1<<extra - 1)
+}
+
+// nTiles returns the number of 1<<bits wide tiles covering size pixels
+func nTiles(size int, bits uint) int {
+	return (size + 1<<bits - 1) >> bits
+}
+
+func abs(x int32) int32 {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+func btou(b bool) uint32 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,448 @@
+package webp
+
+import (
+	"image"
+	"math"
+)
+
+// The VP8 lossy bitstream is specified in RFC 6386. Frames are coded as a
+// single key frame of 16x16 predicted macroblocks, reconstructed exactly as
+// the decoder will so prediction never drifts.
+
+// prediction modes of whole luma macroblocks and of chroma blocks
+const (
+	predDC = iota
+	predTM
+	predVE
+	predHE
+	nModes
+)
+
+// plane is one component of a frame, padded to whole macroblocks
+type plane struct {
+	pix    []uint8
+	stride int
+}
+
+func newPlane(w, h int) plane {
+	return plane{pix: make([]uint8, w*h), stride: w}
+}
+
+func (p plane) at(x, y int) uint8 {
+	return p.pix[y*p.stride+x]
+}
+
+// quantizer holds the step and rounding bias, out of 256, for the DC and AC
+// coefficients of one kind of block
+type quantizer struct {
+	step [2]int32
+	bias [2]int32
+}
+
+// quantize returns the levels of coeffs and their dequantized values, from
+// position first in raster order
+func (q *quantizer) quantize(coeffs *[16]int32, first int) ([16]int16, [16]int32) {
+	var levels [16]int16
+	var deq [16]int32
+	for i := first; i < 16; i++ {
+		k := min(i, 1)
+		step := q.step[k]
+		c := coeffs[i]
+		a := (max(c, -c) + step*q.bias[k]>>8) / step
+		// levels and coefficients have to fit the decoder's tables and int16
+		a = min(a, 2048, 32767/step)
+		if c < 0 {
+			a = -a
+		}
+		levels[i] = int16(a)
+		deq[i] = a * step
+	}
+	return levels, deq
+}
+
+// macroblock is the coded form of 16x16 luma and 8x8 chroma pixels
+type macroblock struct {
+	yMode, uvMode uint8
+	skip          bool
+	y2            [16]int16     // luma DC levels, Walsh-Hadamard transformed
+	y             [16][16]int16 // luma AC levels, first of each unused
+	uv            [8][16]int16  // U then V
+}
+
+type vp8Encoder struct {
+	w, h     int
+	mbw, mbh int
+
+	// source and reconstruction, as the decoder will see it
+	y, u, v    plane
+	ry, ru, rv plane
+
+	qIndex     int
+	y1, y2, uv quantizer
+
+	mbs   []macroblock
+	probs [nPlane][nBand][nContext][nProb]uint8
+}
+
+// encodeLossy returns the VP8 chunk for img, ignoring alpha
+func encodeLossy(img *image.NRGBA, quality float32) []byte {
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	e := &vp8Encoder{
+		w:   w,
+		h:   h,
+		mbw: (w + 15) / 16,
+		mbh: (h + 15) / 16,
+	}
+	e.toYUV(img)
+	e.setQuantizers(qualityToIndex(quality))
+
+	e.mbs = make([]macroblock, e.mbw*e.mbh)
+	for mby := 0; mby < e.mbh; mby++ {
+		for mbx := 0; mbx < e.mbw; mbx++ {
+			e.mbs[mby*e.mbw+mbx] = e.encodeMacroblock(mbx, mby)
+		}
+	}
+
+	return e.frame()
+}
+
+// qualityToIndex maps quality to a quantizer index the way libwebp does,
+// roughly linear in perceived quality
+func qualityToIndex(quality float32) int {
+	c := float64(quality) / 100
+	linear := 2*c - 1
+	if c < 0.75 {
+		linear = c * 2 / 3
+	}
+	q := int(math.Round(127 * (1 - math.Cbrt(linear))))
+	return min(max(q, 0), 127)
+}
+
+func (e *vp8Encoder) setQuantizers(q int) {
+	e.qIndex = q
+
+	y2ac := int32(dequantTableAC[q]) * 155 / 100
+	e.y1 = quantizer{
+		step: [2]int32{int32(dequantTableDC[q]), int32(dequantTableAC[q])},
+		bias: [2]int32{96, 110},
+	}
+	e.y2 = quantizer{
+		step: [2]int32{int32(dequantTableDC[q]) * 2, max(y2ac, 8)},
+		bias: [2]int32{96, 108},
+	}
+	e.uv = quantizer{
+		step: [2]int32{int32(dequantTableDC[min(q, 117)]), int32(dequantTableAC[q])},
+		bias: [2]int32{110, 115},
+	}
+}
+
+// toYUV converts img to limited range BT.601 with chroma averaged over each
+// 2x2 block, as libwebp does, repeating the edges to fill whole macroblocks
+func (e *vp8Encoder) toYUV(img *image.NRGBA) {
+	pw, ph := 16*e.mbw, 16*e.mbh
+	e.y, e.ry = newPlane(pw, ph), newPlane(pw, ph)
+	e.u, e.ru = newPlane(pw/2, ph/2), newPlane(pw/2, ph/2)
+	e.v, e.rv = newPlane(pw/2, ph/2), newPlane(pw/2, ph/2)
+
+	rgb := func(x, y int) (int32, int32, int32) {
+		i := min(y, e.h-1)*img.Stride + 4*min(x, e.w-1)
+		return int32(img.Pix[i]), int32(img.Pix[i+1]), int32(img.Pix[i+2])
+	}
+
+	for y := 0; y < ph; y++ {
+		for x := 0; x < pw; x++ {
+			r, g, b := rgb(x, y)
+			e.y.pix[y*pw+x] = uint8((16839*r + 33059*g + 6420*b + 16<<16 + 1<<15) >> 16)
+		}
+	}
+
+	clip := func(v int32) uint8 {
+		return uint8(min(max(v, 0), 255))
+	}
+	for y := 0; y < ph/2; y++ {
+		for x := 0; x < pw/2; x++ {
+			var r, g, b int32
+			for _, p := range [4][2]int{{0, 0}, {1, 0}, {0, 1}, {1, 1}} {
+				pr, pg, pb := rgb(2*x+p[0], 2*y+p[1])
+				r, g, b = r+pr, g+pg, b+pb
+			}
+			e.u.pix[y*pw/2+x] = clip((-9719*r - 19081*g + 28800*b + 128<<18 + 1<<17) >> 18)
+			e.v.pix[y*pw/2+x] = clip((28800*r - 24116*g - 4684*b + 128<<18 + 1<<17) >> 18)
+		}
+	}
+}
+
+// border holds the reconstructed pixels above and left of a block, or the
+// decoder's constants at the frame edges
+type border struct {
+	top, left       [16]uint8
+	topLeft         uint8
+	hasTop, hasLeft bool
+	size            int
+}
+
+func newBorder(p plane, x, y, size int) border {
+	b := border{size: size, hasTop: y > 0, hasLeft: x > 0}
+	for i := 0; i < size; i++ {
+		b.top[i], b.left[i] = 0x7f, 0x81
+		if b.hasTop {
+			b.top[i] = p.at(x+i, y-1)
+		}
+		if b.hasLeft {
+			b.left[i] = p.at(x-1, y+i)
+		}
+	}
+
+	switch {
+	case !b.hasTop:
+		b.topLeft = 0x7f
+	case !b.hasLeft:
+		b.topLeft = 0x81
+	default:
+		b.topLeft = p.at(x-1, y-1)
+	}
+
+	return b
+}
+
+// predict fills dst with the prediction of mode, DC only averages the edges
+// inside the frame
+func (b *border) predict(mode int, dst []uint8) {
+	n := b.size
+	switch mode {
+	case predDC:
+		var sum, count int
+		if b.hasTop {
+			for _, v := range b.top[:n] {
+				sum += int(v)
+			}
+			count += n
+		}
+		if b.hasLeft {
+			for _, v := range b.left[:n] {
+				sum += int(v)
+			}
+			count += n
+		}
+		dc := uint8(0x80)
+		if count > 0 {
+			dc = uint8((sum + count/2) / count)
+		}
+		for i := range dst[:n*n] {
+			dst[i] = dc
+		}
+	case predTM:
+		for j := 0; j < n; j++ {
+			for i := 0; i < n; i++ {
+				v := int(b.left[j]) + int(b.top[i]) - int(b.topLeft)
+				dst[j*n+i] = uint8(min(max(v, 0), 255))
+			}
+		}
+	case predVE:
+		for j := 0; j < n; j++ {
+			copy(dst[j*n:j*n+n], b.top[:n])
+		}
+	case predHE:
+		for j := 0; j < n; j++ {
+			for i := 0; i < n; i++ {
+				dst[j*n+i] = b.left[j]
+			}
+		}
+	}
+}
+
+// bestMode returns the mode whose prediction is closest to the source blocks
+func bestMode(borders []border, srcs []plane, x, y int, preds [][nModes][256]uint8) int {
+	best, bestErr := predDC, -1
+	for mode := 0; mode < nModes; mode++ {
+		err := 0
+		for k := range borders {
+			n := borders[k].size
+			pred := preds[k][mode][:n*n]
+			borders[k].predict(mode, pred)
+			for j := 0; j < n; j++ {
+				for i := 0; i < n; i++ {
+					d := int(srcs[k].at(x+i, y+j)) - int(pred[j*n+i])
+					err += d * d
+				}
+			}
+		}
+		if bestErr < 0 || err < bestErr {
+			best, bestErr = mode, err
+		}
+	}
+	return best
+}
+
+func (e *vp8Encoder) encodeMacroblock(mbx, mby int) macroblock {
+	var mb macroblock
+
+	// luma, predicted as a whole
+	x, y := 16*mbx, 16*mby
+	lb := []border{newBorder(e.ry, x, y, 16)}
+	lp := make([][nModes][256]uint8, 1)
+	mb.yMode = uint8(bestMode(lb, []plane{e.y}, x, y, lp))
+	pred := lp[0][mb.yMode][:]
+
+	var coeffs [16][16]int32
+	var dcs [16]int32
+	for n := 0; n < 16; n++ {
+		bx, by := 4*(n%4), 4*(n/4)
+		coeffs[n] = forwardDCT(e.y, x+bx, y+by, pred[by*16+bx:], 16)
+		dcs[n] = coeffs[n][0]
+	}
+
+	// the DC of every block is coded together in a second transform
+	wht := forwardWHT(&dcs)
+	var y2deq [16]int32
+	mb.y2, y2deq = e.y2.quantize(&wht, 0)
+	dcs = inverseWHT(&y2deq)
+
+	for n := 0; n < 16; n++ {
+		bx, by := 4*(n%4), 4*(n/4)
+		var deq [16]int32
+		mb.y[n], deq = e.y1.quantize(&coeffs[n], 1)
+		deq[0] = dcs[n]
+		inverseDCT(&deq, pred[by*16+bx:], 16, e.ry, x+bx, y+by)
+	}
+
+	// chroma, both planes share a mode
+	x, y = 8*mbx, 8*mby
+	cb := []border{newBorder(e.ru, x, y, 8), newBorder(e.rv, x, y, 8)}
+	cp := make([][nModes][256]uint8, 2)
+	mb.uvMode = uint8(bestMode(cb, []plane{e.u, e.v}, x, y, cp))
+
+	for k, p := range []struct{ src, rec plane }{{e.u, e.ru}, {e.v, e.rv}} {
+		pred := cp[k][mb.uvMode][:64]
+		for n := 0; n < 4; n++ {
+			bx, by := 4*(n%2), 4*(n/2)
+			c := forwardDCT(p.src, x+bx, y+by, pred[by*8+bx:], 8)
+			var deq [16]int32
+			mb.uv[4*k+n], deq = e.uv.quantize(&c, 0)
+			inverseDCT(&deq, pred[by*8+bx:], 8, p.rec, x+bx, y+by)
+		}
+	}
+
+	mb.skip = mb.y2 == [16]int16{} && mb.y == [16][16]int16{} && mb.uv == [8][16]int16{}
+
+	return mb
+}
+
+// forwardDCT transforms the 4x4 residual of src at x,y against pred, whose
+// rows are stride apart, as libwebp's FTransform
+func forwardDCT(src plane, x, y int, pred []uint8, stride int) [16]int32 {
+	var tmp, out [16]int32
+	for i := 0; i < 4; i++ {
+		var d [4]int32
+		for j := range d {
+			d[j] = int32(src.at(x+j, y+i)) - int32(pred[i*stride+j])
+		}
+		a0, a1 := d[0]+d[3], d[1]+d[2]
+		a2, a3 := d[1]-d[2], d[0]-d[3]
+		tmp[0+i*4] = (a0 + a1) * 8
+		tmp[1+i*4] = (a2*2217 + a3*5352 + 1812) >> 9
+		tmp[2+i*4] = (a0 - a1) * 8
+		tmp[3+i*4] = (a3*2217 - a2*5352 + 937) >> 9
+	}
+	for i := 0; i < 4; i++ {
+		a0, a1 := tmp[0+i]+tmp[12+i], tmp[4+i]+tmp[8+i]
+		a2, a3 := tmp[4+i]-tmp[8+i], tmp[0+i]-tmp[12+i]
+		out[0+i] = (a0 + a1 + 7) >> 4
+		out[4+i] = (a2*2217+a3*5352+12000)>>16 + int32(btou(a3 != 0))
+		out[8+i] = (a0 - a1 + 7) >> 4
+		out[12+i] = (a3*2217 - a2*5352 + 51000) >> 16
+	}
+	return out
+}
+
+// inverseDCT adds the inverse transform of coeffs to pred and stores the
+// result in dst at x,y, exactly as the decoder does
+func inverseDCT(coeffs *[16]int32, pred []uint8, stride int, dst plane, x, y int) {
+	const (
+		c1 = 85627 // 65536 * cos(pi/8) * sqrt(2)
+		c2 = 35468 // 65536 * sin(pi/8) * sqrt(2)
+	)
+	// the decoder keeps coefficients as int16
+	var c [16]int32
+	for i, v := range coeffs {
+		c[i] = int32(int16(v))
+	}
+
+	var m [4][4]int32
+	for i := 0; i < 4; i++ {
+		a := c[i] + c[8+i]
+		b := c[i] - c[8+i]
+		cc := (c[4+i]*c2)>>16 - (c[12+i]*c1)>>16
+		d := (c[4+i]*c1)>>16 + (c[12+i]*c2)>>16
+		m[i][0] = a + d
+		m[i][1] = b + cc
+		m[i][2] = b - cc
+		m[i][3] = a - d
+	}
+	for j := 0; j < 4; j++ {
+		dc := m[0][j] + 4
+		a := dc + m[2][j]
+		b := dc - m[2][j]
+		cc := (m[1][j]*c2)>>16 - (m[3][j]*c1)>>16
+		d := (m[1][j]*c1)>>16 + (m[3][j]*c2)>>16
+		row := [4]int32{(a + d) >> 3, (b + cc) >> 3, (b - cc) >> 3, (a - d) >> 3}
+		for i, r := range row {
+			v := int32(pred[j*stride+i]) + r
+			dst.pix[(y+j)*dst.stride+x+i] = uint8(min(max(v, 0), 255))
+		}
+	}
+}
+
+// forwardWHT transforms the DC coefficients of the 16 luma blocks, the
+// inverse of the decoder's transform
+func forwardWHT(in *[16]int32) [16]int32 {
+	var tmp, out [16]int32
+	for i := 0; i < 4; i++ {
+		a0, a1 := in[0+i]+in[12+i], in[4+i]+in[8+i]
+		a2, a3 := in[4+i]-in[8+i], in[0+i]-in[12+i]
+		tmp[0+i] = a0 + a1
+		tmp[8+i] = a0 - a1
+		tmp[4+i] = a3 + a2
+		tmp[12+i] = a3 - a2
+	}
+	for i := 0; i < 4; i++ {
+		a0, a1 := tmp[0+i*4]+tmp[3+i*4], tmp[1+i*4]+tmp[2+i*4]
+		a2, a3 := tmp[1+i*4]-tmp[2+i*4], tmp[0+i*4]-tmp[3+i*4]
+		out[0+i*4] = (a0 + a1) >> 1
+		out[1+i*4] = (a3 + a2) >> 1
+		out[2+i*4] = (a0 - a1) >> 1
+		out[3+i*4] = (a3 - a2) >> 1
+	}
+	return out
+}
+
+// inverseWHT returns the DC coefficient of each luma block, exactly as the
+// decoder does
+func inverseWHT(in *[16]int32) [16]int32 {
+	var c [16]int32
+	for i, v := range in {
+		c[i] = int32(int16(v))
+	}
+
+	var m, out [16]int32
+	for i := 0; i < 4; i++ {
+		a0, a1 := c[0+i]+c[12+i], c[4+i]+c[8+i]
+		a2, a3 := c[4+i]-c[8+i], c[0+i]-c[12+i]
+		m[0+i] = a0 + a1
+		m[8+i] = a0 - a1
+		m[4+i] = a3 + a2
+		m[12+i] = a3 - a2
+	}
+	for i := 0; i < 4; i++ {
+		dc := m[0+i*4] + 3
+		a0 := dc + m[3+i*4]
+		a1 := m[1+i*4] + m[2+i*4]
+		a2 := m[1+i*4] - m[2+i*4]
+		a3 := dc - m[3+i*4]
+		out[4*i+0] = int32(int16((a0 + a1) >> 3))
+		out[4*i+1] = int32(int16((a3 + a2) >> 3))
+		out[4*i+2] = int32(int16((a0 - a1) >> 3))
+		out[4*i+3] = int32(int16((a3 - a2) >> 3))
+	}
+	return out
+}
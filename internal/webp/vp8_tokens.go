@@ -0,0 +1,377 @@
+package webp
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// boolEncoder is the arithmetic coder of RFC 6386 section 7, prob is the
+// chance out of 256 of writing false
+type boolEncoder struct {
+	buf      []byte
+	rng      uint32
+	bottom   uint32
+	bitCount int
+}
+
+func newBoolEncoder() *boolEncoder {
+	return &boolEncoder{rng: 255, bitCount: 24}
+}
+
+func (e *boolEncoder) putBit(b bool, prob uint8) {
+	split := 1 + (e.rng-1)*uint32(prob)>>8
+	if b {
+		e.bottom += split
+		e.rng -= split
+	} else {
+		e.rng = split
+	}
+
+	for e.rng < 128 {
+		e.rng <<= 1
+		if e.bottom&(1<<31) != 0 {
+			e.carry()
+		}
+		e.bottom <<= 1
+		e.bitCount--
+		if e.bitCount == 0 {
+			e.buf = append(e.buf, byte(e.bottom>>24))
+			e.bottom &= 1<<24 - 1
+			e.bitCount = 8
+		}
+	}
+}
+
+// carry propagates an overflow of bottom into the bytes already written
+func (e *boolEncoder) carry() {
+	i := len(e.buf) - 1
+	for i >= 0 && e.buf[i] == 0xff {
+		e.buf[i] = 0
+		i--
+	}
+	e.buf[i]++
+}
+
+// putLiteral writes the low n bits of v, most significant first
+func (e *boolEncoder) putLiteral(v uint32, n int) {
+	for i := n - 1; i >= 0; i-- {
+		e.putBit(v>>i&1 != 0, 128)
+	}
+}
+
+// bytes flushes the coder and returns what it wrote
+func (e *boolEncoder) bytes() []byte {
+	for i := 0; i < 32; i++ {
+		e.putBit(false, 128)
+	}
+	return e.buf
+}
+
+// bitCost is the cost in bits of writing b with prob
+func bitCost(b bool, prob uint8) float64 {
+	p := float64(prob) / 256
+	if b {
+		p = 1 - p
+	}
+	return -math.Log2(p)
+}
+
+// tokenWriter codes coefficient tokens, or with no encoder only counts how
+// often each probability sees each value
+type tokenWriter struct {
+	enc    *boolEncoder
+	probs  *[nPlane][nBand][nContext][nProb]uint8
+	counts *[nPlane][nBand][nContext][nProb][2]uint32
+}
+
+func (t *tokenWriter) bit(b bool, plane, band, ctx, i int) {
+	if t.enc == nil {
+		t.counts[plane][band][ctx][i][btou(b)]++
+		return
+	}
+	t.enc.putBit(b, t.probs[plane][band][ctx][i])
+}
+
+// fixed writes b with a probability that is not adapted
+func (t *tokenWriter) fixed(b bool, prob uint8) {
+	if t.enc != nil {
+		t.enc.putBit(b, prob)
+	}
+}
+
+// writeCoeffs codes the levels of one block in zigzag order from first,
+// returning whether any is non zero, the mirror of parseResiduals4 in the
+// decoder
+func (t *tokenWriter) writeCoeffs(plane, ctx, first int, levels *[16]int16) uint8 {
+	last := -1
+	for n := 15; n >= first; n-- {
+		if levels[zigzag[n]] != 0 {
+			last = n
+			break
+		}
+	}
+
+	n := first
+	band := int(bands[n])
+	t.bit(last >= 0, plane, band, ctx, 0)
+	if last < 0 {
+		return 0
+	}
+
+	for n < 16 {
+		v := int32(levels[zigzag[n]])
+		n++
+		if v == 0 {
+			t.bit(false, plane, band, ctx, 1)
+			band, ctx = int(bands[n]), 0
+			continue
+		}
+		t.bit(true, plane, band, ctx, 1)
+
+		a := uint32(abs(v))
+		next := 2
+		if a == 1 {
+			t.bit(false, plane, band, ctx, 2)
+			next = 1
+		} else {
+			t.bit(true, plane, band, ctx, 2)
+			t.writeLevel(a, plane, band, ctx)
+		}
+		t.fixed(v < 0, 128)
+
+		band, ctx = int(bands[n]), next
+		if n == 16 {
+			break
+		}
+		t.bit(n <= last, plane, band, ctx, 0)
+		if n > last {
+			break
+		}
+	}
+	return 1
+}
+
+// writeLevel codes a level above 1, section 13.2
+func (t *tokenWriter) writeLevel(a uint32, plane, band, ctx int) {
+	if a <= 4 {
+		t.bit(false, plane, band, ctx, 3)
+		t.bit(a != 2, plane, band, ctx, 4)
+		if a != 2 {
+			t.bit(a == 4, plane, band, ctx, 5)
+		}
+		return
+	}
+	t.bit(true, plane, band, ctx, 3)
+
+	if a <= 10 {
+		t.bit(false, plane, band, ctx, 6)
+		t.bit(a > 6, plane, band, ctx, 7)
+		if a <= 6 {
+			t.fixed(a == 6, 159)
+		} else {
+			t.fixed((a-7)>>1 != 0, 165)
+			t.fixed((a-7)&1 != 0, 145)
+		}
+		return
+	}
+	t.bit(true, plane, band, ctx, 6)
+
+	// categories 3 to 6 carry 3, 4, 5 and 11 extra bits
+	cat := 0
+	for cat < 3 && a >= 3+8<<(cat+1) {
+		cat++
+	}
+	t.bit(cat>>1 != 0, plane, band, ctx, 8)
+	t.bit(cat&1 != 0, plane, band, ctx, 9+cat>>1)
+
+	extra := a - (3 + 8<<cat)
+	nbits := 0
+	for nbits < len(cat3456[cat]) && cat3456[cat][nbits] != 0 {
+		nbits++
+	}
+	for i := 0; i < nbits; i++ {
+		t.fixed(extra>>(nbits-1-i)&1 != 0, cat3456[cat][i])
+	}
+}
+
+// nzContext records which blocks along a macroblock edge had coefficients
+type nzContext struct {
+	y  [4]uint8
+	u  [2]uint8
+	v  [2]uint8
+	y2 uint8
+}
+
+// writeResiduals codes the blocks of mb, updating the contexts of the
+// macroblocks left and above
+func (t *tokenWriter) writeResiduals(mb *macroblock, left, top *nzContext) {
+	left.y2 = t.writeCoeffs(planeY2, int(left.y2+top.y2), 0, &mb.y2)
+	top.y2 = left.y2
+
+	for y := 0; y < 4; y++ {
+		nz := left.y[y]
+		for x := 0; x < 4; x++ {
+			nz = t.writeCoeffs(planeY1WithY2, int(nz+top.y[x]), 1, &mb.y[4*y+x])
+			top.y[x] = nz
+		}
+		left.y[y] = nz
+	}
+
+	for k, c := range []struct{ left, top *[2]uint8 }{{&left.u, &top.u}, {&left.v, &top.v}} {
+		for y := 0; y < 2; y++ {
+			nz := c.left[y]
+			for x := 0; x < 2; x++ {
+				nz = t.writeCoeffs(planeUV, int(nz+c.top[x]), 0, &mb.uv[4*k+2*y+x])
+				c.top[x] = nz
+			}
+			c.left[y] = nz
+		}
+	}
+}
+
+// writeTokens codes the residuals of every macroblock that has any
+func (e *vp8Encoder) writeTokens(t *tokenWriter, useSkip bool) {
+	top := make([]nzContext, e.mbw)
+	for mby := 0; mby < e.mbh; mby++ {
+		var left nzContext
+		for mbx := 0; mbx < e.mbw; mbx++ {
+			mb := &e.mbs[mby*e.mbw+mbx]
+			if useSkip && mb.skip {
+				left, top[mbx] = nzContext{}, nzContext{}
+				continue
+			}
+			t.writeResiduals(mb, &left, &top[mbx])
+		}
+	}
+}
+
+// updateProbs adapts the token probabilities to counts where the saving
+// pays for the update, writing the updates to hdr
+func (e *vp8Encoder) updateProbs(hdr *boolEncoder, counts *[nPlane][nBand][nContext][nProb][2]uint32) {
+	for i := range e.probs {
+		for j := range e.probs[i] {
+			for k := range e.probs[i][j] {
+				for l := range e.probs[i][j][k] {
+					c := counts[i][j][k][l]
+					old := defaultTokenProb[i][j][k][l]
+					upd := tokenProbUpdateProb[i][j][k][l]
+					e.probs[i][j][k][l] = old
+
+					total := c[0] + c[1]
+					if total == 0 {
+						hdr.putBit(false, upd)
+						continue
+					}
+					p := uint8(min(max((uint64(c[0])*256+uint64(total)/2)/uint64(total), 1), 255))
+					cost := func(p uint8) float64 {
+						return float64(c[0])*bitCost(false, p) + float64(c[1])*bitCost(true, p)
+					}
+					if cost(p)+8+bitCost(true, upd) >= cost(old)+bitCost(false, upd) {
+						hdr.putBit(false, upd)
+						continue
+					}
+					hdr.putBit(true, upd)
+					hdr.putLiteral(uint32(p), 8)
+					e.probs[i][j][k][l] = p
+				}
+			}
+		}
+	}
+}
+
+// frame writes the frame header, the first partition of modes and a single
+// partition of tokens
+func (e *vp8Encoder) frame() []byte {
+	hdr := newBoolEncoder()
+	hdr.putLiteral(0, 1) // color space
+	hdr.putLiteral(0, 1) // clamping required
+	hdr.putLiteral(0, 1) // no segmentation
+
+	// normal loop filter, its strength follows the quantizer
+	hdr.putLiteral(0, 1)
+	hdr.putLiteral(uint32(min(int(dequantTableAC[e.qIndex])*3/8, 63)), 6)
+	hdr.putLiteral(0, 3) // sharpness
+	hdr.putLiteral(0, 1) // no filter deltas
+
+	hdr.putLiteral(0, 2) // one token partition
+
+	hdr.putLiteral(uint32(e.qIndex), 7)
+	for i := 0; i < 5; i++ {
+		hdr.putLiteral(0, 1) // no quantizer deltas
+	}
+
+	hdr.putLiteral(0, 1) // keep probabilities past this frame
+
+	skipped := 0
+	for i := range e.mbs {
+		if e.mbs[i].skip {
+			skipped++
+		}
+	}
+	useSkip := skipped > 0
+
+	var counts [nPlane][nBand][nContext][nProb][2]uint32
+	e.writeTokens(&tokenWriter{counts: &counts}, useSkip)
+	e.updateProbs(hdr, &counts)
+
+	hdr.putLiteral(uint32(btou(useSkip)), 1)
+	skipProb := uint8(0)
+	if useSkip {
+		skipProb = uint8(min(max(255*(len(e.mbs)-skipped)/len(e.mbs), 1), 255))
+		hdr.putLiteral(uint32(skipProb), 8)
+	}
+
+	for i := range e.mbs {
+		mb := &e.mbs[i]
+		if useSkip {
+			hdr.putBit(mb.skip, skipProb)
+		}
+		hdr.putBit(true, 145) // 16x16 prediction
+		writeYMode(hdr, mb.yMode)
+		writeUVMode(hdr, mb.uvMode)
+	}
+
+	tokens := newBoolEncoder()
+	e.writeTokens(&tokenWriter{enc: tokens, probs: &e.probs}, useSkip)
+
+	first, rest := hdr.bytes(), tokens.bytes()
+	buf := make([]byte, 0, 10+len(first)+len(rest))
+	tag := uint32(1)<<4 | uint32(len(first))<<5 // key frame, version 0, shown
+	buf = append(buf, byte(tag), byte(tag>>8), byte(tag>>16))
+	buf = append(buf, 0x9d, 0x01, 0x2a)
+	buf = binary.LittleEndian.AppendUint16(buf, uint16(e.w))
+	buf = binary.LittleEndian.AppendUint16(buf, uint16(e.h))
+	buf = append(buf, first...)
+	return append(buf, rest...)
+}
+
+// writeYMode codes a 16x16 luma mode with the key frame tree, section 11.2
+func writeYMode(e *boolEncoder, mode uint8) {
+	switch mode {
+	case predDC:
+		e.putBit(false, 156)
+		e.putBit(false, 163)
+	case predVE:
+		e.putBit(false, 156)
+		e.putBit(true, 163)
+	case predHE:
+		e.putBit(true, 156)
+		e.putBit(false, 128)
+	case predTM:
+		e.putBit(true, 156)
+		e.putBit(true, 128)
+	}
+}
+
+// writeUVMode codes a chroma mode with the key frame tree
+func writeUVMode(e *boolEncoder, mode uint8) {
+	e.putBit(mode != predDC, 142)
+	if mode == predDC {
+		return
+	}
+	e.putBit(mode != predVE, 114)
+	if mode == predVE {
+		return
+	}
+	e.putBit(mode == predTM, 183)
+}
@@ -0,0 +1,126 @@
+// Package webp encodes images as WebP, lossy (VP8) or lossless (VP8L). It is
+// the encoding half of golang.org/x/image/webp, which only decodes.
+package webp
+
+import (
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/draw"
+	"io"
+)
+
+// DefaultQuality is the lossy quality used when Options leaves it unset
+const DefaultQuality = 75
+
+// both bitstreams store dimensions minus one in 14 bits
+const maxDimension = 1 << 14
+
+// Options are the encoding parameters, a nil *Options encodes lossy at
+// DefaultQuality
+type Options struct {
+	// Lossless keeps every pixel exactly, Quality is ignored
+	Lossless bool
+	// Quality ranges from 1 to 100, higher is better and larger
+	Quality float32
+}
+
+// Encode writes m to w in WebP format
+func Encode(w io.Writer, m image.Image, o *Options) error {
+	b := m.Bounds()
+	if b.Empty() {
+		return errors.New("webp: empty image")
+	}
+	if b.Dx() > maxDimension || b.Dy() > maxDimension {
+		return errors.New("webp: image is too large to encode")
+	}
+
+	quality := float32(DefaultQuality)
+	lossless := false
+	if o != nil {
+		lossless = o.Lossless
+		if o.Quality > 0 {
+			quality = min(o.Quality, 100)
+		}
+	}
+
+	img := toNRGBA(m)
+
+	if lossless {
+		return writeRIFF(w, chunk{"VP8L", encodeLossless(img)})
+	}
+
+	frame := encodeLossy(img, quality)
+	if opaque(img) {
+		return writeRIFF(w, chunk{"VP8 ", frame})
+	}
+
+	// alpha travels in its own chunk, announced by the extended header
+	var vp8x [10]byte
+	vp8x[0] = 1 << 4 // alpha
+	putUint24(vp8x[4:], uint32(b.Dx()-1))
+	putUint24(vp8x[7:], uint32(b.Dy()-1))
+
+	return writeRIFF(w,
+		chunk{"VP8X", vp8x[:]},
+		chunk{"ALPH", encodeAlpha(img)},
+		chunk{"VP8 ", frame},
+	)
+}
+
+type chunk struct {
+	fourCC string
+	data   []byte
+}
+
+// writeRIFF writes the WEBP RIFF container holding chunks, each padded to an
+// even length
+func writeRIFF(w io.Writer, chunks ...chunk) error {
+	size := 4
+	for _, c := range chunks {
+		size += 8 + len(c.data) + len(c.data)&1
+	}
+
+	buf := make([]byte, 0, 8+size)
+	buf = append(buf, "RIFF"...)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(size))
+	buf = append(buf, "WEBP"...)
+	for _, c := range chunks {
+		buf = append(buf, c.fourCC...)
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(len(c.data)))
+		buf = append(buf, c.data...)
+		if len(c.data)&1 != 0 {
+			buf = append(buf, 0)
+		}
+	}
+
+	_, err := w.Write(buf)
+	return err
+}
+
+func putUint24(b []byte, v uint32) {
+	b[0] = byte(v)
+	b[1] = byte(v >> 8)
+	b[2] = byte(v >> 16)
+}
+
+// toNRGBA returns m as non premultiplied pixels with its origin at 0,0
+func toNRGBA(m image.Image) *image.NRGBA {
+	b := m.Bounds()
+	if n, ok := m.(*image.NRGBA); ok && b.Min == (image.Point{}) && n.Stride == 4*b.Dx() {
+		return n
+	}
+
+	n := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(n, n.Bounds(), m, b.Min, draw.Src)
+	return n
+}
+
+func opaque(img *image.NRGBA) bool {
+	for i := 3; i < len(img.Pix); i += 4 {
+		if img.Pix[i] != 0xff {
+			return false
+		}
+	}
+	return true
+}
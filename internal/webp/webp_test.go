@@ -0,0 +1,189 @@
+package webp
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"math/rand"
+	"testing"
+
+	xwebp "golang.org/x/image/webp"
+)
+
+// createTestImage returns a w x h gradient with some noise, a rough stand in
+// for a photo
+func createTestImage(w, h int, alpha bool) *image.NRGBA {
+	rng := rand.New(rand.NewSource(int64(w*h + 1)))
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			a := uint8(255)
+			if alpha {
+				a = uint8(x * 255 / w)
+			}
+			img.SetNRGBA(x, y, color.NRGBA{
+				R: uint8(x*255/w) + uint8(rng.Intn(8)),
+				G: uint8(y*255/h) + uint8(rng.Intn(8)),
+				B: uint8((x+y)*127/(w+h)) + uint8(rng.Intn(8)),
+				A: a,
+			})
+		}
+	}
+	return img
+}
+
+// createPaletteImage returns a w x h image of stripes in n colours
+func createPaletteImage(w, h, n int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := uint8((x/3 + y/5) % n)
+			img.SetNRGBA(x, y, color.NRGBA{R: c * 40, G: 255 - c*30, B: c * 7, A: 255 - c})
+		}
+	}
+	return img
+}
+
+func encodeDecode(t *testing.T, img image.Image, o *Options) image.Image {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := Encode(&buf, img, o); err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	out, err := xwebp.Decode(&buf)
+	if err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+	if out.Bounds().Size() != img.Bounds().Size() {
+		t.Fatalf("expected size %v, got %v", img.Bounds().Size(), out.Bounds().Size())
+	}
+	return out
+}
+
+func TestEncodeLossless_RoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		img  *image.NRGBA
+	}{
+		{"photo", createTestImage(67, 45, false)},
+		{"photo with alpha", createTestImage(40, 31, true)},
+		{"palette", createPaletteImage(50, 20, 12)},
+		{"two colours", createPaletteImage(33, 9, 2)},
+		{"one colour", createPaletteImage(16, 16, 1)},
+		{"one pixel", createTestImage(1, 1, true)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := encodeDecode(t, tt.img, &Options{Lossless: true})
+			b := tt.img.Bounds()
+			for y := b.Min.Y; y < b.Max.Y; y++ {
+				for x := b.Min.X; x < b.Max.X; x++ {
+					want := tt.img.NRGBAAt(x, y)
+					if want.A == 0 {
+						want = color.NRGBA{}
+					}
+					got := color.NRGBAModel.Convert(out.At(x, y)).(color.NRGBA)
+					if got != want {
+						t.Fatalf("pixel %d,%d: expected %v, got %v", x, y, want, got)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestEncodeLossy_RoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		img     *image.NRGBA
+		quality float32
+		maxErr  float64
+	}{
+		{"default quality", createTestImage(67, 45, false), 0, 4},
+		{"high quality", createTestImage(67, 45, false), 100, 1.5},
+		{"low quality", createTestImage(120, 80, false), 10, 12},
+		{"one pixel", createTestImage(1, 1, false), 0, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := encodeDecode(t, tt.img, &Options{Quality: tt.quality})
+			ycc, ok := out.(*image.YCbCr)
+			if !ok {
+				t.Fatalf("expected *image.YCbCr, got %T", out)
+			}
+
+			// the decoder's colour conversion differs from the encoder's, so
+			// compare luma
+			var sum float64
+			b := tt.img.Bounds()
+			for y := b.Min.Y; y < b.Max.Y; y++ {
+				for x := b.Min.X; x < b.Max.X; x++ {
+					c := tt.img.NRGBAAt(x, y)
+					want := (16839*int(c.R) + 33059*int(c.G) + 6420*int(c.B) + 16<<16 + 1<<15) >> 16
+					got := int(ycc.Y[ycc.YOffset(x, y)])
+					sum += float64(abs(int32(got - want)))
+				}
+			}
+			if mean := sum / float64(b.Dx()*b.Dy()); mean > tt.maxErr {
+				t.Errorf("expected mean luma error at most %v, got %v", tt.maxErr, mean)
+			}
+		})
+	}
+}
+
+func TestEncodeLossy_KeepsAlpha(t *testing.T) {
+	img := createTestImage(30, 20, true)
+	out := encodeDecode(t, img, nil)
+	n, ok := out.(*image.NYCbCrA)
+	if !ok {
+		t.Fatalf("expected *image.NYCbCrA, got %T", out)
+	}
+	for y := 0; y < 20; y++ {
+		for x := 0; x < 30; x++ {
+			if got, want := n.A[n.AOffset(x, y)], img.NRGBAAt(x, y).A; got != want {
+				t.Fatalf("pixel %d,%d: expected alpha %d, got %d", x, y, want, got)
+			}
+		}
+	}
+}
+
+func TestEncode_RejectsEmpty(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Encode(&buf, image.NewNRGBA(image.Rect(0, 0, 0, 5)), nil); err == nil {
+		t.Error("expected an error for an empty image")
+	}
+}
+
+func TestTransforms_RoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	src := newPlane(4, 4)
+	for i := range src.pix {
+		src.pix[i] = uint8(rng.Intn(256))
+	}
+	pred := make([]uint8, 16)
+	for i := range pred {
+		pred[i] = uint8(rng.Intn(256))
+	}
+
+	coeffs := forwardDCT(src, 0, 0, pred, 4)
+	dst := newPlane(4, 4)
+	inverseDCT(&coeffs, pred, 4, dst, 0, 0)
+	for i := range src.pix {
+		if d := int32(src.pix[i]) - int32(dst.pix[i]); abs(d) > 1 {
+			t.Fatalf("DCT pixel %d: expected %d, got %d", i, src.pix[i], dst.pix[i])
+		}
+	}
+
+	var dcs [16]int32
+	for i := range dcs {
+		dcs[i] = int32(rng.Intn(4096) - 2048)
+	}
+	wht := forwardWHT(&dcs)
+	back := inverseWHT(&wht)
+	for i := range dcs {
+		if d := dcs[i] - back[i]; abs(d) > 1 {
+			t.Fatalf("WHT coefficient %d: expected %d, got %d", i, dcs[i], back[i])
+		}
+	}
+}
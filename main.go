@@ -2,8 +2,10 @@ package main
 
 import (
 	"context"
+	"go-image-web/internal/config"
 	"go-image-web/internal/db"
 	"go-image-web/internal/handlers"
+	"go-image-web/internal/jobs"
 	"go-image-web/internal/repo"
 	"go-image-web/internal/services"
 	"go-image-web/internal/store"
@@ -24,29 +26,84 @@ const (
 
 	DbDir  string = "data/db"
 	DbPath string = "data/db/storage.db"
+
+	// pragmas set on every pooled connection, not just the first
+	DbDSN string = DbPath + "?_foreign_keys=on&_busy_timeout=5000"
 )
 
 func main() {
 
+	// maintenance commands run instead of the server
+	if len(os.Args) > 1 {
+		runCommand(os.Args[1], os.Args[2:])
+		return
+	}
+
+	// load settings from environment
+	cfg := config.Load()
+
 	// initialise database
 	xdb := openDB()
 	defer xdb.Close()
 
+	// initialise image storage
+	store.Configure(openStorage(cfg), cfg.TmpDir)
+	store.ConfigureTransformCache(cfg.TransformCacheDir)
+	services.SetSigningKey(cfg.ImageSigningKey)
+	services.ConfigureDecoding(cfg.MaxImagePixels, cfg.DecodeMemoryBytes)
+	configureVarients(cfg)
+
 	// initialise mux router
 	router := handlers.SetupRouter()
 
+	// load image metadata from database
+	imageRepo := repo.NewImageRepo(xdb)
+	if err := store.LoadImages(imageRepo); err != nil {
+		log.Fatal(err)
+	}
+	store.SetVarientCacheBudget(cfg.VarientCacheBytes)
+
+	// start background jobs, picking up any left over from the last run
+	queue := jobs.NewQueue(repo.NewJobRepo(xdb), cfg.JobWorkers, cfg.JobMaxAttempts, cfg.JobRetention)
+	services.RegisterImageJobs(queue)
+	if err := queue.Start(context.Background()); err != nil {
+		log.Fatal(err)
+	}
+
+	// collect orphaned images and files now and then
+	gcCtx, stopGC := context.WithCancel(context.Background())
+	if cfg.GCInterval > 0 {
+		go store.RunGC(gcCtx, cfg.GCInterval, cfg.GCGrace)
+	}
+
 	// create post repo
 	postRepo := repo.NewRepo(xdb)
 
 	// create post service
-	postService := services.NewPostService(postRepo)
+	postService := services.NewPostService(postRepo, cfg)
 
-	// create index handler
-	indexHandler := handlers.NewIndexHandler(postService)
+	// create board service
+	boardService := services.NewBoardService(repo.NewBoardRepo(xdb), cfg.RepostPolicy)
+
+	// create staff service, nobody is staff without a key
+	staffService := services.NewStaffService(cfg.StaffKey)
+
+	// create index and staff handlers
+	indexHandler := handlers.NewIndexHandler(postService, boardService, staffService)
+	staffHandler := handlers.NewStaffHandler(staffService)
 
 	// register routes with handler functions
 	router.HandleFunc("/", indexHandler.Home).Methods("GET")
-	router.HandleFunc("/upload", indexHandler.Upload).Methods("POST")
+	router.HandleFunc("/staff", staffHandler.Page).Methods("GET")
+	router.HandleFunc("/staff", staffHandler.Login).Methods("POST")
+	router.HandleFunc("/{board:[a-z0-9]+}", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, r.URL.Path+"/", http.StatusMovedPermanently)
+	}).Methods("GET")
+	router.HandleFunc("/{board:[a-z0-9]+}/", indexHandler.Board).Methods("GET")
+	router.HandleFunc("/{board:[a-z0-9]+}/upload", indexHandler.Upload).Methods("POST")
+	router.HandleFunc("/{board:[a-z0-9]+}/thread/{no:[0-9]+}", indexHandler.Thread).Methods("GET")
+	router.HandleFunc("/{board:[a-z0-9]+}/post/{no:[0-9]+}", indexHandler.Post).Methods("GET")
+	router.HandleFunc("/{board:[a-z0-9]+}/post/{no:[0-9]+}/delete", indexHandler.DeletePost).Methods("POST")
 
 	// serve static server
 	fs := http.FileServer(http.Dir(AssetsFolder))
@@ -60,7 +117,8 @@ func main() {
 		IdleTimeout:  120 * time.Second,
 	}
 
-	go handleGracefulShutdown(server)
+	stopped := make(chan struct{})
+	go handleGracefulShutdown(server, queue, stopGC, stopped)
 
 	// listen and serve on port
 	log.Printf("started on port :9991")
@@ -69,12 +127,13 @@ func main() {
 		log.Fatal(err)
 	}
 
+	<-stopped
 }
 
 func openDB() *sqlx.DB {
 	// create/open database
 	store.CheckCreateDir(DbDir)
-	xdb, err := sqlx.Open("sqlite3", DbPath)
+	xdb, err := sqlx.Open("sqlite3", DbDSN)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -87,9 +146,6 @@ func openDB() *sqlx.DB {
 	}
 	log.Printf("running with sqlite version: %s", version)
 
-	xdb.MustExec(`PRAGMA foreign_keys = ON;`)
-	xdb.MustExec(`PRAGMA busy_timeout = 5000;`)
-
 	if err := db.EnsureSchema(xdb); err != nil {
 		log.Fatal(err)
 	}
@@ -97,7 +153,44 @@ func openDB() *sqlx.DB {
 	return xdb
 }
 
-func handleGracefulShutdown(server *http.Server) {
+// configureVarients sets how originals and varients are encoded
+func configureVarients(cfg *config.Config) {
+	profile, err := store.LoadVarientProfile(cfg.VarientProfiles, cfg.VarientProfile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	store.SetVarientProfile(profile)
+	store.OriginalQuality = cfg.OriginalQuality
+	store.KeepUploads = cfg.KeepUploads
+
+	log.Printf("varient profile %s: widths %v, formats %v, quality %d", profile.Name, profile.Widths, profile.Formats, profile.Quality)
+}
+
+func openStorage(cfg *config.Config) store.Storage {
+	if cfg.StorageBackend != config.StorageS3 {
+		log.Printf("storing images in %s", cfg.StorageDir)
+		return store.NewLocalStorage(cfg.StorageDir)
+	}
+
+	s3, err := store.NewS3Storage(store.S3Config{
+		Endpoint:  cfg.S3Endpoint,
+		Region:    cfg.S3Region,
+		Bucket:    cfg.S3Bucket,
+		AccessKey: cfg.S3AccessKey,
+		SecretKey: cfg.S3SecretKey,
+		PathStyle: cfg.S3PathStyle,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("storing images in s3 bucket %s at %s", cfg.S3Bucket, cfg.S3Endpoint)
+
+	return s3
+}
+
+func handleGracefulShutdown(server *http.Server, queue *jobs.Queue, stopGC context.CancelFunc, stopped chan<- struct{}) {
+	defer close(stopped)
+
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, syscall.SIGTERM, syscall.SIGINT)
 	<-c
@@ -107,4 +200,11 @@ func handleGracefulShutdown(server *http.Server) {
 	defer cancel()
 
 	server.Shutdown(ctx)
+	stopGC()
+
+	// unfinished jobs are requeued on the next start
+	jobCtx, jobCancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer jobCancel()
+
+	queue.Stop(jobCtx)
 }
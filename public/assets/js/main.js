@@ -0,0 +1,57 @@
+// animated images show a still thumbnail, clicking swaps in the animation
+// and clicking again collapses it
+document.addEventListener("click", (e) => {
+  const link = e.target.closest("a[data-animation]");
+  if (!link || e.button !== 0 || e.ctrlKey || e.metaKey || e.shiftKey) {
+    return;
+  }
+  e.preventDefault();
+
+  const img = link.querySelector("img");
+  // a <source> would keep winning over the img, so stills are set aside
+  const sources = link.querySelectorAll("picture source");
+  const container = link.closest(".post-image");
+  const expanded = container.classList.toggle("expanded");
+
+  if (expanded) {
+    img.dataset.stillSrc = img.src;
+    img.dataset.stillSrcset = img.srcset;
+    img.dataset.stillSizes = img.sizes;
+    sources.forEach((source) => {
+      source.dataset.stillSrcset = source.srcset;
+      source.removeAttribute("srcset");
+    });
+    img.srcset = link.dataset.animation;
+    img.sizes = "(max-width: 768px) 100vw, 800px";
+    img.src = link.href;
+  } else {
+    sources.forEach((source) => {
+      source.srcset = source.dataset.stillSrcset;
+    });
+    img.srcset = img.dataset.stillSrcset;
+    img.sizes = img.dataset.stillSizes;
+    img.src = img.dataset.stillSrc;
+  }
+});
+
+// placeholders sit behind an image until it loads, after that they would
+// show through any transparency
+function clearPlaceholder(img) {
+  img.style.removeProperty("background");
+}
+
+document.addEventListener(
+  "load",
+  (e) => {
+    if (e.target.tagName === "IMG") {
+      clearPlaceholder(e.target);
+    }
+  },
+  true,
+);
+
+document.querySelectorAll("img[style]").forEach((img) => {
+  if (img.complete) {
+    clearPlaceholder(img);
+  }
+});